@@ -2,7 +2,11 @@ package haraqa
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"io"
 	"net"
 	"net/http"
@@ -20,9 +24,37 @@ import (
 )
 
 var (
-	ErrTopicAlreadyExists = headers.ErrTopicAlreadyExists
-	ErrNoContent          = headers.ErrNoContent
-	ErrInvalidTopic       = headers.ErrInvalidTopic
+	ErrTopicAlreadyExists     = headers.ErrTopicAlreadyExists
+	ErrNoContent              = headers.ErrNoContent
+	ErrInvalidTopic           = headers.ErrInvalidTopic
+	ErrInvalidGroup           = headers.ErrInvalidGroup
+	ErrCorruptMessage         = headers.ErrCorruptMessage
+	ErrInvalidFrame           = headers.ErrInvalidFrame
+	ErrInvalidEncoding        = headers.ErrInvalidEncoding
+	ErrInvalidSince           = headers.ErrInvalidHeaderSince
+	ErrInvalidTopicConfig     = headers.ErrInvalidTopicConfig
+	ErrMessageTooLarge        = headers.ErrMessageTooLarge
+	ErrOutOfOrderSequence     = headers.ErrOutOfOrderSequence
+	ErrUnexpectedOffset       = headers.ErrUnexpectedOffset
+	ErrInvalidTransaction     = headers.ErrInvalidTransaction
+	ErrInvalidNotBefore       = headers.ErrInvalidNotBefore
+	ErrResyncUnsupported      = headers.ErrResyncUnsupported
+	ErrConditionalUnsupported = headers.ErrConditionalUnsupported
+)
+
+// TopicConfig is the configuration stored with a topic. Zero values fall back to the settings of the server
+type TopicConfig = headers.TopicConfig
+
+// ProduceInfo holds the ids and timestamps the server gave to produced messages
+type ProduceInfo = headers.ProduceInfo
+
+// TransactionBatch is a batch of messages for a topic, produced with the batches of other topics by ProduceTransaction
+type TransactionBatch = headers.TransactionBatch
+
+// Encodings supported by WithCompression
+const (
+	EncodingIdentity = headers.EncodingIdentity
+	EncodingGzip     = headers.EncodingGzip
 )
 
 // Option represents a optional function argument to NewClient
@@ -51,6 +83,7 @@ func WithHTTPClient(client *http.Client) Option {
 	}
 }
 
+// WithConsumerGroup sets the consumer group used when consuming and committing offsets
 func WithConsumerGroup(group string) Option {
 	return func(c *Client) error {
 		c.consumerGroup = group
@@ -58,11 +91,63 @@ func WithConsumerGroup(group string) Option {
 	}
 }
 
+// WithAutoCommit enables the server to commit the consumer group offset after each consume request.
+// It has no effect unless a consumer group is also set
+func WithAutoCommit(autoCommit bool) Option {
+	return func(c *Client) error {
+		c.autoCommit = autoCommit
+		return nil
+	}
+}
+
+// WithCompression sets the encoding of produced batches and of the batches requested when consuming.
+// The server decodes produced batches before they are written, an empty encoding or EncodingIdentity
+// sends and requests batches uncompressed
+func WithCompression(encoding string) Option {
+	return func(c *Client) error {
+		switch encoding {
+		case "", EncodingIdentity:
+			c.encoding = ""
+		case EncodingGzip:
+			c.encoding = encoding
+		default:
+			return errors.Wrapf(ErrInvalidEncoding, "unsupported encoding %q", encoding)
+		}
+		return nil
+	}
+}
+
+// WithIdempotence makes produce requests idempotent. The client sends a random producer id along with a sequence
+// number for each batch of a topic, so the server acknowledges a resent batch without writing it again.
+// Batches to the same topic are sent one at a time. The sequence only advances once a batch is acknowledged,
+// so after an error the same batch should be produced again before any other batch to that topic
+func WithIdempotence() Option {
+	return func(c *Client) error {
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return errors.Wrap(err, "unable to generate producer id")
+		}
+		c.producerID = hex.EncodeToString(b[:])
+		c.sequences = &sync.Map{}
+		return nil
+	}
+}
+
+// producerSequence is the sequence number of the next batch an idempotent client produces to a topic
+type producerSequence struct {
+	mux  sync.Mutex
+	next uint64
+}
+
 // Client is a lightweight client around the haraqa http api, use NewClient() to create a new client
 type Client struct {
 	c             *http.Client
 	url           string
 	consumerGroup string
+	autoCommit    bool
+	encoding      string
+	producerID    string
+	sequences     *sync.Map
 	dialer        *websocket.Dialer
 	closer        chan struct{}
 }
@@ -122,6 +207,75 @@ func (c *Client) CreateTopic(topic string) error {
 	return nil
 }
 
+// CreateTopicWithConfig Creates a new topic with the given config. It returns an error if the topic already exists
+func (c *Client) CreateTopicWithConfig(topic string, config TopicConfig) error {
+	b, err := json.Marshal(&config)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, c.url+"/topics/"+topic, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header[headers.ContentType] = []string{"application/json"}
+
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		err = headers.ReadErrors(resp.Header)
+		return errors.Wrap(err, "error creating topic")
+	}
+	return nil
+}
+
+// SetTopicConfig Replaces the config stored with a topic
+func (c *Client) SetTopicConfig(topic string, config TopicConfig) error {
+	b, err := json.Marshal(&headers.ModifyRequest{Config: &config})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPatch, c.url+"/topics/"+topic, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header[headers.ContentType] = []string{"application/json"}
+
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		err = headers.ReadErrors(resp.Header)
+		return errors.Wrap(err, "error setting topic config")
+	}
+	return nil
+}
+
+// TopicConfig Gets the config stored with a topic
+func (c *Client) TopicConfig(topic string) (*TopicConfig, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url+"/config/"+topic, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = headers.ReadErrors(resp.Header)
+		return nil, errors.Wrap(err, "error getting topic config")
+	}
+	var config TopicConfig
+	if err = json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, errors.Wrap(err, "invalid topic config")
+	}
+	return &config, nil
+}
+
 // DeleteTopic Delete a topic
 func (c *Client) DeleteTopic(topic string) error {
 	req, err := http.NewRequest(http.MethodDelete, c.url+"/topics/"+topic, nil)
@@ -161,29 +315,112 @@ func (c *Client) ListTopics(prefix, suffix, regex string) ([]string, error) {
 	return strings.Split(string(body), ","), nil
 }
 
-// Produce sends messages from a reader to the designated topic
-func (c *Client) Produce(topic string, sizes []int64, r io.Reader) error {
+// Message is a message with an optional key and headers, as produced by ProduceMessages and
+// returned by ConsumeMessages
+type Message struct {
+	Key     []byte
+	Headers map[string]string
+	Value   []byte
+}
+
+// Produce sends messages from a reader to the designated topic. The ids and timestamps given to the messages are
+// returned, or nil if the server does not report them
+func (c *Client) Produce(topic string, sizes []int64, r io.Reader) (*ProduceInfo, error) {
+	return c.produce(topic, sizes, r, false, -1, time.Time{})
+}
+
+// produce sends the messages to the topic. If expected is not negative the server only stores them if it is the id
+// of the next message of the topic. If notBefore is not zero consumer groups do not receive them before that time
+func (c *Client) produce(topic string, sizes []int64, r io.Reader, framed bool, expected int64, notBefore time.Time) (*ProduceInfo, error) {
+	r, err := c.encode(r)
+	if err != nil {
+		return nil, err
+	}
 	req, err := http.NewRequest(http.MethodPost, c.url+"/topics/"+topic, r)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.Header = headers.SetSizes(sizes, req.Header)
+	if c.encoding != "" {
+		req.Header[headers.ContentEncoding] = []string{c.encoding}
+	}
+	if framed {
+		req.Header[headers.HeaderFramed] = []string{"true"}
+	}
+	if expected >= 0 {
+		req.Header[headers.HeaderExpectedID] = []string{strconv.FormatInt(expected, 10)}
+	}
+	if !notBefore.IsZero() {
+		req.Header[headers.HeaderNotBefore] = []string{notBefore.UTC().Format(time.RFC3339Nano)}
+	}
+	var seq *producerSequence
+	if c.producerID != "" {
+		tmp, _ := c.sequences.LoadOrStore(topic, &producerSequence{})
+		seq = tmp.(*producerSequence)
+		seq.mux.Lock()
+		defer seq.mux.Unlock()
+		req.Header = headers.SetSequence(c.producerID, seq.next, req.Header)
+	}
 
 	resp, err := c.c.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
 		err = headers.ReadErrors(resp.Header)
-		return errors.Wrap(err, "error producing")
+		return nil, errors.Wrap(err, "error producing")
 	}
-	return nil
+	if seq != nil {
+		seq.next++
+	}
+	info, err := headers.ReadProduceInfo(resp.Header)
+	return info, errors.Wrap(err, "unable to read produced ids")
+}
+
+// encode compresses a request body with the encoding of the client
+func (c *Client) encode(r io.Reader) (io.Reader, error) {
+	if c.encoding != EncodingGzip {
+		return r, nil
+	}
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(gw, r); err != nil {
+		return nil, errors.Wrap(err, "unable to compress messages")
+	}
+	if err := gw.Close(); err != nil {
+		return nil, errors.Wrap(err, "unable to compress messages")
+	}
+	return &buf, nil
+}
+
+// ProduceMsgs sends the messages to the designated topic. The ids and timestamps given to the messages are
+// returned, or nil if the server does not report them or there are no messages
+func (c *Client) ProduceMsgs(topic string, msgs ...[]byte) (*ProduceInfo, error) {
+	return c.produceMsgs(topic, -1, time.Time{}, msgs)
+}
+
+// ProduceIf sends the messages to the designated topic only if expected is the id the next message of the topic
+// is given, as when appending to an event sourced aggregate. If another producer stored messages first,
+// nothing is stored and ErrUnexpectedOffset is returned. ErrConditionalUnsupported is returned if the queue
+// of the server cannot produce conditionally
+func (c *Client) ProduceIf(topic string, expected int64, msgs ...[]byte) (*ProduceInfo, error) {
+	if expected < 0 {
+		return nil, headers.ErrInvalidMessageID
+	}
+	return c.produceMsgs(topic, expected, time.Time{}, msgs)
+}
+
+// ProduceAt sends the messages to the designated topic, delaying their delivery to consumer groups until notBefore.
+// Consumer groups reading from their offset skip the messages until then, and receive them before any later message
+// once they are due. Consumers reading by id still receive them in order
+func (c *Client) ProduceAt(topic string, notBefore time.Time, msgs ...[]byte) (*ProduceInfo, error) {
+	return c.produceMsgs(topic, -1, notBefore, msgs)
 }
 
-// ProduceMsgs sends the messages to the designated topic
-func (c *Client) ProduceMsgs(topic string, msgs ...[]byte) error {
+func (c *Client) produceMsgs(topic string, expected int64, notBefore time.Time, msgs [][]byte) (*ProduceInfo, error) {
 	if len(msgs) == 0 {
-		return nil
+		return nil, nil
 	}
 	sizes := make([]int64, 0, len(msgs))
 	for i := range msgs {
@@ -192,9 +429,65 @@ func (c *Client) ProduceMsgs(topic string, msgs ...[]byte) error {
 		}
 	}
 	if len(sizes) == 0 {
-		return nil
+		return nil, nil
+	}
+	return c.produce(topic, sizes, bytes.NewBuffer(bytes.Join(msgs, nil)), false, expected, notBefore)
+}
+
+// ProduceMessages sends the messages, along with their keys and headers, to the designated topic.
+// The ids and timestamps given to the messages are returned, as with ProduceMsgs
+func (c *Client) ProduceMessages(topic string, msgs ...Message) (*ProduceInfo, error) {
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+	sizes := make([]int64, len(msgs))
+	var buf []byte
+	for i := range msgs {
+		n := len(buf)
+		buf = headers.AppendFrame(buf, msgs[i].Key, msgs[i].Headers, msgs[i].Value)
+		sizes[i] = int64(len(buf) - n)
+	}
+	return c.produce(topic, sizes, bytes.NewReader(buf), true, -1, time.Time{})
+}
+
+// ProduceTransaction sends batches of messages for several topics, which the server stores atomically. Either every
+// batch is stored and visible to consumers or none is. The ids and timestamps given to each batch are returned in the
+// order of the batches, nil for batches without messages. All topics must be served by the same server
+func (c *Client) ProduceTransaction(batches ...TransactionBatch) ([]*ProduceInfo, error) {
+	if len(batches) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(&headers.TransactionRequest{Batches: batches})
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.encode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url+"/transactions", r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header[headers.ContentType] = []string{"application/json"}
+	if c.encoding != "" {
+		req.Header[headers.ContentEncoding] = []string{c.encoding}
+	}
+
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = headers.ReadErrors(resp.Header)
+		return nil, errors.Wrap(err, "error producing transaction")
 	}
-	return c.Produce(topic, sizes, bytes.NewBuffer(bytes.Join(msgs, nil)))
+	var response headers.TransactionResponse
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, errors.Wrap(err, "unable to read produced ids")
+	}
+	return response.Batches, nil
 }
 
 var getRequestPool = &sync.Pool{
@@ -207,39 +500,96 @@ var getRequestPool = &sync.Pool{
 // Consume reads messages off of a topic starting from id, no more than the given limit is returned.
 // If limit is less than 1, the server sets the limit.
 func (c *Client) Consume(topic string, id int64, limit int) (io.ReadCloser, []int64, error) {
+	r, sizes, _, err := c.consume(topic, id, limit, time.Time{}, false)
+	return r, sizes, err
+}
+
+// ConsumeSince reads messages off of a topic starting from the first message produced at or after the given time,
+// no more than the given limit is returned. If limit is less than 1, the server sets the limit.
+func (c *Client) ConsumeSince(topic string, since time.Time, limit int) (io.ReadCloser, []int64, error) {
+	if since.IsZero() {
+		return nil, nil, errors.Wrap(ErrInvalidSince, "time cannot be zero")
+	}
+	r, sizes, _, err := c.consume(topic, 0, limit, since, false)
+	return r, sizes, err
+}
+
+// consume requests messages from the topic, starting from since if it is set and from id otherwise.
+// It returns if the server responded with framed messages
+func (c *Client) consume(topic string, id int64, limit int, since time.Time, framed bool) (io.ReadCloser, []int64, bool, error) {
 	var err error
 	req := getRequestPool.Get().(*http.Request)
 	defer getRequestPool.Put(req)
 	req.URL, err = url.Parse(c.url + "/topics/" + topic)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, false, err
+	}
+	if framed {
+		req.Header[headers.HeaderFramed] = []string{"true"}
+	} else {
+		delete(req.Header, headers.HeaderFramed)
+	}
+	// setting the header keeps the transport from requesting and decoding gzip on its own
+	if c.encoding != "" {
+		req.Header[headers.AcceptEncoding] = []string{c.encoding}
+	} else {
+		req.Header[headers.AcceptEncoding] = []string{EncodingIdentity}
 	}
 	req.Header[headers.HeaderID] = []string{strconv.FormatInt(id, 10)}
+	if !since.IsZero() {
+		req.Header[headers.HeaderSince] = []string{since.Format(time.RFC3339Nano)}
+	} else {
+		delete(req.Header, headers.HeaderSince)
+	}
 	if limit > 0 {
 		req.Header[headers.HeaderLimit] = []string{strconv.Itoa(limit)}
 	}
 	if c.consumerGroup != "" {
 		req.Header[headers.HeaderConsumerGroup] = []string{c.consumerGroup}
+		if c.autoCommit {
+			req.Header[headers.HeaderAutoCommit] = []string{"true"}
+		}
 	}
 
 	resp, err := c.c.Do(req)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, false, err
 	}
 	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
 		err = headers.ReadErrors(resp.Header)
 		if err == nil {
 			err = errors.New("unexpected server response")
 		}
-		return nil, nil, errors.Wrap(err, "error consuming")
+		return nil, nil, false, errors.Wrap(err, "error consuming")
 	}
 
 	sizes, err := headers.ReadSizes(resp.Header)
 	if err != nil {
-		return nil, nil, err
+		_ = resp.Body.Close()
+		return nil, nil, false, err
+	}
+
+	body := resp.Body
+	if resp.Header.Get(headers.ContentEncoding) == EncodingGzip {
+		gr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			_ = resp.Body.Close()
+			return nil, nil, false, errors.Wrap(err, "unable to decompress messages")
+		}
+		body = &gzipBody{Reader: gr, body: resp.Body}
 	}
+	return body, sizes, resp.Header.Get(headers.HeaderFramed) == "true", nil
+}
 
-	return resp.Body, sizes, nil
+// gzipBody decompresses a consume response, closing it along with the decompressor
+type gzipBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (b *gzipBody) Close() error {
+	_ = b.Reader.Close()
+	return b.body.Close()
 }
 
 // ConsumeMsgs reads messages off of a topic starting from id, no more than the given limit is returned.
@@ -261,6 +611,102 @@ func (c *Client) ConsumeMsgs(topic string, id int64, limit int) ([][]byte, error
 	return msgs, nil
 }
 
+// ConsumeMessages reads messages, along with their keys and headers, off of a topic starting from id.
+// No more than the given limit is returned. If limit is less than 1, the server sets the limit.
+func (c *Client) ConsumeMessages(topic string, id int64, limit int) ([]Message, error) {
+	r, sizes, framed, err := c.consume(topic, id, limit, time.Time{}, true)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	msgs := make([]Message, len(sizes))
+	for i := range sizes {
+		b := make([]byte, sizes[i])
+		_, err = io.ReadAtLeast(r, b, len(b))
+		if err != nil {
+			return nil, err
+		}
+		if !framed {
+			msgs[i].Value = b
+			continue
+		}
+		msgs[i].Key, msgs[i].Headers, msgs[i].Value, err = headers.ParseFrame(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+// CommitOffset sets the offset of the client's consumer group for the topic. Consume calls
+// using the consumer group with an id of 0 or less will start from this offset
+func (c *Client) CommitOffset(topic string, id int64) error {
+	if c.consumerGroup == "" {
+		return headers.ErrInvalidGroup
+	}
+	req, err := http.NewRequest(http.MethodPut, c.url+"/offsets/"+topic, nil)
+	if err != nil {
+		return err
+	}
+	req.Header[headers.HeaderConsumerGroup] = []string{c.consumerGroup}
+	req.Header[headers.HeaderID] = []string{strconv.FormatInt(id, 10)}
+
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		err = headers.ReadErrors(resp.Header)
+		return errors.Wrap(err, "error committing offset")
+	}
+	return nil
+}
+
+// Resync asks the server to reconcile its volumes, copying any data missing from a volume from the other volumes.
+// The server also resyncs its volumes on startup
+func (c *Client) Resync() error {
+	req, err := http.NewRequest(http.MethodPost, c.url+"/resync", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		err = headers.ReadErrors(resp.Header)
+		return errors.Wrap(err, "error resyncing volumes")
+	}
+	return nil
+}
+
+// OffsetAt returns the id of the first message of a topic produced at or after the given time.
+// If every message was produced before then, the id of the next message to be produced is returned
+func (c *Client) OffsetAt(topic string, t time.Time) (int64, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url+"/offsets/"+topic, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header[headers.HeaderSince] = []string{t.Format(time.RFC3339Nano)}
+
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = headers.ReadErrors(resp.Header)
+		return 0, errors.Wrap(err, "error getting offset")
+	}
+	id, err := strconv.ParseInt(resp.Header.Get(headers.HeaderID), 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid offset")
+	}
+	return id, nil
+}
+
 // WatchTopics opens a websocket to the server to listen for changes to the given topics.
 // It writes the name of any modified topics to the given channel until a context cancellation or an error occurs
 func (c *Client) WatchTopics(ctx context.Context, topics []string, ch chan<- string) error {
@@ -4,10 +4,13 @@ package haraqa
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -73,6 +76,32 @@ func TestOptions(t *testing.T) {
 			t.Error(c.consumerGroup, group)
 		}
 	}
+
+	// WithAutoCommit
+	{
+		c := &Client{}
+		err := WithAutoCommit(true)(c)
+		if err != nil {
+			t.Error(err)
+		}
+		if !c.autoCommit {
+			t.Error("auto commit not set")
+		}
+	}
+
+	// WithCompression
+	{
+		c := &Client{}
+		if err := WithCompression(EncodingGzip)(c); err != nil || c.encoding != EncodingGzip {
+			t.Error(err, c.encoding)
+		}
+		if err := WithCompression(EncodingIdentity)(c); err != nil || c.encoding != "" {
+			t.Error(err, c.encoding)
+		}
+		if err := WithCompression("br")(c); !errors.Is(err, ErrInvalidEncoding) {
+			t.Error(err)
+		}
+	}
 }
 
 func TestNewClient(t *testing.T) {
@@ -118,7 +147,7 @@ func TestClient_InvalidRequests(t *testing.T) {
 		if err == nil {
 			t.Error(err)
 		}
-		err = c.Produce("produce_topic", nil, nil)
+		_, err = c.Produce("produce_topic", nil, nil)
 		if err == nil {
 			t.Error(err)
 		}
@@ -163,6 +192,57 @@ func TestClient_CreateTopic(t *testing.T) {
 	}
 }
 
+func TestClient_TopicConfig(t *testing.T) {
+	config := TopicConfig{SegmentBytes: 1024, Compact: true}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/topics/config_topic":
+			var got TopicConfig
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil || got != config {
+				headers.SetError(w, headers.ErrInvalidTopicConfig)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPatch && r.URL.Path == "/topics/config_topic":
+			var got headers.ModifyRequest
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil || got.Config == nil || *got.Config != config {
+				headers.SetError(w, headers.ErrInvalidTopicConfig)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet && r.URL.Path == "/config/config_topic":
+			w.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(w).Encode(&config)
+		default:
+			headers.SetError(w, headers.ErrTopicDoesNotExist)
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(WithHTTPClient(ts.Client()), WithURL(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.CreateTopicWithConfig("config_topic", config); err != nil {
+		t.Error(err)
+	}
+	if err = c.CreateTopicWithConfig("config_topic", TopicConfig{}); !errors.Is(err, ErrInvalidTopicConfig) {
+		t.Error(err)
+	}
+	if err = c.SetTopicConfig("config_topic", config); err != nil {
+		t.Error(err)
+	}
+	if err = c.SetTopicConfig("missing", config); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+	if got, err := c.TopicConfig("config_topic"); err != nil || *got != config {
+		t.Error(err, got)
+	}
+	if _, err = c.TopicConfig("missing"); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+}
+
 func TestClient_DeleteTopic(t *testing.T) {
 	var count int
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -256,6 +336,9 @@ func TestClient_Produce(t *testing.T) {
 			if string(b) != "test_body" {
 				t.Error(string(b))
 			}
+			if count == 0 {
+				headers.SetProduceInfo(&headers.ProduceInfo{FirstID: 3, LastID: 5, FirstTimestamp: time.Unix(100, 0), LastTimestamp: time.Unix(100, 0)}, w.Header())
+			}
 			w.WriteHeader(http.StatusOK)
 		case 2:
 			headers.SetError(w, headers.ErrInvalidHeaderSizes)
@@ -269,24 +352,265 @@ func TestClient_Produce(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = c.Produce("produce_topic", []int64{1, 3, 5}, bytes.NewBuffer([]byte("test_body")))
+	info, err := c.Produce("produce_topic", []int64{1, 3, 5}, bytes.NewBuffer([]byte("test_body")))
+	if err != nil || info == nil || info.FirstID != 3 || info.LastID != 5 || !info.LastTimestamp.Equal(time.Unix(100, 0)) {
+		t.Error(info, err)
+	}
+	// older servers do not report ids
+	info, err = c.ProduceMsgs("produce_topic", []byte("t"), []byte("est"), []byte("_body"))
+	if err != nil || info != nil {
+		t.Error(info, err)
+	}
+	_, err = c.Produce("produce_topic", []int64{1, 3, 5}, nil)
+	if !errors.Is(err, headers.ErrInvalidHeaderSizes) {
+		t.Error(err)
+	}
+	info, err = c.ProduceMsgs("produce_topic")
+	if err != nil || info != nil {
+		t.Error(info, err)
+	}
+	info, err = c.ProduceMsgs("produce_topic", nil)
+	if err != nil || info != nil {
+		t.Error(info, err)
+	}
+}
+
+func TestClient_Messages(t *testing.T) {
+	msgs := []Message{
+		{Key: []byte("key"), Headers: map[string]string{"content-type": "text/plain"}, Value: []byte("hello")},
+		{Value: []byte("world")},
+	}
+	var stored []byte
+	var sizes []int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			if r.Header.Get(headers.HeaderFramed) != "true" {
+				t.Errorf("invalid framed header %+v", r.Header)
+			}
+			var err error
+			if sizes, err = headers.ReadSizes(r.Header); err != nil {
+				t.Error(err)
+			}
+			if stored, err = io.ReadAll(r.Body); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet:
+			// respond as an older server which ignores the framed header on the second request
+			if r.Header.Get(headers.HeaderID) == "0" {
+				w.Header()[headers.HeaderFramed] = []string{"true"}
+				headers.SetSizes(sizes, w.Header())
+				_, _ = w.Write(stored)
+				return
+			}
+			headers.SetSizes([]int64{5}, w.Header())
+			_, _ = w.Write([]byte("plain"))
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(WithHTTPClient(ts.Client()), WithURL(ts.URL))
 	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.ProduceMessages("message_topic"); err != nil {
+		t.Error(err)
+	}
+	if _, err = c.ProduceMessages("message_topic", msgs...); err != nil {
 		t.Error(err)
 	}
-	err = c.ProduceMsgs("produce_topic", []byte("t"), []byte("est"), []byte("_body"))
+	consumed, err := c.ConsumeMessages("message_topic", 0, -1)
+	if err != nil || !reflect.DeepEqual(consumed, msgs) {
+		t.Error(err, consumed)
+	}
+	consumed, err = c.ConsumeMessages("message_topic", 1, -1)
+	if err != nil || !reflect.DeepEqual(consumed, []Message{{Value: []byte("plain")}}) {
+		t.Error(err, consumed)
+	}
+}
+
+func TestClient_Compression(t *testing.T) {
+	var stored []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			if r.Header.Get(headers.ContentEncoding) != headers.EncodingGzip {
+				t.Errorf("invalid content encoding %+v", r.Header)
+			}
+			gr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored, err = io.ReadAll(gr); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet:
+			if r.Header.Get(headers.AcceptEncoding) != headers.EncodingGzip {
+				t.Errorf("invalid accept encoding %+v", r.Header)
+			}
+			headers.SetSizes([]int64{5, 5}, w.Header())
+			w.Header()[headers.ContentEncoding] = []string{headers.EncodingGzip}
+			gw := gzip.NewWriter(w)
+			_, _ = gw.Write(stored)
+			_ = gw.Close()
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(WithHTTPClient(ts.Client()), WithURL(ts.URL), WithCompression(EncodingGzip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.ProduceMsgs("compressed_topic", []byte("hello"), []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := c.ConsumeMsgs("compressed_topic", 0, -1)
+	if err != nil || !reflect.DeepEqual(msgs, [][]byte{[]byte("hello"), []byte("world")}) {
+		t.Error(err, msgs)
+	}
+}
+
+func TestClient_Idempotence(t *testing.T) {
+	var producers []string
+	var sequences []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		producers = append(producers, r.Header.Get(headers.HeaderProducerID))
+		sequences = append(sequences, r.Header.Get(headers.HeaderSequence))
+		switch len(sequences) {
+		case 1:
+			headers.SetError(w, headers.ErrClosed)
+		case 3:
+			headers.SetProduceInfo(&headers.ProduceInfo{FirstID: 1, LastID: 1, Duplicate: true}, w.Header())
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(WithHTTPClient(ts.Client()), WithURL(ts.URL), WithIdempotence())
 	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sequence only advances once a batch is acknowledged
+	if _, err = c.ProduceMsgs("idempotent_topic", []byte("hello")); !errors.Is(err, headers.ErrClosed) {
 		t.Error(err)
 	}
-	err = c.Produce("produce_topic", []int64{1, 3, 5}, nil)
-	if !errors.Is(err, headers.ErrInvalidHeaderSizes) {
+	if _, err = c.ProduceMsgs("idempotent_topic", []byte("hello")); err != nil {
+		t.Error(err)
+	}
+	if info, err := c.ProduceMsgs("idempotent_topic", []byte("world")); err != nil || info == nil || !info.Duplicate {
+		t.Error(info, err)
+	}
+	if _, err = c.ProduceMsgs("other_topic", []byte("hello")); err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(sequences, []string{"0", "0", "1", "0"}) {
+		t.Error(sequences)
+	}
+	if len(producers[0]) != 32 || producers[0] != producers[1] || producers[0] != producers[3] {
+		t.Error(producers)
+	}
+}
+
+func TestClient_ProduceIf(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(headers.HeaderSizes) != "5" {
+			t.Error(r.Header)
+		}
+		switch r.Header.Get(headers.HeaderExpectedID) {
+		case "2":
+		case "3":
+			headers.SetError(w, headers.ErrConditionalUnsupported)
+			return
+		default:
+			headers.SetError(w, headers.ErrUnexpectedOffset)
+			return
+		}
+		headers.SetProduceInfo(&headers.ProduceInfo{FirstID: 2, LastID: 2}, w.Header())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(WithHTTPClient(ts.Client()), WithURL(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := c.ProduceIf("conditional_topic", 2, []byte("hello")); err != nil || info.FirstID != 2 {
+		t.Error(info, err)
+	}
+	if _, err = c.ProduceIf("conditional_topic", 1, []byte("hello")); !errors.Is(err, ErrUnexpectedOffset) {
+		t.Error(err)
+	}
+	if _, err = c.ProduceIf("conditional_topic", 3, []byte("hello")); !errors.Is(err, ErrConditionalUnsupported) {
 		t.Error(err)
 	}
-	err = c.ProduceMsgs("produce_topic")
+	if _, err = c.ProduceIf("conditional_topic", -1, []byte("hello")); !errors.Is(err, headers.ErrInvalidMessageID) {
+		t.Error(err)
+	}
+}
+
+func TestClient_ProduceAt(t *testing.T) {
+	notBefore := time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(headers.HeaderNotBefore) != "2030-01-02T03:04:05.000000006Z" {
+			headers.SetError(w, headers.ErrInvalidNotBefore)
+			return
+		}
+		headers.SetProduceInfo(&headers.ProduceInfo{FirstID: 4, LastID: 5}, w.Header())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(WithHTTPClient(ts.Client()), WithURL(ts.URL))
 	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := c.ProduceAt("scheduled_topic", notBefore.In(time.FixedZone("", 3600)), []byte("hello"), []byte("world")); err != nil || info.LastID != 5 {
+		t.Error(info, err)
+	}
+	if _, err = c.ProduceMsgs("scheduled_topic", []byte("hello")); !errors.Is(err, ErrInvalidNotBefore) {
 		t.Error(err)
 	}
-	err = c.ProduceMsgs("produce_topic", nil)
+}
+
+func TestClient_ProduceTransaction(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/transactions" {
+			t.Error(r.Method, r.URL.Path)
+		}
+		var request headers.TransactionRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+		if len(request.Batches) != 2 || request.Batches[1].Topic != "topic_b" {
+			headers.SetError(w, headers.ErrInvalidTransaction)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(headers.TransactionResponse{Batches: []*headers.ProduceInfo{{FirstID: 1, LastID: 2}, {FirstID: 5, LastID: 5}}})
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(WithHTTPClient(ts.Client()), WithURL(ts.URL))
 	if err != nil {
+		t.Fatal(err)
+	}
+	if infos, err := c.ProduceTransaction(); infos != nil || err != nil {
+		t.Error(infos, err)
+	}
+	infos, err := c.ProduceTransaction(
+		TransactionBatch{Topic: "topic_a", Messages: [][]byte{[]byte("hello"), []byte("there")}},
+		TransactionBatch{Topic: "topic_b", Messages: [][]byte{[]byte("world")}},
+	)
+	if err != nil || len(infos) != 2 || infos[0].LastID != 2 || infos[1].FirstID != 5 {
+		t.Error(infos, err)
+	}
+	_, err = c.ProduceTransaction(TransactionBatch{Topic: "topic_a", Messages: [][]byte{[]byte("hello")}})
+	if !errors.Is(err, ErrInvalidTransaction) {
 		t.Error(err)
 	}
 }
@@ -303,6 +627,9 @@ func TestClient_Consume(t *testing.T) {
 		if r.Header.Get(headers.HeaderID) != "123" || r.Header.Get(headers.HeaderLimit) != "456" {
 			t.Errorf("invalid header %+v", r.Header)
 		}
+		if r.Header.Get(headers.HeaderAutoCommit) != "true" {
+			t.Errorf("invalid auto commit header %+v", r.Header)
+		}
 
 		switch count {
 		case 0, 3:
@@ -333,7 +660,7 @@ func TestClient_Consume(t *testing.T) {
 	ts.EnableHTTP2 = true
 	defer ts.Close()
 
-	c, err := NewClient(WithHTTPClient(ts.Client()), WithURL(ts.URL), WithConsumerGroup("consumer-group"))
+	c, err := NewClient(WithHTTPClient(ts.Client()), WithURL(ts.URL), WithConsumerGroup("consumer-group"), WithAutoCommit(true))
 	if err != nil {
 		t.Error(err)
 	}
@@ -388,6 +715,105 @@ func TestClient_Consume(t *testing.T) {
 	}
 }
 
+func TestClient_Since(t *testing.T) {
+	since := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(headers.HeaderSince) != since.Format(time.RFC3339Nano) {
+			headers.SetError(w, headers.ErrInvalidHeaderSince)
+			return
+		}
+		switch r.URL.Path {
+		case "/offsets/since_topic":
+			w.Header()[headers.HeaderID] = []string{"123"}
+			w.WriteHeader(http.StatusOK)
+		case "/topics/since_topic":
+			headers.SetSizes([]int64{5}, w.Header())
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write([]byte("hello"))
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(WithHTTPClient(ts.Client()), WithURL(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := c.OffsetAt("since_topic", since); err != nil || id != 123 {
+		t.Error(err, id)
+	}
+	if _, err = c.OffsetAt("since_topic", since.Add(time.Second)); !errors.Is(err, ErrInvalidSince) {
+		t.Error(err)
+	}
+
+	r, sizes, err := c.ConsumeSince("since_topic", since, -1)
+	if err != nil || !reflect.DeepEqual(sizes, []int64{5}) {
+		t.Fatal(err, sizes)
+	}
+	if b, err := io.ReadAll(r); err != nil || string(b) != "hello" {
+		t.Error(err, string(b))
+	}
+	_ = r.Close()
+	if _, _, err = c.ConsumeSince("since_topic", time.Time{}, -1); !errors.Is(err, ErrInvalidSince) {
+		t.Error(err)
+	}
+
+	// the start time is not sent with later requests
+	if _, _, err = c.Consume("since_topic", 0, -1); !errors.Is(err, ErrInvalidSince) {
+		t.Error(err)
+	}
+}
+
+func TestClient_CommitOffset(t *testing.T) {
+	var count int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("invalid method %s", r.Method)
+		}
+		if r.URL.String() != "/offsets/commit_topic" {
+			t.Errorf("invalid url path %q", r.URL.String())
+		}
+		if r.Header.Get(headers.HeaderConsumerGroup) != "consumer-group" || r.Header.Get(headers.HeaderID) != "123" {
+			t.Errorf("invalid header %+v", r.Header)
+		}
+		switch count {
+		case 0:
+			w.WriteHeader(http.StatusNoContent)
+		case 1:
+			headers.SetError(w, headers.ErrTopicDoesNotExist)
+		}
+		count++
+	}))
+	ts.EnableHTTP2 = true
+	defer ts.Close()
+
+	c, err := NewClient(WithHTTPClient(ts.Client()), WithURL(ts.URL))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// missing group
+	err = c.CommitOffset("commit_topic", 123)
+	if !errors.Is(err, ErrInvalidGroup) {
+		t.Error(err)
+	}
+
+	c.consumerGroup = "consumer-group"
+	err = c.CommitOffset("commit_topic", 123)
+	if err != nil {
+		t.Error(err)
+	}
+	err = c.CommitOffset("commit_topic", 123)
+	if !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+
+	c.url = string([]byte{0, 1, 2, 3, 255})
+	err = c.CommitOffset("commit_topic", 123)
+	if err == nil {
+		t.Error(err)
+	}
+}
+
 func TestClient_WatchTopics(t *testing.T) {
 	c, err := NewClient()
 	if err != nil {
@@ -455,3 +881,39 @@ func TestClient_Close(t *testing.T) {
 		t.Error("channel should be closed")
 	}
 }
+
+func TestClient_Resync(t *testing.T) {
+	var count int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("invalid method %s", r.Method)
+		}
+		if r.URL.String() != "/resync" {
+			t.Errorf("invalid url path %q", r.URL.String())
+		}
+		switch count {
+		case 0:
+			w.WriteHeader(http.StatusNoContent)
+		case 1:
+			headers.SetError(w, headers.ErrResyncUnsupported)
+		}
+		count++
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(WithHTTPClient(ts.Client()), WithURL(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Resync(); err != nil {
+		t.Error(err)
+	}
+	if err = c.Resync(); !errors.Is(err, ErrResyncUnsupported) {
+		t.Error(err)
+	}
+
+	c.url = string([]byte{0, 1, 2, 3, 255})
+	if err = c.Resync(); err == nil {
+		t.Error(err)
+	}
+}
@@ -37,7 +37,7 @@ var produceCmd = &cobra.Command{
 			for i := range msgs {
 				msgsBytes[i] = []byte(msgs[i])
 			}
-			err = client.ProduceMsgs(topic, msgsBytes...)
+			_, err = client.ProduceMsgs(topic, msgsBytes...)
 			if err != nil {
 				fmt.Printf("Unable to produce message(s) %q: %q\n", msgs, err.Error())
 				os.Exit(1)
@@ -65,7 +65,7 @@ var produceCmd = &cobra.Command{
 				continue
 			}
 			vfmt.Printf("Producing message %q\n", string(msg))
-			err = client.ProduceMsgs(topic, msg)
+			_, err = client.ProduceMsgs(topic, msg)
 			if err != nil {
 				fmt.Printf("Unable to produce message %q: %q\n", string(msg), err.Error())
 				client.Close()
@@ -5,13 +5,17 @@ import (
 	"flag"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 
+	"github.com/haraqa/haraqa/pkg/archive"
+	"github.com/haraqa/haraqa/pkg/migrate"
 	"github.com/haraqa/haraqa/pkg/server"
 )
 
@@ -19,8 +23,14 @@ import (
 var content embed.FS
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrateDirs(os.Args[2:])
+		return
+	}
+
 	var (
 		ballastSize  int64
+		engine       string
 		httpPort     uint
 		fileCache    bool
 		fileEntries  int64
@@ -28,15 +38,50 @@ func main() {
 		consumeLimit int64
 		cors         bool
 		docs         bool
+		syncPolicy   string
+		syncInterval time.Duration
+		retention    time.Duration
+		maxAge       time.Duration
+		maxBytes     int64
+		maxCount     int64
+		compaction   time.Duration
+		tombstoneAge time.Duration
+		compacted    string
+		compression  time.Duration
+		archiveEvery time.Duration
+		archiveAge   time.Duration
+		archiveDir   string
+		archiveCache string
+		cacheSize    int
+		segmentBytes int64
+		segmentAge   time.Duration
 	)
 	flag.Int64Var(&ballastSize, "ballast", 1<<30, "Garbage collection ballast")
 	flag.UintVar(&httpPort, "http", 4353, "Port to listen on")
+	flag.StringVar(&engine, "engine", string(migrate.EngineQueue), "Storage format of the volumes: queue or filequeue")
 	flag.BoolVar(&fileCache, "cache", true, "Enable queue file caching")
 	flag.Int64Var(&fileEntries, "entries", 5000, "The number of msg entries per queue file")
+	flag.Int64Var(&segmentBytes, "segment-bytes", 0, "Start a new queue file once the latest file holds this many bytes of messages, unlimited if 0")
+	flag.DurationVar(&segmentAge, "segment-age", 0, "Start a new queue file once the first message of the latest file is older than this age, unlimited if 0")
 	flag.Int64Var(&consumeLimit, "limit", -1, "Default batch limit for consumers")
 	flag.BoolVar(&promEnabled, "prometheus", true, "Enable prometheus metrics")
 	flag.BoolVar(&cors, "cors", true, "Enable CORS")
 	flag.BoolVar(&docs, "docs", true, "Enable Docs pages")
+	flag.StringVar(&syncPolicy, "sync", string(server.SyncNone), "When to sync messages to disk: none, batch or interval")
+	flag.DurationVar(&syncInterval, "sync-interval", time.Second, "Interval between syncs with the interval sync policy")
+	flag.DurationVar(&retention, "retention", time.Minute, "Interval between retention runs, applying the retention flags and the retention of each topic config, retention is disabled if 0")
+	flag.DurationVar(&maxAge, "retention-age", 0, "Remove messages older than this age, unlimited if 0")
+	flag.Int64Var(&maxBytes, "retention-bytes", 0, "Remove the oldest messages of topics larger than this many bytes, unlimited if 0")
+	flag.Int64Var(&maxCount, "retention-count", 0, "Remove the oldest messages of topics with more than this many messages, unlimited if 0")
+	flag.DurationVar(&compaction, "compaction", time.Hour, "Interval between compaction runs of the compaction topics and the topics configured to be compacted, compaction is disabled if 0")
+	flag.DurationVar(&tombstoneAge, "compaction-tombstone-age", 24*time.Hour, "How long tombstones are kept by compaction")
+	flag.StringVar(&compacted, "compaction-topics", "", "Comma separated list of topics to compact by message key")
+	flag.DurationVar(&compression, "compression", 0, "Interval between compressing closed segments, compression is disabled if 0")
+	flag.DurationVar(&archiveEvery, "archive", 0, "Interval between moving old segments to the archive directory, archiving is disabled if 0")
+	flag.DurationVar(&archiveAge, "archive-age", 7*24*time.Hour, "Archive closed segments once all of their messages are older than this age")
+	flag.StringVar(&archiveDir, "archive-dir", ".haraqa-archive", "Directory archived segments are moved to")
+	flag.StringVar(&archiveCache, "archive-cache-dir", ".haraqa-archive-cache", "Directory archived segments are fetched back into when consumed")
+	flag.IntVar(&cacheSize, "archive-cache-segments", 16, "The number of fetched segments kept in the archive cache per topic")
 	flag.Parse()
 
 	// setup logger
@@ -52,10 +97,54 @@ func main() {
 		logger.Fatal("Missing directory args")
 	}
 
+	// refuse to read volumes written in another format
+	detected, err := migrate.Detect(flag.Args())
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if detected != "" && detected != migrate.Engine(engine) {
+		logger.Fatalf("Volumes are stored in the %s format, run with -engine %s or convert them with the migrate command", detected, detected)
+	}
+
 	// get options
 	var opts []server.Option
-	opts = append(opts, server.WithDefaultQueue(flag.Args(), fileCache, fileEntries))
+	switch migrate.Engine(engine) {
+	case migrate.EngineQueue:
+		opts = append(opts, server.WithDefaultQueue(flag.Args(), fileCache, fileEntries))
+	case migrate.EngineFileQueue:
+		opts = append(opts, server.WithFileQueue(flag.Args(), fileCache, fileEntries))
+	default:
+		logger.Fatalf("Unknown engine %q", engine)
+	}
 	opts = append(opts, server.WithLogger(logger))
+	if segmentBytes > 0 || segmentAge > 0 {
+		opts = append(opts, server.WithSegmentRolling(segmentBytes, segmentAge))
+	}
+	opts = append(opts, server.WithSyncPolicy(server.SyncPolicy(syncPolicy), syncInterval))
+	if retention > 0 {
+		opts = append(opts, server.WithRetention(retention, server.RetentionPolicy{
+			MaxAge:   maxAge,
+			MaxBytes: maxBytes,
+			MaxCount: maxCount,
+		}, nil))
+	}
+	if compaction > 0 {
+		var topics []string
+		if compacted != "" {
+			topics = strings.Split(compacted, ",")
+		}
+		opts = append(opts, server.WithCompaction(compaction, tombstoneAge, topics...))
+	}
+	if compression > 0 {
+		opts = append(opts, server.WithCompression(compression))
+	}
+	if archiveEvery > 0 {
+		store, err := archive.NewDir(archiveDir)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		opts = append(opts, server.WithArchive(archiveEvery, archiveAge, store, archiveCache, cacheSize))
+	}
 	if consumeLimit > 0 {
 		opts = append(opts, server.WithDefaultConsumeLimit(consumeLimit))
 	}
@@ -98,6 +187,42 @@ func main() {
 	logger.Fatal(http.ListenAndServe(":"+strconv.FormatUint(uint64(httpPort), 10), nil))
 }
 
+// migrateDirs converts the data directories of a stopped server between the queue formats
+func migrateDirs(args []string) {
+	var (
+		from       string
+		to         string
+		src        string
+		dst        string
+		entries    int64
+		verifyOnly bool
+	)
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.StringVar(&from, "from", string(migrate.EngineQueue), "Format of the source directories: queue or filequeue")
+	flags.StringVar(&to, "to", string(migrate.EngineFileQueue), "Format of the destination directories: queue or filequeue")
+	flags.StringVar(&src, "src", "", "Comma separated list of source directories")
+	flags.StringVar(&dst, "dst", "", "Comma separated list of destination directories")
+	flags.Int64Var(&entries, "entries", 5000, "The number of msg entries per file in the destination")
+	flags.BoolVar(&verifyOnly, "verify-only", false, "Only verify a previous migration")
+	_ = flags.Parse(args)
+
+	logger := logrus.New()
+	if src == "" || dst == "" {
+		logger.Fatal("Missing -src or -dst directories")
+	}
+	srcDirs, dstDirs := strings.Split(src, ","), strings.Split(dst, ",")
+	if !verifyOnly {
+		err := migrate.Migrate(migrate.Engine(from), srcDirs, migrate.Engine(to), dstDirs, entries, logger.Infof)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if err := migrate.Verify(migrate.Engine(from), srcDirs, migrate.Engine(to), dstDirs, logger.Infof); err != nil {
+		logger.Fatal(err)
+	}
+	logger.Println("Migration verified")
+}
+
 func promMetrics() (func(http.Handler) http.Handler, *Metrics) {
 	inFlightGauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "in_flight_requests",
@@ -149,31 +274,135 @@ func promMetrics() (func(http.Handler) http.Handler, *Metrics) {
 		},
 	)
 
+	produceLatency := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "produce_latency_seconds",
+			Help:    "A histogram of the time taken to write produced batches, by sync policy.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"sync_policy"},
+	)
+	syncLatency := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "sync_latency_seconds",
+			Help:    "A histogram of the time taken by interval syncs, by sync policy.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"sync_policy"},
+	)
+
+	retentionRemoved := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "retention_removed_messages_total",
+			Help: "A counter for messages removed by retention, by topic.",
+		},
+		[]string{"topic"},
+	)
+	retentionLatency := prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "retention_latency_seconds",
+			Help:    "A histogram of the time taken to apply retention to a topic.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	compactionRemoved := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "compaction_removed_messages_total",
+			Help: "A counter for messages removed by compaction, by topic.",
+		},
+		[]string{"topic"},
+	)
+	compactionLatency := prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "compaction_latency_seconds",
+			Help:    "A histogram of the time taken to compact a topic.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	compressionSaved := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "compression_saved_bytes_total",
+			Help: "A counter for bytes saved by compressing closed segments, by topic.",
+		},
+		[]string{"topic"},
+	)
+	compressionLatency := prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "compression_latency_seconds",
+			Help:    "A histogram of the time taken to compress the closed segments of a topic.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	archivedSegments := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "archive_moved_segments_total",
+			Help: "A counter for segments moved to the archive, by topic.",
+		},
+		[]string{"topic"},
+	)
+	archiveLatency := prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "archive_latency_seconds",
+			Help:    "A histogram of the time taken to archive the old segments of a topic.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
 	// Register all of the metrics in the standard registry.
-	prometheus.MustRegister(inFlightGauge, counter, duration, requestSize, responseSize, produceBatchSize, consumeBatchSize)
+	prometheus.MustRegister(inFlightGauge, counter, duration, requestSize, responseSize, produceBatchSize, consumeBatchSize, produceLatency, syncLatency, retentionRemoved, retentionLatency, compactionRemoved, compactionLatency, compressionSaved, compressionLatency, archivedSegments, archiveLatency)
 
 	return func(next http.Handler) http.Handler {
-			return promhttp.InstrumentHandlerInFlight(inFlightGauge,
-				promhttp.InstrumentHandlerDuration(duration,
-					promhttp.InstrumentHandlerRequestSize(requestSize,
-						promhttp.InstrumentHandlerResponseSize(responseSize,
-							promhttp.InstrumentHandlerCounter(counter,
-								next,
-							),
+		return promhttp.InstrumentHandlerInFlight(inFlightGauge,
+			promhttp.InstrumentHandlerDuration(duration,
+				promhttp.InstrumentHandlerRequestSize(requestSize,
+					promhttp.InstrumentHandlerResponseSize(responseSize,
+						promhttp.InstrumentHandlerCounter(counter,
+							next,
 						),
 					),
 				),
-			)
-		}, &Metrics{
-			produceHist: produceBatchSize,
-			consumeHist: consumeBatchSize,
-		}
+			),
+		)
+	}, &Metrics{
+		produceHist:        produceBatchSize,
+		consumeHist:        consumeBatchSize,
+		produceLatency:     produceLatency,
+		syncLatency:        syncLatency,
+		retentionRemoved:   retentionRemoved,
+		retentionLatency:   retentionLatency,
+		compactionRemoved:  compactionRemoved,
+		compactionLatency:  compactionLatency,
+		compressionSaved:   compressionSaved,
+		compressionLatency: compressionLatency,
+		archivedSegments:   archivedSegments,
+		archiveLatency:     archiveLatency,
+	}
 }
 
-// Metrics is a prometheus based implementation of the haraqa Metrics interface
+var _ server.Metrics = &Metrics{}
+var _ server.LatencyMetrics = &Metrics{}
+var _ server.RetentionMetrics = &Metrics{}
+var _ server.CompactionMetrics = &Metrics{}
+var _ server.CompressionMetrics = &Metrics{}
+var _ server.ArchiveMetrics = &Metrics{}
+
+// Metrics is a prometheus based implementation of the haraqa Metrics interface and its optional interfaces
 type Metrics struct {
-	produceHist prometheus.Histogram
-	consumeHist prometheus.Histogram
+	produceHist        prometheus.Histogram
+	consumeHist        prometheus.Histogram
+	produceLatency     *prometheus.HistogramVec
+	syncLatency        *prometheus.HistogramVec
+	retentionRemoved   *prometheus.CounterVec
+	retentionLatency   prometheus.Histogram
+	compactionRemoved  *prometheus.CounterVec
+	compactionLatency  prometheus.Histogram
+	compressionSaved   *prometheus.CounterVec
+	compressionLatency prometheus.Histogram
+	archivedSegments   *prometheus.CounterVec
+	archiveLatency     prometheus.Histogram
 }
 
 // ProduceMsgs updates the produce histogram with the batch size
@@ -185,3 +414,37 @@ func (m *Metrics) ProduceMsgs(n int) {
 func (m *Metrics) ConsumeMsgs(n int) {
 	m.consumeHist.Observe(float64(n))
 }
+
+// ProduceLatency updates the produce latency histogram for the sync policy
+func (m *Metrics) ProduceLatency(syncPolicy server.SyncPolicy, d time.Duration) {
+	m.produceLatency.WithLabelValues(string(syncPolicy)).Observe(d.Seconds())
+}
+
+// SyncLatency updates the sync latency histogram for the sync policy
+func (m *Metrics) SyncLatency(syncPolicy server.SyncPolicy, d time.Duration) {
+	m.syncLatency.WithLabelValues(string(syncPolicy)).Observe(d.Seconds())
+}
+
+// RetentionRun updates the retention counter and latency histogram
+func (m *Metrics) RetentionRun(topic string, removed int64, d time.Duration) {
+	m.retentionRemoved.WithLabelValues(topic).Add(float64(removed))
+	m.retentionLatency.Observe(d.Seconds())
+}
+
+// CompactionRun updates the compaction counter and latency histogram
+func (m *Metrics) CompactionRun(topic string, removed int64, d time.Duration) {
+	m.compactionRemoved.WithLabelValues(topic).Add(float64(removed))
+	m.compactionLatency.Observe(d.Seconds())
+}
+
+// CompressionRun updates the compression counter and latency histogram
+func (m *Metrics) CompressionRun(topic string, saved int64, d time.Duration) {
+	m.compressionSaved.WithLabelValues(topic).Add(float64(saved))
+	m.compressionLatency.Observe(d.Seconds())
+}
+
+// ArchiveRun updates the archive counter and latency histogram
+func (m *Metrics) ArchiveRun(topic string, archived int64, d time.Duration) {
+	m.archivedSegments.WithLabelValues(topic).Add(float64(archived))
+	m.archiveLatency.Observe(d.Seconds())
+}
@@ -134,7 +134,7 @@ func (u *User) SendMsg(topic, msg string) {
 	time.Sleep(time.Second * 4)
 
 	fmt.Println("\n"+u.username, "SENDING:", msg)
-	err := u.client.ProduceMsgs(topic, []byte(msg))
+	_, err := u.client.ProduceMsgs(topic, []byte(msg))
 	if err != nil {
 		panic(err)
 	}
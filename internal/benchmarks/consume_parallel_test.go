@@ -0,0 +1,96 @@
+package benchmarks
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/filequeue"
+	"github.com/haraqa/haraqa/internal/queue"
+)
+
+type consumeQueue interface {
+	CreateTopic(topic string) error
+	Produce(topic string, msgSizes []int64, timestamp uint64, r io.Reader) error
+	Consume(group, topic string, id int64, limit int64, w http.ResponseWriter) (int, error)
+	Close() error
+}
+
+// discardWriter is a ResponseWriter dropping the consumed messages
+type discardWriter http.Header
+
+func (w discardWriter) Header() http.Header         { return http.Header(w) }
+func (w discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardWriter) WriteHeader(int)             {}
+
+// BenchmarkParallelConsume consumes a hot topic from many goroutines while a producer keeps writing to it
+func BenchmarkParallelConsume(b *testing.B) {
+	b.Run("queue", benchParallelConsume(func(dir string) (consumeQueue, error) {
+		return queue.NewQueue([]string{dir}, true, 5000)
+	}))
+	b.Run("filequeue", benchParallelConsume(func(dir string) (consumeQueue, error) {
+		return filequeue.New(true, 5000, dir)
+	}))
+}
+
+func benchParallelConsume(newQueue func(dir string) (consumeQueue, error)) func(b *testing.B) {
+	return func(b *testing.B) {
+		dir, err := os.MkdirTemp("", ".haraqa*")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		q, err := newQueue(dir)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer q.Close()
+
+		const topic = "benchtopic"
+		if err = q.CreateTopic(topic); err != nil {
+			b.Fatal(err)
+		}
+		sizes := make([]int64, 100)
+		for i := range sizes {
+			sizes[i] = 100
+		}
+		data := make([]byte, 100*len(sizes))
+		for i := 0; i < 20; i++ {
+			if err = q.Produce(topic, sizes, uint64(time.Now().Unix()), bytes.NewReader(data)); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		// keep producing to the segment being consumed
+		var stop int32
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for atomic.LoadInt32(&stop) == 0 {
+				_ = q.Produce(topic, sizes[:1], uint64(time.Now().Unix()), bytes.NewReader(data[:100]))
+				time.Sleep(time.Millisecond)
+			}
+		}()
+
+		b.SetBytes(int64(len(data)))
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			w := discardWriter{}
+			var id int64
+			for pb.Next() {
+				if _, err := q.Consume("", topic, id, int64(len(sizes)), w); err != nil {
+					b.Error(err)
+					return
+				}
+				id = (id + int64(len(sizes))) % 2000
+			}
+		})
+		b.StopTimer()
+		atomic.StoreInt32(&stop, 1)
+		<-done
+	}
+}
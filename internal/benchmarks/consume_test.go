@@ -64,7 +64,7 @@ func BenchmarkConsume(b *testing.B) {
 
 	for i := 0; i < b.N; i += len(msgs) {
 		body := bytes.NewBuffer(data)
-		err = c.Produce("benchtopic", sizes, body)
+		_, err = c.Produce("benchtopic", sizes, body)
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -79,7 +79,7 @@ func benchProducer(batchSize int, c *haraqa.Client) func(b *testing.B) {
 		b.ReportAllocs()
 		for i := 0; i < b.N; i += len(msgs) {
 			body := bytes.NewBuffer(data)
-			err = c.Produce("benchtopic", sizes, body)
+			_, err = c.Produce("benchtopic", sizes, body)
 			if err != nil {
 				b.Fatal(err)
 			}
@@ -106,7 +106,7 @@ func benchProducerN(N, batchSize int, c *haraqa.Client) func(b *testing.B) {
 			go func() {
 				for range ch {
 					body := bytes.NewBuffer(data)
-					err = c.Produce("benchtopic", sizes, body)
+					_, err = c.Produce("benchtopic", sizes, body)
 					if err != nil {
 						b.Fatal(err)
 					}
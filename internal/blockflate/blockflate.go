@@ -0,0 +1,200 @@
+// Package blockflate compresses files as a sequence of independently deflated blocks followed by an index
+// of the block offsets, so any range of the original file can be read without decompressing all of it.
+//
+// The layout of a compressed file is
+//
+//	block... offset... blockSize size numBlocks magic
+//
+// where each offset and trailer field is a little endian uint64
+package blockflate
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Ext is the extension added to the name of a compressed file
+const Ext = ".z"
+
+// DefaultBlockSize is the uncompressed size of each block
+const DefaultBlockSize = 64 << 10
+
+const (
+	trailerSize = 32
+	magic       = 0x7a6c666b6c62 // "blkflz"
+)
+
+// ErrInvalidFile is returned when opening a file which was not written by Write
+var ErrInvalidFile = errors.New("invalid compressed file")
+
+// Write compresses src to w in blocks of blockSize bytes and returns the compressed size
+func Write(w io.Writer, src []byte, blockSize int) (int64, error) {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return 0, err
+	}
+
+	offsets := make([]byte, 0, (len(src)/blockSize+1)*8)
+	var written int64
+	for off := 0; off < len(src); off += blockSize {
+		end := off + blockSize
+		if end > len(src) {
+			end = len(src)
+		}
+		buf.Reset()
+		fw.Reset(&buf)
+		if _, err = fw.Write(src[off:end]); err != nil {
+			return written, err
+		}
+		if err = fw.Close(); err != nil {
+			return written, err
+		}
+		offsets = appendUint64(offsets, uint64(written))
+		n, err := w.Write(buf.Bytes())
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	trailer := appendUint64(nil, uint64(blockSize))
+	trailer = appendUint64(trailer, uint64(len(src)))
+	trailer = appendUint64(trailer, uint64(len(offsets)/8))
+	trailer = appendUint64(trailer, magic)
+	n, err := w.Write(append(offsets, trailer...))
+	return written + int64(n), err
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	return append(b, tmp[:]...)
+}
+
+// Reader reads ranges of the original contents of a compressed file
+type Reader struct {
+	r         io.ReaderAt
+	closer    io.Closer
+	blockSize int64
+	size      int64
+	offsets   []int64 // offset of each block, followed by the offset of the index
+}
+
+// Open opens a compressed file for reading
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	r, err := NewReader(f, stat.Size())
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.Wrapf(err, "unable to open %q", path)
+	}
+	r.closer = f
+	return r, nil
+}
+
+// NewReader returns a Reader of the compressed contents of r, which is size bytes long
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	if size < trailerSize {
+		return nil, ErrInvalidFile
+	}
+	var trailer [trailerSize]byte
+	if _, err := r.ReadAt(trailer[:], size-trailerSize); err != nil {
+		return nil, err
+	}
+	blocks := int64(binary.LittleEndian.Uint64(trailer[16:]))
+	indexAt := size - trailerSize - blocks*8
+	if binary.LittleEndian.Uint64(trailer[24:]) != magic || blocks < 0 || indexAt < 0 {
+		return nil, ErrInvalidFile
+	}
+
+	index := make([]byte, blocks*8)
+	if _, err := r.ReadAt(index, indexAt); err != nil {
+		return nil, err
+	}
+	offsets := make([]int64, blocks+1)
+	for i := int64(0); i < blocks; i++ {
+		offsets[i] = int64(binary.LittleEndian.Uint64(index[i*8:]))
+	}
+	offsets[blocks] = indexAt
+	return &Reader{
+		r:         r,
+		blockSize: int64(binary.LittleEndian.Uint64(trailer[0:])),
+		size:      int64(binary.LittleEndian.Uint64(trailer[8:])),
+		offsets:   offsets,
+	}, nil
+}
+
+// Size returns the size of the original contents
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// ReadAt reads len(p) bytes of the original contents starting at off, decompressing only the blocks holding them
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	var n int
+	for n < len(p) && off < r.size {
+		block := off / r.blockSize
+		data, err := r.readBlock(block)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], data[off-block*r.blockSize:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// ReadAll returns the original contents
+func (r *Reader) ReadAll() ([]byte, error) {
+	b := make([]byte, r.size)
+	_, err := r.ReadAt(b, 0)
+	return b, err
+}
+
+func (r *Reader) readBlock(block int64) ([]byte, error) {
+	start, end := r.offsets[block], r.offsets[block+1]
+	fr := flate.NewReader(io.NewSectionReader(r.r, start, end-start))
+	defer fr.Close()
+
+	size := r.blockSize
+	if rem := r.size - block*r.blockSize; rem < size {
+		size = rem
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(fr, data); err != nil {
+		return nil, errors.Wrapf(err, "unable to decompress block %d", block)
+	}
+	return data, nil
+}
+
+// Close closes the underlying file, if the Reader was opened with Open
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
@@ -0,0 +1,85 @@
+package blockflate
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestBlockflate(t *testing.T) {
+	src := bytes.Repeat([]byte("0123456789abcdef"), 100)
+	var buf bytes.Buffer
+	n, err := Write(&buf, src, 100)
+	if err != nil || n != int64(buf.Len()) {
+		t.Fatal(err, n, buf.Len())
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil || r.Size() != int64(len(src)) {
+		t.Fatal(err)
+	}
+
+	// ranges within and across blocks
+	for _, tc := range [][2]int{{0, 10}, {95, 210}, {1590, 1600}, {0, 1600}} {
+		p := make([]byte, tc[1]-tc[0])
+		if n, err := r.ReadAt(p, int64(tc[0])); err != nil || n != len(p) || !bytes.Equal(p, src[tc[0]:tc[1]]) {
+			t.Error(tc, err, n)
+		}
+	}
+
+	// past the end
+	p := make([]byte, 20)
+	if n, err := r.ReadAt(p, 1590); err != io.EOF || n != 10 {
+		t.Error(err, n)
+	}
+	if b, err := r.ReadAll(); err != nil || !bytes.Equal(b, src) {
+		t.Error(err)
+	}
+
+	// invalid files
+	if _, err = NewReader(bytes.NewReader(src), int64(len(src))); !errors.Is(err, ErrInvalidFile) {
+		t.Error(err)
+	}
+	if _, err = NewReader(bytes.NewReader(nil), 0); !errors.Is(err, ErrInvalidFile) {
+		t.Error(err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := os.MkdirTemp("", ".haraqa*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// empty files hold no blocks
+	var buf bytes.Buffer
+	if _, err = Write(&buf, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "empty"+Ext)
+	if err = os.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(path)
+	if err != nil || r.Size() != 0 {
+		t.Fatal(err)
+	}
+	if err = r.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = Open(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	if err = os.WriteFile(path, []byte("invalid"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(path); !errors.Is(err, ErrInvalidFile) {
+		t.Error(err)
+	}
+}
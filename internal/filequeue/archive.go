@@ -0,0 +1,371 @@
+package filequeue
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/blockflate"
+	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/haraqa/haraqa/pkg/archive"
+)
+
+// SetArchive sets the store closed segments are moved to by ArchiveSegments. Consume fetches archived segments
+// back into cacheDir, where up to cacheSegments of the most recently read segments of each topic are kept
+func (q *FileQueue) SetArchive(store archive.ArchiveStore, cacheDir string, cacheSegments int) error {
+	if store == nil {
+		return errors.New("invalid archive store: store cannot be nil")
+	}
+	cacheDir = filepath.Clean(cacheDir)
+	for _, rootDir := range q.rootDirNames {
+		if cacheDir == rootDir {
+			return errors.Errorf("invalid archive cache directory %q: directory is a queue volume", cacheDir)
+		}
+	}
+	if err := osMkdirAll(cacheDir, os.ModePerm); err != nil {
+		return errors.Wrapf(err, "unable to create archive cache directory %q", cacheDir)
+	}
+	q.archive = store
+	q.archiveCacheDir = cacheDir
+	q.archiveCacheSegments = cacheSegments
+	q.archiveNames = &sync.Map{}
+	return nil
+}
+
+// ArchiveSegments moves the closed segments of a topic, whose messages were all produced before the given time,
+// to the archive store and removes them from every volume. The number of archived segments is returned
+func (q *FileQueue) ArchiveSegments(topic string, before time.Time) (int64, error) {
+	if q.archive == nil {
+		return 0, errors.New("no archive store set")
+	}
+	if topic == "" {
+		return 0, nil
+	}
+	topicPath := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic)
+
+	mux := q.topicLock(topic)
+	mux.Lock()
+	names, err := segmentNames(topicPath)
+	mux.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, headers.ErrTopicDoesNotExist
+		}
+		return 0, errors.Wrapf(err, "unable to list segments of topic %q", topic)
+	}
+
+	// compaction and compression rewrite closed segments, they must not change while they are archived
+	rewrite := q.rewriteLock(topic)
+	rewrite.Lock()
+	defer rewrite.Unlock()
+
+	var archived int64
+	for i := 0; i < len(names)-1; i++ {
+		path := filepath.Join(topicPath, names[i])
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return archived, err
+		}
+		_, last, err := segmentTimestamps(path, info.Size()/datEntryLength)
+		if err != nil {
+			return archived, err
+		}
+		// segments are produced in order, the remaining ones are newer
+		if !last.Before(before) {
+			break
+		}
+		if err = q.archiveSegment(topic, names[i]); err != nil {
+			return archived, errors.Wrapf(err, "unable to archive segment %q of topic %q", names[i], topic)
+		}
+		archived++
+	}
+	if archived > 0 {
+		q.archiveNames.Delete(topic)
+	}
+
+	if err = q.evictArchiveCache(topic); err != nil {
+		return archived, errors.Wrapf(err, "unable to evict archived segments of topic %q", topic)
+	}
+	return archived, nil
+}
+
+// archiveSegment uploads the log and then the dat file of a segment, so the archived dat file is only
+// visible once the segment is complete. The segment is then removed from every volume
+func (q *FileQueue) archiveSegment(topic, name string) error {
+	path := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic, name)
+	logName := name + ".log"
+	if _, err := os.Stat(path + ".log"); os.IsNotExist(err) {
+		logName += blockflate.Ext
+	}
+	for _, file := range []string{logName, name} {
+		if err := q.putArchive(topic, file, filepath.Join(filepath.Dir(path), file)); err != nil {
+			return err
+		}
+	}
+
+	mux := q.topicLock(topic)
+	mux.Lock()
+	defer mux.Unlock()
+	lock := q.segmentLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// the segment was truncated while it was uploaded
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return q.deleteArchived(topic, name)
+	}
+	if err := q.removeSegment(topic, name); err != nil {
+		return err
+	}
+	if q.consumeNameCache != nil {
+		q.consumeNameCache.Delete(topic)
+	}
+	return nil
+}
+
+func (q *FileQueue) putArchive(topic, name, path string) error {
+	f, err := osOpen(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return q.archive.Put(topic, name, f)
+}
+
+// deleteArchived removes the dat and then the log files of an archived segment from the store
+func (q *FileQueue) deleteArchived(topic, name string) error {
+	for _, file := range []string{name, name + ".log", name + ".log" + blockflate.Ext} {
+		if err := q.archive.Delete(topic, file); err != nil {
+			return errors.Wrapf(err, "unable to delete archived file %q", file)
+		}
+	}
+	return nil
+}
+
+// archivedNames returns the names of the archived segments of a topic in ascending order
+func (q *FileQueue) archivedNames(topic string) ([]string, error) {
+	if v, ok := q.archiveNames.Load(topic); ok {
+		return v.([]string), nil
+	}
+	files, err := q.archive.List(topic)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list archived segments of topic %q", topic)
+	}
+	names := make([]string, 0, len(files)/2)
+	for _, name := range files {
+		if !strings.ContainsRune(name, '.') {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	q.archiveNames.Store(topic, names)
+	return names, nil
+}
+
+// fetchArchived returns the path to the cached dat file of the archived segment holding id,
+// fetching the segment from the store if it is not cached. An empty path is returned if no segment holds id
+func (q *FileQueue) fetchArchived(topic string, id int64) (string, error) {
+	names, err := q.archivedNames(topic)
+	if err != nil {
+		return "", err
+	}
+	exact := formatName(id)
+	i := sort.Search(len(names), func(i int) bool { return names[i] > exact })
+	if i == 0 {
+		return "", nil
+	}
+	name := names[i-1]
+	dir := filepath.Join(q.archiveCacheDir, topic)
+	path := filepath.Join(dir, name)
+
+	// mark cached segments as recently read
+	now := time.Now()
+	if err = os.Chtimes(path, now, now); err == nil {
+		return path, nil
+	}
+
+	q.archiveFetch.Lock()
+	defer q.archiveFetch.Unlock()
+	if _, err = os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err = osMkdirAll(dir, os.ModePerm); err != nil {
+		return "", errors.Wrapf(err, "unable to create archive cache directory %q", dir)
+	}
+
+	// fetch the log before the dat file, a cached dat file means the segment is complete
+	err = q.getArchive(topic, name+".log", dir)
+	if errors.Is(err, os.ErrNotExist) {
+		err = q.getArchive(topic, name+".log"+blockflate.Ext, dir)
+	}
+	if err == nil {
+		err = q.getArchive(topic, name, dir)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		// the segment was removed from the archive since it was listed
+		q.archiveNames.Delete(topic)
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to fetch archived segment %q of topic %q", name, topic)
+	}
+	return path, nil
+}
+
+func (q *FileQueue) getArchive(topic, name, dir string) error {
+	r, err := q.archive.Get(topic, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, ".fetch-"+name)
+	if err = writeSynced(tmp, b); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// evictArchiveCache removes all but the most recently read cached segments of a topic
+func (q *FileQueue) evictArchiveCache(topic string) error {
+	dir := filepath.Join(q.archiveCacheDir, topic)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	type cached struct {
+		name    string
+		modTime time.Time
+	}
+	segments := make([]cached, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.ContainsRune(entry.Name(), '.') {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		segments = append(segments, cached{name: entry.Name(), modTime: info.ModTime()})
+	}
+	if len(segments) <= q.archiveCacheSegments {
+		return nil
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].modTime.After(segments[j].modTime) })
+
+	// hold off consumers reading the cached segments
+	lock := q.segmentLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+	for _, segment := range segments[q.archiveCacheSegments:] {
+		if err = removeCached(dir, segment.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeCached removes the dat and then the log files of a cached segment
+func removeCached(dir, name string) error {
+	path := filepath.Join(dir, name)
+	for _, p := range []string{path, path + ".log", path + ".log" + blockflate.Ext} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "unable to remove file %s", p)
+		}
+	}
+	return nil
+}
+
+// truncateArchive removes the archived segments of a topic matching the truncate request and adds the
+// remaining archived segments to the topic info. Archived segments are only removed by truncating to an id
+func (q *FileQueue) truncateArchive(topic string, request headers.ModifyRequest, topicInfo *headers.TopicInfo) error {
+	q.archiveNames.Delete(topic)
+	names, err := q.archivedNames(topic)
+	if err != nil || len(names) == 0 {
+		return err
+	}
+
+	var removed int
+	for i, name := range names {
+		next := topicInfo.MinOffset
+		if i < len(names)-1 {
+			next, _ = strconv.ParseInt(names[i+1], 10, 64)
+		}
+		if request.Truncate >= 0 && (request.Truncate == 0 || next < 0 || next >= request.Truncate) {
+			break
+		}
+		if err = q.deleteArchived(topic, name); err != nil {
+			return err
+		}
+		if err = q.removeCachedSegment(topic, name); err != nil {
+			return err
+		}
+		removed++
+	}
+	if removed > 0 {
+		q.archiveNames.Delete(topic)
+	}
+	if removed == len(names) {
+		return nil
+	}
+
+	// the oldest remaining message is archived
+	base, err := strconv.ParseInt(names[removed], 10, 64)
+	if err != nil {
+		return nil
+	}
+	topicInfo.MinOffset = base
+	r, err := q.archive.Get(topic, names[removed])
+	if err != nil {
+		return errors.Wrapf(err, "unable to read archived segment %q of topic %q", names[removed], topic)
+	}
+	defer r.Close()
+	var entry [datEntryLength]byte
+	if _, err = io.ReadFull(r, entry[:]); err != nil {
+		topicInfo.FirstTimestamp = time.Time{}
+		return nil
+	}
+	ts, _ := decodeTimestamp(binary.LittleEndian.Uint64(entry[8:]))
+	topicInfo.FirstTimestamp = time.Unix(int64(ts), 0).UTC()
+	return nil
+}
+
+// removeCachedSegment removes the cached copy of an archived segment, waiting for consumers to finish reading it
+func (q *FileQueue) removeCachedSegment(topic, name string) error {
+	lock := q.segmentLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+	return removeCached(filepath.Join(q.archiveCacheDir, topic), name)
+}
+
+// deleteArchivedTopic removes every archived and cached file of a topic
+func (q *FileQueue) deleteArchivedTopic(topic string) error {
+	q.archiveNames.Delete(topic)
+	files, err := q.archive.List(topic)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		if err = q.archive.Delete(topic, name); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(filepath.Join(q.archiveCacheDir, topic))
+}
@@ -0,0 +1,134 @@
+package filequeue
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/haraqa/haraqa/pkg/archive"
+)
+
+func TestFileQueue_ArchiveSegments(t *testing.T) {
+	dirs := []string{".haraqa-archive1", ".haraqa-archive2", ".haraqa-archive-store", ".haraqa-archive-cache"}
+	topic := "archive-topic"
+	for _, dir := range dirs {
+		_ = os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	q, err := New(true, 2, dirs[:2]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if _, err = q.ArchiveSegments(topic, time.Now()); err == nil {
+		t.Error("expected an error without an archive store")
+	}
+	store, err := archive.NewDir(dirs[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.SetArchive(store, dirs[0], 1); err == nil {
+		t.Error("expected an error for a cache directory on a volume")
+	}
+	if err = q.SetArchive(store, dirs[3], 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.ArchiveSegments(topic, time.Now()); err != headers.ErrTopicDoesNotExist {
+		t.Error(err)
+	}
+
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	produced := time.Now().Add(-time.Hour)
+	for i := 0; i < 3; i++ {
+		if err = q.Produce(topic, []int64{5, 5}, uint64(produced.Unix()), bytes.NewBufferString("hellohello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = q.CompressSegments(topic); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is old enough
+	if n, err := q.ArchiveSegments(topic, produced.Add(-time.Minute)); err != nil || n != 0 {
+		t.Fatal(err, n)
+	}
+
+	// closed segments are moved to the store, the latest segment is kept
+	if n, err := q.ArchiveSegments(topic, time.Now()); err != nil || n != 2 {
+		t.Fatal(err, n)
+	}
+	for _, dir := range dirs[:2] {
+		for _, name := range []string{formatName(0), formatName(2)} {
+			if _, err := os.Stat(filepath.Join(dir, topic, name)); !os.IsNotExist(err) {
+				t.Error(err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dir, topic, formatName(4)+".log")); err != nil {
+			t.Error(err)
+		}
+	}
+	names, err := store.List(topic)
+	sort.Strings(names)
+	if err != nil || !reflect.DeepEqual(names, []string{formatName(0), formatName(0) + ".log.z", formatName(2), formatName(2) + ".log.z"}) {
+		t.Error(err, names)
+	}
+
+	// archived segments are fetched back on consume
+	for id := int64(0); id < 6; id++ {
+		w := httptest.NewRecorder()
+		if n, err := q.Consume("", topic, id, 1, w); err != nil || n != 1 || w.Body.String() != "hello" {
+			t.Fatal(id, err, n, w.Body.String())
+		}
+	}
+	for _, name := range []string{formatName(0), formatName(2)} {
+		if _, err := os.Stat(filepath.Join(dirs[3], topic, name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// only the most recently read segment stays cached
+	if n, err := q.ArchiveSegments(topic, time.Now()); err != nil || n != 0 {
+		t.Fatal(err, n)
+	}
+	if _, err := os.Stat(filepath.Join(dirs[3], topic, formatName(0))); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(dirs[3], topic, formatName(2))); err != nil {
+		t.Error(err)
+	}
+
+	// archived segments are part of the topic info and are removed by truncating
+	info, err := q.ModifyTopic(topic, headers.ModifyRequest{})
+	if err != nil || info.MinOffset != 0 || info.MaxOffset != 5 || info.FirstTimestamp.Unix() != produced.Unix() {
+		t.Fatal(err, info)
+	}
+	if info, err = q.ModifyTopic(topic, headers.ModifyRequest{Truncate: 3}); err != nil || info.MinOffset != 2 {
+		t.Fatal(err, info)
+	}
+	if names, err = store.List(topic); err != nil || len(names) != 2 {
+		t.Error(err, names)
+	}
+	w := httptest.NewRecorder()
+	if n, err := q.Consume("", topic, 0, 1, w); err != nil || n != 0 {
+		t.Error(err, n)
+	}
+
+	if err = q.DeleteTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if names, err = store.List(topic); err != nil || len(names) != 0 {
+		t.Error(err, names)
+	}
+	if _, err := os.Stat(filepath.Join(dirs[3], topic)); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,81 @@
+package filequeue
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// Dat entries keep their original 32 byte layout. The upper 16 bits of the timestamp field hold
+// flags and the upper 32 bits of the size field hold the CRC32C of the message when flagChecksum is set.
+// Entries written before checksums were introduced have no flags and are served unverified
+const (
+	timestampMask = 1<<48 - 1
+	sizeMask      = 1<<32 - 1
+	flagChecksum  = 1 << 48
+	flagBatchEnd  = 1 << 49 // set on the last entry of each produced batch
+	flagFramed    = 1 << 50 // set on messages stored with a key and headers frame, see headers.AppendFrame
+	flagCompacted = 1 << 51 // set on entries whose message was removed by compaction, the size is zero
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// decodeTimestamp returns the timestamp and flags of a dat entry timestamp field
+func decodeTimestamp(v uint64) (uint64, uint64) {
+	return v & timestampMask, v &^ timestampMask
+}
+
+// decodeSize returns the message size and checksum of a dat entry size field
+func decodeSize(v uint64) (int64, uint32) {
+	return int64(v & sizeMask), uint32(v >> 32)
+}
+
+// encodeSize packs the message size and checksum into a dat entry size field
+func encodeSize(size int64, crc uint32) uint64 {
+	return uint64(size)&sizeMask | uint64(crc)<<32
+}
+
+// verifyLog checks the checksum of every message in buf, which holds the log contents starting at startAt.
+// Messages failing the check are re-read from the same log file in the other volumes.
+// An error is returned if no volume holds a valid copy of a message
+func (q *FileQueue) verifyLog(buf []byte, data []byte, limit int64, startAt uint64, topic, logName string) error {
+	for i := int64(0); i < limit; i++ {
+		entry := data[i*datEntryLength:]
+		_, flags := decodeTimestamp(binary.LittleEndian.Uint64(entry[8:]))
+		if flags&flagChecksum == 0 {
+			continue
+		}
+		size, crc := decodeSize(binary.LittleEndian.Uint64(entry[24:]))
+		off := binary.LittleEndian.Uint64(entry[16:])
+		msg := buf[off-startAt : off-startAt+uint64(size)]
+		if crc32.Checksum(msg, crcTable) == crc {
+			continue
+		}
+		if !q.repairMessage(msg, int64(off), crc, topic, logName) {
+			return errors.Wrapf(headers.ErrCorruptMessage, "message %d in %q", binary.LittleEndian.Uint64(entry), filepath.Join(topic, logName))
+		}
+	}
+	return nil
+}
+
+// repairMessage attempts to fill msg with a valid copy read from one of the other volumes
+func (q *FileQueue) repairMessage(msg []byte, off int64, crc uint32, topic, logName string) bool {
+	for i := len(q.rootDirNames) - 2; i >= 0; i-- {
+		f, err := openLog(filepath.Join(q.rootDirNames[i], topic, logName))
+		if err != nil {
+			continue
+		}
+		tmp := make([]byte, len(msg))
+		_, err = f.ReadAt(tmp, off)
+		_ = f.Close()
+		if err == nil && crc32.Checksum(tmp, crcTable) == crc {
+			copy(msg, tmp)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package filequeue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestFileQueue_Checksum(t *testing.T) {
+	topic := "checksum-topic"
+	dirs := []string{".haraqa-checksum1", ".haraqa-checksum2"}
+	for _, dir := range dirs {
+		_ = os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	q, err := New(false, 5000, dirs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Produce(topic, []int64{5, 5, 5}, uint64(time.Now().Unix()), bytes.NewBuffer([]byte("helloworldagain"))); err != nil {
+		t.Fatal(err)
+	}
+
+	consume := func(expected string, errExpected error) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		_, err := q.Consume("", topic, 0, -1, w)
+		if !errors.Is(err, errExpected) {
+			t.Error(err)
+		}
+		b, _ := io.ReadAll(w.Body)
+		if string(b) != expected {
+			t.Error(string(b))
+		}
+	}
+	corrupt := func(dir string, off int64, b byte) {
+		t.Helper()
+		f, err := os.OpenFile(filepath.Join(dir, topic, formatName(0)+".log"), os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err = f.WriteAt([]byte{b}, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	consume("helloworldagain", nil)
+
+	// corrupt the volume consumers read from, the other volume is used instead
+	corrupt(dirs[1], 6, 'W')
+	consume("helloworldagain", nil)
+
+	// corrupt every volume
+	corrupt(dirs[0], 6, 'W')
+	consume("", headers.ErrCorruptMessage)
+
+	// entries written without a checksum are not verified
+	dat, err := os.OpenFile(filepath.Join(dirs[1], topic, formatName(0)), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dat.Close()
+	var entry [datEntryLength]byte
+	if _, err = dat.ReadAt(entry[:], datEntryLength); err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint64(entry[8:], uint64(time.Now().Unix()))
+	binary.LittleEndian.PutUint64(entry[24:], 5)
+	if _, err = dat.WriteAt(entry[:], datEntryLength); err != nil {
+		t.Fatal(err)
+	}
+	consume("hellowWrldagain", nil)
+}
+
+func TestEncodeSize(t *testing.T) {
+	size, crc := decodeSize(encodeSize(1234, 0xdeadbeef))
+	if size != 1234 || crc != 0xdeadbeef {
+		t.Error(size, crc)
+	}
+	ts, flags := decodeTimestamp(uint64(1600000000) | flagChecksum)
+	if ts != 1600000000 || flags != flagChecksum {
+		t.Error(ts, flags)
+	}
+}
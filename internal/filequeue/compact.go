@@ -0,0 +1,266 @@
+package filequeue
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/blockflate"
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// Compact rewrites the closed segments of a topic so only the latest message of each key remains.
+// Removed messages keep their dat entry, flagged as compacted, so the remaining messages keep their ids.
+// Tombstones, keyed messages with an empty body, are removed once produced before tombstonesBefore.
+// Messages without a key are never removed. The number of messages removed is returned
+func (q *FileQueue) Compact(topic string, tombstonesBefore time.Time) (int64, error) {
+	if topic == "" {
+		return 0, nil
+	}
+	topicPath := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic)
+
+	// find the segments and the current length of the latest one
+	mux := q.topicLock(topic)
+	mux.Lock()
+	names, err := segmentNames(topicPath)
+	var latestEntries int64
+	if err == nil && len(names) > 0 {
+		var info os.FileInfo
+		info, err = os.Stat(filepath.Join(topicPath, names[len(names)-1]))
+		if err == nil {
+			latestEntries = info.Size() / datEntryLength
+		}
+	}
+	mux.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, headers.ErrTopicDoesNotExist
+		}
+		return 0, errors.Wrapf(err, "unable to list segments of topic %q", topic)
+	}
+	if len(names) < 2 {
+		return 0, nil
+	}
+
+	// compaction and compression both rewrite closed segments, only one may run at a time
+	rewrite := q.rewriteLock(topic)
+	rewrite.Lock()
+	defer rewrite.Unlock()
+
+	// find the latest id of each key
+	latest := make(map[string]int64)
+	for i, name := range names {
+		entries := int64(-1)
+		if i == len(names)-1 {
+			entries = latestEntries
+		}
+		dat, log, err := q.readSegment(topic, name, entries)
+		if err != nil {
+			return 0, err
+		}
+		for n := 0; n < len(dat); n += datEntryLength {
+			if key, _, ok := messageKey(dat[n:n+datEntryLength], log); ok {
+				latest[key] = int64(binary.LittleEndian.Uint64(dat[n:]))
+			}
+		}
+	}
+
+	// rewrite every closed segment holding messages which are no longer needed
+	var removed int64
+	for _, name := range names[:len(names)-1] {
+		dat, log, err := q.readSegment(topic, name, -1)
+		if err != nil {
+			return removed, err
+		}
+		newDat, newLog, n := compactSegment(dat, log, latest, tombstonesBefore)
+		if n == 0 {
+			continue
+		}
+		replaced, err := q.replaceSegment(topic, name, newDat, newLog)
+		if err != nil {
+			return removed, errors.Wrapf(err, "unable to replace segment %q of topic %q", name, topic)
+		}
+		if replaced {
+			removed += n
+		}
+	}
+	return removed, nil
+}
+
+// compactSegment returns the dat and log contents of a segment without the messages which are not
+// the latest of their key, along with the number of messages removed
+func compactSegment(dat, log []byte, latest map[string]int64, tombstonesBefore time.Time) ([]byte, []byte, int64) {
+	newDat := make([]byte, len(dat))
+	newLog := make([]byte, 0, len(log))
+	var removed int64
+	for n := 0; n < len(dat); n += datEntryLength {
+		entry := newDat[n : n+datEntryLength]
+		copy(entry, dat[n:n+datEntryLength])
+		id := int64(binary.LittleEndian.Uint64(entry))
+		ts, flags := decodeTimestamp(binary.LittleEndian.Uint64(entry[8:]))
+		binary.LittleEndian.PutUint64(entry[16:], uint64(len(newLog)))
+
+		key, tombstone, ok := messageKey(dat[n:n+datEntryLength], log)
+		remove := ok && (latest[key] != id || tombstone && time.Unix(int64(ts), 0).Before(tombstonesBefore))
+		if !remove {
+			size, _ := decodeSize(binary.LittleEndian.Uint64(entry[24:]))
+			off := binary.LittleEndian.Uint64(dat[n+16:])
+			newLog = append(newLog, log[off:off+uint64(size)]...)
+			continue
+		}
+		binary.LittleEndian.PutUint64(entry[8:], ts|flags&flagBatchEnd|flagCompacted)
+		binary.LittleEndian.PutUint64(entry[24:], 0)
+		removed++
+	}
+	return newDat, newLog, removed
+}
+
+// messageKey returns the key of the message of a dat entry and if the message is a tombstone.
+// False is returned if the message has no key or was already compacted
+func messageKey(entry, log []byte) (string, bool, bool) {
+	_, flags := decodeTimestamp(binary.LittleEndian.Uint64(entry[8:]))
+	if flags&flagFramed == 0 || flags&flagCompacted != 0 {
+		return "", false, false
+	}
+	size, _ := decodeSize(binary.LittleEndian.Uint64(entry[24:]))
+	off := binary.LittleEndian.Uint64(entry[16:])
+	key, _, body, err := headers.ParseFrame(log[off : off+uint64(size)])
+	if err != nil || len(key) == 0 {
+		return "", false, false
+	}
+	return string(key), len(body) == 0, true
+}
+
+// readSegment reads the first entries of a segment dat file and the verified log contents they refer to.
+// If entries is negative the whole segment is read
+func (q *FileQueue) readSegment(topic, name string, entries int64) ([]byte, []byte, error) {
+	path := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic, name)
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "unable to read dat file %q", path)
+	}
+	if entries < 0 || entries > int64(len(dat)/datEntryLength) {
+		entries = int64(len(dat) / datEntryLength)
+	}
+	dat = dat[:entries*datEntryLength]
+	if entries == 0 {
+		return dat, nil, nil
+	}
+
+	last := dat[len(dat)-datEntryLength:]
+	size, _ := decodeSize(binary.LittleEndian.Uint64(last[24:]))
+	log := make([]byte, binary.LittleEndian.Uint64(last[16:])+uint64(size))
+	f, err := openLog(path + ".log")
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "unable to open log file %q", path+".log")
+	}
+	defer f.Close()
+	if _, err = f.ReadAt(log, 0); err != nil && err != io.EOF {
+		return nil, nil, errors.Wrapf(err, "unable to read log file %q", path+".log")
+	}
+	if err = q.verifyLog(log, dat, entries, 0, topic, name+".log"); err != nil {
+		return nil, nil, err
+	}
+	return dat, log, nil
+}
+
+// replaceSegment swaps the dat and log files of a segment on every volume. Nothing is replaced, and
+// false is returned, if the segment was removed while it was being compacted
+func (q *FileQueue) replaceSegment(topic, name string, dat, log []byte) (bool, error) {
+	for _, rootDir := range q.rootDirNames {
+		tmp := filepath.Join(rootDir, topic, ".compact-"+name)
+		if err := writeSynced(tmp, dat); err != nil {
+			return false, err
+		}
+		if err := writeSynced(tmp+".log", log); err != nil {
+			return false, err
+		}
+	}
+
+	mux := q.topicLock(topic)
+	mux.Lock()
+	defer mux.Unlock()
+	lock := q.segmentLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, err := os.Stat(filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic, name))
+	exists := err == nil
+	for _, rootDir := range q.rootDirNames {
+		tmp := filepath.Join(rootDir, topic, ".compact-"+name)
+		path := filepath.Join(rootDir, topic, name)
+		for _, suffix := range []string{".log", ""} {
+			if !exists {
+				_ = os.Remove(tmp + suffix)
+				continue
+			}
+			if err = os.Rename(tmp+suffix, path+suffix); err != nil {
+				return false, err
+			}
+		}
+
+		// the compacted log replaces any compressed copy
+		if err = os.Remove(path + ".log" + blockflate.Ext); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return exists, nil
+}
+
+// segmentLock returns the lock guarding the segment files of a topic from being replaced while they are read
+func (q *FileQueue) segmentLock(topic string) *sync.RWMutex {
+	lock, ok := q.segmentLocks.Load(topic)
+	if !ok {
+		lock, _ = q.segmentLocks.LoadOrStore(topic, &sync.RWMutex{})
+	}
+	return lock.(*sync.RWMutex)
+}
+
+// rewriteLock returns the lock serializing rewrites of the closed segments of a topic
+func (q *FileQueue) rewriteLock(topic string) *sync.Mutex {
+	lock, ok := q.rewriteLocks.Load(topic)
+	if !ok {
+		lock, _ = q.rewriteLocks.LoadOrStore(topic, &sync.Mutex{})
+	}
+	return lock.(*sync.Mutex)
+}
+
+// segmentNames returns the dat file names of a topic in ascending order
+func segmentNames(topicPath string) ([]string, error) {
+	entries, err := os.ReadDir(topicPath)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries)/2)
+	for _, entry := range entries {
+		if entry.IsDir() || strings.ContainsRune(entry.Name(), '.') {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func writeSynced(path string, b []byte) error {
+	f, err := osOpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create file %q", path)
+	}
+	if _, err = f.Write(b); err != nil {
+		_ = f.Close()
+		return errors.Wrapf(err, "unable to write file %q", path)
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return errors.Wrapf(err, "unable to sync file %q", path)
+	}
+	return f.Close()
+}
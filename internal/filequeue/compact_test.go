@@ -0,0 +1,98 @@
+package filequeue
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestFileQueue_Compact(t *testing.T) {
+	dirs := []string{".haraqa-compact1", ".haraqa-compact2"}
+	topic := "compact-topic"
+	for _, dir := range dirs {
+		_ = os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	q, err := New(false, 2, dirs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	produce := func(key string, body string) {
+		t.Helper()
+		frame := headers.AppendFrame(nil, []byte(key), nil, []byte(body))
+		if err := q.ProduceFramed(topic, []int64{int64(len(frame))}, uint64(time.Now().Unix()), bytes.NewBuffer(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	consume := func(id, limit int64, expected string, nextID string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		if _, err := q.Consume("", topic, id, limit, w); err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := io.ReadAll(w.Body); string(b) != expected || w.Header().Get(headers.HeaderNextID) != nextID {
+			t.Errorf("consume %d: got %q %v", id, string(b), w.Header())
+		}
+	}
+
+	produce("a", "1")
+	produce("b", "1")
+	produce("a", "2")
+	produce("", "x")
+	produce("b", "")
+	produce("c", "1")
+
+	// the older messages of a and b are removed, the tombstone is in the latest segment
+	removed, err := q.Compact(topic, time.Time{})
+	if err != nil || removed != 2 {
+		t.Fatal(err, removed)
+	}
+	consume(0, -1, "2x", "4")
+	consume(1, 1, "2", "3")
+	consume(4, -1, "1", "6")
+
+	// compacting again is a no-op
+	if removed, err = q.Compact(topic, time.Time{}); err != nil || removed != 0 {
+		t.Fatal(err, removed)
+	}
+
+	// once closed, old tombstones are removed too
+	produce("c", "2")
+	produce("d", "1")
+	if removed, err = q.Compact(topic, time.Now().Add(time.Hour)); err != nil || removed != 2 {
+		t.Fatal(err, removed)
+	}
+	consume(4, -1, "21", "8")
+
+	// every volume holds the compacted segments
+	for _, name := range []string{formatName(0), formatName(4)} {
+		for _, suffix := range []string{"", ".log"} {
+			b1, err1 := os.ReadFile(filepath.Join(dirs[0], topic, name+suffix))
+			b2, err2 := os.ReadFile(filepath.Join(dirs[1], topic, name+suffix))
+			if err1 != nil || err2 != nil || !bytes.Equal(b1, b2) {
+				t.Error(name+suffix, err1, err2)
+			}
+		}
+	}
+	if names, err := segmentNames(filepath.Join(dirs[1], topic)); err != nil || !reflect.DeepEqual(names, []string{formatName(0), formatName(2), formatName(4), formatName(6)}) {
+		t.Error(err, names)
+	}
+
+	// missing topics
+	if _, err = q.Compact("missing", time.Time{}); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+}
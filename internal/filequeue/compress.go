@@ -0,0 +1,132 @@
+package filequeue
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/blockflate"
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// CompressSegments compresses the log files of the closed segments of a topic on every volume. The checksum of
+// every message is verified first, messages failing it are repaired from the other volumes.
+// Compressed logs are read transparently by Consume. The number of bytes saved on each volume is returned
+func (q *FileQueue) CompressSegments(topic string) (int64, error) {
+	if topic == "" {
+		return 0, nil
+	}
+	topicPath := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic)
+
+	mux := q.topicLock(topic)
+	mux.Lock()
+	names, err := segmentNames(topicPath)
+	mux.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, headers.ErrTopicDoesNotExist
+		}
+		return 0, errors.Wrapf(err, "unable to list segments of topic %q", topic)
+	}
+	if len(names) < 2 {
+		return 0, nil
+	}
+
+	// compaction and compression both rewrite closed segments, only one may run at a time
+	rewrite := q.rewriteLock(topic)
+	rewrite.Lock()
+	defer rewrite.Unlock()
+
+	var saved int64
+	for _, name := range names[:len(names)-1] {
+		if _, err = os.Stat(filepath.Join(topicPath, name+".log")); os.IsNotExist(err) {
+			// already compressed
+			continue
+		}
+
+		// the compressed log replaces the log on every volume, so every message is verified and repaired first
+		_, log, err := q.readSegment(topic, name, -1)
+		if err != nil {
+			return saved, err
+		}
+		var buf bytes.Buffer
+		if _, err = blockflate.Write(&buf, log, blockflate.DefaultBlockSize); err != nil {
+			return saved, errors.Wrapf(err, "unable to compress segment %q of topic %q", name, topic)
+		}
+		replaced, err := q.replaceLog(topic, name, buf.Bytes())
+		if err != nil {
+			return saved, errors.Wrapf(err, "unable to replace log of segment %q of topic %q", name, topic)
+		}
+		if replaced {
+			saved += int64(len(log) - buf.Len())
+		}
+	}
+	return saved, nil
+}
+
+// replaceLog swaps the log file of a segment for its compressed copy on every volume. Nothing is replaced,
+// and false is returned, if the segment was removed while it was being compressed
+func (q *FileQueue) replaceLog(topic, name string, compressed []byte) (bool, error) {
+	for _, rootDir := range q.rootDirNames {
+		if err := writeSynced(filepath.Join(rootDir, topic, ".compress-"+name+".log"+blockflate.Ext), compressed); err != nil {
+			return false, err
+		}
+	}
+
+	mux := q.topicLock(topic)
+	mux.Lock()
+	defer mux.Unlock()
+	lock := q.segmentLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+
+	exists := true
+	for _, rootDir := range q.rootDirNames {
+		if _, err := os.Stat(filepath.Join(rootDir, topic, name+".log")); err != nil {
+			exists = false
+		}
+	}
+	for _, rootDir := range q.rootDirNames {
+		tmp := filepath.Join(rootDir, topic, ".compress-"+name+".log"+blockflate.Ext)
+		path := filepath.Join(rootDir, topic, name+".log")
+		if !exists {
+			_ = os.Remove(tmp)
+			continue
+		}
+		if err := os.Rename(tmp, path+blockflate.Ext); err != nil {
+			return false, err
+		}
+		if err := os.Remove(path); err != nil {
+			return false, err
+		}
+	}
+	return exists, nil
+}
+
+// logReader is an open log file, compressed or not
+type logReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// openLog opens the log file at path, falling back to its compressed copy once the segment was compressed
+func openLog(path string) (logReader, error) {
+	f, err := osOpen(path)
+	if err == nil {
+		return f, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	z, zErr := blockflate.Open(path + blockflate.Ext)
+	if zErr != nil {
+		if os.IsNotExist(zErr) {
+			return nil, err
+		}
+		return nil, zErr
+	}
+	return z, nil
+}
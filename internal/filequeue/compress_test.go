@@ -0,0 +1,145 @@
+package filequeue
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/blockflate"
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestFileQueue_CompressSegments(t *testing.T) {
+	dirs := []string{".haraqa-compress1", ".haraqa-compress2"}
+	topic := "compress-topic"
+	for _, dir := range dirs {
+		_ = os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	q, err := New(true, 2, dirs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	msg := strings.Repeat("compressible message ", 100)
+	for i := 0; i < 3; i++ {
+		if err = q.Produce(topic, []int64{int64(len(msg)), int64(len(msg))}, uint64(time.Now().Unix()), bytes.NewBufferString(msg+msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved, err := q.CompressSegments(topic)
+	if err != nil || saved <= 0 {
+		t.Fatal(err, saved)
+	}
+	if saved, err = q.CompressSegments(topic); err != nil || saved != 0 {
+		t.Fatal(err, saved)
+	}
+
+	// closed segments are compressed on every volume, the latest segment is not
+	for _, dir := range dirs {
+		for _, name := range []string{formatName(0), formatName(2)} {
+			path := filepath.Join(dir, topic, name+".log")
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Error(path, err)
+			}
+			if _, err := os.Stat(path + blockflate.Ext); err != nil {
+				t.Error(err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dir, topic, formatName(4)+".log")); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// consumers read compressed segments transparently
+	for id := int64(0); id < 6; id++ {
+		w := httptest.NewRecorder()
+		n, err := q.Consume("", topic, id, 1, w)
+		if err != nil || n != 1 {
+			t.Fatal(id, err, n)
+		}
+		if b, _ := io.ReadAll(w.Body); string(b) != msg {
+			t.Error(id, len(b))
+		}
+	}
+
+	// producing continues in the latest segment
+	if err = q.Produce(topic, []int64{5}, uint64(time.Now().Unix()), bytes.NewBufferString("hello")); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if n, err := q.Consume("", topic, 6, -1, w); err != nil || n != 1 || w.Body.String() != "hello" {
+		t.Error(err, n, w.Body.String())
+	}
+
+	// removed segments take their compressed logs with them
+	info, err := q.ModifyTopic(topic, headers.ModifyRequest{Truncate: 5})
+	if err != nil || info.MinOffset != 4 {
+		t.Fatal(err, info)
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, topic, formatName(0)+".log"+blockflate.Ext)); !os.IsNotExist(err) {
+			t.Error(err)
+		}
+	}
+}
+
+func TestFileQueue_CompressSegmentsRepair(t *testing.T) {
+	dirs := []string{".haraqa-compress-repair1", ".haraqa-compress-repair2"}
+	topic := "compress-topic"
+	for _, dir := range dirs {
+		_ = os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	q, err := New(false, 2, dirs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	msg := strings.Repeat("compressible message ", 100)
+	for i := 0; i < 2; i++ {
+		if err = q.Produce(topic, []int64{int64(len(msg)), int64(len(msg))}, uint64(time.Now().Unix()), bytes.NewBufferString(msg+msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a corrupt message on the last volume is repaired before the log is compressed
+	path := filepath.Join(dirs[1], topic, formatName(0)+".log")
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte("corrupt"), 0); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	if _, err = q.CompressSegments(topic); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		z, err := blockflate.Open(filepath.Join(dir, topic, formatName(0)+".log"+blockflate.Ext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len(msg)*2)
+		_, err = z.ReadAt(b, 0)
+		_ = z.Close()
+		if err != nil && err != io.EOF || string(b) != msg+msg {
+			t.Error(dir, err)
+		}
+	}
+}
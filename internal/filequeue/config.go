@@ -0,0 +1,93 @@
+package filequeue
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// topicConfigName is the name of the hidden file in a topic directory used to store the topic configuration
+const topicConfigName = ".config"
+
+// SetTopicConfig stores the configuration of a topic on every volume, replacing any previous configuration
+func (q *FileQueue) SetTopicConfig(topic string, config headers.TopicConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(&config)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode topic config")
+	}
+
+	// serialize with produce, so a batch is never split by a half applied config
+	mux := q.topicLock(topic)
+	mux.Lock()
+	defer mux.Unlock()
+	for _, dir := range q.rootDirNames {
+		path := filepath.Join(dir, topic, topicConfigName)
+		if _, err = os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+			return headers.ErrTopicDoesNotExist
+		}
+		if err = writeSynced(path+".tmp", b); err != nil {
+			return err
+		}
+		if err = os.Rename(path+".tmp", path); err != nil {
+			return errors.Wrapf(err, "unable to replace topic config %q", path)
+		}
+	}
+
+	if q.configCache != nil {
+		q.configCache.Store(topic, config)
+	}
+	return nil
+}
+
+// TopicConfig returns the configuration stored with a topic. A topic without a stored configuration
+// returns a zero configuration
+func (q *FileQueue) TopicConfig(topic string) (*headers.TopicConfig, error) {
+	if q.configCache != nil {
+		if v, ok := q.configCache.Load(topic); ok {
+			config := v.(headers.TopicConfig)
+			return &config, nil
+		}
+	}
+
+	// read from the last volume first, falling back to the other volumes
+	var config headers.TopicConfig
+	var err error
+	for i := len(q.rootDirNames) - 1; i >= 0; i-- {
+		var b []byte
+		if b, err = os.ReadFile(filepath.Join(q.rootDirNames[i], topic, topicConfigName)); err != nil {
+			continue
+		}
+		if err = json.Unmarshal(b, &config); err == nil {
+			break
+		}
+	}
+	if os.IsNotExist(err) {
+		if _, statErr := os.Stat(filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic)); os.IsNotExist(statErr) {
+			return nil, headers.ErrTopicDoesNotExist
+		}
+		err = nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read config of topic %q", topic)
+	}
+
+	if q.configCache != nil {
+		q.configCache.Store(topic, config)
+	}
+	return &config, nil
+}
+
+// segmentBytes returns the max bytes of the latest segment of a topic, from the topic config if set
+func (q *FileQueue) segmentBytes(topic string) int64 {
+	if config, err := q.TopicConfig(topic); err == nil && config.SegmentBytes > 0 {
+		return config.SegmentBytes
+	}
+	return q.maxBytes
+}
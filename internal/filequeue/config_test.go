@@ -0,0 +1,77 @@
+package filequeue
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestFileQueue_TopicConfig(t *testing.T) {
+	for _, cache := range []bool{true, false} {
+		dirs := []string{".haraqa-config1", ".haraqa-config2"}
+		for _, dir := range dirs {
+			_ = os.RemoveAll(dir)
+		}
+		q, err := New(cache, 100, dirs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const topic = "config-topic"
+		if _, err = q.TopicConfig(topic); err != headers.ErrTopicDoesNotExist {
+			t.Error(err)
+		}
+		if err = q.SetTopicConfig(topic, headers.TopicConfig{}); err != headers.ErrTopicDoesNotExist {
+			t.Error(err)
+		}
+		if err = q.CreateTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+		if config, err := q.TopicConfig(topic); err != nil || *config != (headers.TopicConfig{}) {
+			t.Error(err, config)
+		}
+		if err = q.SetTopicConfig(topic, headers.TopicConfig{SegmentBytes: -1}); err != headers.ErrInvalidTopicConfig {
+			t.Error(err)
+		}
+
+		// the config is stored on every volume and hidden from the segments
+		expected := headers.TopicConfig{SegmentBytes: 10, ConsumeLimit: 5, Compact: true}
+		if err = q.SetTopicConfig(topic, expected); err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range dirs {
+			if _, err = os.Stat(filepath.Join(dir, topic, topicConfigName)); err != nil {
+				t.Error(err)
+			}
+		}
+		if config, err := q.TopicConfig(topic); err != nil || *config != expected {
+			t.Error(err, config)
+		}
+		if config, err := (&FileQueue{rootDirNames: q.rootDirNames}).TopicConfig(topic); err != nil || *config != expected {
+			t.Error(err, config)
+		}
+
+		// segment bytes of the topic roll segments
+		for i := 0; i < 3; i++ {
+			if err = q.Produce(topic, []int64{5, 5}, 100, bytes.NewBufferString("hellohello")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if names, err := segmentNames(filepath.Join(dirs[1], topic)); err != nil || len(names) != 3 {
+			t.Error(cache, err, names)
+		}
+
+		if err = q.DeleteTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = q.TopicConfig(topic); err != headers.ErrTopicDoesNotExist {
+			t.Error(err)
+		}
+		_ = q.Close()
+		for _, dir := range dirs {
+			_ = os.RemoveAll(dir)
+		}
+	}
+}
@@ -14,157 +14,217 @@ import (
 	"github.com/pkg/errors"
 )
 
-// Consume copies messages from a log to the writer
+// Consume copies messages from a log to the writer. Only the body of framed messages is written
 func (q *FileQueue) Consume(group, topic string, id int64, limit int64, w http.ResponseWriter) (int, error) {
-	id = getGroupOffsetID(group, topic, id)
+	return q.consume(group, topic, id, limit, w, false)
+}
+
+// ConsumeFramed copies messages from a log to the writer, every message is written framed with its key and headers
+func (q *FileQueue) ConsumeFramed(group, topic string, id int64, limit int64, w http.ResponseWriter) (int, error) {
+	return q.consume(group, topic, id, limit, w, true)
+}
+
+func (q *FileQueue) consume(group, topic string, id int64, limit int64, w http.ResponseWriter, framed bool) (int, error) {
+	id = q.getGroupOffsetID(group, topic, id)
+
+	// hold off the compactor from replacing segments while they are read
+	lock := q.segmentLock(topic)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	for {
+		var visible bool
+		if id, limit, visible = q.visibleRange(topic, id, limit); !visible {
+			return 0, nil
+		}
+		data, datPath, err := q.readConsumeDat(topic, id, limit)
+		if err != nil || len(data) == 0 {
+			return 0, err
+		}
+		n, nextID, err := q.consumeResponse(w, data, topic, datPath, framed)
+		if err != nil || n > 0 {
+			return n, err
+		}
+
+		// every message read was removed by compaction, continue after them
+		id = nextID
+	}
+}
 
-	datName, err := getConsumeDat(q.consumeNameCache, filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic), topic, id)
+// readConsumeDat returns up to limit dat entries starting from id, along with the path of the dat file.
+// Segments no longer on the volumes are read from the archive cache if an archive store is set
+func (q *FileQueue) readConsumeDat(topic string, id int64, limit int64) ([]byte, string, error) {
+	datName, latest, err := getConsumeDat(q.consumeNameCache, filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic), topic, id)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return 0, headers.ErrTopicDoesNotExist
+			return nil, "", headers.ErrTopicDoesNotExist
 		}
-		return 0, errors.Wrap(err, "unable to get consume dat filename")
+		return nil, "", errors.Wrap(err, "unable to get consume dat filename")
 	}
 	path := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic, datName)
+	if !latest {
+		// closed segments are no longer written, their dat is read from memory
+		if data, ok, err := q.readMappedDat(path, id, limit); ok {
+			return data, path, err
+		}
+	}
 	dat, err := os.Open(path)
+	if os.IsNotExist(err) && q.archive != nil && id >= 0 {
+		if path, err = q.fetchArchived(topic, id); err != nil || path == "" {
+			return nil, "", err
+		}
+		dat, err = os.Open(path)
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
-			return 0, nil
+			return nil, "", nil
 		}
-		return 0, err
+		return nil, "", err
 	}
 	defer dat.Close()
 
 	stat, err := dat.Stat()
 	if err != nil {
-		return 0, err
+		return nil, "", err
 	}
 
-	// check if id was less than 0
-	if id < 0 {
-		id = stat.Size()/datEntryLength - 1
-		if id < 0 {
-			return 0, nil
-		}
-	}
-
-	if id > stat.Size()/datEntryLength-1 {
-		base, err := strconv.ParseInt(stat.Name(), 10, 64)
-		if err != nil {
-			return 0, err
-		}
-		id = id - base
-		if id > stat.Size()/datEntryLength-1 {
-			return 0, nil
-		}
-	}
-
-	if limit < 0 {
-		limit = (stat.Size() - id*datEntryLength) / datEntryLength
+	id, limit, err = datRange(filepath.Base(path), stat.Size(), id, limit)
+	if err != nil || limit == 0 {
+		return nil, "", err
 	}
 
 	data := make([]byte, limit*datEntryLength)
 	length, err := dat.ReadAt(data, id*datEntryLength)
 	if err != nil && length == 0 {
-		return 0, err
-	}
-	limit = int64(length) / datEntryLength
-
-	return q.consumeResponse(w, data, limit, path+".log")
-}
-
-func getGroupOffsetID(group, topic string, id int64) int64 {
-	if group == "" || id > 0 {
-		return id
+		return nil, "", err
 	}
-	// TODO: LOOKUP consumer group offset
-	return id
+	return data[:length-length%datEntryLength], path, nil
 }
 
-func getConsumeDat(consumeNameCache *sync.Map, path string, topic string, id int64) (string, error) {
+// getConsumeDat returns the name of the dat file holding id, and if it is the latest dat file of the topic
+func getConsumeDat(consumeNameCache *sync.Map, path string, topic string, id int64) (string, bool, error) {
 	exact := formatName(id)
 	if consumeNameCache != nil {
 		value, ok := consumeNameCache.Load(topic)
 		if ok {
-			names := value.([]string)
-			for i := range names {
-				if len(names[i]) == len(exact) && names[i] <= exact {
-					return names[i], nil
-				}
+			if name, latest, ok := findConsumeDat(value.([]string), exact, false); ok {
+				return name, latest, nil
 			}
 		}
 	}
 
 	dir, err := os.Open(path)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 	defer dir.Close()
 
 	names, err := dir.Readdirnames(-1)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
+	names = removeHidden(names)
 	sort.Sort(sortableDirNames(names))
 	if consumeNameCache != nil {
 		consumeNameCache.Store(topic, names)
 	}
-	if id < 0 {
-		for i := range names {
-			if len(names[i]) == len(exact) {
-				return names[i], nil
-			}
-		}
+	if name, latest, ok := findConsumeDat(names, exact, id < 0); ok {
+		return name, latest, nil
 	}
+	return formatName(0), len(names) == 0, nil
+}
 
-	for i := range names {
-		if len(names[i]) == len(exact) && names[i] <= exact {
-			return names[i], nil
+// findConsumeDat returns the dat file with the greatest base id not after exact, or the latest dat file if
+// latestOnly is set. The names are compared by value rather than position, base ids being formatted
+// to a fixed width, so their order does not matter
+func findConsumeDat(names []string, exact string, latestOnly bool) (string, bool, bool) {
+	var latest, found string
+	for _, name := range names {
+		if len(name) != len(exact) {
+			continue
+		}
+		if name > latest {
+			latest = name
+		}
+		if name <= exact && name > found {
+			found = name
 		}
 	}
-	return formatName(0), nil
-}
-
-var reqPool = sync.Pool{
-	New: func() interface{} {
-		return &http.Request{}
-	},
+	if latestOnly {
+		found = latest
+	}
+	return found, found != "" && found == latest, found != ""
 }
 
-func (q *FileQueue) consumeResponse(w http.ResponseWriter, data []byte, limit int64, filename string) (int, error) {
-	sizes := make([]int64, limit)
-	startTime := time.Unix(int64(binary.LittleEndian.Uint64(data[8:])), 0)
+// consumeResponse writes the messages of the dat entries to w, skipping any removed by compaction.
+// Nothing is written if every message was removed. The id following the last entry is returned
+func (q *FileQueue) consumeResponse(w http.ResponseWriter, data []byte, topic, datPath string, framed bool) (int, int64, error) {
+	limit := int64(len(data) / datEntryLength)
+	sizes := make([]int64, 0, limit)
+	stored := make([]bool, 0, limit)
+	startTS, _ := decodeTimestamp(binary.LittleEndian.Uint64(data[8:]))
+	startTime := time.Unix(int64(startTS), 0)
 	endTime := startTime
 	startAt := binary.LittleEndian.Uint64(data[16:])
 	endAt := startAt
-	for i := range sizes {
-		size := binary.LittleEndian.Uint64(data[i*datEntryLength+24:])
-		sizes[i] = int64(size)
-		endAt += size
-		if i == len(sizes)-1 {
-			endTime = time.Unix(int64(binary.LittleEndian.Uint64(data[i*datEntryLength+8:])), 0)
+	for i := int64(0); i < limit; i++ {
+		ts, flags := decodeTimestamp(binary.LittleEndian.Uint64(data[i*datEntryLength+8:]))
+		size, _ := decodeSize(binary.LittleEndian.Uint64(data[i*datEntryLength+24:]))
+		endAt += uint64(size)
+		if i == limit-1 {
+			endTime = time.Unix(int64(ts), 0)
+		}
+		if flags&flagCompacted != 0 {
+			continue
 		}
+		sizes = append(sizes, size)
+		stored = append(stored, flags&flagFramed != 0)
+	}
+	nextID := int64(binary.LittleEndian.Uint64(data[(limit-1)*datEntryLength:])) + 1
+	if len(sizes) == 0 {
+		return 0, nextID, nil
 	}
-	endAt--
 
-	f, err := os.Open(filename)
+	logName := filepath.Base(datPath) + ".log"
+	filename := datPath + ".log"
+	f, err := openLog(filename)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 	defer f.Close()
 
+	// read and verify the messages before sending any of them
+	buf := make([]byte, endAt-startAt)
+	if _, err = f.ReadAt(buf, int64(startAt)); err != nil {
+		return 0, 0, errors.Wrapf(err, "unable to read log file %q", filename)
+	}
+	if err = q.verifyLog(buf, data, limit, startAt, topic, logName); err != nil {
+		return 0, 0, err
+	}
+	body, err := headers.ConvertFrames(buf, sizes, stored, framed)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "unable to convert messages in %q", filename)
+	}
+
 	wHeader := w.Header()
 	wHeader[headers.HeaderStartTime] = []string{startTime.Format(time.ANSIC)}
 	wHeader[headers.HeaderEndTime] = []string{endTime.Format(time.ANSIC)}
 	wHeader[headers.HeaderFileName] = []string{filename}
 	wHeader[headers.ContentType] = []string{"application/octet-stream"}
 	headers.SetSizes(sizes, wHeader)
-	rangeHeader := "bytes=" + strconv.FormatUint(startAt, 10) + "-" + strconv.FormatUint(endAt, 10)
-	wHeader["Range"] = []string{rangeHeader}
-
-	req := reqPool.Get().(*http.Request)
-	req.Header = wHeader
-	http.ServeContent(w, req, filename, endTime, f)
-	reqPool.Put(req)
-	return len(sizes), nil
+	wHeader[headers.HeaderNextID] = []string{strconv.FormatInt(nextID, 10)}
+	wHeader[headers.LastModified] = []string{endTime.UTC().Format(http.TimeFormat)}
+	if framed {
+		wHeader[headers.HeaderFramed] = []string{"true"}
+	}
+	// the range only matches the log file if the messages were not converted
+	if len(body) == len(buf) && len(buf) > 0 {
+		wHeader["Content-Range"] = []string{"bytes " + strconv.FormatUint(startAt, 10) + "-" + strconv.FormatUint(endAt-1, 10) + "/*"}
+	}
+	wHeader["Content-Length"] = []string{strconv.Itoa(len(body))}
+	w.WriteHeader(http.StatusPartialContent)
+	if _, err = w.Write(body); err != nil {
+		return 0, 0, errors.Wrap(err, "unable to write messages")
+	}
+	return len(sizes), nextID, nil
 }
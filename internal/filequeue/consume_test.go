@@ -5,7 +5,9 @@ import (
 	"io"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -77,6 +79,9 @@ func TestFileQueue_Consume(t *testing.T) {
 		if !reflect.DeepEqual(sizes, msgSizes) {
 			t.Error(sizes, msgSizes)
 		}
+		if next := w.Header().Get(headers.HeaderNextID); next != "5" {
+			t.Error(next)
+		}
 
 		b, err := io.ReadAll(w.Body)
 		if err != nil {
@@ -215,3 +220,43 @@ func TestFileQueue_Consume(t *testing.T) {
 		}
 	}
 }
+
+func TestGetConsumeDat(t *testing.T) {
+	// cached names in an order which does not start with the latest dat file
+	cache := &sync.Map{}
+	cache.Store("topic", []string{formatName(0), formatName(0) + ".log", formatName(10), formatName(5), formatName(10) + ".log"})
+	for _, tt := range []struct {
+		id     int64
+		name   string
+		latest bool
+	}{
+		{id: 0, name: formatName(0), latest: false},
+		{id: 7, name: formatName(5), latest: false},
+		{id: 10, name: formatName(10), latest: true},
+		{id: 12, name: formatName(10), latest: true},
+	} {
+		name, latest, err := getConsumeDat(cache, "", "topic", tt.id)
+		if err != nil {
+			t.Error(err)
+		}
+		if name != tt.name || latest != tt.latest {
+			t.Error(tt.id, name, latest)
+		}
+	}
+
+	// names read from the directory
+	dir := t.TempDir()
+	for _, name := range []string{formatName(0), formatName(0) + ".log", formatName(10), formatName(10) + ".log"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name, latest, err := getConsumeDat(nil, dir, "topic", -1)
+	if err != nil || name != formatName(10) || !latest {
+		t.Error(name, latest, err)
+	}
+	name, latest, err = getConsumeDat(nil, dir, "topic", 3)
+	if err != nil || name != formatName(0) || latest {
+		t.Error(name, latest, err)
+	}
+}
@@ -1,6 +1,130 @@
 package filequeue
 
+import (
+	"encoding/binary"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+const consumerOffsetPrefix = ".consumer-"
+
 // SetConsumerOffset sets the offset for a given consumer group + topic
 func (q *FileQueue) SetConsumerOffset(group, topic string, id int64) error {
+	if group == "" {
+		return nil
+	}
+	if id < 0 {
+		return headers.ErrInvalidMessageID
+	}
+
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(id))
+
+	// write the offset to every volume
+	files := make(MultiWriteAtCloser, 0, len(q.rootDirNames))
+	defer files.Close()
+	for _, dir := range q.rootDirNames {
+		path := filepath.Join(dir, topic, consumerOffsetName(group))
+		f, err := osOpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return headers.ErrTopicDoesNotExist
+			}
+			return errors.Wrapf(err, "unable to open/create consumer offset file %q", path)
+		}
+		files = append(files, f)
+	}
+	if err := files.WriteAt(buf[:], 0); err != nil {
+		return errors.Wrap(err, "unable to write consumer offset")
+	}
+
+	if q.groupCache != nil {
+		q.groupCache.Store(groupKey{group, topic}, id)
+	}
 	return nil
 }
+
+// groupKey is the key of a cached consumer group offset
+type groupKey struct {
+	group, topic string
+}
+
+// dropGroupOffsets removes the cached offsets of every consumer group of the topic
+func (q *FileQueue) dropGroupOffsets(topic string) {
+	if q.groupCache == nil {
+		return
+	}
+	q.groupCache.Range(func(key, _ interface{}) bool {
+		if k, ok := key.(groupKey); ok && k.topic == topic {
+			q.groupCache.Delete(key)
+		}
+		return true
+	})
+}
+
+// getGroupOffsetID returns the stored offset of the consumer group if the id is 0 or negative.
+// If the group has no stored offset the id is returned as is
+func (q *FileQueue) getGroupOffsetID(group, topic string, id int64) int64 {
+	if group == "" || id > 0 {
+		return id
+	}
+	if q.groupCache != nil {
+		v, found := q.groupCache.Load(groupKey{group, topic})
+		if cachedID, ok := v.(int64); found && ok {
+			return cachedID
+		}
+	}
+
+	// read from the last volume first, falling back to the other volumes
+	name := consumerOffsetName(group)
+	for i := len(q.rootDirNames) - 1; i >= 0; i-- {
+		stored, err := readConsumerOffset(filepath.Join(q.rootDirNames[i], topic, name))
+		if err != nil {
+			continue
+		}
+		if q.groupCache != nil {
+			q.groupCache.Store(groupKey{group, topic}, stored)
+		}
+		return stored
+	}
+	return id
+}
+
+func readConsumerOffset(path string) (int64, error) {
+	f, err := osOpen(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var buf [8]byte
+	if _, err = f.ReadAt(buf[:], 0); err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf[:])), nil
+}
+
+// consumerOffsetName returns the name of the hidden file in a topic directory
+// used to store the offset of a consumer group
+func consumerOffsetName(group string) string {
+	return consumerOffsetPrefix + url.PathEscape(group)
+}
+
+// removeHidden filters out any hidden files, such as consumer offsets, from a list of directory names
+func removeHidden(names []string) []string {
+	var i int
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		names[i] = name
+		i++
+	}
+	return names[:i]
+}
@@ -0,0 +1,144 @@
+package filequeue
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestFileQueue_SetConsumerOffset(t *testing.T) {
+	topic := "offset-topic"
+	group := "offset/group"
+	dirs := []string{".haraqa-offsets1", ".haraqa-offsets2"}
+	for _, dir := range dirs {
+		_ = os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	q, err := New(true, 5000, dirs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// topic doesn't exist
+	err = q.SetConsumerOffset(group, topic, 1)
+	if !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Produce(topic, []int64{5, 5, 5}, uint64(time.Now().Unix()), bytes.NewBuffer([]byte("helloworldagain"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// invalid id
+	err = q.SetConsumerOffset(group, topic, -1)
+	if !errors.Is(err, headers.ErrInvalidMessageID) {
+		t.Error(err)
+	}
+
+	// no group is a noop
+	if err = q.SetConsumerOffset("", topic, 1); err != nil {
+		t.Error(err)
+	}
+
+	// no stored offset, id is unchanged
+	if id := q.getGroupOffsetID(group, topic, -1); id != -1 {
+		t.Error(id)
+	}
+
+	if err = q.SetConsumerOffset(group, topic, 1); err != nil {
+		t.Error(err)
+	}
+	for _, dir := range dirs {
+		offset, err := readConsumerOffset(filepath.Join(dir, topic, consumerOffsetName(group)))
+		if err != nil || offset != 1 {
+			t.Error(offset, err)
+		}
+	}
+
+	// offset is used for 0 and -1, but not for positive ids
+	for _, id := range []int64{0, -1} {
+		if v := q.getGroupOffsetID(group, topic, id); v != 1 {
+			t.Error(id, v)
+		}
+	}
+	if id := q.getGroupOffsetID(group, topic, 2); id != 2 {
+		t.Error(id)
+	}
+	if id := q.getGroupOffsetID("", topic, 0); id != 0 {
+		t.Error(id)
+	}
+	w := httptest.NewRecorder()
+	n, err := q.Consume(group, topic, 0, -1, w)
+	if err != nil || n != 2 {
+		t.Error(n, err)
+	}
+	if w.Body.String() != "worldagain" {
+		t.Error(w.Body.String())
+	}
+	if err = q.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// offsets are loaded on restart, falling back to other volumes
+	if err = os.Remove(filepath.Join(dirs[1], topic, consumerOffsetName(group))); err != nil {
+		t.Error(err)
+	}
+	q, err = New(false, 5000, dirs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := q.getGroupOffsetID(group, topic, 0); id != 1 {
+		t.Error(id)
+	}
+
+	// offset files are not treated as segments
+	names, err := q.ListTopics("", "", "")
+	if err != nil || !reflect.DeepEqual(names, []string{topic}) {
+		t.Error(names, err)
+	}
+	name, err := getLatestDat(filepath.Join(dirs[1], topic))
+	if err != nil || name != formatName(0) {
+		t.Error(name, err)
+	}
+	if err = q.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileQueue_DeleteTopicGroupCache(t *testing.T) {
+	q, err := New(true, 10, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for _, topic := range []string{"a:b", "b"} {
+		if err = q.CreateTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+		if err = q.SetConsumerOffset("group", topic, 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the offsets of the deleted topic are dropped, even if another topic name ends the same
+	if err = q.DeleteTopic("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.groupCache.Load(groupKey{"group", "a:b"}); !ok {
+		t.Error("expected offset of topic a:b to stay cached")
+	}
+	if _, ok := q.groupCache.Load(groupKey{"group", "b"}); ok {
+		t.Error("expected offset of topic b to be dropped")
+	}
+}
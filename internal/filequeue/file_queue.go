@@ -8,22 +8,42 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/haraqa/haraqa/pkg/archive"
 )
 
 // FileQueue implements the haraqa queue by storing messages in log files, under topic based directories
 type FileQueue struct {
 	rootDirNames     []string
 	max              int64
+	maxBytes         int64
+	maxAge           time.Duration
 	produceLocks     *sync.Map
 	produceCache     *sync.Map
 	consumeNameCache *sync.Map
+	groupCache       *sync.Map
+	configCache      *sync.Map
+	syncOnWrite      bool
+	dirty            *sync.Map
+	segmentLocks     *sync.Map
+	rewriteLocks     *sync.Map
+	datCache         *sync.Map // memory mapped dat files of closed segments by path
+	datMapping       sync.Mutex
+	transactions     sync.Map // first id of the transaction being written by topic
+
+	archive              archive.ArchiveStore
+	archiveCacheDir      string
+	archiveCacheSegments int
+	archiveNames         *sync.Map
+	archiveFetch         sync.Mutex
 }
 
-// New creates a new FileQueue
+// New creates a new FileQueue. The volumes are not checked or resynced, call Recover before producing or consuming
+// to repair torn writes and bring diverged volumes back in sync, as the server does on startup
 func New(cacheFiles bool, maxEntries int64, dirs ...string) (*FileQueue, error) {
 	if len(dirs) == 0 {
 		return nil, errors.New("at least one directory must be given")
@@ -54,10 +74,15 @@ func New(cacheFiles bool, maxEntries int64, dirs ...string) (*FileQueue, error)
 		rootDirNames: dirNames,
 		max:          maxEntries,
 		produceLocks: &sync.Map{},
+		segmentLocks: &sync.Map{},
+		rewriteLocks: &sync.Map{},
 	}
 	if cacheFiles {
 		q.produceCache = &sync.Map{}
 		q.consumeNameCache = &sync.Map{}
+		q.groupCache = &sync.Map{}
+		q.configCache = &sync.Map{}
+		q.datCache = &sync.Map{}
 	}
 	return q, nil
 }
@@ -83,6 +108,12 @@ func (q *FileQueue) Close() error {
 			return true
 		})
 	}
+	if q.datCache != nil {
+		q.datCache.Range(func(key, _ interface{}) bool {
+			q.unmapDat(key.(string))
+			return true
+		})
+	}
 	return nil
 }
 
@@ -100,17 +131,16 @@ func (q *FileQueue) GetTopicOwner(topic string) (string, error) {
 func (q *FileQueue) ListTopics(prefix, suffix, regex string) ([]string, error) {
 	var names []string
 	rootDir := q.rootDirNames[len(q.rootDirNames)-1]
-	err := fs.WalkDir(os.DirFS("."), rootDir, func(path string, d fs.DirEntry, err error) error {
+	err := fs.WalkDir(os.DirFS(rootDir), ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return errors.Wrapf(err, "unable to walk directory %q to list topics", rootDir)
 		}
 		if !d.IsDir() {
 			return nil
 		}
-		if strings.EqualFold(path, rootDir) {
+		if path == "." {
 			return nil
 		}
-		path = filepath.ToSlash(strings.TrimPrefix(path, rootDir+string(filepath.Separator)))
 
 		if prefix != "" && !strings.HasPrefix(path, prefix) {
 			return nil
@@ -159,20 +189,30 @@ func (q *FileQueue) CreateTopic(topic string) error {
 	return nil
 }
 
-// DeleteTopic deletes the topic and any nested topic within
+// DeleteTopic deletes the topic and any nested topic within, along with its archived segments
 func (q *FileQueue) DeleteTopic(topic string) error {
 	for _, name := range q.rootDirNames {
 		os.RemoveAll(filepath.Join(name, topic))
 	}
+	if q.archive != nil {
+		if err := q.deleteArchivedTopic(topic); err != nil {
+			return errors.Wrapf(err, "unable to delete archived segments of topic %q", topic)
+		}
+	}
 	if q.consumeNameCache != nil {
 		q.consumeNameCache.Delete(topic)
 	}
 	if q.produceCache != nil {
 		q.produceCache.Delete(topic)
 	}
+	if q.configCache != nil {
+		q.configCache.Delete(topic)
+	}
+	q.unmapTopicDats(topic)
 	if q.produceLocks != nil {
 		q.produceLocks.Delete(topic)
 	}
+	q.dropGroupOffsets(topic)
 
 	return nil
 }
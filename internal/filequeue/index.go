@@ -0,0 +1,141 @@
+package filequeue
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/haraqa/haraqa/internal/mmap"
+)
+
+// mappedDat is the memory mapped dat file of a closed segment
+type mappedDat struct {
+	mux  sync.RWMutex
+	info os.FileInfo
+	data []byte // nil once unmapped
+}
+
+// unmap releases the mapping once no reader is using it
+func (m *mappedDat) unmap() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	err := mmap.Unmap(m.data)
+	m.data = nil
+	return err
+}
+
+// readMappedDat returns up to limit dat entries starting from id from the memory mapped dat file of a closed
+// segment, mapping it on first use. It reports false if the file can't be mapped, it is then read as before.
+// The mapping is replaced whenever the file is, so rewritten segments are never read from a stale mapping
+func (q *FileQueue) readMappedDat(path string, id, limit int64) ([]byte, bool, error) {
+	if q.datCache == nil {
+		return nil, false, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		q.unmapDat(path)
+		return nil, false, nil
+	}
+	v, _ := q.datCache.Load(path)
+	m, _ := v.(*mappedDat)
+	if m == nil || !os.SameFile(m.info, info) || m.info.Size() != info.Size() {
+		if m = q.mapDat(path); m == nil {
+			return nil, false, nil
+		}
+	}
+
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	if m.data == nil {
+		// unmapped by a concurrent replacement
+		return nil, false, nil
+	}
+	start, limit, err := datRange(filepath.Base(path), int64(len(m.data)), id, limit)
+	if err != nil || limit == 0 {
+		return nil, true, err
+	}
+	return append([]byte(nil), m.data[start*datEntryLength:(start+limit)*datEntryLength]...), true, nil
+}
+
+// mapDat maps a dat file, replacing and releasing any previous mapping of the path
+func (q *FileQueue) mapDat(path string) *mappedDat {
+	q.datMapping.Lock()
+	defer q.datMapping.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() < datEntryLength {
+		return nil
+	}
+	if v, ok := q.datCache.Load(path); ok {
+		if m := v.(*mappedDat); os.SameFile(m.info, info) && m.info.Size() == info.Size() {
+			// mapped by a concurrent reader
+			return m
+		}
+	}
+	data, err := mmap.Map(f, info.Size()-info.Size()%datEntryLength)
+	if err != nil {
+		return nil
+	}
+	m := &mappedDat{info: info, data: data}
+	if v, ok := q.datCache.Load(path); ok {
+		_ = v.(*mappedDat).unmap()
+	}
+	q.datCache.Store(path, m)
+	return m
+}
+
+// unmapDat releases the mapping of a dat file if there is one
+func (q *FileQueue) unmapDat(path string) {
+	if q.datCache == nil {
+		return
+	}
+	q.datMapping.Lock()
+	defer q.datMapping.Unlock()
+	if v, ok := q.datCache.Load(path); ok {
+		q.datCache.Delete(path)
+		_ = v.(*mappedDat).unmap()
+	}
+}
+
+// unmapTopicDats releases the mappings of the dat files of a topic and of its nested topics
+func (q *FileQueue) unmapTopicDats(topic string) {
+	if q.datCache == nil {
+		return
+	}
+	prefix := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic) + string(filepath.Separator)
+	q.datCache.Range(func(key, _ interface{}) bool {
+		if path, ok := key.(string); ok && strings.HasPrefix(path, prefix) {
+			q.unmapDat(path)
+		}
+		return true
+	})
+}
+
+// datRange returns the index of the entry holding id and the number of entries to read from a dat file of the
+// given name and size. A negative id reads the last entry, a negative limit every entry after id
+func datRange(name string, size, id, limit int64) (int64, int64, error) {
+	numEntries := size / datEntryLength
+	if id < 0 {
+		id = numEntries - 1
+	} else {
+		base, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		id -= base
+	}
+	if id < 0 || id >= numEntries {
+		return 0, 0, nil
+	}
+	if limit < 0 || limit > numEntries-id {
+		limit = numEntries - id
+	}
+	return id, limit, nil
+}
@@ -0,0 +1,96 @@
+package filequeue
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestFileQueue_MappedDat(t *testing.T) {
+	dir, err := os.MkdirTemp("", ".haraqa*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := New(true, 2, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	const topic = "mapped-topic"
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"a", "bb", "ccc"} {
+		if err = q.Produce(topic, []int64{int64(len(msg))}, 100, bytes.NewBufferString(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	consume := func(id int64, expected string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		if _, err := q.Consume("", topic, id, -1, w); err != nil || w.Body.String() != expected {
+			t.Error(id, err, w.Body.String())
+		}
+	}
+	isMapped := func(name string) bool {
+		_, ok := q.datCache.Load(filepath.Join(dir, topic, name))
+		return ok
+	}
+
+	// only the closed segment is mapped
+	consume(1, "bb")
+	consume(0, "abb")
+	consume(2, "ccc")
+	if isMapped(formatName(0)) != (runtime.GOOS == "linux") || isMapped(formatName(2)) {
+		t.Error(isMapped(formatName(0)), isMapped(formatName(2)))
+	}
+
+	// a replaced dat file is mapped again
+	path := filepath.Join(dir, topic, formatName(0))
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path+".tmp", dat[:datEntryLength], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+	consume(0, "a")
+
+	// removed segments are unmapped
+	if err = q.removeSegment(topic, formatName(0)); err != nil {
+		t.Fatal(err)
+	}
+	if isMapped(formatName(0)) {
+		t.Error("expected the removed segment to be unmapped")
+	}
+}
+
+func TestDatRange(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		size, id, limit int64
+		start, count    int64
+		expectErr       bool
+	}{
+		{name: formatName(0), size: 5 * datEntryLength, id: 2, limit: -1, start: 2, count: 3},
+		{name: formatName(0), size: 5 * datEntryLength, id: -1, limit: 10, start: 4, count: 1},
+		{name: formatName(0), size: 5 * datEntryLength, id: 5, limit: 1},
+		{name: formatName(0), size: 0, id: -1, limit: 1},
+		// segments rolled by size may hold more entries than their base id
+		{name: formatName(3), size: 5 * datEntryLength, id: 4, limit: 2, start: 1, count: 2},
+		{name: formatName(3), size: 5 * datEntryLength, id: 2, limit: 2},
+		{name: "invalid", size: datEntryLength, id: 0, limit: 1, expectErr: true},
+	} {
+		start, count, err := datRange(tc.name, tc.size, tc.id, tc.limit)
+		if (err != nil) != tc.expectErr || start != tc.start || count != tc.count {
+			t.Error(tc, start, count, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package filequeue
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// ExportSegments calls fn with the base id and the entries of every local segment of a topic, in order.
+// Segments moved to an archive store are not exported
+func (q *FileQueue) ExportSegments(topic string, fn func(baseID int64, entries []headers.Entry) error) error {
+	topicPath := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic)
+
+	// hold off the compactor from replacing segments while they are read
+	lock := q.segmentLock(topic)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	names, err := segmentNames(topicPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return headers.ErrTopicDoesNotExist
+		}
+		return errors.Wrapf(err, "unable to list segments of topic %q", topic)
+	}
+	for _, name := range names {
+		baseID, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		entries, err := readSegment(filepath.Join(topicPath, name))
+		if err != nil {
+			return errors.Wrapf(err, "unable to read segment %q of topic %q", name, topic)
+		}
+		if err = fn(baseID, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegment returns the entries of the segment with the given dat file, reading the messages from its log
+func readSegment(path string) ([]headers.Entry, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	log, err := openLog(path + ".log")
+	if err != nil {
+		return nil, err
+	}
+	defer log.Close()
+
+	entries := make([]headers.Entry, len(dat)/datEntryLength)
+	for i := range entries {
+		entry := dat[i*datEntryLength : (i+1)*datEntryLength]
+		entries[i] = headers.Entry{
+			ID:        int64(binary.LittleEndian.Uint64(entry[0:8])),
+			Timestamp: binary.LittleEndian.Uint64(entry[8:16]),
+			Size:      binary.LittleEndian.Uint64(entry[24:32]),
+		}
+		size, _ := decodeSize(entries[i].Size)
+		entries[i].Data = make([]byte, size)
+		if size == 0 {
+			continue
+		}
+		if _, err = log.ReadAt(entries[i].Data, int64(binary.LittleEndian.Uint64(entry[16:24]))); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// ImportSegment writes a segment holding the given entries to every volume. The ids of the entries must follow
+// the base id, timestamps, flags and checksums are kept as is. The topic must exist and not hold the segment yet
+func (q *FileQueue) ImportSegment(topic string, baseID int64, entries []headers.Entry) error {
+	var dat, log []byte
+	for i, entry := range entries {
+		if entry.ID != baseID+int64(i) {
+			return errors.Errorf("invalid id %d of entry %d in segment %d", entry.ID, i, baseID)
+		}
+		size, _ := decodeSize(entry.Size)
+		if size != int64(len(entry.Data)) {
+			return errors.Errorf("invalid size of entry %d: %d bytes but %d are given", entry.ID, size, len(entry.Data))
+		}
+		var buf [datEntryLength]byte
+		binary.LittleEndian.PutUint64(buf[0:8], uint64(entry.ID))
+		binary.LittleEndian.PutUint64(buf[8:16], entry.Timestamp)
+		binary.LittleEndian.PutUint64(buf[16:24], uint64(len(log)))
+		binary.LittleEndian.PutUint64(buf[24:32], entry.Size)
+		dat = append(dat, buf[:]...)
+		log = append(log, entry.Data...)
+	}
+
+	mux := q.topicLock(topic)
+	mux.Lock()
+	defer mux.Unlock()
+
+	name := formatName(baseID)
+	for _, dir := range q.rootDirNames {
+		path := filepath.Join(dir, topic, name)
+		if _, err := os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+			return headers.ErrTopicDoesNotExist
+		}
+		if _, err := os.Stat(path); err == nil {
+			return errors.Errorf("segment %q of topic %q already exists", name, topic)
+		}
+
+		// write the log before the dat file, a dat file means the segment is complete
+		if err := writeSynced(path+".log", log); err != nil {
+			return err
+		}
+		if err := writeSynced(path, dat); err != nil {
+			return err
+		}
+	}
+
+	if q.produceCache != nil {
+		if v, ok := q.produceCache.LoadAndDelete(topic); ok {
+			closeCachedFiles(v.(*cacheableProduceFile))
+		}
+	}
+	if q.consumeNameCache != nil {
+		q.consumeNameCache.Delete(topic)
+	}
+	return nil
+}
@@ -1,84 +1,211 @@
 package filequeue
 
 import (
+	"encoding/binary"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/haraqa/haraqa/internal/blockflate"
 	"github.com/haraqa/haraqa/internal/headers"
 	"github.com/pkg/errors"
 )
 
-// ModifyTopic updates the topic to truncate/remove messages and return the topic offset info
+// ModifyTopic updates the topic to truncate/remove messages and return the topic offset info.
+// Whole segments are removed from every volume. The latest segment is kept when truncating to a negative id,
+// limiting the size or if the request asks to keep it. Archived segments are included in the topic info, they are only removed by truncating to an id
 func (q *FileQueue) ModifyTopic(topic string, request headers.ModifyRequest) (*headers.TopicInfo, error) {
 	if topic == "" {
 		return nil, nil
 	}
+
+	// lock actions on the topic
+	mux := q.topicLock(topic)
+	mux.Lock()
+	defer mux.Unlock()
+
 	topicPath := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic)
 	latest, err := getLatestDat(topicPath)
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to open latest dat file for %q", topic)
 	}
 
-	topicInfo := &headers.TopicInfo{}
-	err = fs.WalkDir(os.DirFS("."), topicPath, func(path string, d fs.DirEntry, err error) error {
+	var keepFrom int64
+	if request.MaxSize > 0 {
+		keepFrom, err = sizeLimit(topicPath, request.MaxSize)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to get size of topic %q", topic)
+		}
+	}
+
+	var removed bool
+	topicInfo := &headers.TopicInfo{MinOffset: -1}
+	err = filepath.WalkDir(topicPath, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			if errors.Is(err, fs.ErrNotExist) {
 				err = nil
 			}
 			return err
 		}
-		if d.IsDir() || strings.ContainsRune(d.Name(), '.') {
+		if d.IsDir() {
+			// skip nested topics
+			if path != topicPath {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if strings.ContainsRune(d.Name(), '.') {
 			return nil
 		}
 		info, err := d.Info()
 		if err != nil {
 			return err
 		}
-		return truncateTopic(request, topicInfo, latest, path, info)
+		remove, err := truncateTopic(request, keepFrom, topicInfo, latest, path, info)
+		if err != nil || !remove {
+			return err
+		}
+		removed = true
+		return q.removeSegment(topic, d.Name())
 	})
+	if removed && q.consumeNameCache != nil {
+		q.consumeNameCache.Delete(topic)
+	}
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to modify topic %q", topic)
 	}
+	if q.archive != nil {
+		if err = q.truncateArchive(topic, request, topicInfo); err != nil {
+			return nil, errors.Wrapf(err, "unable to modify archived segments of topic %q", topic)
+		}
+	}
+	if topicInfo.MinOffset < 0 {
+		topicInfo.MinOffset = 0
+	}
 
 	return topicInfo, nil
 }
 
-func truncateTopic(request headers.ModifyRequest, topicInfo *headers.TopicInfo, latest string, path string, info fs.FileInfo) error {
-	// remove all but latest if truncate is negative
-	if request.Truncate < 0 && !strings.HasPrefix(info.Name(), latest) {
-		return errors.Wrapf(os.Remove(path), "unable to remove truncated file %s", path)
-	}
-
-	// remove all before modtime
-	if !request.Before.IsZero() && info.ModTime().Before(request.Before) {
-		return errors.Wrapf(os.Remove(path), "unable to remove timed out file %s", path)
-	}
-
-	// remove if file is completely before the truncate point
+// truncateTopic returns true if the segment should be removed, otherwise it adds the segment to the topic info
+func truncateTopic(request headers.ModifyRequest, keepFrom int64, topicInfo *headers.TopicInfo, latest string, path string, info fs.FileInfo) (bool, error) {
+	// remove unparsable files
 	base, err := strconv.ParseInt(info.Name(), 10, 64)
 	if err != nil {
-		return errors.Wrapf(os.Remove(path), "unable to remove unparsable file %s", path)
+		return true, nil
 	}
 	datSize := info.Size() / datEntryLength
-	if request.Truncate > 0 && base+datSize < request.Truncate {
-		if err = os.Remove(path); err != nil {
-			return errors.Wrapf(os.Remove(path), "unable to remove file %s", path)
+	first, last, err := segmentTimestamps(path, datSize)
+	if err != nil {
+		return false, err
+	}
+
+	if info.Name() != latest || (request.Truncate >= 0 && !request.KeepLatest) {
+		switch {
+		// remove all but latest if truncate is negative
+		case request.Truncate < 0:
+			return true, nil
+		// remove if every message was produced before the given time
+		case !request.Before.IsZero() && last.Before(request.Before):
+			return true, nil
+		// remove if file is completely before the truncate point
+		case request.Truncate > 0 && base+datSize < request.Truncate:
+			return true, nil
+		// remove if the newer segments already hold the max size
+		case base < keepFrom:
+			return true, nil
 		}
-		return errors.Wrapf(os.Remove(path+".log"), "unable to remove file %s", path)
 	}
 
 	// check if this is the lowest point
-	if request.Truncate < 0 || base <= request.Truncate {
+	if topicInfo.MinOffset < 0 || base < topicInfo.MinOffset {
 		topicInfo.MinOffset = base
-		topicInfo.MaxOffset = base + datSize - 1
+		topicInfo.FirstTimestamp = first
 	}
 
 	// assign the max offset
-	if base+datSize > topicInfo.MaxOffset {
+	if base+datSize-1 > topicInfo.MaxOffset {
 		topicInfo.MaxOffset = base + datSize - 1
 	}
+	return false, nil
+}
+
+// segmentTimestamps returns the produce time of the first and last entries of a dat file.
+// Zero times are returned if the dat file has no entries
+func segmentTimestamps(path string, entries int64) (time.Time, time.Time, error) {
+	if entries <= 0 {
+		return time.Time{}, time.Time{}, nil
+	}
+	dat, err := osOpen(path)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Wrapf(err, "unable to open dat file %q", path)
+	}
+	defer dat.Close()
+
+	var entry [datEntryLength]byte
+	timestamps := [2]time.Time{}
+	for i, n := range []int64{0, entries - 1} {
+		if _, err = dat.ReadAt(entry[:], n*datEntryLength); err != nil {
+			return time.Time{}, time.Time{}, errors.Wrapf(err, "unable to read dat file %q", path)
+		}
+		ts, _ := decodeTimestamp(binary.LittleEndian.Uint64(entry[8:]))
+		timestamps[i] = time.Unix(int64(ts), 0).UTC()
+	}
+	return timestamps[0], timestamps[1], nil
+}
+
+// sizeLimit returns the base id of the oldest segment that can be kept without the topic exceeding maxSize bytes.
+// The latest segment is always kept, even if it exceeds maxSize on its own
+func sizeLimit(topicPath string, maxSize int64) (int64, error) {
+	entries, err := os.ReadDir(topicPath)
+	if err != nil {
+		return 0, err
+	}
+	sizes := make(map[int64]int64)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		base, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSuffix(entry.Name(), blockflate.Ext), ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return 0, err
+		}
+		sizes[base] += info.Size()
+	}
+
+	bases := make([]int64, 0, len(sizes))
+	for base := range sizes {
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] > bases[j] })
+
+	var total int64
+	for i, base := range bases {
+		total += sizes[base]
+		if i > 0 && total > maxSize {
+			return bases[i-1], nil
+		}
+	}
+	return 0, nil
+}
+
+// removeSegment removes the dat and log files, compressed or not, of a segment from every volume
+func (q *FileQueue) removeSegment(topic, name string) error {
+	q.unmapDat(filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic, name))
+	for _, rootDir := range q.rootDirNames {
+		path := filepath.Join(rootDir, topic, name)
+		for _, p := range []string{path, path + ".log", path + ".log" + blockflate.Ext} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "unable to remove file %s", p)
+			}
+		}
+	}
 	return nil
 }
@@ -76,3 +76,123 @@ func TestFileQueue_ModifyTopic(t *testing.T) {
 		t.Error(info)
 	}
 }
+
+func TestFileQueue_ModifyTopicMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	topic := "modify-topic"
+
+	q, err := New(false, 2, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	// each segment holds 64 bytes of entries and 10 bytes of messages
+	for i := 0; i < 3; i++ {
+		if err = q.Produce(topic, []int64{5, 5}, uint64(time.Now().Unix()), bytes.NewBuffer([]byte("helloworld"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := q.ModifyTopic(topic, headers.ModifyRequest{
+		MaxSize: 150,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if info == nil || info.MinOffset != 2 || info.MaxOffset != 5 {
+		t.Error(info)
+	}
+	if _, err = os.Stat(filepath.Join(dir, topic, formatName(0)+".log")); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+
+	// the latest segment is kept even if it exceeds the max size
+	info, err = q.ModifyTopic(topic, headers.ModifyRequest{
+		MaxSize: 1,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if info == nil || info.MinOffset != 4 || info.MaxOffset != 5 {
+		t.Error(info)
+	}
+}
+
+func TestFileQueue_ModifyTopicKeepLatest(t *testing.T) {
+	dir := t.TempDir()
+	topic := "modify-topic"
+
+	q, err := New(false, 2, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = q.Produce(topic, []int64{5, 5}, uint64(time.Now().Unix()), bytes.NewBuffer([]byte("helloworld"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// requests covering the whole topic keep the latest segment if asked to
+	for _, request := range []headers.ModifyRequest{
+		{Before: time.Now().Add(time.Second), KeepLatest: true},
+		{Truncate: 100, KeepLatest: true},
+	} {
+		info, err := q.ModifyTopic(topic, request)
+		if err != nil || info == nil || info.MinOffset != 4 || info.MaxOffset != 5 {
+			t.Error(request, info, err)
+		}
+	}
+
+	// otherwise the latest segment is removed as well
+	info, err := q.ModifyTopic(topic, headers.ModifyRequest{Truncate: 100})
+	if err != nil || info == nil || info.MinOffset != 0 || info.MaxOffset != 0 {
+		t.Error(info, err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, topic, formatName(4))); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+}
+
+func TestFileQueue_ModifyTopicTimestamps(t *testing.T) {
+	dir := ".haraqa-modify-timestamps"
+	topic := "modify-topic"
+
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	q, err := New(false, 2, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	old := now.Add(-2 * time.Hour)
+	for _, ts := range []time.Time{old, now, now} {
+		if err = q.Produce(topic, []int64{5, 5}, uint64(ts.Unix()), bytes.NewBuffer([]byte("helloworld"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// file times are ignored, only the message timestamps are used
+	if err = os.Chtimes(filepath.Join(dir, topic, formatName(2)), old, old); err != nil {
+		t.Fatal(err)
+	}
+	info, err := q.ModifyTopic(topic, headers.ModifyRequest{
+		Before: now.Add(-time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.MinOffset != 2 || info.MaxOffset != 5 || !info.FirstTimestamp.Equal(now) {
+		t.Error(info)
+	}
+	if _, err = os.Stat(filepath.Join(dir, topic, formatName(0))); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+}
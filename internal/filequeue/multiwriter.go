@@ -42,6 +42,18 @@ func (mw MultiWriteAtCloser) WriteAt(p []byte, off int64) error {
 	return nil
 }
 
+// Sync commits the contents of each writer to stable storage, if the writer supports it
+func (mw MultiWriteAtCloser) Sync() error {
+	for _, w := range mw {
+		if s, ok := w.(interface{ Sync() error }); ok {
+			if err := s.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // CopyNAt performs a CopyNAt to each of the writers in order
 func (mw MultiWriteAtCloser) CopyNAt(r io.Reader, N, off int64) error {
 	// get log buffer
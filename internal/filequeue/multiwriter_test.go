@@ -3,6 +3,7 @@ package filequeue
 import (
 	"bytes"
 	"io"
+	"os"
 	"testing"
 
 	"github.com/golang/mock/gomock"
@@ -109,3 +110,27 @@ func TestMultiWriteAtCloser_CopyNAt(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestMultiWriteAtCloser_Sync(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	f, err := os.CreateTemp("", ".haraqa-sync*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// writers without a Sync method are skipped
+	mw := MultiWriteAtCloser{NewMockWriteAtCloser(ctrl), f}
+	if err = mw.Sync(); err != nil {
+		t.Error(err)
+	}
+
+	// sync errors are returned
+	_ = f.Close()
+	if err = mw.Sync(); err == nil {
+		t.Error("expected error syncing closed file")
+	}
+}
@@ -2,12 +2,15 @@ package filequeue
 
 import (
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/haraqa/haraqa/internal/headers"
 	"github.com/pkg/errors"
@@ -17,36 +20,101 @@ const datEntryLength = 32
 
 // Produce copies messages from the reader into the queue log
 func (q *FileQueue) Produce(topic string, msgSizes []int64, timestamp uint64, r io.Reader) error {
+	_, err := q.produce(topic, -1, msgSizes, timestamp&timestampMask, r)
+	return err
+}
+
+// ProduceFramed copies framed messages from the reader into the queue log. Each message holds its
+// key and headers in the format written by headers.AppendFrame
+func (q *FileQueue) ProduceFramed(topic string, msgSizes []int64, timestamp uint64, r io.Reader) error {
+	_, err := q.produce(topic, -1, msgSizes, timestamp&timestampMask|flagFramed, r)
+	return err
+}
+
+// ProduceOffsets copies messages from the reader into the queue log, framed messages if framed is set, and returns
+// the ids and timestamps given to them
+func (q *FileQueue) ProduceOffsets(topic string, msgSizes []int64, timestamp uint64, framed bool, r io.Reader) (*headers.ProduceInfo, error) {
+	timestamp &= timestampMask
+	if framed {
+		timestamp |= flagFramed
+	}
+	return q.produce(topic, -1, msgSizes, timestamp, r)
+}
+
+// ProduceIf copies messages from the reader into the queue log as ProduceOffsets does, but only if expected is the
+// id the next message of the topic is given. Otherwise nothing is written and headers.ErrUnexpectedOffset is returned
+func (q *FileQueue) ProduceIf(topic string, expected int64, msgSizes []int64, timestamp uint64, framed bool, r io.Reader) (*headers.ProduceInfo, error) {
+	if expected < 0 {
+		return nil, headers.ErrInvalidMessageID
+	}
+	timestamp &= timestampMask
+	if framed {
+		timestamp |= flagFramed
+	}
+	return q.produce(topic, expected, msgSizes, timestamp, r)
+}
+
+// produce writes the messages to the topic, any flags in the upper bits of the timestamp are set on every entry.
+// If expected is not negative the messages are only written if the next id of the topic matches it.
+// The ids and timestamps given to the messages are returned, or nil if there are no messages
+func (q *FileQueue) produce(topic string, expected int64, msgSizes []int64, timestamp uint64, r io.Reader) (*headers.ProduceInfo, error) {
 	if len(msgSizes) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	if r == nil {
-		return headers.ErrInvalidBodyMissing
+		return nil, headers.ErrInvalidBodyMissing
 	}
 
 	// lock actions on the topic
-	mux, ok := q.produceLocks.Load(topic)
-	if !ok {
-		mux, _ = q.produceLocks.LoadOrStore(topic, &sync.Mutex{})
-	}
-	mux.(*sync.Mutex).Lock()
-	defer mux.(*sync.Mutex).Unlock()
+	mux := q.topicLock(topic)
+	mux.Lock()
+	defer mux.Unlock()
+	return q.produceLocked(topic, expected, msgSizes, timestamp, r)
+}
 
+// produceLocked writes the messages to the topic as produce does, the topic lock must be held
+func (q *FileQueue) produceLocked(topic string, expected int64, msgSizes []int64, timestamp uint64, r io.Reader) (*headers.ProduceInfo, error) {
 	// Open files
-	pf, err := q.openProduceFile(topic)
+	pf, err := q.openProduceFile(topic, timestamp&timestampMask)
 	if err != nil {
 		if os.IsNotExist(errors.Cause(err)) {
 			err = headers.ErrTopicDoesNotExist
 		}
-		return errors.Wrap(err, "open producer file error")
+		return nil, errors.Wrap(err, "open producer file error")
 	}
 	isNewFile := pf.CurrentDatOffset == 0
+	firstID := pf.NextID
+	if expected >= 0 && firstID != expected {
+		q.releaseProduceFile(topic, pf)
+		return nil, headers.ErrUnexpectedOffset
+	}
 
 	// Write logs & dats
 	err = pf.Write(msgSizes, timestamp, r)
 	if err != nil {
-		return errors.Wrap(err, "write producer file error")
+		return nil, errors.Wrap(err, "write producer file error")
+	}
+
+	// flush to disk or mark for the next sync
+	if q.syncOnWrite {
+		if err = pf.Logs.Sync(); err != nil {
+			return nil, errors.Wrap(err, "unable to sync log files")
+		}
+		if err = pf.Dats.Sync(); err != nil {
+			return nil, errors.Wrap(err, "unable to sync dat files")
+		}
+		if isNewFile {
+			if err = q.syncTopicDirs(topic); err != nil {
+				return nil, errors.Wrap(err, "unable to sync topic directories")
+			}
+		}
+	}
+	if q.dirty != nil {
+		q.dirty.Store(filepath.Join(topic, pf.DatName), struct{}{})
+		if isNewFile {
+			q.dirty.Store(dirtyDir(topic), struct{}{})
+		}
 	}
 
 	// Add back to pool
@@ -56,14 +124,40 @@ func (q *FileQueue) Produce(topic string, msgSizes []int64, timestamp uint64, r
 	if q.consumeNameCache != nil && isNewFile {
 		q.consumeNameCache.Delete(topic)
 	}
-	return nil
+	ts := time.Unix(int64(timestamp&timestampMask), 0)
+	return &headers.ProduceInfo{FirstID: firstID, LastID: pf.NextID - 1, FirstTimestamp: ts, LastTimestamp: ts}, nil
+}
+
+// nextID returns the id the next message produced to the topic is given, the topic lock must be held
+func (q *FileQueue) nextID(topic string) (int64, error) {
+	pf, err := q.openProduceFile(topic, 0)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return 0, headers.ErrTopicDoesNotExist
+		}
+		return 0, errors.Wrap(err, "open producer file error")
+	}
+	nextID := pf.NextID
+	q.releaseProduceFile(topic, pf)
+	return nextID, nil
+}
+
+// releaseProduceFile returns open produce files to the cache, or closes them if files are not cached
+func (q *FileQueue) releaseProduceFile(topic string, pf *cacheableProduceFile) {
+	if q.produceCache != nil {
+		q.produceCache.Store(topic, pf)
+		return
+	}
+	closeCachedFiles(pf)
 }
 
 type cacheableProduceFile struct {
+	DatName          string
 	Dats, Logs       MultiWriteAtCloser
 	NextID           int64
 	CurrentDatOffset int64
 	CurrentLogOffset int64
+	FirstTimestamp   uint64
 }
 
 func closeCachedFiles(pf *cacheableProduceFile) {
@@ -80,19 +174,47 @@ func closeCachedFiles(pf *cacheableProduceFile) {
 	}
 	pf.CurrentDatOffset = 0
 	pf.CurrentLogOffset = 0
+	pf.FirstTimestamp = 0
+}
+
+// SetRollPolicy sets when the latest segment of a topic is closed and a new segment is started, in addition to the
+// max number of entries per segment. A segment rolls once its log holds maxBytes, or once its first message is maxAge
+// older than the batch being produced. Zero values disable the limit. Single batches are never split across segments.
+// The segment bytes of a topic config take precedence over maxBytes
+func (q *FileQueue) SetRollPolicy(maxBytes int64, maxAge time.Duration) {
+	q.maxBytes = maxBytes
+	q.maxAge = maxAge
+}
+
+// segmentFull reports if a segment must roll over before a batch produced at timestamp is written to it.
+// A segment is full once it holds the max number of entries, or once it exceeds maxBytes or the max age of the roll policy
+func (q *FileQueue) segmentFull(pf *cacheableProduceFile, timestamp uint64, maxBytes int64) bool {
+	entries := pf.CurrentDatOffset / datEntryLength
+	switch {
+	case entries >= q.max:
+		return true
+	case entries == 0:
+		return false
+	case maxBytes > 0 && pf.CurrentLogOffset >= maxBytes:
+		return true
+	case q.maxAge > 0 && timestamp > pf.FirstTimestamp:
+		return time.Duration(timestamp-pf.FirstTimestamp)*time.Second >= q.maxAge
+	}
+	return false
 }
 
-func (q *FileQueue) openProduceFile(topic string) (*cacheableProduceFile, error) {
+func (q *FileQueue) openProduceFile(topic string, timestamp uint64) (*cacheableProduceFile, error) {
 	var pf *cacheableProduceFile
 	var datName string
 	var loaded bool
+	maxBytes := q.segmentBytes(topic)
 
 	// attempt to load from cache
 	if q.produceCache != nil {
 		if tmp, ok := q.produceCache.Load(topic); ok {
 			if pf, ok = tmp.(*cacheableProduceFile); ok {
 				// if we haven't reached the max cap, return
-				if pf.CurrentDatOffset/datEntryLength < q.max {
+				if !q.segmentFull(pf, timestamp, maxBytes) {
 					return pf, nil
 				}
 
@@ -116,6 +238,7 @@ func (q *FileQueue) openProduceFile(topic string) (*cacheableProduceFile, error)
 
 	// open file set
 OpenFileSet:
+	pf.DatName = datName
 	for _, dir := range q.rootDirNames {
 		datPath := filepath.Join(dir, topic, datName)
 		dat, err := osOpenFile(datPath, os.O_RDWR|os.O_CREATE, 0666)
@@ -154,14 +277,23 @@ OpenFileSet:
 			}
 			pf.NextID = int64(binary.LittleEndian.Uint64(data[0:8])) + 1
 			pf.CurrentDatOffset = datEntryLength * (size / datEntryLength)
-			pf.CurrentLogOffset = int64(binary.LittleEndian.Uint64(data[16:24]) + binary.LittleEndian.Uint64(data[24:32]))
+			msgSize, _ := decodeSize(binary.LittleEndian.Uint64(data[24:32]))
+			pf.CurrentLogOffset = int64(binary.LittleEndian.Uint64(data[16:24])) + msgSize
+			if _, err = dat.ReadAt(data[:], 0); err != nil {
+				closeCachedFiles(pf)
+				return nil, errors.Wrap(err, "unable to read dat")
+			}
+			pf.FirstTimestamp, _ = decodeTimestamp(binary.LittleEndian.Uint64(data[8:16]))
 
 			// check if this file has been filled
-			if size/datEntryLength >= q.max {
+			if q.segmentFull(pf, timestamp, maxBytes) {
 				closeCachedFiles(pf)
 				datName = formatName(pf.NextID)
 				goto OpenFileSet
 			}
+		} else if baseID, err := strconv.ParseInt(datName, 10, 64); err == nil {
+			// an empty segment starts at its base id
+			pf.NextID = baseID
 		}
 	}
 
@@ -186,38 +318,69 @@ func (pf *cacheableProduceFile) Write(msgSizes []int64, timestamp uint64, r io.R
 	}
 	defer bufPool.Put(data)
 
-	// create data entries
+	// write logs
+	var total int64
 	for _, size := range msgSizes {
+		total += size
+	}
+	buf := bufPool.Get().([]byte)
+	if total > int64(cap(buf)) {
+		buf = make([]byte, total)
+	} else {
+		buf = buf[:total]
+	}
+	defer bufPool.Put(buf)
+	if _, err := io.ReadAtLeast(r, buf, len(buf)); err != nil {
+		return errors.Wrap(err, "unable to read input")
+	}
+	if err := pf.Logs.WriteAt(buf, pf.CurrentLogOffset); err != nil {
+		return errors.Wrap(err, "unable to copy to log file")
+	}
+
+	// create data entries
+	var pos int64
+	for i, size := range msgSizes {
+		flags := uint64(flagChecksum)
+		if i == len(msgSizes)-1 {
+			flags |= flagBatchEnd
+		}
 		binary.LittleEndian.PutUint64(data[n:], uint64(nextID))
 		n += 8
-		binary.LittleEndian.PutUint64(data[n:], timestamp)
+		binary.LittleEndian.PutUint64(data[n:], timestamp|flags)
 		n += 8
 		binary.LittleEndian.PutUint64(data[n:], uint64(offset))
 		n += 8
-		binary.LittleEndian.PutUint64(data[n:], uint64(size))
+		binary.LittleEndian.PutUint64(data[n:], encodeSize(size, crc32.Checksum(buf[pos:pos+size], crcTable)))
 		n += 8
 		offset += size
+		pos += size
 		nextID++
 	}
 
-	// write logs
-	err := pf.Logs.CopyNAt(r, offset-pf.CurrentLogOffset, pf.CurrentLogOffset)
-	if err != nil {
-		return errors.Wrap(err, "unable to copy to log file")
-	}
-
 	// write dat
-	err = pf.Dats.WriteAt(data, pf.CurrentDatOffset)
+	err := pf.Dats.WriteAt(data, pf.CurrentDatOffset)
 	if err != nil {
 		return errors.Wrap(err, "unable to write to dat file")
 	}
 
+	if pf.CurrentDatOffset == 0 {
+		pf.FirstTimestamp = timestamp & timestampMask
+	}
 	pf.NextID = nextID
 	pf.CurrentDatOffset += int64(len(data))
 	pf.CurrentLogOffset = offset
 	return nil
 }
 
+// topicLock returns the lock used to serialize writes to a topic
+func (q *FileQueue) topicLock(topic string) *sync.Mutex {
+	mux, ok := q.produceLocks.Load(topic)
+	if !ok {
+		mux, _ = q.produceLocks.LoadOrStore(topic, &sync.Mutex{})
+	}
+	return mux.(*sync.Mutex)
+}
+
 func getLatestDat(path string) (string, error) {
 	dir, err := osOpen(path)
 	if err != nil {
@@ -228,12 +391,21 @@ func getLatestDat(path string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	sort.Sort(sortableDirNames(names))
-	for i := range names {
-		if !strings.HasSuffix(names[i], ".log") {
-			return names[i], nil
+	names = removeHidden(names)
+
+	// skip log files, compressed or not
+	var n int
+	for _, name := range names {
+		if !strings.ContainsRune(name, '.') {
+			names[n] = name
+			n++
 		}
 	}
+	names = names[:n]
+	sort.Sort(sortableDirNames(names))
+	if len(names) > 0 {
+		return names[0], nil
+	}
 	return formatName(0), nil
 }
 
@@ -0,0 +1,63 @@
+package filequeue
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// producerStatesName is the name of the hidden file in a topic directory used to store the windows of idempotent producers
+const producerStatesName = ".producers"
+
+// SetProducerStates stores the windows of the idempotent producers of a topic on every volume,
+// replacing any previous windows
+func (q *FileQueue) SetProducerStates(topic string, states map[string]headers.ProducerState) error {
+	b, err := json.Marshal(states)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode producer states")
+	}
+	for _, dir := range q.rootDirNames {
+		path := filepath.Join(dir, topic, producerStatesName)
+		if _, err = os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+			return headers.ErrTopicDoesNotExist
+		}
+		if err = writeSynced(path+".tmp", b); err != nil {
+			return err
+		}
+		if err = os.Rename(path+".tmp", path); err != nil {
+			return errors.Wrapf(err, "unable to replace producer states %q", path)
+		}
+	}
+	return nil
+}
+
+// ProducerStates returns the windows of the idempotent producers of a topic, keyed by producer id.
+// A topic without stored windows returns an empty map
+func (q *FileQueue) ProducerStates(topic string) (map[string]headers.ProducerState, error) {
+	// read from the last volume first, falling back to the other volumes
+	states := make(map[string]headers.ProducerState)
+	var err error
+	for i := len(q.rootDirNames) - 1; i >= 0; i-- {
+		var b []byte
+		if b, err = os.ReadFile(filepath.Join(q.rootDirNames[i], topic, producerStatesName)); err != nil {
+			continue
+		}
+		if err = json.Unmarshal(b, &states); err == nil {
+			break
+		}
+	}
+	if os.IsNotExist(err) {
+		if _, statErr := os.Stat(filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic)); os.IsNotExist(statErr) {
+			return nil, headers.ErrTopicDoesNotExist
+		}
+		err = nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read producer states of topic %q", topic)
+	}
+	return states, nil
+}
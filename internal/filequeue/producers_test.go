@@ -0,0 +1,58 @@
+package filequeue
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestFileQueue_ProducerStates(t *testing.T) {
+	dirs := []string{".haraqa-producers1", ".haraqa-producers2"}
+	for _, dir := range dirs {
+		_ = os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+	q, err := New(false, 100, dirs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	const topic = "producers-topic"
+	if _, err = q.ProducerStates(topic); err != headers.ErrTopicDoesNotExist {
+		t.Error(err)
+	}
+	if err = q.SetProducerStates(topic, nil); err != headers.ErrTopicDoesNotExist {
+		t.Error(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if states, err := q.ProducerStates(topic); err != nil || len(states) != 0 {
+		t.Error(states, err)
+	}
+
+	// the windows are stored on every volume and hidden from the segments
+	expected := map[string]headers.ProducerState{
+		"p1": {Sequence: 3, Updated: time.Unix(100, 0).UTC(), Batches: []headers.ProducedBatch{
+			{Sequence: 3, Info: &headers.ProduceInfo{FirstID: 5, LastID: 6}},
+		}},
+	}
+	if err = q.SetProducerStates(topic, expected); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		if _, err = os.Stat(filepath.Join(dir, topic, producerStatesName)); err != nil {
+			t.Error(err)
+		}
+	}
+	if states, err := q.ProducerStates(topic); err != nil || !reflect.DeepEqual(states, expected) {
+		t.Error(states, err)
+	}
+	if topics, err := q.ListTopics("", "", ""); err != nil || len(topics) != 1 {
+		t.Error(topics, err)
+	}
+}
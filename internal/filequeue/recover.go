@@ -0,0 +1,128 @@
+package filequeue
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Recover repairs the queue after an unclean shutdown or the replacement of a volume.
+// Torn writes at the end of each topic are truncated back to the last complete batch on every volume,
+// then any diverged volumes are resynced. Discarded and copied data is reported through logf, which may be nil
+func (q *FileQueue) Recover(logf func(format string, args ...interface{})) error {
+	if logf == nil {
+		logf = noopLogf
+	}
+
+	topics, err := q.listAllTopics()
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		if err = q.recoverTopic(topic, logf); err != nil {
+			return errors.Wrapf(err, "unable to recover topic %q", topic)
+		}
+	}
+	if err = q.recoverTransactions(logf); err != nil {
+		return err
+	}
+	return q.Resync(logf)
+}
+
+func (q *FileQueue) recoverTopic(topic string, logf func(format string, args ...interface{})) error {
+	// lock actions on the topic
+	mux := q.topicLock(topic)
+	mux.Lock()
+	defer mux.Unlock()
+
+	var recovered bool
+	for _, rootDir := range q.rootDirNames {
+		path := filepath.Join(rootDir, topic)
+		datName, err := getLatestDat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return errors.Wrapf(err, "unable to find latest dat file for %q", path)
+		}
+		ok, err := recoverTail(filepath.Join(path, datName), logf)
+		if err != nil {
+			return err
+		}
+		recovered = recovered || ok
+	}
+
+	// drop any cached producer state, it may point past the recovered tail
+	if recovered && q.produceCache != nil {
+		if v, ok := q.produceCache.Load(topic); ok {
+			closeCachedFiles(v.(*cacheableProduceFile))
+			q.produceCache.Delete(topic)
+		}
+	}
+	return nil
+}
+
+// recoverTail truncates a dat/log pair to the end of the last complete batch.
+// A batch is complete if its last dat entry is flagged as the end of the batch and
+// all of its messages are within the log file. Entries written without flags are always complete
+func recoverTail(datPath string, logf func(format string, args ...interface{})) (bool, error) {
+	dat, err := osOpenFile(datPath, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "unable to open dat file %q", datPath)
+	}
+	defer dat.Close()
+	logPath := datPath + ".log"
+	log, err := osOpenFile(logPath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to open log file %q", logPath)
+	}
+	defer log.Close()
+
+	datStat, err := dat.Stat()
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to stat dat file %q", datPath)
+	}
+	logStat, err := log.Stat()
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to stat log file %q", logPath)
+	}
+
+	// walk back from the last entry to the end of the last complete batch
+	var entry [datEntryLength]byte
+	var logEnd int64
+	keep := datStat.Size() / datEntryLength
+	for ; keep > 0; keep-- {
+		if _, err = dat.ReadAt(entry[:], (keep-1)*datEntryLength); err != nil {
+			return false, errors.Wrapf(err, "unable to read dat file %q", datPath)
+		}
+		_, flags := decodeTimestamp(binary.LittleEndian.Uint64(entry[8:]))
+		size, _ := decodeSize(binary.LittleEndian.Uint64(entry[24:]))
+		end := int64(binary.LittleEndian.Uint64(entry[16:])) + size
+		if end <= logStat.Size() && (flags == 0 || flags&flagBatchEnd != 0) {
+			logEnd = end
+			break
+		}
+	}
+
+	var recovered bool
+	if discarded := datStat.Size() - keep*datEntryLength; discarded > 0 {
+		if err = dat.Truncate(keep * datEntryLength); err != nil {
+			return false, errors.Wrapf(err, "unable to truncate dat file %q", datPath)
+		}
+		logf("recover: discarded %d bytes of torn index entries from %q", discarded, datPath)
+		recovered = true
+	}
+	if discarded := logStat.Size() - logEnd; discarded > 0 {
+		if err = log.Truncate(logEnd); err != nil {
+			return false, errors.Wrapf(err, "unable to truncate log file %q", logPath)
+		}
+		logf("recover: discarded %d bytes of torn messages from %q", discarded, logPath)
+		recovered = true
+	}
+	return recovered, nil
+}
@@ -0,0 +1,90 @@
+package filequeue
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileQueue_Recover(t *testing.T) {
+	topic := "recover-topic"
+	dir := ".haraqa-recover"
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	q, err := New(true, 5000, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Produce(topic, []int64{5, 5}, uint64(time.Now().Unix()), bytes.NewBufferString("helloworld")); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Produce(topic, []int64{5, 5, 5}, uint64(time.Now().Unix()), bytes.NewBufferString("tornbatchwrites")); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	datPath := filepath.Join(dir, topic, formatName(0))
+
+	// nothing to recover
+	if err = q.Recover(logf); err != nil || len(logs) != 0 {
+		t.Fatal(err, logs)
+	}
+
+	// torn log write and partial dat entry
+	if err = os.Truncate(datPath+".log", 22); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(datPath, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	q, err = New(false, 5000, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Recover(logf); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 {
+		t.Error(logs)
+	}
+	if stat, err := os.Stat(datPath); err != nil || stat.Size() != 2*datEntryLength {
+		t.Error(err, stat.Size())
+	}
+	if stat, err := os.Stat(datPath + ".log"); err != nil || stat.Size() != 10 {
+		t.Error(err, stat.Size())
+	}
+
+	// produce after the recovery continues from the last complete batch
+	if err = q.Produce(topic, []int64{5}, uint64(time.Now().Unix()), bytes.NewBufferString("again")); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	n, err := q.Consume("", topic, 0, -1, w)
+	if err != nil || n != 3 {
+		t.Fatal(err, n)
+	}
+	if b, _ := io.ReadAll(w.Body); string(b) != "helloworldagain" {
+		t.Error(string(b))
+	}
+}
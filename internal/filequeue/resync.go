@@ -0,0 +1,230 @@
+package filequeue
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Resync reconciles the volumes of the queue. Any topic or dat/log segment that is missing from a volume,
+// or shorter than on another volume, is copied from the volume holding the most data. On a tie the later
+// volume is preferred, as it is the one consumers read from. Hidden files such as consumer offsets are
+// copied from the volume holding the most recently written copy wherever their contents differ.
+// Each copy is reported through logf, which may be nil. Resync is called by Recover and may also be called while
+// the queue is in use, each topic is locked while it is resynced
+func (q *FileQueue) Resync(logf func(format string, args ...interface{})) error {
+	if len(q.rootDirNames) < 2 {
+		return nil
+	}
+	if logf == nil {
+		logf = noopLogf
+	}
+
+	topics, err := q.listAllTopics()
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		if err = q.resyncTopic(topic, logf); err != nil {
+			return errors.Wrapf(err, "unable to resync topic %q", topic)
+		}
+	}
+	return nil
+}
+
+// listAllTopics returns the topics found on any of the volumes
+func (q *FileQueue) listAllTopics() ([]string, error) {
+	found := make(map[string]struct{})
+	for _, rootDir := range q.rootDirNames {
+		err := filepath.WalkDir(rootDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return errors.Wrapf(err, "unable to walk directory %q to list topics", rootDir)
+			}
+			if !d.IsDir() || path == rootDir {
+				return nil
+			}
+			if strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			rel, err := filepath.Rel(rootDir, path)
+			if err != nil {
+				return err
+			}
+			found[rel] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	topics := make([]string, 0, len(found))
+	for topic := range found {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+func (q *FileQueue) resyncTopic(topic string, logf func(format string, args ...interface{})) error {
+	// lock out produces, rewrites and consumes of the topic, as the queue may be serving while it is resynced
+	unlock := q.lockTopics([]string{topic})
+	defer unlock()
+	lock := q.segmentLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// gather the size of each file on each volume, -1 if missing
+	sizes := make(map[string][]int64)
+	hidden := make(map[string][]os.FileInfo)
+	for i, rootDir := range q.rootDirNames {
+		dir := filepath.Join(rootDir, topic)
+		if err := osMkdirAll(dir, os.ModePerm); err != nil {
+			return errors.Wrapf(err, "unable to create topic directory %q", dir)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read topic directory %q", dir)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return errors.Wrapf(err, "unable to stat %q", filepath.Join(dir, entry.Name()))
+			}
+			if strings.HasPrefix(entry.Name(), ".") {
+				if _, ok := hidden[entry.Name()]; !ok {
+					hidden[entry.Name()] = make([]os.FileInfo, len(q.rootDirNames))
+				}
+				hidden[entry.Name()][i] = info
+				continue
+			}
+			if _, ok := sizes[entry.Name()]; !ok {
+				sizes[entry.Name()] = make([]int64, len(q.rootDirNames))
+				for j := range sizes[entry.Name()] {
+					sizes[entry.Name()][j] = -1
+				}
+			}
+			sizes[entry.Name()][i] = info.Size()
+		}
+	}
+
+	// copy missing data from the most complete volume
+	var repaired bool
+	for name, volumeSizes := range sizes {
+		src := 0
+		for i := range volumeSizes {
+			if volumeSizes[i] >= volumeSizes[src] {
+				src = i
+			}
+		}
+		srcPath := filepath.Join(q.rootDirNames[src], topic, name)
+		for i := range volumeSizes {
+			if volumeSizes[i] >= volumeSizes[src] {
+				continue
+			}
+			off := volumeSizes[i]
+			if off < 0 {
+				off = 0
+			}
+			dstPath := filepath.Join(q.rootDirNames[i], topic, name)
+			if err := copyFileRange(srcPath, dstPath, off, volumeSizes[src]-off); err != nil {
+				return err
+			}
+			logf("resync: copied %d bytes at offset %d from %q to %q", volumeSizes[src]-off, off, srcPath, dstPath)
+			repaired = true
+		}
+	}
+
+	for name, infos := range hidden {
+		ok, err := q.resyncHidden(topic, name, infos, logf)
+		if err != nil {
+			return err
+		}
+		repaired = repaired || ok
+	}
+
+	// drop any cached state, it may have been read from a stale volume
+	if repaired {
+		if q.produceCache != nil {
+			if v, ok := q.produceCache.Load(topic); ok {
+				closeCachedFiles(v.(*cacheableProduceFile))
+				q.produceCache.Delete(topic)
+			}
+		}
+		if q.consumeNameCache != nil {
+			q.consumeNameCache.Delete(topic)
+		}
+		q.dropGroupOffsets(topic)
+	}
+	return nil
+}
+
+// resyncHidden replaces a hidden file, such as a consumer offset or a topic config, on the volumes where it is
+// missing or differs from the most recently written copy. Sizes are not compared, as an offset or config may change
+// without changing size
+func (q *FileQueue) resyncHidden(topic, name string, infos []os.FileInfo, logf func(format string, args ...interface{})) (bool, error) {
+	src := -1
+	for i := range infos {
+		if infos[i] != nil && (src < 0 || !infos[i].ModTime().Before(infos[src].ModTime())) {
+			src = i
+		}
+	}
+	srcPath := filepath.Join(q.rootDirNames[src], topic, name)
+	b, err := os.ReadFile(srcPath)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to read file %q", srcPath)
+	}
+
+	var repaired bool
+	for i := range infos {
+		if i == src {
+			continue
+		}
+		dstPath := filepath.Join(q.rootDirNames[i], topic, name)
+		if infos[i] != nil {
+			if current, err := os.ReadFile(dstPath); err == nil && bytes.Equal(current, b) {
+				continue
+			}
+		}
+		if err = writeSynced(dstPath, b); err != nil {
+			return false, err
+		}
+		logf("resync: copied %q to %q", srcPath, dstPath)
+		repaired = true
+	}
+	return repaired, nil
+}
+
+// copyFileRange copies n bytes starting at off from the src file to the same offset in the dst file
+func copyFileRange(srcPath, dstPath string, off, n int64) error {
+	src, err := osOpen(srcPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open file %q", srcPath)
+	}
+	defer src.Close()
+
+	dst, err := osOpenFile(dstPath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open/create file %q", dstPath)
+	}
+	defer dst.Close()
+
+	if _, err = dst.Seek(off, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "unable to seek file %q", dstPath)
+	}
+	if _, err = io.Copy(dst, io.NewSectionReader(src, off, n)); err != nil {
+		return errors.Wrapf(err, "unable to copy %q to %q", srcPath, dstPath)
+	}
+	return nil
+}
+
+func noopLogf(format string, args ...interface{}) {}
@@ -0,0 +1,106 @@
+package filequeue
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileQueue_Resync(t *testing.T) {
+	topic := "resync/topic"
+	group := "resync-group"
+	dirs := []string{".haraqa-resync1", ".haraqa-resync2", ".haraqa-resync3"}
+	for _, dir := range dirs {
+		_ = os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	q, err := New(true, 2, dirs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Produce(topic, []int64{5, 5}, uint64(time.Now().Unix()), bytes.NewBuffer([]byte("helloworld"))); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Produce(topic, []int64{5}, uint64(time.Now().Unix()), bytes.NewBuffer([]byte("again"))); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.SetConsumerOffset(group, topic, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// remove the first volume, truncate the last and remove a segment from the middle
+	if err = os.RemoveAll(dirs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(filepath.Join(dirs[2], topic, formatName(2)+".log"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(filepath.Join(dirs[2], topic, formatName(2)), datEntryLength/2); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(dirs[1], topic, formatName(0))); err != nil {
+		t.Fatal(err)
+	}
+
+	// the last volume holds an older offset of the same width
+	offsetPath := filepath.Join(dirs[2], topic, consumerOffsetName(group))
+	stale, err := os.ReadFile(offsetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale[0]++
+	if err = os.WriteFile(offsetPath, stale, 0666); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(offsetPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = New(false, 2, dirs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.Resync(t.Logf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{formatName(0), formatName(0) + ".log", formatName(2), formatName(2) + ".log", consumerOffsetName(group)} {
+		expected, err := os.ReadFile(filepath.Join(dirs[1], topic, name))
+		if name == formatName(0) {
+			expected, err = os.ReadFile(filepath.Join(dirs[2], topic, name))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range dirs {
+			b, err := os.ReadFile(filepath.Join(dir, topic, name))
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			if !bytes.Equal(b, expected) {
+				t.Error(dir, name, b, expected)
+			}
+		}
+	}
+
+	// nothing to do with a single volume
+	q, err = New(false, 2, dirs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Resync(nil); err != nil {
+		t.Error(err)
+	}
+}
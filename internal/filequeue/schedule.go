@@ -0,0 +1,69 @@
+package filequeue
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// scheduleName is the name of the hidden file in a topic directory used to store the scheduling index of the topic
+const scheduleName = ".schedule"
+
+// SetSchedule stores the scheduling index of a topic on every volume, replacing any previous index
+func (q *FileQueue) SetSchedule(topic string, schedule *headers.Schedule) error {
+	b, err := json.Marshal(schedule)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode schedule")
+	}
+	for _, dir := range q.rootDirNames {
+		path := filepath.Join(dir, topic, scheduleName)
+		if _, err = os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+			return headers.ErrTopicDoesNotExist
+		}
+		if err = writeSynced(path+".tmp", b); err != nil {
+			return err
+		}
+		if err = os.Rename(path+".tmp", path); err != nil {
+			return errors.Wrapf(err, "unable to replace schedule %q", path)
+		}
+	}
+	return nil
+}
+
+// Schedule returns the scheduling index of a topic. A topic without a stored index returns an empty index
+func (q *FileQueue) Schedule(topic string) (*headers.Schedule, error) {
+	// read from the last volume first, falling back to the other volumes
+	schedule := &headers.Schedule{}
+	var err error
+	for i := len(q.rootDirNames) - 1; i >= 0; i-- {
+		var b []byte
+		if b, err = os.ReadFile(filepath.Join(q.rootDirNames[i], topic, scheduleName)); err != nil {
+			continue
+		}
+		if err = json.Unmarshal(b, schedule); err == nil {
+			break
+		}
+	}
+	if os.IsNotExist(err) {
+		if _, statErr := os.Stat(filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic)); os.IsNotExist(statErr) {
+			return nil, headers.ErrTopicDoesNotExist
+		}
+		err = nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read schedule of topic %q", topic)
+	}
+	return schedule, nil
+}
+
+// ConsumerOffset returns the offset committed by the consumer group for the topic, or -1 if it has not committed one
+func (q *FileQueue) ConsumerOffset(group, topic string) (int64, error) {
+	if group == "" {
+		return 0, headers.ErrInvalidGroup
+	}
+	return q.getGroupOffsetID(group, topic, -1), nil
+}
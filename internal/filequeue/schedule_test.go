@@ -0,0 +1,68 @@
+package filequeue
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestFileQueue_Schedule(t *testing.T) {
+	dirs := []string{".haraqa-schedule1", ".haraqa-schedule2"}
+	for _, dir := range dirs {
+		_ = os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+	q, err := New(false, 100, dirs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	const topic = "schedule-topic"
+	if _, err = q.Schedule(topic); err != headers.ErrTopicDoesNotExist {
+		t.Error(err)
+	}
+	if err = q.SetSchedule(topic, &headers.Schedule{}); err != headers.ErrTopicDoesNotExist {
+		t.Error(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if schedule, err := q.Schedule(topic); err != nil || len(schedule.Pending) != 0 || len(schedule.Deferred) != 0 {
+		t.Error(schedule, err)
+	}
+
+	// the index is stored on every volume and hidden from the segments
+	expected := &headers.Schedule{
+		Pending:  []headers.ScheduledBatch{{FirstID: 3, LastID: 4, NotBefore: time.Unix(200, 0).UTC()}},
+		Deferred: map[string][]headers.ScheduledBatch{"group": {{FirstID: 1, LastID: 1, NotBefore: time.Unix(100, 0).UTC()}}},
+	}
+	if err = q.SetSchedule(topic, expected); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		if _, err = os.Stat(filepath.Join(dir, topic, scheduleName)); err != nil {
+			t.Error(err)
+		}
+	}
+	if schedule, err := q.Schedule(topic); err != nil || !reflect.DeepEqual(schedule, expected) {
+		t.Error(schedule, err)
+	}
+
+	// committed offsets of consumer groups
+	if _, err = q.ConsumerOffset("", topic); err != headers.ErrInvalidGroup {
+		t.Error(err)
+	}
+	if id, err := q.ConsumerOffset("group", topic); err != nil || id != -1 {
+		t.Error(id, err)
+	}
+	if err = q.SetConsumerOffset("group", topic, 7); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := q.ConsumerOffset("group", topic); err != nil || id != 7 {
+		t.Error(id, err)
+	}
+}
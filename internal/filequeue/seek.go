@@ -0,0 +1,109 @@
+package filequeue
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// OffsetAt returns the id of the first message of a topic produced at or after t. Archived segments are searched
+// as well. If every message was produced before t, the id of the next message to be produced is returned
+func (q *FileQueue) OffsetAt(topic string, t time.Time) (int64, error) {
+	topicPath := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic)
+
+	// hold off the compactor from replacing segments while they are read
+	lock := q.segmentLock(topic)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	names, err := segmentNames(topicPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, headers.ErrTopicDoesNotExist
+		}
+		return 0, errors.Wrapf(err, "unable to list segments of topic %q", topic)
+	}
+	archived := 0
+	if q.archive != nil {
+		archivedNames, err := q.archivedNames(topic)
+		if err != nil {
+			return 0, err
+		}
+		archived = len(archivedNames)
+		names = append(append(make([]string, 0, archived+len(names)), archivedNames...), names...)
+	}
+	if len(names) == 0 {
+		return 0, nil
+	}
+
+	// find the first segment with a message produced at or after t
+	var searchErr error
+	dats := make(map[int][]byte)
+	i := sort.Search(len(names), func(i int) bool {
+		dat, err := q.readSeekDat(topic, names[i], i < archived)
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		dats[i] = dat
+		n := int64(len(dat) / datEntryLength)
+		return n > 0 && !entryTime(dat, n-1).Before(t)
+	})
+	if searchErr != nil {
+		return 0, searchErr
+	}
+	if i == len(names) {
+		dat, ok := dats[len(names)-1]
+		if !ok {
+			if dat, err = q.readSeekDat(topic, names[len(names)-1], len(names)-1 < archived); err != nil {
+				return 0, err
+			}
+		}
+		if len(dat) < datEntryLength {
+			return strconv.ParseInt(names[len(names)-1], 10, 64)
+		}
+		return int64(binary.LittleEndian.Uint64(dat[len(dat)-len(dat)%datEntryLength-datEntryLength:])) + 1, nil
+	}
+
+	// find the first message of the segment produced at or after t
+	dat := dats[i]
+	n := sort.Search(len(dat)/datEntryLength, func(n int) bool {
+		return !entryTime(dat, int64(n)).Before(t)
+	})
+	return int64(binary.LittleEndian.Uint64(dat[n*datEntryLength:])), nil
+}
+
+// readSeekDat returns the entries of a dat file, reading archived dat files from the cache or from the store
+func (q *FileQueue) readSeekDat(topic, name string, archived bool) ([]byte, error) {
+	if !archived {
+		dat, err := os.ReadFile(filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic, name))
+		if os.IsNotExist(err) {
+			// removed since the segments were listed
+			return nil, nil
+		}
+		return dat, err
+	}
+	if dat, err := os.ReadFile(filepath.Join(q.archiveCacheDir, topic, name)); err == nil {
+		return dat, nil
+	}
+	r, err := q.archive.Get(topic, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read archived segment %q of topic %q", name, topic)
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// entryTime returns the produce time of the nth entry of a dat file
+func entryTime(dat []byte, n int64) time.Time {
+	ts, _ := decodeTimestamp(binary.LittleEndian.Uint64(dat[n*datEntryLength+8:]))
+	return time.Unix(int64(ts), 0)
+}
@@ -0,0 +1,71 @@
+package filequeue
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/haraqa/haraqa/pkg/archive"
+)
+
+func TestFileQueue_OffsetAt(t *testing.T) {
+	dirs := []string{".haraqa-seek", ".haraqa-seek-store", ".haraqa-seek-cache"}
+	topic := "seek-topic"
+	for _, dir := range dirs {
+		_ = os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+	q, err := New(true, 2, dirs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if _, err = q.OffsetAt(topic, time.Unix(0, 0)); err != headers.ErrTopicDoesNotExist {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := q.OffsetAt(topic, time.Unix(0, 0)); err != nil || id != 0 {
+		t.Fatal(err, id)
+	}
+
+	for _, ts := range []uint64{100, 200, 300} {
+		if err = q.Produce(topic, []int64{5}, ts, bytes.NewBufferString("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if err = q.Produce(topic, []int64{5}, ts+1, bytes.NewBufferString("world")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the oldest segment is searched in the archive
+	store, err := archive.NewDir(dirs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.SetArchive(store, dirs[2], 0); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := q.ArchiveSegments(topic, time.Unix(150, 0)); err != nil || n != 1 {
+		t.Fatal(err, n)
+	}
+
+	for ts, expected := range map[int64]int64{
+		50:  0,
+		100: 0,
+		101: 1,
+		102: 2,
+		201: 3,
+		250: 4,
+		301: 5,
+		302: 6,
+	} {
+		if id, err := q.OffsetAt(topic, time.Unix(ts, 0)); err != nil || id != expected {
+			t.Error(ts, err, id, expected)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package filequeue
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// dirtyDir marks a topic directory holding newly created segment files for the next sync
+type dirtyDir string
+
+// SetSyncPolicy sets how written messages are committed to stable storage. If onWrite is true
+// each batch is synced before Produce returns. If deferred is true the files written to are
+// tracked and synced by the next call to Sync. Otherwise flushing is left to the operating system
+func (q *FileQueue) SetSyncPolicy(onWrite, deferred bool) {
+	q.syncOnWrite = onWrite
+	q.dirty = nil
+	if deferred {
+		q.dirty = &sync.Map{}
+	}
+}
+
+// Sync commits the files written to since the previous call to stable storage, on every volume
+func (q *FileQueue) Sync() error {
+	if q.dirty == nil {
+		return nil
+	}
+	var err error
+	q.dirty.Range(func(key, value interface{}) bool {
+		// the key is removed before syncing so a write made meanwhile marks the file again,
+		// and restored if the sync fails so the next call retries it
+		q.dirty.Delete(key)
+		if topic, ok := key.(dirtyDir); ok {
+			if err = q.syncTopicDirs(string(topic)); err != nil {
+				q.dirty.Store(key, value)
+				return false
+			}
+			return true
+		}
+		name := key.(string)
+		for _, dir := range q.rootDirNames {
+			for _, path := range []string{filepath.Join(dir, name), filepath.Join(dir, name+".log")} {
+				if err = syncFile(path); err != nil {
+					q.dirty.Store(key, value)
+					return false
+				}
+			}
+		}
+		return true
+	})
+	return err
+}
+
+// syncTopicDirs commits the entries of the topic directory on every volume, so newly created segment files
+// survive a crash along with their contents
+func (q *FileQueue) syncTopicDirs(topic string) error {
+	for _, dir := range q.rootDirNames {
+		if err := syncFile(filepath.Join(dir, topic)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncFile(path string) error {
+	f, err := osOpen(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "unable to open %q to sync", path)
+	}
+	defer f.Close()
+	return errors.Wrapf(f.Sync(), "unable to sync %q", path)
+}
@@ -0,0 +1,148 @@
+package filequeue
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileQueue_Sync(t *testing.T) {
+	topic := "sync-topic"
+	dirs := []string{".haraqa-sync1", ".haraqa-sync2"}
+	for _, dir := range dirs {
+		_ = os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	q, err := New(true, 5000, dirs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing to sync
+	if err = q.Sync(); err != nil {
+		t.Error(err)
+	}
+
+	// sync on write
+	q.SetSyncPolicy(true, false)
+	if err = q.Produce(topic, []int64{5}, uint64(time.Now().Unix()), bytes.NewBufferString("hello")); err != nil {
+		t.Error(err)
+	}
+
+	// deferred sync
+	q.SetSyncPolicy(false, true)
+	if err = q.Produce(topic, []int64{5}, uint64(time.Now().Unix()), bytes.NewBufferString("world")); err != nil {
+		t.Error(err)
+	}
+	if _, ok := q.dirty.Load(filepath.Join(topic, formatName(0))); !ok {
+		t.Error("expected file to be marked for sync")
+	}
+	if err = q.Sync(); err != nil {
+		t.Error(err)
+	}
+	if _, ok := q.dirty.Load(filepath.Join(topic, formatName(0))); ok {
+		t.Error("expected file to be synced")
+	}
+
+	// failed syncs are retried by the next call
+	q.dirty.Store(filepath.Join(topic, "unsyncable"), struct{}{})
+	path := filepath.Join(dirs[0], topic, "unsyncable")
+	if err = os.Symlink("unsyncable", path); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Sync(); err == nil {
+		t.Error("expected sync error")
+	}
+	if _, ok := q.dirty.Load(filepath.Join(topic, "unsyncable")); !ok {
+		t.Error("expected file to stay marked for sync")
+	}
+	if err = os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Sync(); err != nil {
+		t.Error(err)
+	}
+
+	// deleted topics are skipped
+	if err = q.Produce(topic, []int64{5}, uint64(time.Now().Unix()), bytes.NewBufferString("again")); err != nil {
+		t.Error(err)
+	}
+	if err = q.DeleteTopic(topic); err != nil {
+		t.Error(err)
+	}
+	if err = q.Sync(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileQueue_SyncTopicDirs(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	q, err := New(true, 5000, dirs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for _, topic := range []string{"on-write", "deferred"} {
+		if err = q.CreateTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// record the paths opened to be synced
+	var opened []string
+	defer func() { osOpen = os.Open }()
+	osOpen = func(name string) (*os.File, error) {
+		opened = append(opened, name)
+		return os.Open(name)
+	}
+	syncedDirs := func(topic string) bool {
+		for _, dir := range dirs {
+			var found bool
+			for _, name := range opened {
+				found = found || name == filepath.Join(dir, topic)
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+
+	// the directories are synced once a new segment is written
+	q.SetSyncPolicy(true, false)
+	if err = q.Produce("on-write", []int64{5}, uint64(time.Now().Unix()), bytes.NewBufferString("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if !syncedDirs("on-write") {
+		t.Error(opened)
+	}
+	opened = nil
+	if err = q.Produce("on-write", []int64{5}, uint64(time.Now().Unix()), bytes.NewBufferString("world")); err != nil {
+		t.Fatal(err)
+	}
+	if syncedDirs("on-write") {
+		t.Error("expected the directories to be synced only for new segments", opened)
+	}
+
+	// or marked for the next sync
+	q.SetSyncPolicy(false, true)
+	if err = q.Produce("deferred", []int64{5}, uint64(time.Now().Unix()), bytes.NewBufferString("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.dirty.Load(dirtyDir("deferred")); !ok {
+		t.Error("expected the topic directory to be marked for sync")
+	}
+	if err = q.Sync(); err != nil {
+		t.Error(err)
+	}
+	if _, ok := q.dirty.Load(dirtyDir("deferred")); ok || !syncedDirs("deferred") {
+		t.Error("expected the topic directory to be synced", opened)
+	}
+}
@@ -0,0 +1,392 @@
+package filequeue
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/blockflate"
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// transactionPrefix is the prefix of the hidden journal files kept in the root of every volume while a
+// transaction is written
+const transactionPrefix = ".transaction-"
+
+// transactionJournal records the next id of every topic of a transaction before any of its batches are written,
+// so the transaction can be rolled back if it is interrupted
+type transactionJournal struct {
+	Topics map[string]int64 `json:"topics"`
+}
+
+// ProduceTransaction writes the batches to their topics atomically. Consumers do not read any message of the
+// transaction until every batch is written and synced, a failed transaction is rolled back before returning and
+// a transaction interrupted by a crash is rolled back by Recover. The ids and timestamps given to each batch are
+// returned in the order of the batches, nil for batches without messages
+func (q *FileQueue) ProduceTransaction(batches []headers.TransactionBatch, timestamp uint64) ([]*headers.ProduceInfo, error) {
+	if len(batches) == 0 {
+		return nil, headers.ErrInvalidBodyMissing
+	}
+	topics := headers.TransactionTopics(batches)
+	for _, topic := range topics {
+		if !headers.ValidTopicPath(topic) {
+			return nil, headers.ErrInvalidTopic
+		}
+	}
+	unlock := q.lockTopics(topics)
+	defer unlock()
+
+	journal := &transactionJournal{Topics: make(map[string]int64, len(topics))}
+	for _, topic := range topics {
+		nextID, err := q.nextID(topic)
+		if err != nil {
+			return nil, err
+		}
+		journal.Topics[topic] = nextID
+	}
+	name, err := q.writeJournal(journal)
+	if err != nil {
+		return nil, err
+	}
+
+	// hide the messages from consumers until the transaction is committed
+	for topic, nextID := range journal.Topics {
+		q.setPending(topic, nextID)
+	}
+	infos, err := q.writeTransaction(name, journal, batches, timestamp&timestampMask)
+	if err != nil {
+		if rollbackErr := q.rollback(journal); rollbackErr != nil {
+			// the journal is kept, Recover rolls back the transaction
+			return nil, errors.Wrapf(rollbackErr, "unable to roll back transaction after %s", err.Error())
+		}
+		_ = q.removeJournal(name)
+	}
+	for _, topic := range topics {
+		q.setPending(topic, -1)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, topic := range topics {
+		q.notifyWatchers(topic)
+	}
+	return infos, nil
+}
+
+// writeTransaction writes every batch of a transaction and commits it by removing its journal
+func (q *FileQueue) writeTransaction(name string, journal *transactionJournal, batches []headers.TransactionBatch, timestamp uint64) ([]*headers.ProduceInfo, error) {
+	infos := make([]*headers.ProduceInfo, len(batches))
+	for i, batch := range batches {
+		if len(batch.Messages) == 0 {
+			continue
+		}
+		sizes := make([]int64, len(batch.Messages))
+		for j := range batch.Messages {
+			sizes[j] = int64(len(batch.Messages[j]))
+		}
+		info, err := q.produceLocked(batch.Topic, -1, sizes, timestamp, bytes.NewReader(bytes.Join(batch.Messages, nil)))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to write batch %d of the transaction", i)
+		}
+		infos[i] = info
+	}
+
+	// every batch must be on disk before the journal is removed
+	if !q.syncOnWrite {
+		for topic, nextID := range journal.Topics {
+			if err := q.syncFrom(topic, nextID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := q.removeJournal(name); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// lockTopics takes the rewrite and produce locks of the topics, in order, and returns a function releasing them.
+// Closed segments holding messages of a transaction are not rewritten until it is committed or rolled back
+func (q *FileQueue) lockTopics(topics []string) func() {
+	for _, topic := range topics {
+		q.rewriteLock(topic).Lock()
+	}
+	for _, topic := range topics {
+		q.topicLock(topic).Lock()
+	}
+	return func() {
+		for _, topic := range topics {
+			q.topicLock(topic).Unlock()
+			q.rewriteLock(topic).Unlock()
+		}
+	}
+}
+
+// setPending hides the messages of the topic from id onwards from consumers, a negative id shows them again.
+// The segment lock is held so the range visible to a consumer does not change while it reads
+func (q *FileQueue) setPending(topic string, id int64) {
+	lock := q.segmentLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+	if id < 0 {
+		q.transactions.Delete(topic)
+		return
+	}
+	q.transactions.Store(topic, id)
+}
+
+// visibleRange limits a read of the topic to the messages before any transaction still being written,
+// the segment lock must be held for reading. False is returned if no message can be read
+func (q *FileQueue) visibleRange(topic string, id, limit int64) (int64, int64, bool) {
+	v, ok := q.transactions.Load(topic)
+	if !ok {
+		return id, limit, true
+	}
+	end := v.(int64)
+	if id < 0 {
+		// the latest committed message
+		return end - 1, 1, end > 0
+	}
+	if id >= end {
+		return id, limit, false
+	}
+	if limit < 0 || limit > end-id {
+		limit = end - id
+	}
+	return id, limit, true
+}
+
+// writeJournal writes the journal of a transaction to every volume and returns its name
+func (q *FileQueue) writeJournal(journal *transactionJournal) (string, error) {
+	b, err := json.Marshal(journal)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to encode transaction journal")
+	}
+	var id [8]byte
+	if _, err = rand.Read(id[:]); err != nil {
+		return "", errors.Wrap(err, "unable to generate transaction id")
+	}
+	name := transactionPrefix + hex.EncodeToString(id[:])
+	for _, dir := range q.rootDirNames {
+		if err = writeSynced(filepath.Join(dir, name), b); err != nil {
+			// a journal left behind would roll back later messages on recovery
+			_ = q.removeJournal(name)
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// removeJournal removes the journal of a transaction from every volume, committing the transaction
+func (q *FileQueue) removeJournal(name string) error {
+	for _, dir := range q.rootDirNames {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "unable to remove transaction journal %q", name)
+		}
+	}
+	return nil
+}
+
+// recoverTransactions rolls back every transaction which was interrupted before it was committed
+func (q *FileQueue) recoverTransactions(logf func(format string, args ...interface{})) error {
+	found := make(map[string]bool)
+	for _, dir := range q.rootDirNames {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return errors.Wrapf(err, "unable to list directory %q", dir)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasPrefix(entry.Name(), transactionPrefix) {
+				found[entry.Name()] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		// read from the last volume first, a journal torn while being written means no batch was written yet
+		journal := &transactionJournal{}
+		for i := len(q.rootDirNames) - 1; i >= 0; i-- {
+			b, err := os.ReadFile(filepath.Join(q.rootDirNames[i], name))
+			if err == nil && json.Unmarshal(b, journal) == nil {
+				break
+			}
+		}
+		topics := make([]string, 0, len(journal.Topics))
+		for topic := range journal.Topics {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+		unlock := q.lockTopics(topics)
+		err := q.rollback(journal)
+		unlock()
+		if err != nil {
+			return errors.Wrapf(err, "unable to roll back transaction %q", name)
+		}
+		if err = q.removeJournal(name); err != nil {
+			return err
+		}
+		logf("recover: rolled back interrupted transaction on topics %q", topics)
+	}
+	return nil
+}
+
+// rollback removes every message written by a transaction, the locks of its topics must be held
+func (q *FileQueue) rollback(journal *transactionJournal) error {
+	for topic, nextID := range journal.Topics {
+		if err := q.truncateFrom(topic, nextID); err != nil {
+			return errors.Wrapf(err, "unable to roll back topic %q", topic)
+		}
+	}
+	return nil
+}
+
+// truncateFrom removes the messages of the topic from id onwards on every volume
+func (q *FileQueue) truncateFrom(topic string, id int64) error {
+	names, err := segmentNames(filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	// drop any cached producer state, it points past the truncated tail
+	if q.produceCache != nil {
+		if v, ok := q.produceCache.Load(topic); ok {
+			closeCachedFiles(v.(*cacheableProduceFile))
+			q.produceCache.Delete(topic)
+		}
+	}
+	if q.consumeNameCache != nil {
+		q.consumeNameCache.Delete(topic)
+	}
+
+	for _, name := range segmentsFrom(names, id) {
+		base, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		if base > id {
+			if err = q.removeSegment(topic, name); err != nil {
+				return err
+			}
+			continue
+		}
+		q.unmapDat(filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic, name))
+		for _, dir := range q.rootDirNames {
+			if err = truncateSegment(filepath.Join(dir, topic, name), id-base); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// truncateSegment truncates the dat and log files of a segment to its first n entries
+func truncateSegment(datPath string, n int64) error {
+	dat, err := osOpenFile(datPath, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "unable to open dat file %q", datPath)
+	}
+	defer dat.Close()
+	stat, err := dat.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "unable to stat dat file %q", datPath)
+	}
+	if stat.Size() <= n*datEntryLength {
+		return nil
+	}
+	if _, err = os.Stat(datPath + ".log" + blockflate.Ext); err == nil {
+		return errors.Errorf("unable to truncate compressed segment %q", datPath)
+	}
+
+	var logEnd int64
+	if n > 0 {
+		var entry [datEntryLength]byte
+		if _, err = dat.ReadAt(entry[:], (n-1)*datEntryLength); err != nil {
+			return errors.Wrapf(err, "unable to read dat file %q", datPath)
+		}
+		size, _ := decodeSize(binary.LittleEndian.Uint64(entry[24:]))
+		logEnd = int64(binary.LittleEndian.Uint64(entry[16:])) + size
+	}
+	if err = dat.Truncate(n * datEntryLength); err != nil {
+		return errors.Wrapf(err, "unable to truncate dat file %q", datPath)
+	}
+	if err = os.Truncate(datPath+".log", logEnd); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "unable to truncate log file %q", datPath+".log")
+	}
+	return nil
+}
+
+// syncFrom commits the segments of the topic holding messages from id onwards to stable storage, on every volume
+func (q *FileQueue) syncFrom(topic string, id int64) error {
+	names, err := segmentNames(filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic))
+	if err != nil {
+		return errors.Wrapf(err, "unable to list segments of topic %q", topic)
+	}
+	for _, name := range segmentsFrom(names, id) {
+		for _, dir := range q.rootDirNames {
+			path := filepath.Join(dir, topic, name)
+			if err = syncFile(path); err != nil {
+				return err
+			}
+			if err = syncFile(path + ".log"); err != nil {
+				return err
+			}
+		}
+	}
+	return q.syncTopicDirs(topic)
+}
+
+// segmentsFrom returns the names of the segments holding the ids from id onwards,
+// the first of which may also hold earlier ids. The names must be in ascending order
+func segmentsFrom(names []string, id int64) []string {
+	for i := len(names) - 1; i >= 0; i-- {
+		if base, err := strconv.ParseInt(names[i], 10, 64); err == nil && base <= id {
+			return names[i:]
+		}
+	}
+	return names
+}
+
+// notifyWatchers rewrites the last dat entry of the topic unchanged, so watchers of the topic learn of
+// messages which became visible without being written
+func (q *FileQueue) notifyWatchers(topic string) {
+	path := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic)
+	name, err := getLatestDat(path)
+	if err != nil {
+		return
+	}
+	dat, err := osOpenFile(filepath.Join(path, name), os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	defer dat.Close()
+	stat, err := dat.Stat()
+	if err != nil || stat.Size() < datEntryLength {
+		return
+	}
+	var entry [datEntryLength]byte
+	off := stat.Size() - stat.Size()%datEntryLength - datEntryLength
+	if _, err = dat.ReadAt(entry[:], off); err == nil {
+		_, _ = dat.WriteAt(entry[:], off)
+	}
+}
@@ -0,0 +1,130 @@
+package headers
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// A framed message holds an optional key and headers before the message body. Each field is prefixed by its
+// length as an unsigned varint:
+//
+//	keyLen key numHeaders [nameLen name valueLen value]... body
+//
+// A message without a key or headers is framed by two zero bytes
+const emptyFrameSize = 2
+
+// AppendFrame appends the framed message to dst and returns the extended buffer.
+// Headers are written in sorted order so identical messages produce identical frames
+func AppendFrame(dst []byte, key []byte, hdrs map[string]string, body []byte) []byte {
+	dst = appendField(dst, key)
+	dst = appendUvarint(dst, uint64(len(hdrs)))
+	names := make([]string, 0, len(hdrs))
+	for name := range hdrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dst = appendField(dst, []byte(name))
+		dst = appendField(dst, []byte(hdrs[name]))
+	}
+	return append(dst, body...)
+}
+
+func appendField(dst []byte, field []byte) []byte {
+	dst = appendUvarint(dst, uint64(len(field)))
+	return append(dst, field...)
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(dst, b[:n]...)
+}
+
+// ParseFrame returns the key, headers and body of a framed message. The key and body share memory with frame
+func ParseFrame(frame []byte) ([]byte, map[string]string, []byte, error) {
+	key, rest, err := readField(frame)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	n, read := binary.Uvarint(rest)
+	if read <= 0 || n > uint64(len(rest)) {
+		return nil, nil, nil, errors.Wrap(ErrInvalidFrame, "invalid header count")
+	}
+	rest = rest[read:]
+	var hdrs map[string]string
+	if n > 0 {
+		hdrs = make(map[string]string, n)
+	}
+	for i := uint64(0); i < n; i++ {
+		var name, value []byte
+		if name, rest, err = readField(rest); err != nil {
+			return nil, nil, nil, err
+		}
+		if value, rest, err = readField(rest); err != nil {
+			return nil, nil, nil, err
+		}
+		hdrs[string(name)] = string(value)
+	}
+	if len(key) == 0 {
+		key = nil
+	}
+	return key, hdrs, rest, nil
+}
+
+// FrameBodyOffset returns the offset of the body within a framed message
+func FrameBodyOffset(frame []byte) (int, error) {
+	_, _, body, err := ParseFrame(frame)
+	if err != nil {
+		return 0, err
+	}
+	return len(frame) - len(body), nil
+}
+
+func readField(b []byte) ([]byte, []byte, error) {
+	n, read := binary.Uvarint(b)
+	if read <= 0 || n > uint64(len(b)-read) {
+		return nil, nil, errors.Wrap(ErrInvalidFrame, "invalid field length")
+	}
+	end := read + int(n)
+	return b[read:end], b[end:], nil
+}
+
+// ConvertFrames rewrites a batch of stored messages for a consumer. The framed flags mark which of the
+// messages were stored framed. If toFramed is set every message is returned framed, otherwise the
+// frames are removed and only the message bodies are returned. The sizes are updated in place
+func ConvertFrames(buf []byte, sizes []int64, framed []bool, toFramed bool) ([]byte, error) {
+	convert := false
+	for i := range framed {
+		if framed[i] != toFramed {
+			convert = true
+			break
+		}
+	}
+	if !convert {
+		return buf, nil
+	}
+
+	out := make([]byte, 0, len(buf)+emptyFrameSize*len(sizes))
+	for i, size := range sizes {
+		msg := buf[:size]
+		buf = buf[size:]
+		start := len(out)
+		switch {
+		case framed[i] == toFramed:
+			out = append(out, msg...)
+		case toFramed:
+			out = AppendFrame(out, nil, nil, msg)
+		default:
+			off, err := FrameBodyOffset(msg)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, msg[off:]...)
+		}
+		sizes[i] = int64(len(out) - start)
+	}
+	return out, nil
+}
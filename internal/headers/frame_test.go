@@ -0,0 +1,73 @@
+package headers
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestFrame(t *testing.T) {
+	hdrs := map[string]string{"content-type": "text/plain", "trace-id": "abc123"}
+	frame := AppendFrame(nil, []byte("key"), hdrs, []byte("body"))
+	key, h, body, err := ParseFrame(frame)
+	if err != nil || string(key) != "key" || !reflect.DeepEqual(h, hdrs) || string(body) != "body" {
+		t.Error(err, key, h, body)
+	}
+
+	// empty frame
+	frame = AppendFrame(nil, nil, nil, []byte("body"))
+	if len(frame) != emptyFrameSize+4 {
+		t.Error(frame)
+	}
+	key, h, body, err = ParseFrame(frame)
+	if err != nil || key != nil || h != nil || string(body) != "body" {
+		t.Error(err, key, h, body)
+	}
+	off, err := FrameBodyOffset(frame)
+	if err != nil || off != emptyFrameSize {
+		t.Error(err, off)
+	}
+
+	// invalid frames
+	for _, frame := range [][]byte{nil, {5, 'k'}, {0}, {0, 1, 3, 'a'}, {0, 1, 1, 'a', 4}} {
+		if _, _, _, err = ParseFrame(frame); !errors.Is(err, ErrInvalidFrame) {
+			t.Error(frame, err)
+		}
+		if _, err = FrameBodyOffset(frame); !errors.Is(err, ErrInvalidFrame) {
+			t.Error(frame, err)
+		}
+	}
+}
+
+func TestConvertFrames(t *testing.T) {
+	framedMsg := AppendFrame(nil, []byte("key"), map[string]string{"a": "b"}, []byte("framed"))
+	buf := append([]byte("plain"), framedMsg...)
+
+	// no conversion needed
+	sizes := []int64{5, int64(len(framedMsg))}
+	out, err := ConvertFrames(buf, sizes, []bool{false, false}, false)
+	if err != nil || !bytes.Equal(out, buf) || sizes[1] != int64(len(framedMsg)) {
+		t.Error(err, out, sizes)
+	}
+
+	// to bodies
+	out, err = ConvertFrames(buf, sizes, []bool{false, true}, false)
+	if err != nil || string(out) != "plainframed" || !reflect.DeepEqual(sizes, []int64{5, 6}) {
+		t.Error(err, string(out), sizes)
+	}
+
+	// to frames
+	sizes = []int64{5, int64(len(framedMsg))}
+	out, err = ConvertFrames(buf, sizes, []bool{false, true}, true)
+	expected := append(AppendFrame(nil, nil, nil, []byte("plain")), framedMsg...)
+	if err != nil || !bytes.Equal(out, expected) || !reflect.DeepEqual(sizes, []int64{7, int64(len(framedMsg))}) {
+		t.Error(err, out, sizes)
+	}
+
+	// invalid frame
+	if _, err = ConvertFrames([]byte("plain\x09"), []int64{5, 1}, []bool{false, true}, false); !errors.Is(err, ErrInvalidFrame) {
+		t.Error(err)
+	}
+}
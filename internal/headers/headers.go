@@ -3,6 +3,8 @@ package headers
 import (
 	"bytes"
 	"net/http"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,56 +23,122 @@ const (
 	HeaderFileName      = "X-File-Name"
 	HeaderWatchTopics   = "X-Topics"
 	HeaderConsumerGroup = "X-Consumer-Group"
+	HeaderAutoCommit    = "X-Auto-Commit"
 	HeaderID            = "X-Id"
+	HeaderNextID        = "X-Next-Id"
 	HeaderLimit         = "X-Limit"
+	HeaderFramed        = "X-Framed"
+	HeaderSince         = "X-Since"
+	HeaderFirstID       = "X-First-Id"
+	HeaderLastID        = "X-Last-Id"
+	HeaderFirstTime     = "X-First-Timestamp"
+	HeaderLastTime      = "X-Last-Timestamp"
+	HeaderProducerID    = "X-Producer-Id"
+	HeaderSequence      = "X-Sequence"
+	HeaderDuplicate     = "X-Duplicate"
+	HeaderExpectedID    = "X-Expected-Id"
+	HeaderNotBefore     = "X-Not-Before"
 	ContentType         = "Content-Type"
+	ContentEncoding     = "Content-Encoding"
+	AcceptEncoding      = "Accept-Encoding"
 	LastModified        = "Last-Modified"
 )
 
 const (
-	errTopicDoesNotExist   = "topic does not exist"
-	errTopicAlreadyExists  = "topic already exists"
-	errInvalidHeaderSizes  = "invalid header: " + HeaderSizes
-	errInvalidMessageID    = "invalid message id"
-	errInvalidMessageLimit = "invalid message limit"
-	errInvalidTopic        = "invalid topic"
-	errInvalidBodyMissing  = "invalid body: body cannot be empty"
-	errInvalidBodyJSON     = "invalid body: invalid json entry"
-	errInvalidWebsocket    = "invalid websocket"
-	errNoContent           = "no content"
-	errClosed              = "server closing"
-	errProxyFailed         = "proxy failed"
+	errTopicDoesNotExist      = "topic does not exist"
+	errTopicAlreadyExists     = "topic already exists"
+	errInvalidHeaderSizes     = "invalid header: " + HeaderSizes
+	errInvalidHeaderSince     = "invalid header: " + HeaderSince
+	errInvalidMessageID       = "invalid message id"
+	errInvalidMessageLimit    = "invalid message limit"
+	errInvalidGroup           = "invalid consumer group"
+	errInvalidTopic           = "invalid topic"
+	errInvalidBodyMissing     = "invalid body: body cannot be empty"
+	errInvalidBodyJSON        = "invalid body: invalid json entry"
+	errInvalidWebsocket       = "invalid websocket"
+	errCorruptMessage         = "corrupt message: checksum mismatch"
+	errInvalidFrame           = "invalid message frame"
+	errInvalidEncoding        = "invalid content encoding"
+	errInvalidTopicConfig     = "invalid topic config"
+	errMessageTooLarge        = "message too large"
+	errNoContent              = "no content"
+	errClosed                 = "server closing"
+	errProxyFailed            = "proxy failed"
+	errInvalidSequence        = "invalid header: " + HeaderSequence
+	errOutOfOrderSequence     = "out of order sequence"
+	errInvalidProducer        = "invalid producer"
+	errUnexpectedOffset       = "unexpected offset"
+	errInvalidTransaction     = "invalid transaction"
+	errInvalidNotBefore       = "invalid header: " + HeaderNotBefore
+	errResyncUnsupported      = "resync not supported"
+	errConditionalUnsupported = "conditional produce not supported"
+)
+
+// Encodings of produce and consume bodies
+const (
+	EncodingIdentity = "identity"
+	EncodingGzip     = "gzip"
 )
 
 // Errors returned by the Client/Server
 var (
-	ErrTopicDoesNotExist   = errors.New(errTopicDoesNotExist)
-	ErrTopicAlreadyExists  = errors.New(errTopicAlreadyExists)
-	ErrInvalidHeaderSizes  = errors.New(errInvalidHeaderSizes)
-	ErrInvalidMessageID    = errors.New(errInvalidMessageID)
-	ErrInvalidMessageLimit = errors.New(errInvalidMessageLimit)
-	ErrInvalidTopic        = errors.New(errInvalidTopic)
-	ErrInvalidBodyMissing  = errors.New(errInvalidBodyMissing)
-	ErrInvalidBodyJSON     = errors.New(errInvalidBodyJSON)
-	ErrInvalidWebsocket    = errors.New(errInvalidWebsocket)
-	ErrNoContent           = errors.New(errNoContent)
-	ErrClosed              = errors.New(errClosed)
-	ErrProxyFailed         = errors.New(errProxyFailed)
+	ErrTopicDoesNotExist      = errors.New(errTopicDoesNotExist)
+	ErrTopicAlreadyExists     = errors.New(errTopicAlreadyExists)
+	ErrInvalidHeaderSizes     = errors.New(errInvalidHeaderSizes)
+	ErrInvalidHeaderSince     = errors.New(errInvalidHeaderSince)
+	ErrInvalidMessageID       = errors.New(errInvalidMessageID)
+	ErrInvalidMessageLimit    = errors.New(errInvalidMessageLimit)
+	ErrInvalidGroup           = errors.New(errInvalidGroup)
+	ErrInvalidTopic           = errors.New(errInvalidTopic)
+	ErrInvalidBodyMissing     = errors.New(errInvalidBodyMissing)
+	ErrInvalidBodyJSON        = errors.New(errInvalidBodyJSON)
+	ErrInvalidWebsocket       = errors.New(errInvalidWebsocket)
+	ErrCorruptMessage         = errors.New(errCorruptMessage)
+	ErrInvalidFrame           = errors.New(errInvalidFrame)
+	ErrInvalidEncoding        = errors.New(errInvalidEncoding)
+	ErrInvalidTopicConfig     = errors.New(errInvalidTopicConfig)
+	ErrMessageTooLarge        = errors.New(errMessageTooLarge)
+	ErrNoContent              = errors.New(errNoContent)
+	ErrClosed                 = errors.New(errClosed)
+	ErrProxyFailed            = errors.New(errProxyFailed)
+	ErrInvalidSequence        = errors.New(errInvalidSequence)
+	ErrOutOfOrderSequence     = errors.New(errOutOfOrderSequence)
+	ErrInvalidProducer        = errors.New(errInvalidProducer)
+	ErrUnexpectedOffset       = errors.New(errUnexpectedOffset)
+	ErrInvalidTransaction     = errors.New(errInvalidTransaction)
+	ErrInvalidNotBefore       = errors.New(errInvalidNotBefore)
+	ErrResyncUnsupported      = errors.New(errResyncUnsupported)
+	ErrConditionalUnsupported = errors.New(errConditionalUnsupported)
 )
 
 var errMap = map[string]error{
-	errTopicDoesNotExist:   ErrTopicDoesNotExist,
-	errTopicAlreadyExists:  ErrTopicAlreadyExists,
-	errInvalidHeaderSizes:  ErrInvalidHeaderSizes,
-	errInvalidMessageID:    ErrInvalidMessageID,
-	errInvalidMessageLimit: ErrInvalidMessageLimit,
-	errInvalidTopic:        ErrInvalidTopic,
-	errInvalidBodyMissing:  ErrInvalidBodyMissing,
-	errInvalidBodyJSON:     ErrInvalidBodyJSON,
-	errInvalidWebsocket:    ErrInvalidWebsocket,
-	errNoContent:           ErrNoContent,
-	errClosed:              ErrClosed,
-	errProxyFailed:         ErrProxyFailed,
+	errTopicDoesNotExist:      ErrTopicDoesNotExist,
+	errTopicAlreadyExists:     ErrTopicAlreadyExists,
+	errInvalidHeaderSizes:     ErrInvalidHeaderSizes,
+	errInvalidHeaderSince:     ErrInvalidHeaderSince,
+	errInvalidMessageID:       ErrInvalidMessageID,
+	errInvalidMessageLimit:    ErrInvalidMessageLimit,
+	errInvalidGroup:           ErrInvalidGroup,
+	errInvalidTopic:           ErrInvalidTopic,
+	errInvalidBodyMissing:     ErrInvalidBodyMissing,
+	errInvalidBodyJSON:        ErrInvalidBodyJSON,
+	errInvalidWebsocket:       ErrInvalidWebsocket,
+	errCorruptMessage:         ErrCorruptMessage,
+	errInvalidFrame:           ErrInvalidFrame,
+	errInvalidEncoding:        ErrInvalidEncoding,
+	errInvalidTopicConfig:     ErrInvalidTopicConfig,
+	errMessageTooLarge:        ErrMessageTooLarge,
+	errNoContent:              ErrNoContent,
+	errClosed:                 ErrClosed,
+	errProxyFailed:            ErrProxyFailed,
+	errInvalidSequence:        ErrInvalidSequence,
+	errOutOfOrderSequence:     ErrOutOfOrderSequence,
+	errInvalidProducer:        ErrInvalidProducer,
+	errUnexpectedOffset:       ErrUnexpectedOffset,
+	errInvalidTransaction:     ErrInvalidTransaction,
+	errInvalidNotBefore:       ErrInvalidNotBefore,
+	errResyncUnsupported:      ErrResyncUnsupported,
+	errConditionalUnsupported: ErrConditionalUnsupported,
 }
 
 // SetError adds the error to the response header and body and sets the status code as needed
@@ -83,21 +151,40 @@ func SetError(w http.ResponseWriter, errOriginal error) {
 	h := w.Header()
 	h[HeaderErrors] = []string{err.Error()}
 	switch err {
-	case ErrTopicDoesNotExist, ErrTopicAlreadyExists:
+	case ErrTopicDoesNotExist, ErrTopicAlreadyExists, ErrUnexpectedOffset:
 		w.WriteHeader(http.StatusPreconditionFailed)
 	case
 		ErrInvalidHeaderSizes,
+		ErrInvalidHeaderSince,
 		ErrInvalidMessageID,
 		ErrInvalidMessageLimit,
+		ErrInvalidGroup,
 		ErrInvalidTopic,
 		ErrInvalidBodyMissing,
 		ErrInvalidBodyJSON,
-		ErrInvalidWebsocket:
+		ErrInvalidWebsocket,
+		ErrInvalidFrame,
+		ErrInvalidTopicConfig,
+		ErrInvalidSequence,
+		ErrInvalidProducer,
+		ErrInvalidTransaction,
+		ErrInvalidNotBefore:
 		w.WriteHeader(http.StatusBadRequest)
+	case ErrOutOfOrderSequence:
+		w.WriteHeader(http.StatusConflict)
+	case ErrInvalidEncoding:
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+	case ErrMessageTooLarge:
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	case ErrCorruptMessage:
+		// no volume holds a valid copy of the message
+		w.WriteHeader(http.StatusGone)
 	case ErrNoContent:
 		w.WriteHeader(http.StatusNoContent)
 	case ErrClosed:
 		w.WriteHeader(http.StatusServiceUnavailable)
+	case ErrResyncUnsupported, ErrConditionalUnsupported:
+		w.WriteHeader(http.StatusNotImplemented)
 	default:
 		w.WriteHeader(http.StatusInternalServerError)
 	}
@@ -202,6 +289,153 @@ func SetSizes(msgSizes []int64, h http.Header) http.Header {
 	return h
 }
 
+// ProduceInfo holds the ids and timestamps given to the messages of a produce request. Messages of a
+// request are stored in order, with no messages of concurrent requests between them.
+// Duplicate is set if an idempotent producer resent a batch which was already stored
+type ProduceInfo struct {
+	FirstID        int64     `json:"firstId"`
+	LastID         int64     `json:"lastId"`
+	FirstTimestamp time.Time `json:"firstTimestamp"`
+	LastTimestamp  time.Time `json:"lastTimestamp"`
+	Duplicate      bool      `json:"duplicate,omitempty"`
+}
+
+// SetProduceInfo sets the ids and timestamps of produced messages in the header
+func SetProduceInfo(info *ProduceInfo, h http.Header) http.Header {
+	h[HeaderFirstID] = []string{strconv.FormatInt(info.FirstID, 10)}
+	h[HeaderLastID] = []string{strconv.FormatInt(info.LastID, 10)}
+	h[HeaderFirstTime] = []string{info.FirstTimestamp.UTC().Format(time.RFC3339)}
+	h[HeaderLastTime] = []string{info.LastTimestamp.UTC().Format(time.RFC3339)}
+	if info.Duplicate {
+		h[HeaderDuplicate] = []string{"true"}
+	}
+	return h
+}
+
+// ReadProduceInfo reads the ids and timestamps of produced messages from the header,
+// it returns nil if the header holds none
+func ReadProduceInfo(h http.Header) (*ProduceInfo, error) {
+	if len(h[HeaderFirstID]) == 0 {
+		return nil, nil
+	}
+	var info ProduceInfo
+	var err error
+	if info.FirstID, err = strconv.ParseInt(getFirst(h, HeaderFirstID), 10, 64); err != nil {
+		return nil, errors.New("invalid header: " + HeaderFirstID)
+	}
+	if info.LastID, err = strconv.ParseInt(getFirst(h, HeaderLastID), 10, 64); err != nil {
+		return nil, errors.New("invalid header: " + HeaderLastID)
+	}
+	if info.FirstTimestamp, err = time.Parse(time.RFC3339, getFirst(h, HeaderFirstTime)); err != nil {
+		return nil, errors.New("invalid header: " + HeaderFirstTime)
+	}
+	if info.LastTimestamp, err = time.Parse(time.RFC3339, getFirst(h, HeaderLastTime)); err != nil {
+		return nil, errors.New("invalid header: " + HeaderLastTime)
+	}
+	info.Duplicate = getFirst(h, HeaderDuplicate) == "true"
+	return &info, nil
+}
+
+// ProducerState is the deduplication window of an idempotent producer on a topic. Sequence is the last sequence
+// stored and Batches holds the ids given to the latest batches, oldest first
+type ProducerState struct {
+	Sequence uint64          `json:"sequence"`
+	Updated  time.Time       `json:"updated"`
+	Batches  []ProducedBatch `json:"batches,omitempty"`
+}
+
+// ProducedBatch is a batch in the window of an idempotent producer
+type ProducedBatch struct {
+	Sequence uint64       `json:"sequence"`
+	Info     *ProduceInfo `json:"info,omitempty"`
+}
+
+// TransactionBatch is a batch of messages produced to a topic as part of a transaction
+type TransactionBatch struct {
+	Topic    string   `json:"topic"`
+	Messages [][]byte `json:"messages"`
+}
+
+// TransactionRequest is the request structure required by the transaction endpoint.
+// Either every batch is stored or none is
+type TransactionRequest struct {
+	Batches []TransactionBatch `json:"batches"`
+}
+
+// TransactionResponse holds the ids and timestamps given to each batch of a transaction, in the order of the request
+type TransactionResponse struct {
+	Batches []*ProduceInfo `json:"batches"`
+}
+
+// TransactionTopics returns the distinct topics of the batches in ascending order, the order their locks are taken in
+func TransactionTopics(batches []TransactionBatch) []string {
+	found := make(map[string]bool, len(batches))
+	topics := make([]string, 0, len(batches))
+	for _, batch := range batches {
+		if !found[batch.Topic] {
+			found[batch.Topic] = true
+			topics = append(topics, batch.Topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// ValidTopicPath reports whether the topic is a relative path which stays within the directory of a volume
+func ValidTopicPath(topic string) bool {
+	if topic == "" || filepath.IsAbs(topic) || filepath.Clean(topic) == "." {
+		return false
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(topic), "/") {
+		if elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// ScheduledBatch is a batch of messages which consumer groups do not receive before a time
+type ScheduledBatch struct {
+	FirstID   int64     `json:"firstId"`
+	LastID    int64     `json:"lastId"`
+	NotBefore time.Time `json:"notBefore"`
+}
+
+// Schedule is the scheduling index of a topic. Pending holds the batches which are not due yet, in order of their ids.
+// Deferred holds the batches each consumer group skipped because they were not due, to be delivered once they are
+type Schedule struct {
+	Pending  []ScheduledBatch            `json:"pending,omitempty"`
+	Deferred map[string][]ScheduledBatch `json:"deferred,omitempty"`
+}
+
+// ReadSequence reads the producer id and the sequence of an idempotent produce request from the header.
+// An empty producer id is returned if the request is not idempotent
+func ReadSequence(h http.Header) (string, uint64, error) {
+	producer := getFirst(h, HeaderProducerID)
+	if producer == "" {
+		return "", 0, nil
+	}
+	seq, err := strconv.ParseUint(getFirst(h, HeaderSequence), 10, 64)
+	if err != nil {
+		return "", 0, ErrInvalidSequence
+	}
+	return producer, seq, nil
+}
+
+// SetSequence sets the producer id and the sequence of an idempotent produce request in the header
+func SetSequence(producer string, seq uint64, h http.Header) http.Header {
+	h[HeaderProducerID] = []string{producer}
+	h[HeaderSequence] = []string{strconv.FormatUint(seq, 10)}
+	return h
+}
+
+func getFirst(h http.Header, key string) string {
+	if v := h[key]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
 var bufPool = sync.Pool{New: func() interface{} {
 	return new(bytes.Buffer)
 }}
@@ -210,10 +444,48 @@ var bufPool = sync.Pool{New: func() interface{} {
 type ModifyRequest struct {
 	Truncate int64     `json:"truncate,omitempty"`
 	Before   time.Time `json:"before,omitempty"`
+	MaxSize  int64     `json:"maxSize,omitempty"`
+
+	// KeepLatest keeps the latest segment even if the request covers it, so retention never empties a topic.
+	// It is only set by the server
+	KeepLatest bool `json:"-"`
+
+	// Config replaces the configuration stored with the topic if set
+	Config *TopicConfig `json:"config,omitempty"`
+}
+
+// TopicConfig is the configuration stored with a topic. Zero values fall back to the settings of the server
+type TopicConfig struct {
+	SegmentBytes   int64 `json:"segmentBytes,omitempty"`   // start a new segment once the latest segment holds this many bytes
+	RetentionAge   int64 `json:"retentionAge,omitempty"`   // remove messages older than this many seconds
+	RetentionBytes int64 `json:"retentionBytes,omitempty"` // remove the oldest messages once the topic holds this many bytes
+	RetentionCount int64 `json:"retentionCount,omitempty"` // remove the oldest messages once the topic holds this many messages
+	ConsumeLimit   int64 `json:"consumeLimit,omitempty"`   // default batch limit for consumers
+	MaxMessageSize int64 `json:"maxMessageSize,omitempty"` // reject produced messages larger than this many bytes
+	Compact        bool  `json:"compact,omitempty"`        // compact the topic by message key
+}
+
+// Validate returns ErrInvalidTopicConfig if any of the values is negative
+func (c *TopicConfig) Validate() error {
+	if c.SegmentBytes < 0 || c.RetentionAge < 0 || c.RetentionBytes < 0 || c.RetentionCount < 0 ||
+		c.ConsumeLimit < 0 || c.MaxMessageSize < 0 {
+		return ErrInvalidTopicConfig
+	}
+	return nil
+}
+
+// Entry is a stored message as copied between the storage engines by a migration. Both engines share
+// the encoding of the timestamp and size fields
+type Entry struct {
+	ID        int64
+	Timestamp uint64 // unix seconds, with the message flags in the upper 16 bits
+	Size      uint64 // message size, with the message checksum in the upper 32 bits
+	Data      []byte
 }
 
 // TopicInfo is the response structure returned by the modify endpoints
 type TopicInfo struct {
-	MinOffset int64 `json:"minOffset"`
-	MaxOffset int64 `json:"maxOffset"`
+	MinOffset      int64     `json:"minOffset"`
+	MaxOffset      int64     `json:"maxOffset"`
+	FirstTimestamp time.Time `json:"firstTimestamp"`
 }
@@ -5,6 +5,7 @@ import (
 	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -21,6 +22,7 @@ func TestErrors(t *testing.T) {
 	testError(t, ErrInvalidHeaderSizes, http.StatusBadRequest)
 	testError(t, ErrInvalidMessageID, http.StatusBadRequest)
 	testError(t, ErrInvalidMessageLimit, http.StatusBadRequest)
+	testError(t, ErrInvalidGroup, http.StatusBadRequest)
 	testError(t, ErrInvalidTopic, http.StatusBadRequest)
 	testError(t, ErrInvalidBodyMissing, http.StatusBadRequest)
 	testError(t, ErrInvalidBodyJSON, http.StatusBadRequest)
@@ -34,6 +36,36 @@ func TestErrors(t *testing.T) {
 	// closed error
 	testError(t, ErrClosed, http.StatusServiceUnavailable)
 
+	// corrupt message
+	testError(t, ErrCorruptMessage, http.StatusGone)
+
+	// invalid frame
+	testError(t, ErrInvalidFrame, http.StatusBadRequest)
+
+	// invalid encoding
+	testError(t, ErrInvalidEncoding, http.StatusUnsupportedMediaType)
+
+	// invalid start time
+	testError(t, ErrInvalidHeaderSince, http.StatusBadRequest)
+
+	// invalid topic config
+	testError(t, ErrInvalidTopicConfig, http.StatusBadRequest)
+
+	// message too large
+	testError(t, ErrMessageTooLarge, http.StatusRequestEntityTooLarge)
+
+	// idempotent producers
+	testError(t, ErrInvalidSequence, http.StatusBadRequest)
+	testError(t, ErrInvalidProducer, http.StatusBadRequest)
+	testError(t, ErrOutOfOrderSequence, http.StatusConflict)
+
+	// conditional produce
+	testError(t, ErrUnexpectedOffset, http.StatusPreconditionFailed)
+	testError(t, ErrInvalidTransaction, http.StatusBadRequest)
+	testError(t, ErrInvalidNotBefore, http.StatusBadRequest)
+	testError(t, ErrResyncUnsupported, http.StatusNotImplemented)
+	testError(t, ErrConditionalUnsupported, http.StatusNotImplemented)
+
 	// undefined error
 	testError(t, errors.New("some new error"), http.StatusInternalServerError)
 
@@ -96,3 +128,66 @@ func testSize(t *testing.T, header http.Header, sizes []int64, err error) {
 		t.Fatal(header, sizes, s)
 	}
 }
+
+func TestProduceInfo(t *testing.T) {
+	if info, err := ReadProduceInfo(http.Header{}); info != nil || err != nil {
+		t.Fatal(info, err)
+	}
+	in := &ProduceInfo{FirstID: 10, LastID: 12, FirstTimestamp: time.Unix(100, 0), LastTimestamp: time.Unix(200, 0)}
+	h := SetProduceInfo(in, http.Header{})
+	out, err := ReadProduceInfo(h)
+	if err != nil || out.FirstID != 10 || out.LastID != 12 ||
+		!out.FirstTimestamp.Equal(in.FirstTimestamp) || !out.LastTimestamp.Equal(in.LastTimestamp) || out.Duplicate {
+		t.Fatal(out, err)
+	}
+	in.Duplicate = true
+	if out, err = ReadProduceInfo(SetProduceInfo(in, http.Header{})); err != nil || !out.Duplicate {
+		t.Fatal(out, err)
+	}
+	for _, key := range []string{HeaderFirstID, HeaderLastID, HeaderFirstTime, HeaderLastTime} {
+		h := SetProduceInfo(in, http.Header{})
+		h[key] = []string{"invalid"}
+		if _, err := ReadProduceInfo(h); err == nil {
+			t.Error(key)
+		}
+	}
+}
+
+func TestSequence(t *testing.T) {
+	if producer, seq, err := ReadSequence(http.Header{}); producer != "" || seq != 0 || err != nil {
+		t.Fatal(producer, seq, err)
+	}
+	if producer, seq, err := ReadSequence(SetSequence("p1", 42, http.Header{})); producer != "p1" || seq != 42 || err != nil {
+		t.Fatal(producer, seq, err)
+	}
+	h := SetSequence("p1", 42, http.Header{})
+	h[HeaderSequence] = []string{"-1"}
+	if _, _, err := ReadSequence(h); err != ErrInvalidSequence {
+		t.Fatal(err)
+	}
+}
+
+func TestTransactionTopics(t *testing.T) {
+	topics := TransactionTopics([]TransactionBatch{{Topic: "b"}, {Topic: "a"}, {Topic: "b"}})
+	if !reflect.DeepEqual(topics, []string{"a", "b"}) {
+		t.Fatal(topics)
+	}
+}
+
+func TestValidTopicPath(t *testing.T) {
+	for topic, valid := range map[string]bool{
+		"topic":        true,
+		"nested/topic": true,
+		"topic..name":  true,
+		"":             false,
+		".":            false,
+		"..":           false,
+		"../outside":   false,
+		"a/../../b":    false,
+		"/abs/topic":   false,
+	} {
+		if ValidTopicPath(topic) != valid {
+			t.Errorf("%q: expected %v", topic, valid)
+		}
+	}
+}
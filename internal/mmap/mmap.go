@@ -0,0 +1,27 @@
+// Package mmap maps files into memory read only, on the platforms supporting it
+package mmap
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrUnsupported is returned by Map on platforms without memory mapped files, callers read the file instead
+var ErrUnsupported = errors.New("memory mapped files are not supported on this platform")
+
+// Map maps the first size bytes of f read only. The mapping stays valid after f is closed, even if the file is
+// removed, and must be released with Unmap. Writes to the file through other handles are visible in the mapping
+func Map(f *os.File, size int64) ([]byte, error) {
+	if size <= 0 || int64(int(size)) != size {
+		return nil, errors.New("invalid size to map")
+	}
+	return mmap(f, int(size))
+}
+
+// Unmap releases a mapping returned by Map, the mapping must not be used afterwards
+func Unmap(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return munmap(b)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package mmap
+
+import "os"
+
+func mmap(f *os.File, size int) ([]byte, error) {
+	return nil, ErrUnsupported
+}
+
+func munmap(b []byte) error {
+	return ErrUnsupported
+}
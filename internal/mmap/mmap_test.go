@@ -0,0 +1,54 @@
+package mmap
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestMap(t *testing.T) {
+	f, err := os.CreateTemp("", ".haraqa*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err = f.WriteString("hello world"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = Map(f, 0); err == nil {
+		t.Error("expected an empty mapping to fail")
+	}
+	b, err := Map(f, 5)
+	if errors.Is(err, ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Error(string(b))
+	}
+
+	// writes are visible and the mapping outlives the file
+	if _, err = f.WriteAt([]byte("j"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "jello" {
+		t.Error(string(b))
+	}
+	if err = Unmap(b); err != nil {
+		t.Error(err)
+	}
+	if err = Unmap(nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,99 @@
+package queue
+
+import (
+	"hash/crc32"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/blockflate"
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// Meta entries keep their original 24 byte layout. The upper 16 bits of the timestamp field hold
+// flags and the upper 32 bits of the size field hold the CRC32C of the message when flagChecksum is set.
+// Entries written before checksums were introduced have no flags and are served unverified
+const (
+	timestampMask = 1<<48 - 1
+	sizeMask      = 1<<32 - 1
+	flagChecksum  = 1 << 48
+	flagBatchEnd  = 1 << 49 // set on the last entry of each write
+	flagFramed    = 1 << 50 // set on messages stored with a key and headers frame, see headers.AppendFrame
+	flagCompacted = 1 << 51 // set on entries whose message was removed by compaction, the size is zero
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func decodeTimestamp(v int64) (int64, int64) {
+	return v & timestampMask, v &^ timestampMask
+}
+
+func decodeSize(v int64) (int64, uint32) {
+	return v & sizeMask, uint32(uint64(v) >> 32)
+}
+
+func encodeSize(size int64, crc uint32) int64 {
+	return int64(uint64(size)&sizeMask | uint64(crc)<<32)
+}
+
+// checksummer computes the checksum of each message as the batch is written to it
+type checksummer struct {
+	sizes []int64
+	crcs  []uint32
+	i     int
+	n     int64
+}
+
+func (c *checksummer) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 && c.i < len(c.sizes) {
+		n := c.sizes[c.i] - c.n
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		c.crcs[c.i] = crc32.Update(c.crcs[c.i], crcTable, p[:n])
+		c.n += n
+		p = p[n:]
+		if c.n == c.sizes[c.i] {
+			c.i++
+			c.n = 0
+		}
+	}
+	return written, nil
+}
+
+// verify checks the checksum of every message in buf, which holds the file contents starting at meta.startAt.
+// Messages failing the check are re-read from the copies of the file in the other directories
+func (f *File) verify(buf []byte, meta Meta) error {
+	var off int64
+	for i, size := range meta.sizes {
+		msg := buf[off : off+size]
+		off += size
+		if meta.checksums[i] < 0 || crc32.Checksum(msg, crcTable) == uint32(meta.checksums[i]) {
+			continue
+		}
+		if !repairMessage(f.extraFiles, msg, meta.startAt+off-size, uint32(meta.checksums[i])) {
+			name := formatName(f.baseID) + blockflate.Ext
+			if f.File != nil {
+				name = f.Name()
+			}
+			return errors.Wrapf(headers.ErrCorruptMessage, "message %d in %q", f.baseID+meta.startID+int64(i), name)
+		}
+	}
+	return nil
+}
+
+// repairMessage attempts to fill msg with a valid copy read from one of the given files, starting with the last
+func repairMessage(files []*os.File, msg []byte, off int64, crc uint32) bool {
+	for i := len(files) - 1; i >= 0; i-- {
+		if files[i] == nil {
+			continue
+		}
+		tmp := make([]byte, len(msg))
+		if _, err := files[i].ReadAt(tmp, off); err == nil && crc32.Checksum(tmp, crcTable) == crc {
+			copy(msg, tmp)
+			return true
+		}
+	}
+	return false
+}
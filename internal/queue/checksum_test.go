@@ -0,0 +1,84 @@
+package queue
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestQueue_Checksum(t *testing.T) {
+	dirNames := make([]string, 2)
+	for i := range dirNames {
+		dirName, err := os.MkdirTemp("", ".haraqa*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dirName)
+		dirNames[i] = dirName
+	}
+	const topic = "topic"
+	q, err := NewQueue(dirNames, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Produce(topic, []int64{2, 4, 8}, uint64(time.Now().Unix()), bytes.NewBufferString("mytestmessages")); err != nil {
+		t.Fatal(err)
+	}
+
+	consume := func(expected string, errExpected error) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		_, err := q.Consume("", topic, 0, -1, w)
+		if !errors.Is(err, errExpected) {
+			t.Error(err)
+		}
+		b, _ := io.ReadAll(w.Body)
+		if string(b) != expected {
+			t.Error(string(b))
+		}
+	}
+	corrupt := func(dir string) {
+		t.Helper()
+		f, err := os.OpenFile(filepath.Join(dir, topic, formatName(0)), os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err = f.WriteAt([]byte("T"), infoSize+10*metaSize+2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	consume("mytestmessages", nil)
+
+	// corrupt the directory consumers read from, the other directory is used instead
+	corrupt(dirNames[1])
+	consume("mytestmessages", nil)
+
+	// corrupt every directory
+	corrupt(dirNames[0])
+	consume("", headers.ErrCorruptMessage)
+}
+
+func TestEncodeSize(t *testing.T) {
+	size, crc := decodeSize(encodeSize(1234, 0xdeadbeef))
+	if size != 1234 || crc != 0xdeadbeef {
+		t.Error(size, crc)
+	}
+	ts, flags := decodeTimestamp(int64(1600000000) | flagChecksum)
+	if ts != 1600000000 || flags != flagChecksum {
+		t.Error(ts, flags)
+	}
+}
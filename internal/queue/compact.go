@@ -0,0 +1,223 @@
+package queue
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/blockflate"
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// Compact rewrites the closed segments of a topic so only the latest message of each key remains.
+// Removed messages keep their meta entry, flagged as compacted, so the remaining messages keep their ids.
+// Tombstones, keyed messages with an empty body, are removed once produced before tombstonesBefore.
+// Messages without a key are never removed. The number of messages removed is returned
+func (q *Queue) Compact(topic string, tombstonesBefore time.Time) (int64, error) {
+	dir := q.RootDir() + string(filepath.Separator) + topic
+	names, err := segmentNames(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, headers.ErrTopicDoesNotExist
+		}
+		return 0, err
+	}
+	if len(names) < 2 {
+		return 0, nil
+	}
+
+	// compaction and compression both rewrite closed segments, only one may run at a time
+	rewrite := q.rewriteLock(topic)
+	rewrite.Lock()
+	defer rewrite.Unlock()
+
+	// find the latest id of each key
+	latest := make(map[string]int64)
+	for _, name := range names {
+		buf, err := readSegmentFile(dir + string(filepath.Separator) + name)
+		if err != nil {
+			return 0, err
+		}
+		baseID, numEntries := segmentInfo(buf)
+		for i := int64(0); i < numEntries; i++ {
+			if key, _, ok := messageKey(buf, i); ok {
+				latest[key] = baseID + i
+			}
+		}
+	}
+
+	// rewrite every closed segment holding messages which are no longer needed
+	var removed int64
+	for _, name := range names[:len(names)-1] {
+		buf, err := readSegmentFile(dir + string(filepath.Separator) + name)
+		if err != nil {
+			return removed, err
+		}
+		compacted, n := compactSegment(buf, latest, tombstonesBefore)
+		if n == 0 {
+			continue
+		}
+		replaced, err := q.replaceSegment(topic, name, compacted)
+		if err != nil {
+			return removed, errors.Wrapf(err, "unable to replace segment %q of topic %q", name, topic)
+		}
+		if replaced {
+			removed += n
+		}
+	}
+	return removed, nil
+}
+
+// readSegmentFile reads a segment file, compressed or not, verifying the checksum of every message
+func readSegmentFile(path string) ([]byte, error) {
+	buf, err := readSegment(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < infoSize {
+		return nil, errors.Errorf("invalid segment file %q", path)
+	}
+	_, numEntries := segmentInfo(buf)
+	for i := int64(0); i < numEntries; i++ {
+		off, size, crc, _, flags := metaEntry(buf, i)
+		if off+size > int64(len(buf)) {
+			return nil, errors.Errorf("invalid segment file %q", path)
+		}
+		if flags&flagChecksum != 0 && crc32.Checksum(buf[off:off+size], crcTable) != crc {
+			return nil, errors.Wrapf(headers.ErrCorruptMessage, "message %d in %q", i, path)
+		}
+	}
+	return buf, nil
+}
+
+// segmentInfo returns the base id and number of entries of a segment file
+func segmentInfo(buf []byte) (int64, int64) {
+	return int64(binary.LittleEndian.Uint64(buf[:8])), int64(binary.LittleEndian.Uint64(buf[16:24]))
+}
+
+// metaEntry returns the offset, size, checksum, timestamp and flags of the nth meta entry of a segment file
+func metaEntry(buf []byte, n int64) (int64, int64, uint32, int64, int64) {
+	meta := buf[infoSize+n*metaSize:]
+	size, crc := decodeSize(int64(binary.LittleEndian.Uint64(meta[8:16])))
+	ts, flags := decodeTimestamp(int64(binary.LittleEndian.Uint64(meta[16:24])))
+	return int64(binary.LittleEndian.Uint64(meta[:8])), size, crc, ts, flags
+}
+
+// messageKey returns the key of the nth message of a segment file and if the message is a tombstone.
+// False is returned if the message has no key or was already compacted
+func messageKey(buf []byte, n int64) (string, bool, bool) {
+	off, size, _, _, flags := metaEntry(buf, n)
+	if flags&flagFramed == 0 || flags&flagCompacted != 0 {
+		return "", false, false
+	}
+	key, _, body, err := headers.ParseFrame(buf[off : off+size])
+	if err != nil || len(key) == 0 {
+		return "", false, false
+	}
+	return string(key), len(body) == 0, true
+}
+
+// compactSegment returns the segment file without the messages which are not the latest of their key,
+// along with the number of messages removed
+func compactSegment(buf []byte, latest map[string]int64, tombstonesBefore time.Time) ([]byte, int64) {
+	baseID, numEntries := segmentInfo(buf)
+	maxEntries := int64(binary.LittleEndian.Uint64(buf[8:16]))
+	dataStart := infoSize + maxEntries*metaSize
+
+	out := make([]byte, dataStart, len(buf))
+	copy(out, buf[:dataStart])
+	var removed int64
+	for i := int64(0); i < numEntries; i++ {
+		meta := out[infoSize+i*metaSize:]
+		off, size, _, ts, flags := metaEntry(buf, i)
+		binary.LittleEndian.PutUint64(meta[:8], uint64(len(out)))
+
+		key, tombstone, ok := messageKey(buf, i)
+		remove := ok && (latest[key] != baseID+i || tombstone && time.Unix(ts, 0).Before(tombstonesBefore))
+		if !remove {
+			out = append(out, buf[off:off+size]...)
+			continue
+		}
+		binary.LittleEndian.PutUint64(meta[8:16], 0)
+		binary.LittleEndian.PutUint64(meta[16:24], uint64(ts|flags&flagBatchEnd|flagCompacted))
+		removed++
+	}
+	binary.LittleEndian.PutUint64(out[24:32], uint64(len(out)))
+	return out, removed
+}
+
+// replaceSegment swaps a segment file in every directory. Nothing is replaced, and false is returned,
+// if the segment was removed while it was being compacted
+func (q *Queue) replaceSegment(topic, name string, buf []byte) (bool, error) {
+	for _, dir := range q.dirs {
+		if err := writeSynced(dir+string(filepath.Separator)+topic+string(filepath.Separator)+".compact-"+name, buf); err != nil {
+			return false, err
+		}
+	}
+
+	lock := q.segmentLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+
+	path := q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + name
+	exists := segmentExists(path)
+	var err error
+	for _, dir := range q.dirs {
+		tmp := dir + string(filepath.Separator) + topic + string(filepath.Separator) + ".compact-" + name
+		if !exists {
+			_ = os.Remove(tmp)
+			continue
+		}
+		if err = os.Rename(tmp, dir+string(filepath.Separator)+topic+string(filepath.Separator)+name); err != nil {
+			return false, err
+		}
+
+		// the compacted segment replaces any compressed copy
+		if err = os.Remove(dir + string(filepath.Separator) + topic + string(filepath.Separator) + name + blockflate.Ext); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	if exists {
+		q.dropCachedFile(path)
+	}
+	return exists, nil
+}
+
+// rewriteLock returns the lock serializing rewrites of the closed segments of a topic
+func (q *Queue) rewriteLock(topic string) *sync.Mutex {
+	lock, ok := q.rewriteLocks.Load(topic)
+	if !ok {
+		lock, _ = q.rewriteLocks.LoadOrStore(topic, &sync.Mutex{})
+	}
+	return lock.(*sync.Mutex)
+}
+
+// segmentLock returns the lock guarding the segments of a topic from being replaced while they are read
+func (q *Queue) segmentLock(topic string) *sync.RWMutex {
+	lock, ok := q.segmentLocks.Load(topic)
+	if !ok {
+		lock, _ = q.segmentLocks.LoadOrStore(topic, &sync.RWMutex{})
+	}
+	return lock.(*sync.RWMutex)
+}
+
+func writeSynced(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
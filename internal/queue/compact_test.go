@@ -0,0 +1,99 @@
+package queue
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestQueue_Compact(t *testing.T) {
+	dirs := make([]string, 2)
+	for i := range dirs {
+		dirName, err := os.MkdirTemp("", ".haraqa*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dirName)
+		dirs[i] = dirName
+	}
+	const topic = "topic"
+	q, err := NewQueue(dirs, true, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	produce := func(key string, body string) {
+		t.Helper()
+		frame := headers.AppendFrame(nil, []byte(key), nil, []byte(body))
+		if err := q.ProduceFramed(topic, []int64{int64(len(frame))}, uint64(time.Now().Unix()), bytes.NewBuffer(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	consume := func(id, limit int64, expected string, nextID string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		if _, err := q.Consume("", topic, id, limit, w); err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := io.ReadAll(w.Body); string(b) != expected || w.Header().Get(headers.HeaderNextID) != nextID {
+			t.Errorf("consume %d: got %q %v", id, string(b), w.Header())
+		}
+	}
+
+	produce("a", "1")
+	produce("b", "1")
+	produce("a", "2")
+	produce("", "x")
+	produce("b", "")
+	produce("c", "1")
+
+	// cache the first segment before it is compacted
+	consume(0, -1, "11", "2")
+
+	// the older messages of a and b are removed, the tombstone is in the latest segment
+	removed, err := q.Compact(topic, time.Time{})
+	if err != nil || removed != 2 {
+		t.Fatal(err, removed)
+	}
+	consume(0, -1, "2x", "4")
+	consume(1, 1, "2", "3")
+	consume(4, -1, "1", "6")
+
+	// compacting again is a no-op
+	if removed, err = q.Compact(topic, time.Time{}); err != nil || removed != 0 {
+		t.Fatal(err, removed)
+	}
+
+	// once closed, old tombstones are removed too
+	produce("c", "2")
+	produce("d", "1")
+	if removed, err = q.Compact(topic, time.Now().Add(time.Hour)); err != nil || removed != 2 {
+		t.Fatal(err, removed)
+	}
+	consume(4, -1, "21", "8")
+
+	// every directory holds the compacted segments
+	for _, name := range []string{formatName(0), formatName(4)} {
+		b1, err1 := os.ReadFile(filepath.Join(dirs[0], topic, name))
+		b2, err2 := os.ReadFile(filepath.Join(dirs[1], topic, name))
+		if err1 != nil || err2 != nil || !bytes.Equal(b1, b2) {
+			t.Error(name, err1, err2)
+		}
+	}
+
+	// missing topics
+	if _, err = q.Compact("missing", time.Time{}); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+}
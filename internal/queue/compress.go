@@ -0,0 +1,198 @@
+package queue
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/blockflate"
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// CompressSegments compresses the segment files of a topic in every directory, except for the latest. Segments
+// rolled by size or age are compressed as well as full ones.
+// Compressed segments are read transparently by Consume. The number of bytes saved in each directory is returned
+func (q *Queue) CompressSegments(topic string) (int64, error) {
+	dir := q.RootDir() + string(filepath.Separator) + topic
+	names, err := segmentNames(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, headers.ErrTopicDoesNotExist
+		}
+		return 0, err
+	}
+	if len(names) < 2 {
+		return 0, nil
+	}
+
+	// compaction and compression both rewrite closed segments, only one may run at a time
+	rewrite := q.rewriteLock(topic)
+	rewrite.Lock()
+	defer rewrite.Unlock()
+
+	var saved int64
+	for _, name := range names[:len(names)-1] {
+		buf, err := os.ReadFile(dir + string(filepath.Separator) + name)
+		if os.IsNotExist(err) {
+			// already compressed
+			continue
+		}
+		if err != nil {
+			return saved, err
+		}
+		if len(buf) < infoSize {
+			continue
+		}
+
+		var compressed bytes.Buffer
+		if _, err = blockflate.Write(&compressed, buf, blockflate.DefaultBlockSize); err != nil {
+			return saved, errors.Wrapf(err, "unable to compress segment %q of topic %q", name, topic)
+		}
+		replaced, err := q.replaceCompressed(topic, name, compressed.Bytes())
+		if err != nil {
+			return saved, errors.Wrapf(err, "unable to replace segment %q of topic %q", name, topic)
+		}
+		if replaced {
+			saved += int64(len(buf) - compressed.Len())
+		}
+	}
+	return saved, nil
+}
+
+// replaceCompressed swaps a segment file for its compressed copy in every directory. Nothing is replaced,
+// and false is returned, if the segment was removed while it was being compressed
+func (q *Queue) replaceCompressed(topic, name string, compressed []byte) (bool, error) {
+	for _, dir := range q.dirs {
+		if err := writeSynced(dir+string(filepath.Separator)+topic+string(filepath.Separator)+".compress-"+name+blockflate.Ext, compressed); err != nil {
+			return false, err
+		}
+	}
+
+	lock := q.segmentLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+
+	exists := true
+	for _, dir := range q.dirs {
+		if _, err := os.Stat(dir + string(filepath.Separator) + topic + string(filepath.Separator) + name); err != nil {
+			exists = false
+		}
+	}
+	for _, dir := range q.dirs {
+		path := dir + string(filepath.Separator) + topic + string(filepath.Separator) + name
+		tmp := dir + string(filepath.Separator) + topic + string(filepath.Separator) + ".compress-" + name + blockflate.Ext
+		if !exists {
+			_ = os.Remove(tmp)
+			continue
+		}
+		if err := os.Rename(tmp, path+blockflate.Ext); err != nil {
+			return false, err
+		}
+		if err := os.Remove(path); err != nil {
+			return false, err
+		}
+	}
+	if exists {
+		q.dropCachedFile(q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + name)
+	}
+	return exists, nil
+}
+
+// dropCachedFile closes and removes a cached file, so the next read opens the replaced segment
+func (q *Queue) dropCachedFile(path string) {
+	if q.fileCache == nil {
+		return
+	}
+	if v, found := q.fileCache.Load(path); found {
+		q.fileCache.Delete(path)
+		if f, ok := v.(*File); ok {
+			_ = f.Close()
+		}
+	}
+}
+
+// segmentReader is an open segment file, compressed or not
+type segmentReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// openSegment opens the segment file at path for reading, falling back to its compressed copy
+func openSegment(path string) (segmentReader, error) {
+	f, err := os.Open(path)
+	if err == nil {
+		return f, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	z, zErr := blockflate.Open(path + blockflate.Ext)
+	if zErr != nil {
+		if os.IsNotExist(zErr) {
+			return nil, err
+		}
+		return nil, zErr
+	}
+	return z, nil
+}
+
+// segmentExists reports if the segment file at path exists, compressed or not
+func segmentExists(path string) bool {
+	if _, err := os.Stat(path); err == nil {
+		return true
+	}
+	_, err := os.Stat(path + blockflate.Ext)
+	return err == nil
+}
+
+// readSegment returns the contents of the segment file at path, decompressing them if needed
+func readSegment(path string) ([]byte, error) {
+	buf, err := os.ReadFile(path)
+	if !os.IsNotExist(err) {
+		return buf, err
+	}
+	z, zErr := blockflate.Open(path + blockflate.Ext)
+	if zErr != nil {
+		if os.IsNotExist(zErr) {
+			return nil, err
+		}
+		return nil, zErr
+	}
+	defer z.Close()
+	return z.ReadAll()
+}
+
+// segmentNames returns the names of the segment files of a topic directory in ascending order.
+// Compressed segments are listed under their uncompressed name
+func segmentNames(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	names = removeHidden(names)
+
+	var i int
+	found := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		name = strings.TrimSuffix(name, blockflate.Ext)
+		if _, ok := found[name]; ok {
+			continue
+		}
+		found[name] = struct{}{}
+		names[i] = name
+		i++
+	}
+	names = names[:i]
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,131 @@
+package queue
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/blockflate"
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestQueue_CompressSegments(t *testing.T) {
+	dirs := make([]string, 2)
+	for i := range dirs {
+		dirName, err := os.MkdirTemp("", ".haraqa*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dirName)
+		dirs[i] = dirName
+	}
+	const topic = "topic"
+	q, err := NewQueue(dirs, true, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	msg := strings.Repeat("compressible message ", 100)
+	for i := 0; i < 3; i++ {
+		if err = q.Produce(topic, []int64{int64(len(msg)), int64(len(msg))}, uint64(time.Now().Unix()), bytes.NewBufferString(msg+msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// cache the first segment before it is compressed
+	w := httptest.NewRecorder()
+	if n, err := q.Consume("", topic, 0, 1, w); err != nil || n != 1 {
+		t.Fatal(err, n)
+	}
+
+	saved, err := q.CompressSegments(topic)
+	if err != nil || saved <= 0 {
+		t.Fatal(err, saved)
+	}
+	if saved, err = q.CompressSegments(topic); err != nil || saved != 0 {
+		t.Fatal(err, saved)
+	}
+
+	// full segments are compressed in every directory, the latest segment is not
+	for _, dir := range dirs {
+		for _, name := range []string{formatName(0), formatName(2)} {
+			path := filepath.Join(dir, topic, name)
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Error(path, err)
+			}
+			if _, err := os.Stat(path + blockflate.Ext); err != nil {
+				t.Error(err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dir, topic, formatName(4))); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// consumers read compressed segments transparently
+	for id := int64(0); id < 6; id++ {
+		w := httptest.NewRecorder()
+		n, err := q.Consume("", topic, id, 1, w)
+		if err != nil || n != 1 {
+			t.Fatal(id, err, n)
+		}
+		if b, _ := io.ReadAll(w.Body); string(b) != msg {
+			t.Error(id, len(b))
+		}
+	}
+
+	// the topic info is read from compressed segments
+	info, err := q.ModifyTopic(topic, headers.ModifyRequest{})
+	if err != nil || info.MinOffset != 0 || info.MaxOffset != 5 || info.FirstTimestamp.IsZero() {
+		t.Fatal(err, info)
+	}
+
+	// removed segments take their compressed files with them
+	if info, err = q.ModifyTopic(topic, headers.ModifyRequest{Truncate: 4}); err != nil || info.MinOffset != 4 {
+		t.Fatal(err, info)
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, topic, formatName(0)+blockflate.Ext)); !os.IsNotExist(err) {
+			t.Error(err)
+		}
+	}
+}
+
+func TestQueue_CompressRolledSegments(t *testing.T) {
+	dir := t.TempDir()
+	const topic = "topic"
+	q, err := NewQueue([]string{dir}, false, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	q.SetRollPolicy(1, 0)
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	msg := strings.Repeat("compressible message ", 100)
+	for i := 0; i < 2; i++ {
+		if err = q.Produce(topic, []int64{int64(len(msg))}, uint64(time.Now().Unix()), bytes.NewBufferString(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// segments rolled by size are compressed even though they are not full
+	if saved, err := q.CompressSegments(topic); err != nil || saved <= 0 {
+		t.Fatal(err, saved)
+	}
+	if _, err = os.Stat(filepath.Join(dir, topic, formatName(0)+blockflate.Ext)); err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, topic, formatName(1))); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,86 @@
+package queue
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// topicConfigName is the name of the hidden file in a topic directory used to store the topic configuration
+const topicConfigName = ".config"
+
+// SetTopicConfig stores the configuration of a topic on every volume, replacing any previous configuration
+func (q *Queue) SetTopicConfig(topic string, config headers.TopicConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(&config)
+	if err != nil {
+		return err
+	}
+	for _, dir := range q.dirs {
+		path := dir + string(filepath.Separator) + topic + string(filepath.Separator) + topicConfigName
+		if _, err = os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+			return headers.ErrTopicDoesNotExist
+		}
+		if err = writeSynced(path+".tmp", b); err != nil {
+			return err
+		}
+		if err = os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+	}
+
+	if q.configCache != nil {
+		q.configCache.Store(topic, config)
+	}
+	return nil
+}
+
+// TopicConfig returns the configuration stored with a topic. A topic without a stored configuration
+// returns a zero configuration
+func (q *Queue) TopicConfig(topic string) (*headers.TopicConfig, error) {
+	if q.configCache != nil {
+		if v, ok := q.configCache.Load(topic); ok {
+			config := v.(headers.TopicConfig)
+			return &config, nil
+		}
+	}
+
+	// read from the last volume first, falling back to the other volumes
+	var config headers.TopicConfig
+	var err error
+	for i := len(q.dirs) - 1; i >= 0; i-- {
+		var b []byte
+		if b, err = os.ReadFile(q.dirs[i] + string(filepath.Separator) + topic + string(filepath.Separator) + topicConfigName); err != nil {
+			continue
+		}
+		if err = json.Unmarshal(b, &config); err == nil {
+			break
+		}
+	}
+	if os.IsNotExist(err) {
+		if _, statErr := os.Stat(q.RootDir() + string(filepath.Separator) + topic); os.IsNotExist(statErr) {
+			return nil, headers.ErrTopicDoesNotExist
+		}
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if q.configCache != nil {
+		q.configCache.Store(topic, config)
+	}
+	return &config, nil
+}
+
+// segmentBytes returns the max bytes of the latest file of a topic, from the topic config if set
+func (q *Queue) segmentBytes(topic string) int64 {
+	if config, err := q.TopicConfig(topic); err == nil && config.SegmentBytes > 0 {
+		return config.SegmentBytes
+	}
+	return q.maxBytes
+}
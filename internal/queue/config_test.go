@@ -0,0 +1,86 @@
+package queue
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestQueue_TopicConfig(t *testing.T) {
+	for _, cache := range []bool{true, false} {
+		dirs := make([]string, 2)
+		for i := range dirs {
+			var err error
+			if dirs[i], err = os.MkdirTemp("", ".haraqa*"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		q, err := NewQueue(dirs, cache, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const topic = "config-topic"
+		if _, err = q.TopicConfig(topic); err != headers.ErrTopicDoesNotExist {
+			t.Error(err)
+		}
+		if err = q.SetTopicConfig(topic, headers.TopicConfig{}); err != headers.ErrTopicDoesNotExist {
+			t.Error(err)
+		}
+		if err = q.CreateTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+		if config, err := q.TopicConfig(topic); err != nil || *config != (headers.TopicConfig{}) {
+			t.Error(err, config)
+		}
+		if err = q.SetTopicConfig(topic, headers.TopicConfig{RetentionAge: -1}); err != headers.ErrInvalidTopicConfig {
+			t.Error(err)
+		}
+
+		// the config is stored on every volume and hidden from the files
+		expected := headers.TopicConfig{SegmentBytes: 10, MaxMessageSize: 5}
+		if err = q.SetTopicConfig(topic, expected); err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range dirs {
+			if _, err = os.Stat(dir + "/" + topic + "/" + topicConfigName); err != nil {
+				t.Error(err)
+			}
+		}
+		if config, err := q.TopicConfig(topic); err != nil || *config != expected {
+			t.Error(err, config)
+		}
+		if config, err := (&Queue{dirs: dirs}).TopicConfig(topic); err != nil || *config != expected {
+			t.Error(err, config)
+		}
+
+		// segment bytes of the topic roll files
+		for i := 0; i < 3; i++ {
+			if err = q.Produce(topic, []int64{5, 5}, 100, bytes.NewBufferString("hellohello")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if names, err := segmentNames(dirs[1] + "/" + topic); err != nil || len(names) != 3 {
+			t.Error(cache, err, names)
+		}
+		for id := int64(0); id < 6; id++ {
+			w := httptest.NewRecorder()
+			if n, err := q.Consume("", topic, id, 1, w); err != nil || n != 1 {
+				t.Error(cache, id, err, n)
+			}
+		}
+
+		if err = q.DeleteTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = q.TopicConfig(topic); err != headers.ErrTopicDoesNotExist {
+			t.Error(err)
+		}
+		_ = q.Close()
+		for _, dir := range dirs {
+			_ = os.RemoveAll(dir)
+		}
+	}
+}
@@ -6,9 +6,13 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/blockflate"
+	"github.com/haraqa/haraqa/internal/mmap"
 )
 
 const (
@@ -16,17 +20,30 @@ const (
 	metaSize = 24
 )
 
+// File is a segment of a topic. Writers hold mux, readers take a snapshot of numEntries and read the entries
+// before it with positional reads, they never wait on writers or on each other
 type File struct {
 	mux sync.Mutex
 	*os.File
 	extraFiles   []*os.File
+	z            *blockflate.Reader // set instead of File once a closed segment is compressed
 	baseID       int64
 	maxEntries   int64
-	numEntries   int64
+	numEntries   int64 // written atomically once the entries before it are in the file and the meta cache
 	writerOffset int64
-	metaCache    map[int64][metaSize / 8]int64
+	metaCache    [][metaSize / 8]int64 // meta of the entries written since the file was opened
+	cacheStart   int64                 // index of the first entry of the meta cache
 	isClosed     bool
 	used         chan struct{}
+
+	// memory mapped info and meta entries of a closed segment, nil if the segment is read with ReadAt
+	indexMux sync.RWMutex
+	index    []byte
+
+	// roll policy of the topic, the file takes no more messages once it holds maxBytes of data or once its
+	// first message is maxAge older than the messages being written
+	maxBytes int64
+	maxAge   time.Duration
 }
 
 func CreateFile(dirs []string, topic string, baseID int64, maxEntries int64) (*File, error) {
@@ -57,7 +74,7 @@ func CreateFile(dirs []string, topic string, baseID int64, maxEntries int64) (*F
 		maxEntries:   maxEntries,
 		numEntries:   0,
 		writerOffset: writerOffset,
-		metaCache:    make(map[int64][metaSize / 8]int64, maxEntries),
+		metaCache:    make([][metaSize / 8]int64, maxEntries),
 		used:         make(chan struct{}, 1),
 	}
 	var err error
@@ -126,19 +143,23 @@ func OpenFile(dirs []string, topic string, baseID int64) (*File, error) {
 	filename := formatName(baseID)
 	path := dirs[len(dirs)-1] + string(filepath.Separator) + topic + string(filepath.Separator) + filename
 	f.File, err = os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		// closed segments may have been compressed, they are only read from the last directory
+		var zErr error
+		if f.z, zErr = blockflate.Open(path + blockflate.Ext); zErr == nil {
+			if err = f.readInfo(f.z); err != nil {
+				return nil, err
+			}
+			return f, nil
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
-	var info [infoSize]byte
-	if _, err := f.File.ReadAt(info[:], 0); err != nil {
+	if err := f.readInfo(f.File); err != nil {
 		return nil, err
 	}
-	f.baseID = int64(binary.LittleEndian.Uint64((info)[0:8]))
-	f.maxEntries = int64(binary.LittleEndian.Uint64((info)[8:16]))
-	f.numEntries = int64(binary.LittleEndian.Uint64((info)[16:24]))
-	f.writerOffset = int64(binary.LittleEndian.Uint64((info)[24:32]))
 
-	f.metaCache = make(map[int64][metaSize / 8]int64, f.maxEntries)
 	for i, dir := range dirs[:len(dirs)-1] {
 		path := dir + string(filepath.Separator) + topic + string(filepath.Separator) + filename
 		f.extraFiles[i], err = os.OpenFile(path, os.O_RDWR, 0)
@@ -150,13 +171,102 @@ func OpenFile(dirs []string, topic string, baseID int64) (*File, error) {
 	return f, nil
 }
 
+// readInfo reads the file info and resets the meta cache
+func (f *File) readInfo(r io.ReaderAt) error {
+	var info [infoSize]byte
+	if _, err := r.ReadAt(info[:], 0); err != nil {
+		return err
+	}
+	f.baseID = int64(binary.LittleEndian.Uint64((info)[0:8]))
+	f.maxEntries = int64(binary.LittleEndian.Uint64((info)[8:16]))
+	f.numEntries = int64(binary.LittleEndian.Uint64((info)[16:24]))
+	f.writerOffset = int64(binary.LittleEndian.Uint64((info)[24:32]))
+
+	f.cacheStart = f.numEntries
+	if f.z == nil && f.maxEntries > f.numEntries {
+		f.metaCache = make([][metaSize / 8]int64, f.maxEntries-f.numEntries)
+	}
+	return nil
+}
+
+// cachedMeta returns the meta of the entry at index i if it was written since the file was opened.
+// The index must be below a snapshot of numEntries
+func (f *File) cachedMeta(i int64) ([metaSize / 8]int64, bool) {
+	i -= f.cacheStart
+	if i < 0 || i >= int64(len(f.metaCache)) {
+		return [metaSize / 8]int64{}, false
+	}
+	return f.metaCache[i], true
+}
+
+// entries returns a snapshot of the number of entries, safe to call without holding the lock
+func (f *File) entries() int64 {
+	return atomic.LoadInt64(&f.numEntries)
+}
+
+// readerAt returns the reader of the file contents, decompressing them if the file was compressed
+func (f *File) readerAt() io.ReaderAt {
+	if f.z != nil {
+		return f.z
+	}
+	return f.File
+}
+
+// mapIndex memory maps the info and meta entries of a closed segment, so reading the meta of its messages
+// needs no system calls. The file keeps being read with ReadAt if mapping fails or is unsupported
+func (f *File) mapIndex() {
+	if f.File == nil || f.z != nil {
+		return
+	}
+	size := infoSize + f.maxEntries*metaSize
+	if stat, err := f.File.Stat(); err != nil || stat.Size() < size {
+		return
+	}
+	b, err := mmap.Map(f.File, size)
+	if err != nil {
+		return
+	}
+	f.indexMux.Lock()
+	f.index = b
+	f.indexMux.Unlock()
+}
+
+// readMappedMeta fills entries with the meta of the entries starting at index id from the memory mapped
+// index, it reports false if the index is not mapped
+func (f *File) readMappedMeta(entries [][metaSize / 8]int64, id int64) bool {
+	f.indexMux.RLock()
+	defer f.indexMux.RUnlock()
+	start := infoSize + id*metaSize
+	if f.index == nil || start+int64(len(entries))*metaSize > int64(len(f.index)) {
+		return false
+	}
+	for i := range entries {
+		off := start + int64(i)*metaSize
+		entries[i] = [metaSize / 8]int64{
+			int64(binary.LittleEndian.Uint64(f.index[off : off+8])),
+			int64(binary.LittleEndian.Uint64(f.index[off+8 : off+16])),
+			int64(binary.LittleEndian.Uint64(f.index[off+16 : off+24])),
+		}
+	}
+	return true
+}
+
 func (f *File) Close() error {
 	f.mux.Lock()
 	defer f.mux.Unlock()
-	errs := make([]error, 0, 1+len(f.extraFiles))
+	f.indexMux.Lock()
+	defer f.indexMux.Unlock()
+	errs := make([]error, 0, 2+len(f.extraFiles))
+	if f.index != nil {
+		errs = append(errs, mmap.Unmap(f.index))
+		f.index = nil
+	}
 	if f.File != nil {
 		errs = append(errs, f.File.Close())
 	}
+	if f.z != nil {
+		errs = append(errs, f.z.Close())
+	}
 	for i := range f.extraFiles {
 		if f.extraFiles[i] != nil {
 			errs = append(errs, f.extraFiles[i].Close())
@@ -174,14 +284,33 @@ func (f *File) Close() error {
 	return nil
 }
 
+// Sync commits the file to stable storage in every directory
+func (f *File) Sync() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.isClosed {
+		return ErrFileClosed
+	}
+	for i := range f.extraFiles {
+		if err := f.extraFiles[i].Sync(); err != nil {
+			return err
+		}
+	}
+	return f.File.Sync()
+}
+
 type Meta struct {
+	startID            int64
 	sizes              []int64
+	checksums          []int64 // -1 if the message was written without a checksum
+	framed             []bool
+	compacted          []bool
 	startAt, endAt     int64
 	startTime, endTime time.Time
 }
 
 func (f *File) ReadMeta(id int64, limit int64) (Meta, error) {
-	if f == nil || f.File == nil {
+	if f == nil || f.File == nil && f.z == nil {
 		return Meta{}, errors.New("file not opened")
 	}
 	// mark as used
@@ -194,79 +323,107 @@ func (f *File) ReadMeta(id int64, limit int64) (Meta, error) {
 	if id < 0 {
 		return Meta{}, errors.New("invalid id")
 	}
-	if id > f.numEntries {
+	numEntries := f.entries()
+	if id > numEntries {
 		return Meta{}, nil
 	}
-	if limit > f.numEntries-id || limit <= 0 {
-		limit = f.numEntries - id
-	}
-
-	output := Meta{
-		sizes: make([]int64, limit),
+	if limit > numEntries-id || limit <= 0 {
+		limit = numEntries - id
 	}
 
+	entries := make([][metaSize / 8]int64, limit)
 	bufOK := true
 	for i := int64(0); i < limit; i++ {
-		meta, ok := f.metaCache[i+id]
+		meta, ok := f.cachedMeta(i + id)
 		if !ok {
 			bufOK = false
 			break
 		}
-		output.sizes[i] = meta[1]
-		switch i {
-		case 0:
-			output.startAt = meta[0]
-			output.startTime = time.Unix(meta[2], 0)
-			if limit == 1 {
-				output.endAt = meta[0] + meta[1]
-				output.endTime = time.Unix(meta[2], 0)
+		entries[i] = meta
+	}
+	if !bufOK && !f.readMappedMeta(entries, id) {
+		buf := make([]byte, metaSize*limit)
+		// TODO: check amount read
+		_, err := f.readerAt().ReadAt(buf[:], infoSize+id*metaSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return Meta{}, err
+		}
+		for i := range entries {
+			off := i * metaSize
+			entries[i] = [metaSize / 8]int64{
+				int64(binary.LittleEndian.Uint64(buf[off : off+8])),
+				int64(binary.LittleEndian.Uint64(buf[off+8 : off+16])),
+				int64(binary.LittleEndian.Uint64(buf[off+16 : off+24])),
 			}
-		case limit - 1:
-			output.endAt = meta[0] + meta[1]
-			output.endTime = time.Unix(meta[2], 0)
 		}
 	}
-	if bufOK {
-		return output, nil
+
+	output := Meta{
+		startID:   id,
+		sizes:     make([]int64, limit),
+		checksums: make([]int64, limit),
+		framed:    make([]bool, limit),
+		compacted: make([]bool, limit),
+	}
+	for i, meta := range entries {
+		size, crc := decodeSize(meta[1])
+		timestamp, flags := decodeTimestamp(meta[2])
+		output.sizes[i] = size
+		output.checksums[i] = -1
+		if flags&flagChecksum != 0 {
+			output.checksums[i] = int64(crc)
+		}
+		output.framed[i] = flags&flagFramed != 0
+		output.compacted[i] = flags&flagCompacted != 0
+		if i == 0 {
+			output.startAt = meta[0]
+			output.startTime = time.Unix(timestamp, 0)
+		}
+		if i == len(entries)-1 {
+			output.endAt = meta[0] + size
+			output.endTime = time.Unix(timestamp, 0)
+		}
 	}
 
-	buf := make([]byte, metaSize*limit)
-	// TODO: check amount read
-	_, err := f.File.ReadAt(buf[:], infoSize+id*metaSize)
-	if err != nil && !errors.Is(err, io.EOF) {
-		return Meta{}, err
+	return output, nil
+}
+
+// readMessages returns the meta and the verified messages of up to limit entries starting at id. The messages
+// are read at their offsets without locking the file, an error matching os.ErrClosed is returned if the file was
+// closed concurrently
+func (f *File) readMessages(id int64, limit int64) (Meta, []byte, error) {
+	meta, err := f.ReadMeta(id, limit)
+	if err != nil || len(meta.sizes) == 0 {
+		return meta, nil, err
 	}
-	output.startAt = int64(binary.LittleEndian.Uint64(buf[:8]))
-	output.startTime = time.Unix(int64(binary.LittleEndian.Uint64(buf[16:24])), 0)
-	var off int
-	for i := 0; i < len(output.sizes); i++ {
-		output.sizes[i] = int64(binary.LittleEndian.Uint64(buf[off+8 : off+16]))
-		off += metaSize
+	buf := make([]byte, meta.endAt-meta.startAt)
+	if _, err = f.readerAt().ReadAt(buf, meta.startAt); err != nil {
+		return Meta{}, nil, err
 	}
-	off -= metaSize
-	if off == 0 {
-		output.endAt = output.startAt
-		output.endTime = output.startTime
-	} else {
-		output.endAt = int64(binary.LittleEndian.Uint64(buf[off:off+8])) + output.sizes[len(output.sizes)-1]
-		output.endTime = time.Unix(int64(binary.LittleEndian.Uint64(buf[off+16:off+24])), 0)
+	if err = f.verify(buf, meta); err != nil {
+		return Meta{}, nil, err
 	}
-
-	return output, nil
+	return meta, buf, nil
 }
 
 var ErrFileClosed = errors.New("file closed")
 
 func (f *File) WriteMessages(timestamp uint64, sizes []int64, r io.Reader) (int, error) {
+	n, _, err := f.writeMessages(timestamp, sizes, r)
+	return n, err
+}
+
+// writeMessages writes as many of the messages as the file takes, returning their number and the id of the first
+func (f *File) writeMessages(timestamp uint64, sizes []int64, r io.Reader) (int, int64, error) {
 	// get producer lock
 	f.mux.Lock()
 	defer f.mux.Unlock()
 	if f.isClosed {
-		return 0, ErrFileClosed
+		return 0, 0, ErrFileClosed
 	}
 
-	if f.numEntries == f.maxEntries {
-		return 0, nil
+	if full, err := f.full(timestamp & timestampMask); err != nil || full {
+		return 0, 0, err
 	}
 
 	// mark as used
@@ -280,66 +437,108 @@ func (f *File) WriteMessages(timestamp uint64, sizes []int64, r io.Reader) (int,
 		quantity = f.maxEntries - f.numEntries
 	}
 
-	cache := make(map[int64][metaSize / 8]int64, quantity)
-
-	var metaOff, off int64
-	var now [8]byte
-	binary.LittleEndian.PutUint64(now[:], timestamp)
-	metaBuf := make([]byte, quantity*metaSize)
+	var off int64
 	for i := range sizes[:quantity] {
-		cache[f.numEntries+int64(i)] = [metaSize / 8]int64{
-			f.writerOffset + off,
-			sizes[i],
-			int64(timestamp),
-		}
-		binary.LittleEndian.PutUint64(metaBuf[metaOff:metaOff+8], uint64(f.writerOffset+off))
-		binary.LittleEndian.PutUint64(metaBuf[metaOff+8:metaOff+16], uint64(sizes[i]))
-		copy(metaBuf[metaOff+16:metaOff+24], now[:])
-		metaOff += metaSize
 		off += sizes[i]
 	}
-	var info [16]byte
-	binary.LittleEndian.PutUint64(info[:8], uint64(f.numEntries+quantity))
-	binary.LittleEndian.PutUint64(info[8:16], uint64(f.writerOffset+off))
 
 	var err error
 	files := append(f.extraFiles, f.File)
 	buf := bufPool.Get().([]byte)
 	defer bufPool.Put(buf)
 
+	// checksum each message as it is read
+	cs := &checksummer{sizes: sizes[:quantity], crcs: make([]uint32, quantity)}
+	tee := io.TeeReader(r, cs)
+
 	remaining := off
 	for remaining > 0 {
 		if remaining < int64(len(buf)) {
 			buf = buf[:remaining]
 		}
 
-		if n, err := io.ReadFull(r, buf); err != nil {
-			return 0, errors.Wrapf(err, "read %d bytes out of %d", n, remaining)
+		if n, err := io.ReadFull(tee, buf); err != nil {
+			return 0, 0, errors.Wrapf(err, "read %d bytes out of %d", n, remaining)
 		}
 
 		for i := range files {
 			// write data
 			if _, err = files[i].WriteAt(buf, f.writerOffset+off-remaining); err != nil {
-				return 0, err
+				return 0, 0, err
 			}
 		}
 		remaining -= int64(len(buf))
 	}
 
-	for i := range files {
-		if err = writeFileMeta(files[i], metaBuf, info, f.numEntries); err != nil {
-			return 0, err
+	var metaOff, msgOff int64
+	ts := int64(timestamp&(timestampMask|flagFramed) | flagChecksum)
+	metaBuf := make([]byte, quantity*metaSize)
+	for i := range sizes[:quantity] {
+		meta := [metaSize / 8]int64{
+			f.writerOffset + msgOff,
+			encodeSize(sizes[i], cs.crcs[i]),
+			ts,
+		}
+		if int64(i) == quantity-1 {
+			meta[2] |= flagBatchEnd
 		}
+		f.metaCache[f.numEntries+int64(i)-f.cacheStart] = meta
+		binary.LittleEndian.PutUint64(metaBuf[metaOff:metaOff+8], uint64(meta[0]))
+		binary.LittleEndian.PutUint64(metaBuf[metaOff+8:metaOff+16], uint64(meta[1]))
+		binary.LittleEndian.PutUint64(metaBuf[metaOff+16:metaOff+24], uint64(meta[2]))
+		metaOff += metaSize
+		msgOff += sizes[i]
 	}
+	var info [16]byte
+	binary.LittleEndian.PutUint64(info[:8], uint64(f.numEntries+quantity))
+	binary.LittleEndian.PutUint64(info[8:16], uint64(f.writerOffset+off))
 
-	for k, v := range cache {
-		f.metaCache[k] = v
+	for i := range files {
+		if err = writeFileMeta(files[i], metaBuf, info, f.numEntries); err != nil {
+			return 0, 0, err
+		}
 	}
 
-	f.numEntries += quantity
+	// publish the entries to readers
+	firstID := f.baseID + f.numEntries
+	atomic.StoreInt64(&f.numEntries, f.numEntries+quantity)
 	f.writerOffset += off
 
-	return int(quantity), nil
+	return int(quantity), firstID, nil
+}
+
+// setRollPolicy sets when the file takes no more messages, in addition to the max number of entries
+func (f *File) setRollPolicy(maxBytes int64, maxAge time.Duration) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.maxBytes = maxBytes
+	f.maxAge = maxAge
+}
+
+// full reports if the file takes no more messages written at timestamp. A file is full once it holds
+// the max number of entries, or once it exceeds the max size or age of the roll policy
+func (f *File) full(timestamp uint64) (bool, error) {
+	switch {
+	case f.numEntries >= f.maxEntries:
+		return true, nil
+	case f.numEntries == 0:
+		return false, nil
+	case f.maxBytes > 0 && f.writerOffset-(infoSize+f.maxEntries*metaSize) >= f.maxBytes:
+		return true, nil
+	case f.maxAge <= 0:
+		return false, nil
+	}
+
+	meta, ok := f.cachedMeta(0)
+	if !ok {
+		var buf [metaSize]byte
+		if _, err := f.readerAt().ReadAt(buf[:], infoSize); err != nil {
+			return false, err
+		}
+		meta[2] = int64(binary.LittleEndian.Uint64(buf[16:24]))
+	}
+	first, _ := decodeTimestamp(meta[2])
+	return timestamp > uint64(first) && time.Duration(timestamp-uint64(first))*time.Second >= f.maxAge, nil
 }
 
 var bufPool = sync.Pool{
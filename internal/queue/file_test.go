@@ -3,6 +3,9 @@ package queue
 import (
 	"bytes"
 	"crypto/rand"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
 
 	"github.com/pkg/errors"
@@ -126,3 +129,53 @@ func (ws *mockWS) Seek(offset int64, whence int) (int64, error) {
 		return 0, errors.New("missing seek response")
 	}
 }
+
+func TestQueue_MappedIndex(t *testing.T) {
+	dirName, err := os.MkdirTemp("", ".haraqa*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirName)
+	q, err := NewQueue([]string{dirName}, true, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	const topic = "topic"
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	msgs := []string{"a", "bb", "ccc", "dddd"}
+	for _, msg := range msgs {
+		if err = q.Produce(topic, []int64{int64(len(msg))}, 100, bytes.NewBufferString(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// drop the cached files so consumers open them
+	for _, name := range []string{formatName(0), formatName(3)} {
+		q.dropCachedFile(filepath.Join(dirName, topic, name))
+	}
+
+	// the closed file is mapped, the latest is not
+	t.Run("consume closed", testConsume(q, "", topic, 1, -1, msgs[1:3]))
+	t.Run("consume latest", testConsume(q, "", topic, 3, -1, msgs[3:]))
+	for name, mapped := range map[string]bool{formatName(0): runtime.GOOS == "linux", formatName(3): false} {
+		v, ok := q.fileCache.Load(filepath.Join(dirName, topic, name))
+		if !ok {
+			t.Fatal("missing cached file", name)
+		}
+		f := v.(*File)
+		if (f.index != nil) != mapped {
+			t.Error(name, f.index)
+		}
+		if err = f.Close(); err != nil {
+			t.Error(err)
+		}
+		if f.index != nil {
+			t.Error("expected the index to be unmapped")
+		}
+	}
+
+	// closed files fall back to reading a fresh copy
+	t.Run("consume unmapped", testConsume(q, "", topic, 0, -1, msgs[:3]))
+}
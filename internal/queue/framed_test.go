@@ -0,0 +1,66 @@
+package queue
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestQueue_Framed(t *testing.T) {
+	dirName, err := os.MkdirTemp("", ".haraqa*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirName)
+	const topic = "topic"
+	q, err := NewQueue([]string{dirName}, true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Produce(topic, []int64{5}, uint64(time.Now().Unix()), bytes.NewBufferString("plain")); err != nil {
+		t.Fatal(err)
+	}
+	frame := headers.AppendFrame(nil, []byte("key"), map[string]string{"trace-id": "abc"}, []byte("framed"))
+	if err = q.ProduceFramed(topic, []int64{int64(len(frame))}, uint64(time.Now().Unix()), bytes.NewBuffer(frame)); err != nil {
+		t.Fatal(err)
+	}
+
+	// consumers without framing only receive the message bodies
+	w := httptest.NewRecorder()
+	n, err := q.Consume("", topic, 0, -1, w)
+	if err != nil || n != 2 {
+		t.Fatal(err, n)
+	}
+	sizes, err := headers.ReadSizes(w.Header())
+	if err != nil || !reflect.DeepEqual(sizes, []int64{5, 6}) {
+		t.Error(err, sizes)
+	}
+	if b, _ := io.ReadAll(w.Body); string(b) != "plainframed" || w.Header().Get(headers.HeaderFramed) != "" {
+		t.Error(string(b), w.Header())
+	}
+
+	// framed consumers receive every message framed
+	w = httptest.NewRecorder()
+	n, err = q.ConsumeFramed("", topic, 0, -1, w)
+	if err != nil || n != 2 {
+		t.Fatal(err, n)
+	}
+	expected := append(headers.AppendFrame(nil, nil, nil, []byte("plain")), frame...)
+	sizes, err = headers.ReadSizes(w.Header())
+	if err != nil || !reflect.DeepEqual(sizes, []int64{7, int64(len(frame))}) {
+		t.Error(err, sizes)
+	}
+	if b, _ := io.ReadAll(w.Body); !bytes.Equal(b, expected) || w.Header().Get(headers.HeaderFramed) != "true" {
+		t.Error(b, w.Header())
+	}
+}
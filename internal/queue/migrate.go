@@ -0,0 +1,123 @@
+package queue
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// ExportSegments calls fn with the base id and the entries of every file of a topic, in order
+func (q *Queue) ExportSegments(topic string, fn func(baseID int64, entries []headers.Entry) error) error {
+	dir := q.RootDir() + string(filepath.Separator) + topic
+
+	// hold off compaction and compression from replacing files while they are read
+	lock := q.segmentLock(topic)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	names, err := segmentNames(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return headers.ErrTopicDoesNotExist
+		}
+		return err
+	}
+	for _, name := range names {
+		if _, err = strconv.ParseInt(name, 10, 64); err != nil {
+			continue
+		}
+		buf, err := readSegment(dir + string(filepath.Separator) + name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read file %q of topic %q", name, topic)
+		}
+		if len(buf) < infoSize {
+			return errors.Errorf("invalid file %q of topic %q", name, topic)
+		}
+		baseID, numEntries := segmentInfo(buf)
+		if int64(len(buf)) < infoSize+numEntries*metaSize {
+			return errors.Errorf("invalid file %q of topic %q", name, topic)
+		}
+		entries := make([]headers.Entry, numEntries)
+		for i := range entries {
+			meta := buf[infoSize+int64(i)*metaSize:]
+			off := int64(binary.LittleEndian.Uint64(meta[:8]))
+			entries[i] = headers.Entry{
+				ID:        baseID + int64(i),
+				Size:      binary.LittleEndian.Uint64(meta[8:16]),
+				Timestamp: binary.LittleEndian.Uint64(meta[16:24]),
+			}
+			size, _ := decodeSize(int64(entries[i].Size))
+			if off+size > int64(len(buf)) {
+				return errors.Errorf("invalid entry %d of file %q of topic %q", entries[i].ID, name, topic)
+			}
+			entries[i].Data = append([]byte(nil), buf[off:off+size]...)
+		}
+		if err = fn(baseID, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportSegment writes a file holding the given entries to every directory. The ids of the entries must follow
+// the base id, timestamps, flags and checksums are kept as is. The file has room for the max entries of the queue,
+// or for the given entries if there are more. The topic must exist and not hold the file yet
+func (q *Queue) ImportSegment(topic string, baseID int64, entries []headers.Entry) error {
+	numEntries := int64(len(entries))
+	maxEntries := q.maxEntries
+	if numEntries > maxEntries {
+		maxEntries = numEntries
+	}
+
+	// info, meta entries then the messages
+	writerOffset := infoSize + maxEntries*metaSize
+	buf := make([]byte, writerOffset)
+	binary.LittleEndian.PutUint64(buf[:8], uint64(baseID))
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(maxEntries))
+	binary.LittleEndian.PutUint64(buf[16:24], uint64(numEntries))
+	binary.LittleEndian.PutUint64(buf[32:40], uint64(time.Now().UTC().Unix()))
+	for i, entry := range entries {
+		if entry.ID != baseID+int64(i) {
+			return errors.Errorf("invalid id %d of entry %d in file %d", entry.ID, i, baseID)
+		}
+		size, _ := decodeSize(int64(entry.Size))
+		if size != int64(len(entry.Data)) {
+			return errors.Errorf("invalid size of entry %d: %d bytes but %d are given", entry.ID, size, len(entry.Data))
+		}
+		meta := buf[infoSize+int64(i)*metaSize:]
+		binary.LittleEndian.PutUint64(meta[:8], uint64(len(buf)))
+		binary.LittleEndian.PutUint64(meta[8:16], entry.Size)
+		binary.LittleEndian.PutUint64(meta[16:24], entry.Timestamp)
+		buf = append(buf, entry.Data...)
+	}
+	binary.LittleEndian.PutUint64(buf[24:32], uint64(len(buf)))
+
+	name := formatName(baseID)
+	for _, dir := range q.dirs {
+		path := dir + string(filepath.Separator) + topic + string(filepath.Separator) + name
+		if _, err := os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+			return headers.ErrTopicDoesNotExist
+		}
+		if segmentExists(path) {
+			return errors.Errorf("file %q of topic %q already exists", name, topic)
+		}
+		tmp := filepath.Dir(path) + string(filepath.Separator) + ".import-" + name
+		if err := writeSynced(tmp, buf); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+	}
+
+	if q.baseIDCache != nil {
+		q.baseIDCache.Delete(topic)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package queue
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// producerStatesName is the name of the hidden file in a topic directory used to store the windows of idempotent producers
+const producerStatesName = ".producers"
+
+// SetProducerStates stores the windows of the idempotent producers of a topic on every volume,
+// replacing any previous windows
+func (q *Queue) SetProducerStates(topic string, states map[string]headers.ProducerState) error {
+	b, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	for _, dir := range q.dirs {
+		path := dir + string(filepath.Separator) + topic + string(filepath.Separator) + producerStatesName
+		if _, err = os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+			return headers.ErrTopicDoesNotExist
+		}
+		if err = writeSynced(path+".tmp", b); err != nil {
+			return err
+		}
+		if err = os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProducerStates returns the windows of the idempotent producers of a topic, keyed by producer id.
+// A topic without stored windows returns an empty map
+func (q *Queue) ProducerStates(topic string) (map[string]headers.ProducerState, error) {
+	// read from the last volume first, falling back to the other volumes
+	states := make(map[string]headers.ProducerState)
+	var err error
+	for i := len(q.dirs) - 1; i >= 0; i-- {
+		var b []byte
+		if b, err = os.ReadFile(q.dirs[i] + string(filepath.Separator) + topic + string(filepath.Separator) + producerStatesName); err != nil {
+			continue
+		}
+		if err = json.Unmarshal(b, &states); err == nil {
+			break
+		}
+	}
+	if os.IsNotExist(err) {
+		if _, statErr := os.Stat(q.RootDir() + string(filepath.Separator) + topic); os.IsNotExist(statErr) {
+			return nil, headers.ErrTopicDoesNotExist
+		}
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return states, nil
+}
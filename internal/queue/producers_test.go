@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestQueue_ProducerStates(t *testing.T) {
+	dirs := make([]string, 2)
+	for i := range dirs {
+		var err error
+		if dirs[i], err = os.MkdirTemp("", ".haraqa*"); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dirs[i])
+	}
+	q, err := NewQueue(dirs, false, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	const topic = "producers-topic"
+	if _, err = q.ProducerStates(topic); err != headers.ErrTopicDoesNotExist {
+		t.Error(err)
+	}
+	if err = q.SetProducerStates(topic, nil); err != headers.ErrTopicDoesNotExist {
+		t.Error(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if states, err := q.ProducerStates(topic); err != nil || len(states) != 0 {
+		t.Error(states, err)
+	}
+
+	// the windows are stored on every volume
+	expected := map[string]headers.ProducerState{
+		"p1": {Sequence: 3, Updated: time.Unix(100, 0).UTC(), Batches: []headers.ProducedBatch{
+			{Sequence: 3, Info: &headers.ProduceInfo{FirstID: 5, LastID: 6}},
+		}},
+	}
+	if err = q.SetProducerStates(topic, expected); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		if _, err = os.Stat(dir + "/" + topic + "/" + producerStatesName); err != nil {
+			t.Error(err)
+		}
+	}
+	if states, err := (&Queue{dirs: dirs}).ProducerStates(topic); err != nil || !reflect.DeepEqual(states, expected) {
+		t.Error(states, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -14,9 +15,22 @@ type Queue struct {
 	fileCache   *sync.Map
 	groupCache  *sync.Map
 	baseIDCache *sync.Map
+	configCache *sync.Map
 	maxEntries  int64
+	syncOnWrite bool
+	dirty       *sync.Map
+	maxBytes    int64
+	maxAge      time.Duration
+
+	// segmentLocks guards the segments of each topic from being replaced by compaction while they are read
+	segmentLocks sync.Map
+	rewriteLocks sync.Map
+	produceLocks sync.Map
+	transactions sync.Map // first id of the transaction being written by topic
 }
 
+// NewQueue creates a new Queue. The directories are not checked or resynced, call Recover before producing or
+// consuming to repair torn writes and bring diverged directories back in sync, as the server does on startup
 func NewQueue(dirs []string, cache bool, maxEntriesPerFile int64) (*Queue, error) {
 	if len(dirs) == 0 {
 		return nil, errors.New("missing directories")
@@ -29,6 +43,7 @@ func NewQueue(dirs []string, cache bool, maxEntriesPerFile int64) (*Queue, error
 		q.fileCache = &sync.Map{}
 		q.groupCache = &sync.Map{}
 		q.baseIDCache = &sync.Map{}
+		q.configCache = &sync.Map{}
 	}
 	for _, dir := range q.dirs {
 		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
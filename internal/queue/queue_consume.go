@@ -1,21 +1,59 @@
 package queue
 
 import (
-	"io"
+	"encoding/binary"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/blockflate"
 	"github.com/haraqa/haraqa/internal/headers"
 )
 
+// Consume writes messages of the topic to w. Only the body of framed messages is written
 func (q *Queue) Consume(group, topic string, id int64, limit int64, w http.ResponseWriter) (int, error) {
+	return q.consume(group, topic, id, limit, w, false)
+}
+
+// ConsumeFramed writes messages of the topic to w, every message is written framed with its key and headers
+func (q *Queue) ConsumeFramed(group, topic string, id int64, limit int64, w http.ResponseWriter) (int, error) {
+	return q.consume(group, topic, id, limit, w, true)
+}
+
+func (q *Queue) consume(group, topic string, id int64, limit int64, w http.ResponseWriter, framed bool) (int, error) {
 	id = q.getGroupOffsetID(group, topic, id)
+
+	lock := q.segmentLock(topic)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	for {
+		var visible bool
+		if limit, visible = q.visibleRange(topic, id, limit); !visible {
+			return 0, nil
+		}
+		n, nextID, err := q.consumeSegment(topic, id, limit, w, framed)
+		if err != nil || n > 0 || nextID <= id {
+			return n, err
+		}
+
+		// every message read was removed by compaction, continue after them
+		id = nextID
+	}
+}
+
+// consumeSegment writes the messages from a single segment file to w, skipping any removed by compaction.
+// Nothing is written if every message was removed. The id following the last message read is returned
+func (q *Queue) consumeSegment(topic string, id int64, limit int64, w http.ResponseWriter, framed bool) (int, int64, error) {
 	filename, baseID, err := q.getBaseID(topic, id)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 	path := q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + filename
 	var f *File
@@ -29,64 +67,79 @@ func (q *Queue) Consume(group, topic string, id int64, limit int64, w http.Respo
 	if f == nil {
 		f, err = OpenFile(q.dirs, topic, baseID)
 		if err != nil {
-			return 0, err
+			return 0, 0, err
 		}
 		if q.fileCache == nil {
 			defer f.Close()
 		} else {
+			// files before the latest are no longer written, their index is read from memory while cached
+			if latest, err := q.getLatestBaseID(topic); err == nil && latest > baseID {
+				f.mapIndex()
+			}
 			q.fileCache.Store(path, f)
 		}
 	}
 
-	meta, err := f.ReadMeta(id, limit)
+	meta, buf, err := f.readMessages(id, limit)
+	if errors.Is(err, os.ErrClosed) {
+		// the cached file was closed by a cache clear, compression or compaction, read from a fresh copy
+		tmp, openErr := OpenFile(q.dirs, topic, baseID)
+		if openErr != nil {
+			return 0, 0, openErr
+		}
+		defer tmp.Close()
+		meta, buf, err = tmp.readMessages(id, limit)
+	}
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 	if len(meta.sizes) == 0 {
-		return 0, nil
+		return 0, id, nil
+	}
+	nextID := id + int64(len(meta.sizes))
+
+	// compacted messages hold no data, only the remaining messages are sent
+	sizes := make([]int64, 0, len(meta.sizes))
+	stored := make([]bool, 0, len(meta.sizes))
+	for i := range meta.sizes {
+		if !meta.compacted[i] {
+			sizes = append(sizes, meta.sizes[i])
+			stored = append(stored, meta.framed[i])
+		}
+	}
+	if len(sizes) == 0 {
+		return 0, nextID, nil
+	}
+	if buf, err = headers.ConvertFrames(buf, sizes, stored, framed); err != nil {
+		return 0, 0, err
 	}
 
 	wHeader := w.Header()
 	wHeader[headers.HeaderFileName] = []string{topic + "/" + filename}
 	wHeader[headers.ContentType] = []string{"application/octet-stream"}
-	headers.SetSizes(meta.sizes, wHeader)
+	headers.SetSizes(sizes, wHeader)
+	wHeader[headers.HeaderNextID] = []string{strconv.FormatInt(nextID, 10)}
+	if framed {
+		wHeader[headers.HeaderFramed] = []string{"true"}
+	}
 
 	// TODO: evaluate if we need timestamps in response message
 	//wHeader[headers.HeaderStartTime] = []string{meta.startTime.Format(time.ANSIC)}
 	//wHeader[headers.HeaderEndTime] = []string{meta.endTime.Format(time.ANSIC)}
 	//wHeader[headers.LastModified] = []string{meta.endTime.UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT")}
 
-	var rs io.ReadSeeker = f
-	if q.fileCache != nil {
-		// lock for the seek operation
-		f.mux.Lock()
-		defer f.mux.Unlock()
-		if f.isClosed {
-			tmp, err := os.Open(path)
-			if err != nil {
-				return 0, err
-			}
-			defer tmp.Close()
-			rs = tmp
-		}
-	}
-	_, err = rs.Seek(meta.startAt, io.SeekStart)
-	if err != nil {
-		return 0, err
-	}
-	if _, err = io.CopyN(w, rs, meta.endAt-meta.startAt); err != nil {
-		return 0, err
+	if _, err = w.Write(buf); err != nil {
+		return 0, 0, err
 	}
 
 	//http.ServeContent(w, req, path, meta.endTime, f)
-	return len(meta.sizes), nil
+	return len(sizes), nextID, nil
 }
 
 func (q *Queue) getBaseID(topic string, id int64) (string, int64, error) {
 	checkID := id - id%q.maxEntries
 	filename := formatName(checkID)
-	_, err := os.Stat(q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + filename)
-	if err == nil {
+	if q.holdsID(topic, checkID, id) {
 		return filename, checkID, nil
 	}
 	dir, err := os.Open(q.RootDir() + string(filepath.Separator) + topic)
@@ -98,12 +151,14 @@ func (q *Queue) getBaseID(topic string, id int64) (string, int64, error) {
 	if err != nil {
 		return "", 0, err
 	}
+	names = removeHidden(names)
 	if len(names) == 0 {
 		return formatName(0), 0, err
 	}
 	sort.Strings(names)
 	baseID := int64(0)
 	for _, name := range names {
+		name = strings.TrimSuffix(name, blockflate.Ext)
 		parsed, err := strconv.ParseInt(name, 10, 64)
 		if err != nil {
 			continue
@@ -151,25 +206,148 @@ func (q *Queue) getBaseID(topic string, id int64) (string, int64, error) {
 }
 */
 
+// holdsID reports if the file of a topic starting at baseID holds id, or is the latest file of the topic.
+// Files which rolled by size or age, or were imported, may hold fewer than the max entries
+func (q *Queue) holdsID(topic string, baseID, id int64) bool {
+	path := q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + formatName(baseID)
+	var numEntries int64
+	var cached interface{}
+	if q.fileCache != nil {
+		cached, _ = q.fileCache.Load(path)
+	}
+	if f, ok := cached.(*File); ok {
+		numEntries = f.entries()
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return false
+		}
+		var info [infoSize]byte
+		_, err = f.ReadAt(info[:], 0)
+		_ = f.Close()
+		if err != nil {
+			return false
+		}
+		_, numEntries = segmentInfo(info[:])
+	}
+	if id < baseID+numEntries {
+		return true
+	}
+	latest, err := q.getLatestBaseID(topic)
+	return err == nil && latest == baseID
+}
+
+// groupKey is the key of a cached consumer group offset
+type groupKey struct {
+	group, topic string
+}
+
+// dropGroupOffsets removes the cached offsets of every consumer group of the topic
+func (q *Queue) dropGroupOffsets(topic string) {
+	if q.groupCache == nil {
+		return
+	}
+	q.groupCache.Range(func(key, _ interface{}) bool {
+		if k, ok := key.(groupKey); ok && k.topic == topic {
+			q.groupCache.Delete(key)
+		}
+		return true
+	})
+}
+
 func (q *Queue) getGroupOffsetID(group, topic string, id int64) int64 {
 	if group == "" || id > 0 {
 		return id
 	}
-	// TODO: LOOKUP consumer group offset
 	if q.groupCache != nil {
-		v, found := q.groupCache.Load(group + ":" + topic)
+		v, found := q.groupCache.Load(groupKey{group, topic})
 		if cachedID, ok := v.(int64); found && ok {
 			return cachedID
 		}
 	}
 
+	// read from the last directory first, falling back to the other directories
+	name := consumerOffsetName(group)
+	for i := len(q.dirs) - 1; i >= 0; i-- {
+		stored, err := readConsumerOffset(q.dirs[i] + string(filepath.Separator) + topic + string(filepath.Separator) + name)
+		if err != nil {
+			continue
+		}
+		if q.groupCache != nil {
+			q.groupCache.Store(groupKey{group, topic}, stored)
+		}
+		return stored
+	}
 	return id
 }
 
 func (q *Queue) SetConsumerOffset(group, topic string, id int64) error {
-	// TODO: set consumer offset
+	if group == "" {
+		return nil
+	}
+	if id < 0 {
+		return headers.ErrInvalidMessageID
+	}
+
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(id))
+	name := consumerOffsetName(group)
+	for _, dir := range q.dirs {
+		if err := writeConsumerOffset(dir+string(filepath.Separator)+topic+string(filepath.Separator)+name, buf); err != nil {
+			if os.IsNotExist(err) {
+				return headers.ErrTopicDoesNotExist
+			}
+			return err
+		}
+	}
+
 	if q.groupCache != nil {
-		q.groupCache.Store(group+":"+topic, id)
+		q.groupCache.Store(groupKey{group, topic}, id)
 	}
 	return nil
 }
+
+func readConsumerOffset(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var buf [8]byte
+	if _, err = f.ReadAt(buf[:], 0); err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf[:])), nil
+}
+
+func writeConsumerOffset(path string, buf [8]byte) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteAt(buf[:], 0); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// consumerOffsetName returns the name of the hidden file in a topic directory
+// used to store the offset of a consumer group
+func consumerOffsetName(group string) string {
+	return ".consumer-" + url.PathEscape(group)
+}
+
+// removeHidden filters out any hidden files, such as consumer offsets, from a list of directory names
+func removeHidden(names []string) []string {
+	var i int
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		names[i] = name
+		i++
+	}
+	return names[:i]
+}
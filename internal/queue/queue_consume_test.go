@@ -2,9 +2,12 @@ package queue
 
 import (
 	"bytes"
+	"fmt"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -115,3 +118,127 @@ func testConsume(q *Queue, group, topic string, id, limit int64, expected []stri
 		}
 	}
 }
+
+func TestQueue_SetConsumerOffset(t *testing.T) {
+	dirNames := make([]string, 2)
+	for i := range dirNames {
+		dirName, err := os.MkdirTemp("", ".haraqa*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dirName)
+		dirNames[i] = dirName
+	}
+	q, err := NewQueue(dirNames, true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const topic, group = "topic", "group"
+
+	// topic doesn't exist
+	if err = q.SetConsumerOffset(group, topic, 1); err != headers.ErrTopicDoesNotExist {
+		t.Error(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	// invalid id
+	if err = q.SetConsumerOffset(group, topic, -1); err != headers.ErrInvalidMessageID {
+		t.Error(err)
+	}
+
+	r := new(bytes.Buffer)
+	msgs := []string{"my", "test", "messages", "are", "here"}
+	var msgSizes []int64
+	for _, msg := range msgs {
+		msgSizes = append(msgSizes, int64(len(msg)))
+		r.WriteString(msg)
+	}
+	if err = q.Produce(topic, msgSizes, uint64(time.Now().Unix()), r); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.SetConsumerOffset(group, topic, 2); err != nil {
+		t.Error(err)
+	}
+	t.Run("consume group offset", testConsume(q, group, topic, 0, -1, msgs[2:]))
+
+	// offset persists after a restart, falling back to the other volume
+	if err = q.Close(); err != nil {
+		t.Error(err)
+	}
+	if err = os.Remove(filepath.Join(dirNames[1], topic, consumerOffsetName(group))); err != nil {
+		t.Error(err)
+	}
+	q, err = NewQueue(dirNames, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	t.Run("consume group offset after restart", testConsume(q, group, topic, 0, -1, msgs[2:]))
+
+	names, err := q.ListTopics("", "", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(names) != 1 || names[0] != topic {
+		t.Error(names)
+	}
+}
+
+func TestQueue_ConcurrentConsume(t *testing.T) {
+	dirName, err := os.MkdirTemp("", ".haraqa*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirName)
+	q, err := NewQueue([]string{dirName}, true, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	const topic, batches = "topic", 40
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Produce(topic, []int64{5, 5}, 100, bytes.NewBufferString("hellohello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// consumers read the messages published so far while the producer keeps writing to the same file
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for c := 0; c < cap(errs); c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < batches; i++ {
+				w := httptest.NewRecorder()
+				n, err := q.Consume("", topic, int64(c+i)%2, 2, w)
+				if err != nil || n == 0 || w.Body.String() != strings.Repeat("hello", n) {
+					errs <- fmt.Errorf("consumer %d: %d %v %q", c, n, err, w.Body.String())
+					return
+				}
+			}
+		}(c)
+	}
+	for i := 0; i < batches; i++ {
+		if err = q.Produce(topic, []int64{5, 5}, 100, bytes.NewBufferString("hellohello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// a cached file closed underneath a consumer is read from a fresh copy
+	v, ok := q.fileCache.Load(filepath.Join(dirName, topic, formatName(50)))
+	if !ok {
+		t.Fatal("missing cached file")
+	}
+	if err = v.(*File).Close(); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("consume closed file", testConsume(q, "", topic, 80, -1, []string{"hello", "hello"}))
+}
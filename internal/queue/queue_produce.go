@@ -6,19 +6,88 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/haraqa/haraqa/internal/blockflate"
 	"github.com/haraqa/haraqa/internal/headers"
 )
 
 func (q *Queue) Produce(topic string, msgSizes []int64, timestamp uint64, r io.Reader) error {
+	_, err := q.produceLatest(topic, -1, msgSizes, timestamp&timestampMask, r)
+	return err
+}
+
+// ProduceFramed writes framed messages to the topic. Each message holds its key and headers
+// in the format written by headers.AppendFrame
+func (q *Queue) ProduceFramed(topic string, msgSizes []int64, timestamp uint64, r io.Reader) error {
+	_, err := q.produceLatest(topic, -1, msgSizes, timestamp&timestampMask|flagFramed, r)
+	return err
+}
+
+// ProduceOffsets writes messages to the topic, framed messages if framed is set, and returns the ids and
+// timestamps given to them
+func (q *Queue) ProduceOffsets(topic string, msgSizes []int64, timestamp uint64, framed bool, r io.Reader) (*headers.ProduceInfo, error) {
+	timestamp &= timestampMask
+	if framed {
+		timestamp |= flagFramed
+	}
+	return q.produceLatest(topic, -1, msgSizes, timestamp, r)
+}
+
+// ProduceIf writes messages to the topic as ProduceOffsets does, but only if expected is the id the next message
+// of the topic is given. Otherwise nothing is written and headers.ErrUnexpectedOffset is returned
+func (q *Queue) ProduceIf(topic string, expected int64, msgSizes []int64, timestamp uint64, framed bool, r io.Reader) (*headers.ProduceInfo, error) {
+	if expected < 0 {
+		return nil, headers.ErrInvalidMessageID
+	}
+	timestamp &= timestampMask
+	if framed {
+		timestamp |= flagFramed
+	}
+	return q.produceLatest(topic, expected, msgSizes, timestamp, r)
+}
+
+// SetRollPolicy sets when the latest file of a topic is closed and a new file is started, in addition to the
+// max number of entries per file. A file rolls once it holds maxBytes of data, or once its first message is maxAge
+// older than the batch being produced. Zero values disable the limit. Single batches are only split across files
+// by the max number of entries. The segment bytes of a topic config take precedence over maxBytes
+func (q *Queue) SetRollPolicy(maxBytes int64, maxAge time.Duration) {
+	q.maxBytes = maxBytes
+	q.maxAge = maxAge
+}
+
+// produceLatest writes the messages to the latest file of the topic. If expected is not negative the messages are
+// only written if the next id of the topic matches it
+func (q *Queue) produceLatest(topic string, expected int64, msgSizes []int64, timestamp uint64, r io.Reader) (*headers.ProduceInfo, error) {
 	if len(msgSizes) == 0 {
-		return nil
+		return nil, nil
 	}
+
+	// serialize batches of the topic, so the next id cannot change between a check and the write
+	mux := q.produceLock(topic)
+	mux.Lock()
+	defer mux.Unlock()
+	return q.produceLatestLocked(topic, expected, msgSizes, timestamp, r)
+}
+
+// produceLatestLocked writes the messages as produceLatest does, the produce lock of the topic must be held
+func (q *Queue) produceLatestLocked(topic string, expected int64, msgSizes []int64, timestamp uint64, r io.Reader) (*headers.ProduceInfo, error) {
 	baseID, err := q.getLatestBaseID(topic)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return q.produce(topic, msgSizes, timestamp, r, baseID, expected)
+}
+
+// produceLock returns the lock held while a batch is written to the topic
+func (q *Queue) produceLock(topic string) *sync.Mutex {
+	mux, ok := q.produceLocks.Load(topic)
+	if !ok {
+		mux, _ = q.produceLocks.LoadOrStore(topic, &sync.Mutex{})
 	}
-	return q.produce(topic, msgSizes, timestamp, r, baseID)
+	return mux.(*sync.Mutex)
 }
 
 func (q *Queue) getLatestBaseID(topic string) (int64, error) {
@@ -38,6 +107,7 @@ func (q *Queue) getLatestBaseID(topic string) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+	names = removeHidden(names)
 	if len(names) == 0 {
 		if q.baseIDCache != nil {
 			q.baseIDCache.Store(topic, int64(0))
@@ -45,7 +115,7 @@ func (q *Queue) getLatestBaseID(topic string) (int64, error) {
 		return 0, nil
 	}
 	sort.Strings(names)
-	baseID, err := strconv.ParseInt(names[len(names)-1], 10, 64)
+	baseID, err := strconv.ParseInt(strings.TrimSuffix(names[len(names)-1], blockflate.Ext), 10, 64)
 	if err != nil {
 		return 0, err
 	}
@@ -55,7 +125,10 @@ func (q *Queue) getLatestBaseID(topic string) (int64, error) {
 	return baseID, nil
 }
 
-func (q *Queue) produce(topic string, msgSizes []int64, timestamp uint64, r io.Reader, baseID int64) error {
+// produce writes the messages to the file starting at baseID, continuing in new files once it is full.
+// Nothing is written if expected is not negative and differs from the next id of the file.
+// The ids and timestamps given to the messages are returned
+func (q *Queue) produce(topic string, msgSizes []int64, timestamp uint64, r io.Reader, baseID, expected int64) (*headers.ProduceInfo, error) {
 	var (
 		f   *File
 		err error
@@ -69,16 +142,18 @@ func (q *Queue) produce(topic string, msgSizes []int64, timestamp uint64, r io.R
 		}
 	}
 
+	var created bool
 	if f == nil {
 		f, err = OpenFile(q.dirs, topic, baseID)
 		if os.IsNotExist(err) {
+			created = true
 			f, err = CreateFile(q.dirs, topic, baseID, q.maxEntries)
 			if os.IsNotExist(err) {
-				return headers.ErrTopicDoesNotExist
+				return nil, headers.ErrTopicDoesNotExist
 			}
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if q.fileCache == nil {
 			defer f.Close()
@@ -87,19 +162,45 @@ func (q *Queue) produce(topic string, msgSizes []int64, timestamp uint64, r io.R
 		}
 	}
 
-	n, err := f.WriteMessages(timestamp, msgSizes, r)
+	if expected >= 0 && baseID+f.entries() != expected {
+		return nil, headers.ErrUnexpectedOffset
+	}
+	f.setRollPolicy(q.segmentBytes(topic), q.maxAge)
+	n, firstID, err := f.writeMessages(timestamp, msgSizes, r)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// flush to disk or mark for the next sync
+	if n > 0 && q.syncOnWrite {
+		if err = f.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	if created && q.syncOnWrite {
+		if err = q.syncTopicDirs(topic); err != nil {
+			return nil, err
+		}
+	}
+	if n > 0 && q.dirty != nil {
+		q.dirty.Store(topic+string(filepath.Separator)+formatName(baseID), struct{}{})
+	}
+	if created && q.dirty != nil {
+		q.dirty.Store(dirtyDir(topic), struct{}{})
 	}
 
 	if n < len(msgSizes) {
-		if f.numEntries == f.maxEntries {
-			baseID += f.maxEntries
-			if q.baseIDCache != nil {
-				q.baseIDCache.Store(topic, baseID)
-			}
+		// the file is full, the remaining messages start a new file
+		baseID += f.entries()
+		if q.baseIDCache != nil {
+			q.baseIDCache.Store(topic, baseID)
+		}
+		info, err := q.produce(topic, msgSizes[n:], timestamp, r, baseID, -1)
+		if err == nil && n > 0 {
+			info.FirstID = firstID
 		}
-		return q.produce(topic, msgSizes[n:], timestamp, r, baseID)
+		return info, err
 	}
-	return nil
+	ts := time.Unix(int64(timestamp&timestampMask), 0)
+	return &headers.ProduceInfo{FirstID: firstID, LastID: firstID + int64(n) - 1, FirstTimestamp: ts, LastTimestamp: ts}, nil
 }
@@ -2,7 +2,11 @@ package queue
 
 import (
 	"bytes"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -58,7 +62,7 @@ func testQueueProduce(cache bool) func(*testing.T) {
 		if err != nil {
 			t.Error(err)
 		}
-		if info.MinOffset != 0 || info.MaxOffset != int64(len(msgs)*2) {
+		if info.MinOffset != 0 || info.MaxOffset != int64(len(msgs)*2)-1 {
 			t.Error(info)
 		}
 	}
@@ -73,3 +77,163 @@ func produceMsgs(q *Queue, topic string, msgs []string) error {
 	}
 	return q.Produce(topic, msgSizes, uint64(time.Now().Unix()), r)
 }
+
+func TestQueue_SetRollPolicy(t *testing.T) {
+	for _, cache := range []bool{true, false} {
+		dir, err := os.MkdirTemp("", ".haraqa*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := NewQueue([]string{dir}, cache, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.SetRollPolicy(10, time.Minute)
+		if err = q.CreateTopic("size"); err != nil {
+			t.Fatal(err)
+		}
+		if err = q.CreateTopic("age"); err != nil {
+			t.Fatal(err)
+		}
+
+		// files roll once they hold max bytes, batches are not split
+		for _, sizes := range [][]int64{{5}, {5}, {5, 5, 5}, {5}} {
+			if err = q.Produce("size", sizes, 100, bytes.NewBuffer(make([]byte, 5*len(sizes)))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		names, err := segmentNames(dir + "/size")
+		if err != nil || !reflect.DeepEqual(names, []string{formatName(0), formatName(2), formatName(5)}) {
+			t.Error(cache, err, names)
+		}
+
+		// files roll once their first message is older than max age
+		for _, ts := range []uint64{100, 130, 159, 160, 200, 220} {
+			if err = q.Produce("age", []int64{1}, ts, bytes.NewBufferString("a")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		names, err = segmentNames(dir + "/age")
+		if err != nil || !reflect.DeepEqual(names, []string{formatName(0), formatName(3), formatName(5)}) {
+			t.Error(cache, err, names)
+		}
+
+		// messages are consumed across rolled files
+		for id := int64(0); id < 6; id++ {
+			w := httptest.NewRecorder()
+			if n, err := q.Consume("", "size", id, 1, w); err != nil || n != 1 {
+				t.Error(cache, id, err, n)
+			}
+		}
+		_ = q.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestQueue_ProduceOffsets(t *testing.T) {
+	dirName, err := os.MkdirTemp("", ".haraqa*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirName)
+	for _, cache := range []bool{false, true} {
+		q, err := NewQueue([]string{dirName}, cache, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		topic := "offsets-topic"
+		if cache {
+			topic += "-cached"
+		}
+		if err = q.CreateTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+		ts := time.Unix(100, 0)
+		if info, err := q.ProduceOffsets(topic, nil, 100, false, nil); err != nil || info != nil {
+			t.Error(info, err)
+		}
+		// the second batch is split across files
+		for _, expected := range []headers.ProduceInfo{
+			{FirstID: 0, LastID: 1, FirstTimestamp: ts, LastTimestamp: ts},
+			{FirstID: 2, LastID: 4, FirstTimestamp: ts, LastTimestamp: ts},
+			{FirstID: 5, LastID: 5, FirstTimestamp: ts, LastTimestamp: ts},
+		} {
+			n := expected.LastID - expected.FirstID + 1
+			sizes := make([]int64, n)
+			for i := range sizes {
+				sizes[i] = 1
+			}
+			info, err := q.ProduceOffsets(topic, sizes, 100, expected.FirstID == 5, bytes.NewBufferString("abc"[:n]))
+			if err != nil || info == nil || *info != expected {
+				t.Error(cache, info, err)
+			}
+		}
+		if _, err = q.ProduceOffsets("missing", []int64{1}, 100, false, bytes.NewBufferString("a")); err == nil {
+			t.Error(err)
+		}
+		_ = q.Close()
+	}
+}
+
+func TestQueue_ProduceIf(t *testing.T) {
+	dir, err := os.MkdirTemp("", ".haraqa*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, cache := range []bool{false, true} {
+		q, err := NewQueue([]string{dir}, cache, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		topic := "conditional-topic"
+		if cache {
+			topic += "-cached"
+		}
+		if err = q.CreateTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = q.ProduceIf(topic, -1, []int64{1}, 100, false, bytes.NewBufferString("a")); err != headers.ErrInvalidMessageID {
+			t.Error(err)
+		}
+
+		// only a batch expecting the next id is written, including batches starting a new file
+		for _, c := range []struct {
+			expected int64
+			n        int
+			err      error
+		}{{1, 1, headers.ErrUnexpectedOffset}, {0, 2, nil}, {0, 1, headers.ErrUnexpectedOffset}, {2, 1, nil}, {3, 2, nil}, {4, 1, headers.ErrUnexpectedOffset}} {
+			sizes := make([]int64, c.n)
+			for i := range sizes {
+				sizes[i] = 1
+			}
+			info, err := q.ProduceIf(topic, c.expected, sizes, 100, false, bytes.NewBufferString("abc"[:c.n]))
+			if err != c.err || (err == nil && (info.FirstID != c.expected || info.LastID != c.expected+int64(c.n)-1)) {
+				t.Error(cache, c.expected, info, err)
+			}
+		}
+
+		// concurrent batches expecting the same id are written once
+		var wg sync.WaitGroup
+		var written int32
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := q.ProduceIf(topic, 5, []int64{1}, 100, false, bytes.NewBufferString("a")); err == nil {
+					atomic.AddInt32(&written, 1)
+				} else if err != headers.ErrUnexpectedOffset {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		if written != 1 {
+			t.Error(cache, written)
+		}
+		if info, err := q.ProduceOffsets(topic, []int64{1}, 100, false, bytes.NewBufferString("a")); err != nil || info.FirstID != 6 {
+			t.Error(info, err)
+		}
+		_ = q.Close()
+	}
+}
@@ -7,9 +7,11 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/haraqa/haraqa/internal/blockflate"
 	"github.com/haraqa/haraqa/internal/headers"
 )
 
@@ -35,6 +37,7 @@ func (q *Queue) ListTopics(prefix, suffix, regex string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	names = removeHidden(names)
 	var i int
 	for _, name := range names {
 		if prefix != "" && !strings.HasPrefix(name, prefix) {
@@ -76,16 +79,22 @@ func (q *Queue) DeleteTopic(topic string) error {
 	for _, dir := range q.dirs {
 		errs = append(errs, os.RemoveAll(dir+string(filepath.Separator)+topic))
 	}
+	q.dropGroupOffsets(topic)
+	if q.configCache != nil {
+		q.configCache.Delete(topic)
+	}
 	return firstError(errs)
 }
 
 func (q *Queue) ModifyTopic(topic string, request headers.ModifyRequest) (*headers.TopicInfo, error) {
-	d, err := os.Open(q.RootDir() + string(filepath.Separator) + topic)
-	if err != nil {
-		return nil, err
-	}
-	defer d.Close()
-	names, err := d.Readdirnames(-1)
+	// segments are removed under the same locks as other rewrites, so no produce or consume uses them meanwhile
+	unlock := q.lockTopics([]string{topic})
+	defer unlock()
+	lock := q.segmentLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+
+	names, err := segmentNames(q.RootDir() + string(filepath.Separator) + topic)
 	if err != nil {
 		return nil, err
 	}
@@ -100,17 +109,39 @@ func (q *Queue) ModifyTopic(topic string, request headers.ModifyRequest) (*heade
 	}
 
 	var idx int
+	var size int64
 	for idx = range names {
 		if trunc != "" && trunc >= names[idx] {
 			break
 		}
-		if !request.Before.IsZero() {
+		if !request.Before.IsZero() || request.MaxSize > 0 {
 			stat, err := os.Stat(q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + names[idx])
+			if os.IsNotExist(err) {
+				stat, err = os.Stat(q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + names[idx] + blockflate.Ext)
+			}
 			if err != nil {
 				return nil, err
 			}
-			modTime := stat.ModTime()
-			if modTime.Before(request.Before) || modTime.Equal(request.Before) {
+
+			// keep the latest segment and any newer segments within the max size
+			size += stat.Size()
+			if request.MaxSize > 0 && idx > 0 && size > request.MaxSize {
+				idx--
+				break
+			}
+			if request.Before.IsZero() {
+				continue
+			}
+
+			// remove the segment and all older segments once every message was produced before the given time
+			bounds, err := readSegmentBounds(q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + names[idx])
+			if err != nil {
+				return nil, err
+			}
+			if bounds.last.Before(request.Before) {
+				if idx > 0 {
+					idx--
+				}
 				break
 			}
 		}
@@ -120,41 +151,74 @@ func (q *Queue) ModifyTopic(topic string, request headers.ModifyRequest) (*heade
 	for _, name := range names[idx+1:] {
 		for _, dir := range q.dirs {
 			errs = append(errs, os.RemoveAll(dir+string(filepath.Separator)+topic+string(filepath.Separator)+name))
+			errs = append(errs, os.RemoveAll(dir+string(filepath.Separator)+topic+string(filepath.Separator)+name+blockflate.Ext))
 		}
+		q.dropCachedFile(q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + name)
 	}
 
-	f, err := os.Open(q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + names[0])
+	latest, err := readSegmentBounds(q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + names[0])
 	if err != nil {
 		return nil, err
 	}
+	oldest := latest
+	if idx != 0 {
+		oldest, err = readSegmentBounds(q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + names[idx])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the max offset is the id of the last message, as with the file queue
+	maxOffset := latest.baseID + latest.numEntries - 1
+	if maxOffset < oldest.baseID {
+		maxOffset = oldest.baseID
+	}
+	return &headers.TopicInfo{
+		MinOffset:      oldest.baseID,
+		MaxOffset:      maxOffset,
+		FirstTimestamp: oldest.first,
+	}, firstError(errs)
+}
+
+// segmentBounds holds the ids and produce times of the messages in a segment file
+type segmentBounds struct {
+	baseID     int64
+	numEntries int64
+	first      time.Time
+	last       time.Time
+}
+
+// readSegmentBounds reads the bounds of a segment file, compressed or not, from its info and meta entries.
+// The times are zero if the segment has no messages
+func readSegmentBounds(path string) (segmentBounds, error) {
+	f, err := openSegment(path)
+	if err != nil {
+		return segmentBounds{}, err
+	}
 	defer f.Close()
 
 	var info [infoSize]byte
 	if _, err = f.ReadAt(info[:], 0); err != nil {
-		return nil, err
+		return segmentBounds{}, err
+	}
+	bounds := segmentBounds{
+		baseID:     int64(binary.LittleEndian.Uint64(info[:8])),
+		numEntries: int64(binary.LittleEndian.Uint64(info[16:24])),
+	}
+	if bounds.numEntries <= 0 {
+		return bounds, nil
 	}
 
-	baseID := int64(binary.LittleEndian.Uint64(info[:8]))
-	numEntries := int64(binary.LittleEndian.Uint64(info[16:24]))
-	min := baseID
-	max := baseID + numEntries
-
-	if idx != 0 {
-		minF, err := os.Open(q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + names[idx])
-		if err != nil {
-			return nil, err
+	var meta [metaSize]byte
+	for _, n := range []int64{0, bounds.numEntries - 1} {
+		if _, err = f.ReadAt(meta[:], infoSize+n*metaSize); err != nil {
+			return segmentBounds{}, err
 		}
-		defer minF.Close()
-
-		var info [infoSize]byte
-		if _, err = minF.ReadAt(info[:], 0); err != nil {
-			return nil, err
+		ts, _ := decodeTimestamp(int64(binary.LittleEndian.Uint64(meta[16:24])))
+		bounds.last = time.Unix(ts, 0).UTC()
+		if n == 0 {
+			bounds.first = bounds.last
 		}
-		min = int64(binary.LittleEndian.Uint64(info[:8]))
 	}
-
-	return &headers.TopicInfo{
-		MinOffset: min,
-		MaxOffset: max,
-	}, firstError(errs)
+	return bounds, nil
 }
@@ -2,6 +2,7 @@ package queue
 
 import (
 	"bytes"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"sort"
@@ -197,10 +198,122 @@ func TestQueue_ModifyTopic(t *testing.T) {
 		t.Error(err)
 	}
 
-	t.Run("trunc 2", testModifyTopic(q, topic, headers.ModifyRequest{Truncate: 2}, 2, 5))
-	t.Run("trunc 3", testModifyTopic(q, topic, headers.ModifyRequest{Truncate: 3}, 2, 5))
-	t.Run("trunc 4", testModifyTopic(q, topic, headers.ModifyRequest{Truncate: 4}, 4, 5))
-	t.Run("trunc 5", testModifyTopic(q, topic, headers.ModifyRequest{Truncate: 4}, 4, 5))
-	t.Run("trunc 6", testModifyTopic(q, topic, headers.ModifyRequest{Truncate: 4}, 4, 5))
-	t.Run("before now", testModifyTopic(q, topic, headers.ModifyRequest{Before: time.Now()}, 4, 5))
+	t.Run("trunc 2", testModifyTopic(q, topic, headers.ModifyRequest{Truncate: 2}, 2, 4))
+	t.Run("trunc 3", testModifyTopic(q, topic, headers.ModifyRequest{Truncate: 3}, 2, 4))
+	t.Run("trunc 4", testModifyTopic(q, topic, headers.ModifyRequest{Truncate: 4}, 4, 4))
+	t.Run("trunc 5", testModifyTopic(q, topic, headers.ModifyRequest{Truncate: 4}, 4, 4))
+	t.Run("trunc 6", testModifyTopic(q, topic, headers.ModifyRequest{Truncate: 4}, 4, 4))
+	t.Run("before now", testModifyTopic(q, topic, headers.ModifyRequest{Before: time.Now()}, 4, 4))
+
+	r.Reset()
+	r.WriteString("more test messages here")
+	if err := q.Produce(topic, []int64{4, 4, 9, 6}, uint64(time.Now().Unix()), r); err != nil {
+		t.Error(err)
+	}
+	var maxSize int64
+	for _, id := range []int64{6, 8} {
+		stat, err := os.Stat(q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + formatName(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		maxSize += stat.Size()
+	}
+	t.Run("max size", testModifyTopic(q, topic, headers.ModifyRequest{MaxSize: maxSize}, 6, 8))
+	t.Run("max size latest", testModifyTopic(q, topic, headers.ModifyRequest{MaxSize: 1}, 8, 8))
+}
+
+func TestQueue_ModifyTopicTimestamps(t *testing.T) {
+	dirName, err := os.MkdirTemp("", ".haraqa*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirName)
+	q, err := NewQueue([]string{dirName}, false, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const topic = "topic"
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	old := now.Add(-2 * time.Hour)
+	for _, ts := range []time.Time{old, now, now} {
+		if err = q.Produce(topic, []int64{5, 5}, uint64(ts.Unix()), bytes.NewBuffer([]byte("helloworld"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// file times are ignored, only the message timestamps are used
+	if err = os.Chtimes(q.RootDir()+string(filepath.Separator)+topic+string(filepath.Separator)+formatName(2), old, old); err != nil {
+		t.Fatal(err)
+	}
+	info, err := q.ModifyTopic(topic, headers.ModifyRequest{Before: now.Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.MinOffset != 2 || info.MaxOffset != 5 || !info.FirstTimestamp.Equal(now) {
+		t.Error(info)
+	}
+	if _, err = os.Stat(q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + formatName(0)); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+}
+
+func TestQueue_ModifyTopicCached(t *testing.T) {
+	q, err := NewQueue([]string{t.TempDir()}, true, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	const topic = "topic"
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	for _, msgs := range []string{"ab", "cd", "ef"} {
+		if err = q.Produce(topic, []int64{1, 1}, uint64(time.Now().Unix()), bytes.NewBufferString(msgs)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := consumeAll(t, q, topic, 0); s != "ab" {
+		t.Fatal(s)
+	}
+
+	// removed segments are no longer read through the cache
+	if _, err = q.ModifyTopic(topic, headers.ModifyRequest{Truncate: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := q.Consume("", topic, 0, -1, httptest.NewRecorder()); n != 0 || !os.IsNotExist(err) {
+		t.Error(n, err)
+	}
+	if s := consumeAll(t, q, topic, 4); s != "ef" {
+		t.Error(s)
+	}
+}
+
+func TestQueue_DeleteTopicGroupCache(t *testing.T) {
+	q, err := NewQueue([]string{t.TempDir()}, true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for _, topic := range []string{"a:b", "b"} {
+		if err = q.CreateTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+		if err = q.SetConsumerOffset("group", topic, 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the offsets of the deleted topic are dropped, even if another topic name ends the same
+	if err = q.DeleteTopic("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.groupCache.Load(groupKey{"group", "a:b"}); !ok {
+		t.Error("expected offset of topic a:b to stay cached")
+	}
+	if _, ok := q.groupCache.Load(groupKey{"group", "b"}); ok {
+		t.Error("expected offset of topic b to be dropped")
+	}
 }
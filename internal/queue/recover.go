@@ -0,0 +1,134 @@
+package queue
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Recover repairs the queue after an unclean shutdown or the replacement of a directory.
+// Torn writes at the end of each topic are rolled back to the last complete write in every directory,
+// then any diverged directories are resynced. Discarded and copied data is reported through logf, which may be nil
+func (q *Queue) Recover(logf func(format string, args ...interface{})) error {
+	if logf == nil {
+		logf = noopLogf
+	}
+
+	topics, err := q.listAllTopics()
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		var recovered bool
+		for _, dir := range q.dirs {
+			ok, err := q.recoverTail(dir, topic, logf)
+			if err != nil {
+				return errors.Wrapf(err, "unable to recover topic %q", topic)
+			}
+			recovered = recovered || ok
+		}
+		if recovered {
+			q.clearTopicCache(topic)
+		}
+	}
+	if err = q.recoverTransactions(logf); err != nil {
+		return err
+	}
+	return q.Resync(logf)
+}
+
+// recoverTail rolls back the latest segment of the topic to the last complete write.
+// A write is complete if its last meta entry is flagged as the end of the write and all
+// of its data is within the file. Entries written without flags are always complete
+func (q *Queue) recoverTail(dir, topic string, logf func(format string, args ...interface{})) (bool, error) {
+	d, err := os.Open(dir + string(filepath.Separator) + topic)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	names, err := d.Readdirnames(-1)
+	_ = d.Close()
+	if err != nil {
+		return false, err
+	}
+	names = removeHidden(names)
+	if len(names) == 0 {
+		return false, nil
+	}
+	sort.Strings(names)
+	path := dir + string(filepath.Separator) + topic + string(filepath.Separator) + names[len(names)-1]
+
+	// hold the producer lock of the cached segment, if any
+	if q.fileCache != nil {
+		if v, ok := q.fileCache.Load(q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + names[len(names)-1]); ok {
+			if f, ok := v.(*File); ok {
+				f.mux.Lock()
+				defer f.mux.Unlock()
+			}
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if stat.Size() < infoSize {
+		return false, errors.Errorf("segment %q is missing its info header", path)
+	}
+	var info [infoSize]byte
+	if _, err = f.ReadAt(info[:], 0); err != nil {
+		return false, err
+	}
+	maxEntries := int64(binary.LittleEndian.Uint64(info[8:16]))
+	numEntries := int64(binary.LittleEndian.Uint64(info[16:24]))
+	writerOffset := int64(binary.LittleEndian.Uint64(info[24:32]))
+	if numEntries > maxEntries {
+		return false, errors.Errorf("segment %q has an invalid number of entries", path)
+	}
+
+	// walk back from the last entry to the end of the last complete write
+	keep, end := numEntries, infoSize+maxEntries*metaSize
+	var meta [metaSize]byte
+	for ; keep > 0; keep-- {
+		if _, err = f.ReadAt(meta[:], infoSize+(keep-1)*metaSize); err != nil {
+			return false, err
+		}
+		size, _ := decodeSize(int64(binary.LittleEndian.Uint64(meta[8:16])))
+		_, flags := decodeTimestamp(int64(binary.LittleEndian.Uint64(meta[16:24])))
+		msgEnd := int64(binary.LittleEndian.Uint64(meta[0:8])) + size
+		if msgEnd <= stat.Size() && (flags == 0 || flags&flagBatchEnd != 0) {
+			end = msgEnd
+			break
+		}
+	}
+
+	var recovered bool
+	if keep != numEntries || end != writerOffset {
+		var tmp [16]byte
+		binary.LittleEndian.PutUint64(tmp[:8], uint64(keep))
+		binary.LittleEndian.PutUint64(tmp[8:16], uint64(end))
+		if _, err = f.WriteAt(tmp[:], 16); err != nil {
+			return false, err
+		}
+		logf("recover: discarded %d torn entries from %q", numEntries-keep, path)
+		recovered = true
+	}
+	if stat.Size() > end {
+		if err = f.Truncate(end); err != nil {
+			return false, err
+		}
+		logf("recover: discarded %d bytes of torn messages from %q", stat.Size()-end, path)
+		recovered = true
+	}
+	return recovered, nil
+}
@@ -0,0 +1,80 @@
+package queue
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueue_Recover(t *testing.T) {
+	dirName, err := os.MkdirTemp("", ".haraqa*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirName)
+	const topic = "topic"
+	q, err := NewQueue([]string{dirName}, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Produce(topic, []int64{2, 4}, uint64(time.Now().Unix()), bytes.NewBufferString("mytest")); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Produce(topic, []int64{8, 3}, uint64(time.Now().Unix()), bytes.NewBufferString("messagesare")); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	path := filepath.Join(dirName, topic, formatName(0))
+	dataStart := int64(infoSize + 10*metaSize)
+
+	// nothing to recover
+	if err = q.Recover(logf); err != nil || len(logs) != 0 {
+		t.Fatal(err, logs)
+	}
+
+	// the info header was written but the data of the last write is incomplete
+	if err = os.Truncate(path, dataStart+10); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Recover(logf); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 {
+		t.Error(logs)
+	}
+	if stat, err := os.Stat(path); err != nil || stat.Size() != dataStart+6 {
+		t.Error(err, stat.Size())
+	}
+	t.Run("consume after recover", testConsume(q, "", topic, 0, -1, []string{"my", "test"}))
+
+	// orphaned data beyond the last write
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("orphan")); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	logs = nil
+	if err = q.Recover(logf); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 {
+		t.Error(logs)
+	}
+	if err = q.Produce(topic, []int64{4}, uint64(time.Now().Unix()), bytes.NewBufferString("here")); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("produce after recover", testConsume(q, "", topic, 0, -1, []string{"my", "test", "here"}))
+}
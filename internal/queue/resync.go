@@ -0,0 +1,291 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/blockflate"
+)
+
+// Resync reconciles the queue directories. Any topic or segment that is missing from a directory, or has
+// fewer entries than in another directory, is copied from the directory holding the most entries. On a tie
+// the later directory is preferred, as it is the one consumers read from. Hidden files such as consumer offsets
+// are copied from the directory holding the most recently written copy wherever their contents differ.
+// Each copy is reported through logf, which may be nil. Resync is called by Recover and may also be called while
+// the queue is in use, each topic is locked while it is resynced
+func (q *Queue) Resync(logf func(format string, args ...interface{})) error {
+	if len(q.dirs) < 2 {
+		return nil
+	}
+	if logf == nil {
+		logf = noopLogf
+	}
+
+	topics, err := q.listAllTopics()
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		if err := q.resyncTopic(topic, logf); err != nil {
+			return errors.Wrapf(err, "unable to resync topic %q", topic)
+		}
+	}
+	return nil
+}
+
+// listAllTopics returns the topics found in any of the directories
+func (q *Queue) listAllTopics() ([]string, error) {
+	found := make(map[string]struct{})
+	for _, dir := range q.dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				found[entry.Name()] = struct{}{}
+			}
+		}
+	}
+	topics := make([]string, 0, len(found))
+	for topic := range found {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+func (q *Queue) resyncTopic(topic string, logf func(format string, args ...interface{})) error {
+	// lock out produces, rewrites and consumes of the topic, as the queue may be serving while it is resynced
+	unlock := q.lockTopics([]string{topic})
+	defer unlock()
+	lock := q.segmentLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+
+	found := make(map[string]struct{})
+	for _, dir := range q.dirs {
+		path := dir + string(filepath.Separator) + topic
+		if err := os.MkdirAll(path, os.ModePerm); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				found[entry.Name()] = struct{}{}
+			}
+		}
+	}
+
+	var repaired bool
+	for name := range found {
+		var ok bool
+		var err error
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, blockflate.Ext) {
+			ok, err = q.resyncHidden(topic, name, logf)
+		} else {
+			ok, err = q.resyncSegment(topic, name, logf)
+		}
+		if err != nil {
+			return err
+		}
+		repaired = repaired || ok
+	}
+
+	// drop any cached state, it may have been read from a stale directory
+	if repaired {
+		q.clearTopicCache(topic)
+	}
+	return nil
+}
+
+// resyncHidden replaces a hidden file, such as a consumer offset, or a compressed segment in the directories where
+// it is missing or differs from the most recently written copy. Sizes are not compared, as an offset or config may
+// change without changing size
+func (q *Queue) resyncHidden(topic, name string, logf func(format string, args ...interface{})) (bool, error) {
+	stats := make([]os.FileInfo, len(q.dirs))
+	src := -1
+	for i, dir := range q.dirs {
+		stat, err := os.Stat(dir + string(filepath.Separator) + topic + string(filepath.Separator) + name)
+		if err != nil {
+			continue
+		}
+		stats[i] = stat
+		if src < 0 || !stat.ModTime().Before(stats[src].ModTime()) {
+			src = i
+		}
+	}
+	if src < 0 {
+		return false, nil
+	}
+	b, err := os.ReadFile(q.dirs[src] + string(filepath.Separator) + topic + string(filepath.Separator) + name)
+	if err != nil {
+		return false, err
+	}
+
+	var repaired bool
+	for i, dir := range q.dirs {
+		if i == src {
+			continue
+		}
+		path := dir + string(filepath.Separator) + topic + string(filepath.Separator) + name
+		if stats[i] != nil {
+			if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, b) {
+				continue
+			}
+		}
+		if err = writeSynced(path, b); err != nil {
+			return false, err
+		}
+		logf("resync: copied %q from %q to %q", name, q.dirs[src], dir)
+		repaired = true
+	}
+	return repaired, nil
+}
+
+// resyncSegment brings a segment file up to date in every directory
+func (q *Queue) resyncSegment(topic, name string, logf func(format string, args ...interface{})) (bool, error) {
+	type segmentInfo struct {
+		exists       bool
+		size         int64
+		baseID       int64
+		maxEntries   int64
+		numEntries   int64
+		writerOffset int64
+	}
+
+	// hold the producer lock of the cached segment, if any
+	if q.fileCache != nil {
+		if v, ok := q.fileCache.Load(q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + name); ok {
+			if f, ok := v.(*File); ok {
+				f.mux.Lock()
+				defer f.mux.Unlock()
+			}
+		}
+	}
+
+	infos := make([]segmentInfo, len(q.dirs))
+	src := -1
+	for i, dir := range q.dirs {
+		f, err := os.Open(dir + string(filepath.Separator) + topic + string(filepath.Separator) + name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return false, err
+		}
+		stat, err := f.Stat()
+		if err == nil && stat.Size() >= infoSize {
+			var info [infoSize]byte
+			if _, err = f.ReadAt(info[:], 0); err == nil {
+				infos[i] = segmentInfo{
+					exists:       true,
+					size:         stat.Size(),
+					baseID:       int64(binary.LittleEndian.Uint64(info[0:8])),
+					maxEntries:   int64(binary.LittleEndian.Uint64(info[8:16])),
+					numEntries:   int64(binary.LittleEndian.Uint64(info[16:24])),
+					writerOffset: int64(binary.LittleEndian.Uint64(info[24:32])),
+				}
+			}
+		}
+		_ = f.Close()
+		if infos[i].exists && (src < 0 || infos[i].numEntries >= infos[src].numEntries) {
+			src = i
+		}
+	}
+	if src < 0 {
+		return false, errors.Errorf("no valid copy of segment %q", name)
+	}
+
+	var repaired bool
+	s := infos[src]
+	for i, d := range infos {
+		if i == src || (d.exists && d.numEntries >= s.numEntries) {
+			continue
+		}
+
+		// copy the whole segment if it's missing or doesn't match the source
+		if !d.exists || d.baseID != s.baseID || d.maxEntries != s.maxEntries || d.writerOffset > s.writerOffset {
+			if err := q.copyRange(topic, name, src, i, 0, s.size); err != nil {
+				return false, err
+			}
+			logf("resync: copied segment %q of %q from %q to %q", name, topic, q.dirs[src], q.dirs[i])
+			repaired = true
+			continue
+		}
+
+		// otherwise copy the missing data, then the missing metadata, then the updated file info
+		metaStart := infoSize + d.numEntries*metaSize
+		metaEnd := infoSize + s.numEntries*metaSize
+		if err := q.copyRange(topic, name, src, i, d.writerOffset, s.writerOffset-d.writerOffset); err != nil {
+			return false, err
+		}
+		if err := q.copyRange(topic, name, src, i, metaStart, metaEnd-metaStart); err != nil {
+			return false, err
+		}
+		if err := q.copyRange(topic, name, src, i, 16, 16); err != nil {
+			return false, err
+		}
+		logf("resync: copied %d entries of segment %q of %q from %q to %q", s.numEntries-d.numEntries, name, topic, q.dirs[src], q.dirs[i])
+		repaired = true
+	}
+	return repaired, nil
+}
+
+// copyRange copies n bytes starting at off from the file in the src directory to the file in the dst directory
+func (q *Queue) copyRange(topic, name string, src, dst int, off, n int64) error {
+	srcPath := q.dirs[src] + string(filepath.Separator) + topic + string(filepath.Separator) + name
+	dstPath := q.dirs[dst] + string(filepath.Separator) + topic + string(filepath.Separator) + name
+
+	r, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if _, err = w.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, io.NewSectionReader(r, off, n)); err != nil {
+		return errors.Wrapf(err, "unable to copy %q to %q", srcPath, dstPath)
+	}
+	return nil
+}
+
+// clearTopicCache closes and removes any cached files and ids of the topic
+func (q *Queue) clearTopicCache(topic string) {
+	if q.fileCache != nil {
+		prefix := q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator)
+		q.fileCache.Range(func(key, value interface{}) bool {
+			if k, ok := key.(string); ok && strings.HasPrefix(k, prefix) {
+				q.fileCache.Delete(key)
+				if f, ok := value.(io.Closer); ok {
+					_ = f.Close()
+				}
+			}
+			return true
+		})
+	}
+	if q.baseIDCache != nil {
+		q.baseIDCache.Delete(topic)
+	}
+	q.dropGroupOffsets(topic)
+}
+
+func noopLogf(format string, args ...interface{}) {}
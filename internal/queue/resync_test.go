@@ -0,0 +1,104 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueue_Resync(t *testing.T) {
+	dirNames := make([]string, 3)
+	for i := range dirNames {
+		dirName, err := os.MkdirTemp("", ".haraqa*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dirName)
+		dirNames[i] = dirName
+	}
+	const topic, group = "topic", "group"
+	q, err := NewQueue(dirNames[:2], false, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Produce(topic, []int64{2, 4, 8}, uint64(time.Now().Unix()), bytes.NewBufferString("mytestmessages")); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.SetConsumerOffset(group, topic, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first directory falls behind, only having the first message
+	if err = os.Remove(filepath.Join(dirNames[0], topic, formatName(2))); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(dirNames[0], topic, formatName(0)), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info [16]byte
+	writerOffset := int64(infoSize + 2*metaSize + 2)
+	binary.LittleEndian.PutUint64(info[:8], 1)
+	binary.LittleEndian.PutUint64(info[8:], uint64(writerOffset))
+	if _, err = f.WriteAt(info[:], 16); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Truncate(writerOffset); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the last volume holds an older offset of the same width
+	offsetPath := filepath.Join(dirNames[0], topic, consumerOffsetName(group))
+	stale, err := os.ReadFile(offsetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale[0]++
+	if err = os.WriteFile(offsetPath, stale, 0666); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(offsetPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// resync, with the third directory being a new empty volume
+	q, err = NewQueue(dirNames, true, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.Resync(t.Logf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{formatName(0), formatName(2), consumerOffsetName(group)} {
+		expected, err := os.ReadFile(filepath.Join(dirNames[1], topic, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range dirNames {
+			b, err := os.ReadFile(filepath.Join(dir, topic, name))
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			if !bytes.Equal(b, expected) {
+				t.Error(dir, name)
+			}
+		}
+	}
+	t.Run("consume after resync", testConsume(q, "", topic, 0, -1, []string{"my", "test"}))
+}
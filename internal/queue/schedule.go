@@ -0,0 +1,67 @@
+package queue
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// scheduleName is the name of the hidden file in a topic directory used to store the scheduling index of the topic
+const scheduleName = ".schedule"
+
+// SetSchedule stores the scheduling index of a topic on every volume, replacing any previous index
+func (q *Queue) SetSchedule(topic string, schedule *headers.Schedule) error {
+	b, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+	for _, dir := range q.dirs {
+		path := dir + string(filepath.Separator) + topic + string(filepath.Separator) + scheduleName
+		if _, err = os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+			return headers.ErrTopicDoesNotExist
+		}
+		if err = writeSynced(path+".tmp", b); err != nil {
+			return err
+		}
+		if err = os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Schedule returns the scheduling index of a topic. A topic without a stored index returns an empty index
+func (q *Queue) Schedule(topic string) (*headers.Schedule, error) {
+	// read from the last volume first, falling back to the other volumes
+	schedule := &headers.Schedule{}
+	var err error
+	for i := len(q.dirs) - 1; i >= 0; i-- {
+		var b []byte
+		if b, err = os.ReadFile(q.dirs[i] + string(filepath.Separator) + topic + string(filepath.Separator) + scheduleName); err != nil {
+			continue
+		}
+		if err = json.Unmarshal(b, schedule); err == nil {
+			break
+		}
+	}
+	if os.IsNotExist(err) {
+		if _, statErr := os.Stat(q.RootDir() + string(filepath.Separator) + topic); os.IsNotExist(statErr) {
+			return nil, headers.ErrTopicDoesNotExist
+		}
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// ConsumerOffset returns the offset committed by the consumer group for the topic, or -1 if it has not committed one
+func (q *Queue) ConsumerOffset(group, topic string) (int64, error) {
+	if group == "" {
+		return 0, headers.ErrInvalidGroup
+	}
+	return q.getGroupOffsetID(group, topic, -1), nil
+}
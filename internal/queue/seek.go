@@ -0,0 +1,79 @@
+package queue
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// OffsetAt returns the id of the first message of a topic produced at or after t.
+// If every message was produced before t, the id of the next message to be produced is returned
+func (q *Queue) OffsetAt(topic string, t time.Time) (int64, error) {
+	dir := q.RootDir() + string(filepath.Separator) + topic
+
+	// hold off compaction and compression from replacing segments while they are read
+	lock := q.segmentLock(topic)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	names, err := segmentNames(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, headers.ErrTopicDoesNotExist
+		}
+		return 0, err
+	}
+	if len(names) == 0 {
+		return 0, nil
+	}
+
+	// find the first segment with a message produced at or after t
+	var searchErr error
+	i := sort.Search(len(names), func(i int) bool {
+		bounds, err := readSegmentBounds(dir + string(filepath.Separator) + names[i])
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return bounds.numEntries > 0 && !bounds.last.Before(t)
+	})
+	if searchErr != nil {
+		return 0, searchErr
+	}
+	if i == len(names) {
+		bounds, err := readSegmentBounds(dir + string(filepath.Separator) + names[len(names)-1])
+		if err != nil {
+			return 0, err
+		}
+		return bounds.baseID + bounds.numEntries, nil
+	}
+
+	// find the first message of the segment produced at or after t
+	f, err := openSegment(dir + string(filepath.Separator) + names[i])
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var info [infoSize]byte
+	if _, err = f.ReadAt(info[:], 0); err != nil {
+		return 0, err
+	}
+	baseID, numEntries := segmentInfo(info[:])
+	var meta [metaSize]byte
+	n := sort.Search(int(numEntries), func(n int) bool {
+		if _, err := f.ReadAt(meta[:], infoSize+int64(n)*metaSize); err != nil {
+			searchErr = err
+			return true
+		}
+		ts, _ := decodeTimestamp(int64(binary.LittleEndian.Uint64(meta[16:24])))
+		return !time.Unix(ts, 0).Before(t)
+	})
+	if searchErr != nil {
+		return 0, searchErr
+	}
+	return baseID + int64(n), nil
+}
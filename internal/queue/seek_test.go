@@ -0,0 +1,61 @@
+package queue
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestQueue_OffsetAt(t *testing.T) {
+	dirName, err := os.MkdirTemp("", ".haraqa*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirName)
+	q, err := NewQueue([]string{dirName}, true, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	const topic = "topic"
+	if _, err = q.OffsetAt(topic, time.Unix(0, 0)); err != headers.ErrTopicDoesNotExist {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := q.OffsetAt(topic, time.Unix(0, 0)); err != nil || id != 0 {
+		t.Fatal(err, id)
+	}
+
+	for _, ts := range []uint64{100, 200, 300} {
+		if err = q.Produce(topic, []int64{5}, ts, bytes.NewBufferString("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if err = q.Produce(topic, []int64{5}, ts+1, bytes.NewBufferString("world")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = q.CompressSegments(topic); err != nil {
+		t.Fatal(err)
+	}
+
+	for ts, expected := range map[int64]int64{
+		50:  0,
+		100: 0,
+		101: 1,
+		102: 2,
+		201: 3,
+		250: 4,
+		301: 5,
+		302: 6,
+	} {
+		if id, err := q.OffsetAt(topic, time.Unix(ts, 0)); err != nil || id != expected {
+			t.Error(ts, err, id, expected)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package queue
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// dirtyDir marks a topic directory holding newly created segment files for the next sync
+type dirtyDir string
+
+// SetSyncPolicy sets how written messages are committed to stable storage. If onWrite is true
+// each write is synced before Produce returns. If deferred is true the files written to are
+// tracked and synced by the next call to Sync. Otherwise flushing is left to the operating system
+func (q *Queue) SetSyncPolicy(onWrite, deferred bool) {
+	q.syncOnWrite = onWrite
+	q.dirty = nil
+	if deferred {
+		q.dirty = &sync.Map{}
+	}
+}
+
+// Sync commits the files written to since the previous call to stable storage, in every directory
+func (q *Queue) Sync() error {
+	if q.dirty == nil {
+		return nil
+	}
+	var errs []error
+	q.dirty.Range(func(key, value interface{}) bool {
+		// the key is removed before syncing so a write made meanwhile marks the file again,
+		// and restored if the sync fails so the next call retries it
+		q.dirty.Delete(key)
+		if topic, ok := key.(dirtyDir); ok {
+			if err := q.syncTopicDirs(string(topic)); err != nil {
+				errs = append(errs, err)
+				q.dirty.Store(key, value)
+			}
+			return true
+		}
+		for _, dir := range q.dirs {
+			if err := syncFile(dir + string(filepath.Separator) + key.(string)); err != nil {
+				errs = append(errs, err)
+				q.dirty.Store(key, value)
+			}
+		}
+		return true
+	})
+	return firstError(errs)
+}
+
+// syncTopicDirs commits the entries of the topic directory in every directory, so newly created segment files
+// survive a crash along with their contents
+func (q *Queue) syncTopicDirs(topic string) error {
+	for _, dir := range q.dirs {
+		if err := syncFile(dir + string(filepath.Separator) + topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
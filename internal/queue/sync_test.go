@@ -0,0 +1,82 @@
+package queue
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueue_Sync(t *testing.T) {
+	dirNames := make([]string, 2)
+	for i := range dirNames {
+		dirName, err := os.MkdirTemp("", ".haraqa*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dirName)
+		dirNames[i] = dirName
+	}
+	const topic = "topic"
+	q, err := NewQueue(dirNames, true, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing to sync
+	if err = q.Sync(); err != nil {
+		t.Error(err)
+	}
+
+	// sync on write
+	q.SetSyncPolicy(true, false)
+	if err = q.Produce(topic, []int64{2}, uint64(time.Now().Unix()), bytes.NewBufferString("my")); err != nil {
+		t.Error(err)
+	}
+
+	// deferred sync, across multiple files
+	q.SetSyncPolicy(false, true)
+	if err = q.Produce(topic, []int64{4, 8}, uint64(time.Now().Unix()), bytes.NewBufferString("testmessages")); err != nil {
+		t.Error(err)
+	}
+	for _, name := range []string{formatName(0), formatName(2)} {
+		if _, ok := q.dirty.Load(topic + string(filepath.Separator) + name); !ok {
+			t.Error("expected file to be marked for sync", name)
+		}
+	}
+	if _, ok := q.dirty.Load(dirtyDir(topic)); !ok {
+		t.Error("expected the directory of the new file to be marked for sync")
+	}
+	if err = q.Sync(); err != nil {
+		t.Error(err)
+	}
+	q.dirty.Range(func(key, _ interface{}) bool {
+		t.Error("expected file to be synced", key)
+		return true
+	})
+
+	// failed syncs are retried by the next call
+	q.dirty.Store(topic+string(filepath.Separator)+"unsyncable", struct{}{})
+	path := dirNames[1] + string(filepath.Separator) + topic + string(filepath.Separator) + "unsyncable"
+	if err = os.Symlink("unsyncable", path); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Sync(); err == nil {
+		t.Error("expected sync error")
+	}
+	if _, ok := q.dirty.Load(topic + string(filepath.Separator) + "unsyncable"); !ok {
+		t.Error("expected file to stay marked for sync")
+	}
+	if err = os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Sync(); err != nil {
+		t.Error(err)
+	}
+	t.Run("consume after sync", testConsume(q, "", topic, 0, -1, []string{"my", "test"}))
+}
@@ -0,0 +1,405 @@
+package queue
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/blockflate"
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// transactionPrefix is the prefix of the hidden journal files kept in every directory while a transaction is written
+const transactionPrefix = ".transaction-"
+
+// transactionJournal records the next id of every topic of a transaction before any of its batches are written,
+// so the transaction can be rolled back if it is interrupted
+type transactionJournal struct {
+	Topics map[string]int64 `json:"topics"`
+}
+
+// ProduceTransaction writes the batches to their topics atomically. Consumers do not read any message of the
+// transaction until every batch is written and synced, a failed transaction is rolled back before returning and
+// a transaction interrupted by a crash is rolled back by Recover. The ids and timestamps given to each batch are
+// returned in the order of the batches, nil for batches without messages
+func (q *Queue) ProduceTransaction(batches []headers.TransactionBatch, timestamp uint64) ([]*headers.ProduceInfo, error) {
+	if len(batches) == 0 {
+		return nil, headers.ErrInvalidBodyMissing
+	}
+	topics := headers.TransactionTopics(batches)
+	for _, topic := range topics {
+		if !headers.ValidTopicPath(topic) {
+			return nil, headers.ErrInvalidTopic
+		}
+	}
+	unlock := q.lockTopics(topics)
+	defer unlock()
+
+	journal := &transactionJournal{Topics: make(map[string]int64, len(topics))}
+	for _, topic := range topics {
+		nextID, err := q.nextID(topic)
+		if err != nil {
+			return nil, err
+		}
+		journal.Topics[topic] = nextID
+	}
+	name, err := q.writeJournal(journal)
+	if err != nil {
+		return nil, err
+	}
+
+	// hide the messages from consumers until the transaction is committed
+	for topic, nextID := range journal.Topics {
+		q.setPending(topic, nextID)
+	}
+	infos, err := q.writeTransaction(name, journal, batches, timestamp&timestampMask)
+	if err != nil {
+		if rollbackErr := q.rollback(journal); rollbackErr != nil {
+			// the journal is kept, Recover rolls back the transaction
+			return nil, errors.Wrapf(rollbackErr, "unable to roll back transaction after %s", err.Error())
+		}
+		_ = q.removeJournal(name)
+	}
+	for _, topic := range topics {
+		q.setPending(topic, -1)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, topic := range topics {
+		q.notifyWatchers(topic)
+	}
+	return infos, nil
+}
+
+// writeTransaction writes every batch of a transaction and commits it by removing its journal
+func (q *Queue) writeTransaction(name string, journal *transactionJournal, batches []headers.TransactionBatch, timestamp uint64) ([]*headers.ProduceInfo, error) {
+	infos := make([]*headers.ProduceInfo, len(batches))
+	for i, batch := range batches {
+		if len(batch.Messages) == 0 {
+			continue
+		}
+		sizes := make([]int64, len(batch.Messages))
+		for j := range batch.Messages {
+			sizes[j] = int64(len(batch.Messages[j]))
+		}
+		info, err := q.produceLatestLocked(batch.Topic, -1, sizes, timestamp, bytes.NewReader(bytes.Join(batch.Messages, nil)))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to write batch %d of the transaction", i)
+		}
+		infos[i] = info
+	}
+
+	// every batch must be on disk before the journal is removed
+	if !q.syncOnWrite {
+		for topic, nextID := range journal.Topics {
+			if err := q.syncFrom(topic, nextID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := q.removeJournal(name); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// lockTopics takes the rewrite and produce locks of the topics, in order, and returns a function releasing them.
+// Closed segments holding messages of a transaction are not rewritten until it is committed or rolled back
+func (q *Queue) lockTopics(topics []string) func() {
+	for _, topic := range topics {
+		q.rewriteLock(topic).Lock()
+	}
+	for _, topic := range topics {
+		q.produceLock(topic).Lock()
+	}
+	return func() {
+		for _, topic := range topics {
+			q.produceLock(topic).Unlock()
+			q.rewriteLock(topic).Unlock()
+		}
+	}
+}
+
+// nextID returns the id the next message produced to the topic is given, the produce lock must be held
+func (q *Queue) nextID(topic string) (int64, error) {
+	baseID, err := q.getLatestBaseID(topic)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, headers.ErrTopicDoesNotExist
+		}
+		return 0, err
+	}
+	path := q.RootDir() + string(filepath.Separator) + topic + string(filepath.Separator) + formatName(baseID)
+	if q.fileCache != nil {
+		if v, found := q.fileCache.Load(path); found {
+			if f, ok := v.(*File); ok {
+				return baseID + f.entries(), nil
+			}
+		}
+	}
+	f, err := openSegment(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// the file is created by the next write
+			return baseID, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+	var info [infoSize]byte
+	if _, err = f.ReadAt(info[:], 0); err != nil {
+		return 0, err
+	}
+	_, numEntries := segmentInfo(info[:])
+	return baseID + numEntries, nil
+}
+
+// setPending hides the messages of the topic from id onwards from consumers, a negative id shows them again.
+// The segment lock is held so the range visible to a consumer does not change while it reads
+func (q *Queue) setPending(topic string, id int64) {
+	lock := q.segmentLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+	if id < 0 {
+		q.transactions.Delete(topic)
+		return
+	}
+	q.transactions.Store(topic, id)
+}
+
+// visibleRange limits a read of the topic to the messages before any transaction still being written,
+// the segment lock must be held for reading. False is returned if no message can be read
+func (q *Queue) visibleRange(topic string, id, limit int64) (int64, bool) {
+	v, ok := q.transactions.Load(topic)
+	if !ok {
+		return limit, true
+	}
+	end := v.(int64)
+	if id >= end {
+		return limit, false
+	}
+	if limit <= 0 || limit > end-id {
+		limit = end - id
+	}
+	return limit, true
+}
+
+// writeJournal writes the journal of a transaction to every directory and returns its name
+func (q *Queue) writeJournal(journal *transactionJournal) (string, error) {
+	b, err := json.Marshal(journal)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to encode transaction journal")
+	}
+	var id [8]byte
+	if _, err = rand.Read(id[:]); err != nil {
+		return "", errors.Wrap(err, "unable to generate transaction id")
+	}
+	name := transactionPrefix + hex.EncodeToString(id[:])
+	for _, dir := range q.dirs {
+		if err = writeSynced(dir+string(filepath.Separator)+name, b); err != nil {
+			// a journal left behind would roll back later messages on recovery
+			_ = q.removeJournal(name)
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// removeJournal removes the journal of a transaction from every directory, committing the transaction
+func (q *Queue) removeJournal(name string) error {
+	for _, dir := range q.dirs {
+		if err := os.Remove(dir + string(filepath.Separator) + name); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "unable to remove transaction journal %q", name)
+		}
+	}
+	return nil
+}
+
+// recoverTransactions rolls back every transaction which was interrupted before it was committed
+func (q *Queue) recoverTransactions(logf func(format string, args ...interface{})) error {
+	found := make(map[string]bool)
+	for _, dir := range q.dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasPrefix(entry.Name(), transactionPrefix) {
+				found[entry.Name()] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		// read from the last directory first, a journal torn while being written means no batch was written yet
+		journal := &transactionJournal{}
+		for i := len(q.dirs) - 1; i >= 0; i-- {
+			b, err := os.ReadFile(q.dirs[i] + string(filepath.Separator) + name)
+			if err == nil && json.Unmarshal(b, journal) == nil {
+				break
+			}
+		}
+		topics := make([]string, 0, len(journal.Topics))
+		for topic := range journal.Topics {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+		unlock := q.lockTopics(topics)
+		err := q.rollback(journal)
+		unlock()
+		if err != nil {
+			return errors.Wrapf(err, "unable to roll back transaction %q", name)
+		}
+		if err = q.removeJournal(name); err != nil {
+			return err
+		}
+		logf("recover: rolled back interrupted transaction on topics %q", topics)
+	}
+	return nil
+}
+
+// rollback removes every message written by a transaction, the locks of its topics must be held
+func (q *Queue) rollback(journal *transactionJournal) error {
+	for topic, nextID := range journal.Topics {
+		if err := q.truncateFrom(topic, nextID); err != nil {
+			return errors.Wrapf(err, "unable to roll back topic %q", topic)
+		}
+	}
+	return nil
+}
+
+// truncateFrom removes the messages of the topic from id onwards in every directory
+func (q *Queue) truncateFrom(topic string, id int64) error {
+	names, err := segmentNames(q.RootDir() + string(filepath.Separator) + topic)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	// cached files and base ids point past the truncated tail
+	q.clearTopicCache(topic)
+	for _, name := range segmentsFrom(names, id) {
+		base, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		for _, dir := range q.dirs {
+			path := dir + string(filepath.Separator) + topic + string(filepath.Separator) + name
+			if base > id {
+				for _, p := range []string{path, path + blockflate.Ext} {
+					if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+						return err
+					}
+				}
+				continue
+			}
+			if err = truncateSegment(path, id-base); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// truncateSegment truncates the segment file at path to its first n entries
+func truncateSegment(path string, n int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if segmentExists(path) {
+				return errors.Errorf("unable to truncate compressed segment %q", path)
+			}
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	var info [infoSize]byte
+	if _, err = f.ReadAt(info[:], 0); err != nil {
+		return err
+	}
+	maxEntries := int64(binary.LittleEndian.Uint64(info[8:16]))
+	if _, numEntries := segmentInfo(info[:]); numEntries <= n {
+		return nil
+	}
+
+	end := infoSize + maxEntries*metaSize
+	if n > 0 {
+		var meta [metaSize]byte
+		if _, err = f.ReadAt(meta[:], infoSize+(n-1)*metaSize); err != nil {
+			return err
+		}
+		size, _ := decodeSize(int64(binary.LittleEndian.Uint64(meta[8:16])))
+		end = int64(binary.LittleEndian.Uint64(meta[0:8])) + size
+	}
+	var tmp [16]byte
+	binary.LittleEndian.PutUint64(tmp[:8], uint64(n))
+	binary.LittleEndian.PutUint64(tmp[8:16], uint64(end))
+	if _, err = f.WriteAt(tmp[:], 16); err != nil {
+		return err
+	}
+	return f.Truncate(end)
+}
+
+// syncFrom commits the segments of the topic holding messages from id onwards to stable storage, in every directory
+func (q *Queue) syncFrom(topic string, id int64) error {
+	names, err := segmentNames(q.RootDir() + string(filepath.Separator) + topic)
+	if err != nil {
+		return err
+	}
+	for _, name := range segmentsFrom(names, id) {
+		for _, dir := range q.dirs {
+			if err = syncFile(dir + string(filepath.Separator) + topic + string(filepath.Separator) + name); err != nil {
+				return err
+			}
+		}
+	}
+	return q.syncTopicDirs(topic)
+}
+
+// segmentsFrom returns the names of the segments holding the ids from id onwards,
+// the first of which may also hold earlier ids. The names must be in ascending order
+func segmentsFrom(names []string, id int64) []string {
+	for i := len(names) - 1; i >= 0; i-- {
+		if base, err := strconv.ParseInt(names[i], 10, 64); err == nil && base <= id {
+			return names[i:]
+		}
+	}
+	return names
+}
+
+// notifyWatchers rewrites the entry count of the latest segment of the topic unchanged, so watchers of the topic
+// learn of messages which became visible without being written
+func (q *Queue) notifyWatchers(topic string) {
+	baseID, err := q.getLatestBaseID(topic)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(q.RootDir()+string(filepath.Separator)+topic+string(filepath.Separator)+formatName(baseID), os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var tmp [8]byte
+	if _, err = f.ReadAt(tmp[:], 16); err == nil {
+		_, _ = f.WriteAt(tmp[:], 16)
+	}
+}
@@ -0,0 +1,213 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func consumeAll(t *testing.T, q *Queue, topic string, id int64) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	n, err := q.Consume("", topic, id, -1, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		return ""
+	}
+	b, err := io.ReadAll(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestQueue_ProduceTransaction(t *testing.T) {
+	dir1, dir2 := t.TempDir(), t.TempDir()
+	for _, cache := range []bool{false, true} {
+		q, err := NewQueue([]string{dir1, dir2}, cache, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		topicA, topicB := fmt.Sprintf("transaction-a-%v", cache), fmt.Sprintf("transaction-b-%v", cache)
+		for _, topic := range []string{topicA, topicB} {
+			if err = q.CreateTopic(topic); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err = q.ProduceOffsets(topicA, []int64{1, 1}, 100, false, bytes.NewBufferString("ab")); err != nil {
+			t.Fatal(err)
+		}
+
+		// no batches
+		if _, err = q.ProduceTransaction(nil, 100); err != headers.ErrInvalidBodyMissing {
+			t.Error(err)
+		}
+
+		// topics escaping the volume
+		if _, err = q.ProduceTransaction([]headers.TransactionBatch{
+			{Topic: "../" + topicA, Messages: [][]byte{[]byte("c")}},
+		}, 100); err != headers.ErrInvalidTopic {
+			t.Error(err)
+		}
+
+		// batches to several topics, across files
+		infos, err := q.ProduceTransaction([]headers.TransactionBatch{
+			{Topic: topicA, Messages: [][]byte{[]byte("c"), []byte("d")}},
+			{Topic: topicB, Messages: [][]byte{[]byte("w")}},
+			{Topic: topicB},
+			{Topic: topicA, Messages: [][]byte{[]byte("e")}},
+		}, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 4 || infos[0].FirstID != 2 || infos[0].LastID != 3 || infos[1].FirstID != 0 || infos[2] != nil || infos[3].FirstID != 4 {
+			t.Fatal(infos)
+		}
+		if s := consumeAll(t, q, topicA, 0); s != "abc" {
+			t.Error(s)
+		}
+		if s := consumeAll(t, q, topicA, 3); s != "de" {
+			t.Error(s)
+		}
+		if s := consumeAll(t, q, topicB, 0); s != "w" {
+			t.Error(s)
+		}
+
+		// a batch to a missing topic fails the whole transaction
+		_, err = q.ProduceTransaction([]headers.TransactionBatch{
+			{Topic: topicA, Messages: [][]byte{[]byte("f"), []byte("g")}},
+			{Topic: "transaction-missing", Messages: [][]byte{[]byte("x")}},
+		}, 100)
+		if err != headers.ErrTopicDoesNotExist {
+			t.Error(err)
+		}
+		if s := consumeAll(t, q, topicA, 3); s != "de" {
+			t.Error(s)
+		}
+		if info, err := q.ProduceOffsets(topicA, []int64{1}, 100, false, bytes.NewBufferString("f")); err != nil || info.FirstID != 5 {
+			t.Error(info, err)
+		}
+
+		// no journal is left behind
+		for _, d := range []string{dir1, dir2} {
+			if matches, _ := filepath.Glob(filepath.Join(d, transactionPrefix+"*")); len(matches) != 0 {
+				t.Error(matches)
+			}
+		}
+		_ = q.Close()
+	}
+}
+
+func TestQueue_TransactionPending(t *testing.T) {
+	q, err := NewQueue([]string{t.TempDir()}, true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	topic := "pending-topic"
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.ProduceOffsets(topic, []int64{1, 1, 1, 1, 1}, 100, false, bytes.NewBufferString("abcde")); err != nil {
+		t.Fatal(err)
+	}
+
+	// messages from id 2 onwards are hidden while a transaction is written
+	q.setPending(topic, 2)
+	for _, c := range []struct {
+		id       int64
+		expected string
+	}{{0, "ab"}, {1, "b"}, {2, ""}, {4, ""}} {
+		if s := consumeAll(t, q, topic, c.id); s != c.expected {
+			t.Error(c.id, s)
+		}
+	}
+	q.setPending(topic, -1)
+	if s := consumeAll(t, q, topic, 2); s != "cde" {
+		t.Error(s)
+	}
+}
+
+func TestQueue_RecoverTransaction(t *testing.T) {
+	dir1, dir2 := t.TempDir(), t.TempDir()
+	q, err := NewQueue([]string{dir1, dir2}, false, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics := []string{"recover-a", "recover-b"}
+	for _, topic := range topics {
+		if err = q.CreateTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = q.ProduceOffsets(topics[0], []int64{1, 1}, 100, false, bytes.NewBufferString("ab")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a transaction interrupted after writing its batches
+	b, err := json.Marshal(transactionJournal{Topics: map[string]int64{topics[0]: 2, topics[1]: 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{dir1, dir2} {
+		if err = os.WriteFile(filepath.Join(dir, transactionPrefix+"interrupted"), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = q.ProduceOffsets(topics[0], []int64{1, 1, 1, 1}, 100, false, bytes.NewBufferString("cdef")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.ProduceOffsets(topics[1], []int64{1}, 100, false, bytes.NewBufferString("x")); err != nil {
+		t.Fatal(err)
+	}
+	if topics, err := q.ListTopics("", "", ""); err != nil || len(topics) != 2 {
+		t.Error(topics, err)
+	}
+	// a journal torn while being written
+	if err = os.WriteFile(filepath.Join(dir2, transactionPrefix+"torn"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	if err = q.Recover(logf); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 {
+		t.Error(logs)
+	}
+	if s := consumeAll(t, q, topics[0], 0); s != "ab" {
+		t.Error(s)
+	}
+	if s := consumeAll(t, q, topics[1], 0); s != "" {
+		t.Error(s)
+	}
+	for _, dir := range []string{dir1, dir2} {
+		if matches, _ := filepath.Glob(filepath.Join(dir, transactionPrefix+"*")); len(matches) != 0 {
+			t.Error(matches)
+		}
+		if _, err = os.Stat(filepath.Join(dir, topics[0], formatName(3))); !os.IsNotExist(err) {
+			t.Error(err)
+		}
+	}
+
+	// ids are given again after the rollback
+	if info, err := q.ProduceOffsets(topics[0], []int64{1}, 100, false, bytes.NewBufferString("c")); err != nil || info.FirstID != 2 {
+		t.Error(info, err)
+	}
+	if s := consumeAll(t, q, topics[0], 0); s != "abc" {
+		t.Error(s)
+	}
+	_ = q.Close()
+}
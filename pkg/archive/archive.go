@@ -0,0 +1,96 @@
+// Package archive provides the stores holding segments which were moved off of the queue volumes
+package archive
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ArchiveStore is a pluggable backend for archived segment files. Files are grouped by topic and identified by name
+type ArchiveStore interface {
+	// Put stores the contents of r under the topic and name, replacing any existing file
+	Put(topic, name string, r io.Reader) error
+	// Get opens a stored file. If the file does not exist the error matches os.ErrNotExist
+	Get(topic, name string) (io.ReadCloser, error)
+	// List returns the names of the files stored under the topic, it is not an error if there are none
+	List(topic string) ([]string, error)
+	// Delete removes a stored file, it is not an error if the file does not exist
+	Delete(topic, name string) error
+}
+
+// Dir is an ArchiveStore keeping files in a local directory, typically a mounted bulk or network storage volume
+type Dir struct {
+	path string
+}
+
+var _ ArchiveStore = &Dir{}
+
+// NewDir creates a Dir store in the given directory, creating the directory if it does not exist
+func NewDir(path string) (*Dir, error) {
+	path = filepath.Clean(path)
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return nil, errors.Wrapf(err, "unable to create archive directory %q", path)
+	}
+	return &Dir{path: path}, nil
+}
+
+// Put writes the file to a temporary file first, so a partial file is never visible under its name
+func (d *Dir) Put(topic, name string, r io.Reader) error {
+	dir := filepath.Join(d.path, filepath.FromSlash(topic))
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return errors.Wrapf(err, "unable to create archive directory %q", dir)
+	}
+	tmp := filepath.Join(dir, ".put-"+name)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return errors.Wrapf(err, "unable to write archive file %q", tmp)
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// Get opens the file for reading
+func (d *Dir) Get(topic, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.path, filepath.FromSlash(topic), name))
+}
+
+// List returns the names of the files of the topic, skipping nested topics and temporary files
+func (d *Dir) List(topic string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(d.path, filepath.FromSlash(topic)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// Delete removes the file
+func (d *Dir) Delete(topic, name string) error {
+	err := os.Remove(filepath.Join(d.path, filepath.FromSlash(topic), name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
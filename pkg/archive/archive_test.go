@@ -0,0 +1,66 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestDir(t *testing.T) {
+	dir, err := os.MkdirTemp("", ".haraqa*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := NewDir(dir + "/archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const topic = "nested/topic"
+	if names, err := d.List(topic); err != nil || len(names) != 0 {
+		t.Error(err, names)
+	}
+
+	for _, name := range []string{"0000000000000000", "0000000000000000.log", "0000000000000000"} {
+		if err = d.Put(topic, name, bytes.NewBufferString("contents of "+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = d.Put("nested", "other", bytes.NewBufferString("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := d.List(topic)
+	sort.Strings(names)
+	if err != nil || !reflect.DeepEqual(names, []string{"0000000000000000", "0000000000000000.log"}) {
+		t.Error(err, names)
+	}
+	if names, err = d.List("nested"); err != nil || !reflect.DeepEqual(names, []string{"other"}) {
+		t.Error(err, names)
+	}
+
+	r, err := d.Get(topic, "0000000000000000.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(r); err != nil || string(b) != "contents of 0000000000000000.log" {
+		t.Error(err, string(b))
+	}
+	_ = r.Close()
+
+	if err = d.Delete(topic, "0000000000000000.log"); err != nil {
+		t.Error(err)
+	}
+	if err = d.Delete(topic, "0000000000000000.log"); err != nil {
+		t.Error(err)
+	}
+	if _, err = d.Get(topic, "0000000000000000.log"); !errors.Is(err, os.ErrNotExist) {
+		t.Error(err)
+	}
+}
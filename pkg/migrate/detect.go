@@ -0,0 +1,62 @@
+package migrate
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Detect returns the engine storing the data directories, or an empty engine if they do not hold any files yet.
+// The filequeue keeps a log next to every segment, while the queue keeps a single file per segment
+func Detect(dirs []string) (Engine, error) {
+	var found Engine
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && path == dir {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			engine := fileEngine(path)
+			switch {
+			case engine == "":
+			case found == "":
+				found = engine
+			case found != engine:
+				return errors.Errorf("found files of both the %s and %s formats", found, engine)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", errors.Wrapf(err, "unable to detect the format of directory %q", dir)
+		}
+	}
+	return found, nil
+}
+
+// fileEngine returns the engine which wrote a file, or an empty engine for files which are not segments
+func fileEngine(path string) Engine {
+	name := filepath.Base(path)
+	if strings.HasSuffix(name, ".log") || strings.HasSuffix(name, ".log.z") {
+		return EngineFileQueue
+	}
+	name = strings.TrimSuffix(name, ".z")
+	if _, err := strconv.ParseUint(name, 10, 64); err != nil {
+		return ""
+	}
+	base := filepath.Join(filepath.Dir(path), name)
+	for _, ext := range []string{".log", ".log.z"} {
+		if _, err := os.Stat(base + ext); err == nil {
+			return EngineFileQueue
+		}
+	}
+	return EngineQueue
+}
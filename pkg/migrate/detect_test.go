@@ -0,0 +1,57 @@
+package migrate
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/haraqa/haraqa/internal/filequeue"
+	"github.com/haraqa/haraqa/internal/queue"
+)
+
+func TestDetect(t *testing.T) {
+	root, err := os.MkdirTemp("", ".haraqa*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// missing and empty directories have no format yet
+	if engine, err := Detect([]string{root + "/missing", root}); err != nil || engine != "" {
+		t.Error(engine, err)
+	}
+
+	q, err := queue.NewQueue([]string{root + "/queue"}, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	fq, err := filequeue.New(false, 10, root+"/filequeue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fq.Close()
+	for _, s := range []store{q, fq} {
+		if err = s.CreateTopic("topic"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if engine, err := Detect([]string{root + "/queue", root + "/filequeue"}); err != nil || engine != "" {
+		t.Error(engine, err)
+	}
+	if err = q.Produce("topic", []int64{5}, 100, bytes.NewBufferString("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err = fq.Produce("topic", []int64{5}, 100, bytes.NewBufferString("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if engine, err := Detect([]string{root + "/queue"}); err != nil || engine != EngineQueue {
+		t.Error(engine, err)
+	}
+	if engine, err := Detect([]string{root + "/filequeue"}); err != nil || engine != EngineFileQueue {
+		t.Error(engine, err)
+	}
+	if _, err := Detect([]string{root + "/queue", root + "/filequeue"}); err == nil {
+		t.Error("expected mixed formats to fail")
+	}
+}
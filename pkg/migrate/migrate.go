@@ -0,0 +1,218 @@
+// Package migrate converts data directories between the storage engines of the server
+package migrate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/filequeue"
+	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/haraqa/haraqa/internal/queue"
+)
+
+// Engine is the name of a storage engine
+type Engine string
+
+// Storage engines which can be migrated between
+const (
+	EngineQueue     Engine = "queue"
+	EngineFileQueue Engine = "filequeue"
+)
+
+// Logger logs the progress of a migration
+type Logger func(format string, args ...interface{})
+
+// store is the part of a storage engine used by a migration
+type store interface {
+	ListTopics(prefix, suffix, regex string) ([]string, error)
+	CreateTopic(topic string) error
+	ExportSegments(topic string, fn func(baseID int64, entries []headers.Entry) error) error
+	ImportSegment(topic string, baseID int64, entries []headers.Entry) error
+	Close() error
+}
+
+var (
+	_ store = &queue.Queue{}
+	_ store = &filequeue.FileQueue{}
+)
+
+// DefaultMaxEntries is the number of messages per file used when none is given, matching the server default
+const DefaultMaxEntries = 5000
+
+// open opens the data directories of an engine, creating them unless they must exist.
+// Caching is disabled as every file is only read or written once
+func open(engine Engine, dirs []string, maxEntries int64, mustExist bool) (store, error) {
+	if len(dirs) == 0 {
+		return nil, errors.New("at least one directory must be given")
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); mustExist && err != nil {
+			return nil, errors.Wrapf(err, "invalid directory %q", dir)
+		}
+	}
+	switch engine {
+	case EngineQueue:
+		return queue.NewQueue(dirs, false, maxEntries)
+	case EngineFileQueue:
+		return filequeue.New(false, maxEntries, dirs...)
+	}
+	return nil, errors.Errorf("unknown engine %q", engine)
+}
+
+// Migrate copies every topic of the data directories src, stored by the engine from, into the data directories dst
+// stored by the engine to. Messages keep their ids, timestamps and checksums. Consumer group offsets and topic
+// configs are copied as well. Files of the target have room for maxEntries messages, or DefaultMaxEntries if 0.
+// The server must not be running on either set of directories
+func Migrate(from Engine, src []string, to Engine, dst []string, maxEntries int64, logf Logger) error {
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+	if overlap(src, dst) {
+		return errors.New("source and destination directories must differ")
+	}
+	s, err := open(from, src, maxEntries, true)
+	if err != nil {
+		return errors.Wrap(err, "unable to open source")
+	}
+	defer s.Close()
+	d, err := open(to, dst, maxEntries, false)
+	if err != nil {
+		return errors.Wrap(err, "unable to open destination")
+	}
+	defer d.Close()
+
+	topics, err := s.ListTopics("", "", "")
+	if err != nil {
+		return errors.Wrap(err, "unable to list topics")
+	}
+	for _, topic := range topics {
+		err = d.CreateTopic(topic)
+		if err != nil && !errors.Is(err, headers.ErrTopicAlreadyExists) {
+			return errors.Wrapf(err, "unable to create topic %q", topic)
+		}
+		var count int
+		err = s.ExportSegments(topic, func(baseID int64, entries []headers.Entry) error {
+			count += len(entries)
+			return d.ImportSegment(topic, baseID, entries)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "unable to migrate topic %q", topic)
+		}
+		if err = copyTopicFiles(src[len(src)-1], dst, topic); err != nil {
+			return errors.Wrapf(err, "unable to migrate offsets of topic %q", topic)
+		}
+		logf("migrated topic %q with %d messages", topic, count)
+	}
+	return nil
+}
+
+// Verify checks that every topic of the data directories src holds the same messages as in the data
+// directories dst, comparing ids, timestamps, flags, checksums and the messages themselves
+func Verify(from Engine, src []string, to Engine, dst []string, logf Logger) error {
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+	s, err := open(from, src, 0, true)
+	if err != nil {
+		return errors.Wrap(err, "unable to open source")
+	}
+	defer s.Close()
+	d, err := open(to, dst, 0, true)
+	if err != nil {
+		return errors.Wrap(err, "unable to open destination")
+	}
+	defer d.Close()
+
+	topics, err := s.ListTopics("", "", "")
+	if err != nil {
+		return errors.Wrap(err, "unable to list topics")
+	}
+	for _, topic := range topics {
+		want, wantCount, err := digest(s, topic)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read topic %q of source", topic)
+		}
+		got, gotCount, err := digest(d, topic)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read topic %q of destination", topic)
+		}
+		if wantCount != gotCount {
+			return errors.Errorf("topic %q holds %d messages but %d were migrated", topic, wantCount, gotCount)
+		}
+		if !bytes.Equal(want, got) {
+			return errors.Errorf("messages of topic %q do not match", topic)
+		}
+		logf("verified topic %q with %d messages", topic, gotCount)
+	}
+	return nil
+}
+
+// digest hashes every message of a topic, the base ids of the files are left out as engines may roll differently
+func digest(s store, topic string) ([]byte, int, error) {
+	h := sha256.New()
+	var count int
+	var buf [24]byte
+	err := s.ExportSegments(topic, func(_ int64, entries []headers.Entry) error {
+		for _, entry := range entries {
+			binary.LittleEndian.PutUint64(buf[:8], uint64(entry.ID))
+			binary.LittleEndian.PutUint64(buf[8:16], entry.Timestamp)
+			binary.LittleEndian.PutUint64(buf[16:24], entry.Size)
+			_, _ = h.Write(buf[:])
+			_, _ = h.Write(entry.Data)
+		}
+		count += len(entries)
+		return nil
+	})
+	return h.Sum(nil), count, err
+}
+
+// copyTopicFiles copies the consumer group offsets, the config and the producer windows of a topic to every destination directory.
+// Both engines store these files the same way
+func copyTopicFiles(src string, dst []string, topic string) error {
+	srcPath := filepath.Join(src, topic)
+	dir, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	names, err := dir.Readdirnames(-1)
+	_ = dir.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, ".consumer-") && name != ".config" && name != ".producers" && name != ".schedule" {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(srcPath, name))
+		if err != nil {
+			return err
+		}
+		for _, d := range dst {
+			if err = os.WriteFile(filepath.Join(d, topic, name), b, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// overlap reports if any directory is in both lists
+func overlap(a, b []string) bool {
+	for i := range a {
+		for j := range b {
+			if filepath.Clean(a[i]) == filepath.Clean(b[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
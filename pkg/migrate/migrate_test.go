@@ -0,0 +1,131 @@
+package migrate
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/haraqa/haraqa/internal/filequeue"
+	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/haraqa/haraqa/internal/queue"
+)
+
+func TestMigrate(t *testing.T) {
+	root, err := os.MkdirTemp("", ".haraqa*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	src := []string{root + "/src1", root + "/src2"}
+	mid := []string{root + "/mid"}
+	dst := []string{root + "/dst1", root + "/dst2"}
+
+	// a queue with a truncated first file, a consumer group and a topic config
+	const topic = "migrate-topic"
+	q, err := queue.NewQueue(src, false, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err = q.Produce(topic, []int64{1, 2}, uint64(100+i), bytes.NewBufferString("abb")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = q.ModifyTopic(topic, headers.ModifyRequest{Truncate: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.SetConsumerOffset("group", topic, 5); err != nil {
+		t.Fatal(err)
+	}
+	config := headers.TopicConfig{ConsumeLimit: 2}
+	if err = q.SetTopicConfig(topic, config); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic("empty-topic"); err != nil {
+		t.Fatal(err)
+	}
+	_ = q.Close()
+
+	if err = Migrate(EngineQueue, src, EngineFileQueue, src[1:], 0, nil); err == nil {
+		t.Error("expected overlapping directories to fail")
+	}
+	if err = Migrate("unknown", src, EngineFileQueue, mid, 0, nil); err == nil {
+		t.Error("expected an unknown engine to fail")
+	}
+	if err = Migrate(EngineQueue, []string{root + "/missing"}, EngineFileQueue, mid, 0, nil); err == nil {
+		t.Error("expected a missing source to fail")
+	}
+	var logs int
+	logf := func(string, ...interface{}) { logs++ }
+	if err = Migrate(EngineQueue, src, EngineFileQueue, mid, 3, logf); err != nil {
+		t.Fatal(err)
+	}
+	if logs != 2 {
+		t.Error(logs)
+	}
+	if err = Verify(EngineQueue, src, EngineFileQueue, mid, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file queue serves the same ids, offsets and config, then keeps producing after them
+	fq, err := filequeue.New(false, 3, mid...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if n, err := fq.Consume("", topic, 3, -1, w); err != nil || n != 3 || w.Body.String() != "bbabb" {
+		t.Error(n, err, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	if n, err := fq.Consume("group", topic, -1, 1, w); err != nil || n != 1 || w.Body.String() != "bb" {
+		t.Error(n, err, w.Body.String())
+	}
+	if c, err := fq.TopicConfig(topic); err != nil || *c != config {
+		t.Error(c, err)
+	}
+	if err = fq.Produce(topic, []int64{3}, 200, bytes.NewBufferString("ccc")); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	if n, err := fq.Consume("", topic, 8, 1, w); err != nil || n != 1 || w.Body.String() != "ccc" {
+		t.Error(n, err, w.Body.String())
+	}
+	_ = fq.Close()
+	if err = Verify(EngineQueue, src, EngineFileQueue, mid, nil); err == nil {
+		t.Error("expected verification of a changed topic to fail")
+	}
+
+	// and back again
+	if err = Migrate(EngineFileQueue, mid, EngineQueue, dst, 3, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = Verify(EngineFileQueue, mid, EngineQueue, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	q, err = queue.NewQueue(dst, false, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for id, expected := range map[int64]string{3: "bb", 4: "a", 7: "bb", 8: "ccc"} {
+		w = httptest.NewRecorder()
+		if n, err := q.Consume("", topic, id, 1, w); err != nil || n != 1 || w.Body.String() != expected {
+			t.Error(id, n, err, w.Body.String())
+		}
+	}
+	w = httptest.NewRecorder()
+	if n, err := q.Consume("group", topic, -1, 1, w); err != nil || n != 1 || w.Body.String() != "bb" {
+		t.Error(n, err, w.Body.String())
+	}
+	if err = q.Produce(topic, []int64{1}, 300, bytes.NewBufferString("d")); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	if n, err := q.Consume("", topic, 9, 1, w); err != nil || n != 1 || w.Body.String() != "d" {
+		t.Error(n, err, w.Body.String())
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import "time"
+
+// archiveLoop moves the old segments of every topic to the archive on every interval until the server closes
+func (s *Server) archiveLoop(archiver Archiver) {
+	defer s.waitGroup.Done()
+	ticker := time.NewTicker(s.archiveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+		s.archive(archiver, time.Now())
+	}
+}
+
+// archive moves the segments of every topic which only hold messages older than the archive age
+func (s *Server) archive(archiver Archiver, now time.Time) {
+	topics, err := s.q.ListTopics("", "", "")
+	if err != nil {
+		s.logger.Errorf("archive: list topics: %s", err.Error())
+		return
+	}
+	for _, topic := range topics {
+		start := time.Now()
+		archived, err := archiver.ArchiveSegments(topic, now.Add(-s.archiveAge))
+		if err != nil {
+			s.logger.Errorf("archive: topic %q: %s", topic, err.Error())
+			continue
+		}
+		if archived > 0 {
+			s.logger.Infof("archive: moved %d segments of topic %q", archived, topic)
+		}
+		if m, ok := s.metrics.(ArchiveMetrics); ok {
+			m.ArchiveRun(topic, archived, time.Since(start))
+		}
+	}
+}
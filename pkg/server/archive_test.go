@@ -0,0 +1,107 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/pkg/archive"
+)
+
+type archiveMetrics struct {
+	noOpMetrics
+	archived map[string]int64
+}
+
+func (m *archiveMetrics) ArchiveRun(topic string, archived int64, d time.Duration) {
+	m.archived[topic] += archived
+}
+
+func TestServer_archive(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	q := NewMockQueue(ctrl)
+	q.EXPECT().RootDir().Return("").AnyTimes()
+	q.EXPECT().Close().Return(nil).Times(1)
+	metrics := &archiveMetrics{archived: make(map[string]int64)}
+	s, err := NewServer(WithQueue(q), WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.archiveAge = time.Hour
+	archiver := NewMockArchiver(ctrl)
+
+	// list error
+	q.EXPECT().ListTopics("", "", "").Return(nil, errors.New("test list error")).Times(1)
+	s.archive(archiver, time.Now())
+
+	now := time.Now()
+	gomock.InOrder(
+		q.EXPECT().ListTopics("", "", "").Return([]string{"logs", "failed"}, nil).Times(1),
+		archiver.EXPECT().ArchiveSegments("logs", now.Add(-time.Hour)).Return(int64(3), nil).Times(1),
+		archiver.EXPECT().ArchiveSegments("failed", now.Add(-time.Hour)).Return(int64(0), errors.New("test archive error")).Times(1),
+	)
+	s.archive(archiver, now)
+
+	if len(metrics.archived) != 1 || metrics.archived["logs"] != 3 {
+		t.Error(metrics.archived)
+	}
+}
+
+func TestServer_archiveLoop(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	store := &archive.Dir{}
+
+	// queue without archiving
+	{
+		q := NewMockQueue(ctrl)
+		_, err := NewServer(WithQueue(q), WithArchive(time.Millisecond, time.Hour, store, "cache", 1))
+		if err == nil || err.Error() != "queue does not support archiving" {
+			t.Fatal(err)
+		}
+	}
+
+	// invalid cache directory
+	{
+		q := struct {
+			*MockQueue
+			*MockArchiver
+		}{NewMockQueue(ctrl), NewMockArchiver(ctrl)}
+		q.MockArchiver.EXPECT().SetArchive(store, "cache", 1).Return(errors.New("test cache error")).Times(1)
+		_, err := NewServer(WithQueue(q), WithArchive(time.Millisecond, time.Hour, store, "cache", 1))
+		if err == nil || err.Error() != "unable to set archive: test cache error" {
+			t.Fatal(err)
+		}
+	}
+
+	q := struct {
+		*MockQueue
+		*MockArchiver
+	}{NewMockQueue(ctrl), NewMockArchiver(ctrl)}
+	q.MockQueue.EXPECT().RootDir().Return("").Times(1)
+	q.MockQueue.EXPECT().Close().Return(nil).Times(1)
+	q.MockQueue.EXPECT().ListTopics("", "", "").Return([]string{"topic"}, nil).MinTimes(1)
+	q.MockArchiver.EXPECT().SetArchive(store, "cache", 1).Return(nil).Times(1)
+	archived := make(chan struct{}, 1)
+	q.MockArchiver.EXPECT().ArchiveSegments("topic", gomock.Any()).DoAndReturn(func(topic string, before time.Time) (int64, error) {
+		select {
+		case archived <- struct{}{}:
+		default:
+		}
+		return 0, nil
+	}).MinTimes(1)
+
+	s, err := NewServer(WithQueue(q), WithArchive(time.Millisecond, time.Hour, store, "cache", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-archived
+	if err = s.Close(); err != nil {
+		t.Error(err)
+	}
+}
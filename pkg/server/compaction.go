@@ -0,0 +1,67 @@
+package server
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// compactionLoop compacts the configured topics on every interval until the server closes
+func (s *Server) compactionLoop(compactor Compactor) {
+	defer s.waitGroup.Done()
+	ticker := time.NewTicker(s.compactionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+		s.compact(compactor, time.Now())
+	}
+}
+
+// compact removes the messages of each configured topic which have been replaced by a newer message with the same key
+func (s *Server) compact(compactor Compactor, now time.Time) {
+	for _, topic := range s.compactedTopics() {
+		start := time.Now()
+		removed, err := compactor.Compact(topic, now.Add(-s.compactionTombstoneAge))
+		if err != nil {
+			if !errors.Is(err, headers.ErrTopicDoesNotExist) {
+				s.logger.Errorf("compaction: topic %q: %s", topic, err.Error())
+			}
+			continue
+		}
+		if removed > 0 {
+			s.logger.Infof("compaction: removed %d messages from topic %q", removed, topic)
+		}
+		if m, ok := s.metrics.(CompactionMetrics); ok {
+			m.CompactionRun(topic, removed, time.Since(start))
+		}
+	}
+}
+
+// compactedTopics returns the topics given to WithCompaction along with the topics configured to be compacted
+func (s *Server) compactedTopics() []string {
+	if _, ok := s.q.(TopicConfigurer); !ok {
+		return s.compactionTopics
+	}
+	all, err := s.q.ListTopics("", "", "")
+	if err != nil {
+		s.logger.Errorf("compaction: list topics: %s", err.Error())
+		return s.compactionTopics
+	}
+	topics := append(make([]string, 0, len(s.compactionTopics)), s.compactionTopics...)
+	given := make(map[string]bool, len(s.compactionTopics))
+	for _, topic := range s.compactionTopics {
+		given[topic] = true
+	}
+	for _, topic := range all {
+		if !given[topic] && s.topicConfig(topic).Compact {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
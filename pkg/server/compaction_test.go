@@ -0,0 +1,113 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+type compactionMetrics struct {
+	noOpMetrics
+	removed map[string]int64
+}
+
+func (m *compactionMetrics) CompactionRun(topic string, removed int64, d time.Duration) {
+	m.removed[topic] += removed
+}
+
+func TestServer_compact(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	now := time.Now()
+	q := NewMockQueue(ctrl)
+	q.EXPECT().RootDir().Return("").AnyTimes()
+	q.EXPECT().Close().Return(nil).Times(1)
+	metrics := &compactionMetrics{removed: make(map[string]int64)}
+	s, err := NewServer(WithQueue(q), WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.compactionTombstoneAge = time.Hour
+	s.compactionTopics = []string{"changelog", "missing", "failed"}
+
+	compactor := NewMockCompactor(ctrl)
+	gomock.InOrder(
+		compactor.EXPECT().Compact("changelog", now.Add(-time.Hour)).Return(int64(5), nil).Times(1),
+		compactor.EXPECT().Compact("missing", now.Add(-time.Hour)).Return(int64(0), headers.ErrTopicDoesNotExist).Times(1),
+		compactor.EXPECT().Compact("failed", now.Add(-time.Hour)).Return(int64(0), errors.New("test compact error")).Times(1),
+	)
+	s.compact(compactor, now)
+
+	if len(metrics.removed) != 1 || metrics.removed["changelog"] != 5 {
+		t.Error(metrics.removed)
+	}
+}
+
+func TestServer_compactionLoop(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// queue without compaction
+	{
+		q := NewMockQueue(ctrl)
+		_, err := NewServer(WithQueue(q), WithCompaction(time.Millisecond, 0, "topic"))
+		if err == nil || err.Error() != "queue does not support compaction" {
+			t.Fatal(err)
+		}
+	}
+
+	q := struct {
+		*MockQueue
+		*MockCompactor
+	}{NewMockQueue(ctrl), NewMockCompactor(ctrl)}
+	q.MockQueue.EXPECT().RootDir().Return("").Times(1)
+	q.MockQueue.EXPECT().Close().Return(nil).Times(1)
+	compacted := make(chan struct{}, 1)
+	q.MockCompactor.EXPECT().Compact("topic", gomock.Any()).DoAndReturn(func(topic string, tombstonesBefore time.Time) (int64, error) {
+		select {
+		case compacted <- struct{}{}:
+		default:
+		}
+		return 0, nil
+	}).MinTimes(1)
+
+	s, err := NewServer(WithQueue(q), WithCompaction(time.Millisecond, 0, "topic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-compacted
+	if err = s.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServer_compactedTopics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	q := struct {
+		*MockQueue
+		*MockTopicConfigurer
+	}{NewMockQueue(ctrl), NewMockTopicConfigurer(ctrl)}
+	s := &Server{q: q, logger: noopLogger{}, compactionTopics: []string{"changelog"}}
+
+	// list error
+	q.MockQueue.EXPECT().ListTopics("", "", "").Return(nil, errors.New("test list error")).Times(1)
+	if topics := s.compactedTopics(); !reflect.DeepEqual(topics, []string{"changelog"}) {
+		t.Error(topics)
+	}
+
+	q.MockQueue.EXPECT().ListTopics("", "", "").Return([]string{"changelog", "configured", "other"}, nil).Times(1)
+	q.MockTopicConfigurer.EXPECT().TopicConfig("configured").Return(&headers.TopicConfig{Compact: true}, nil).Times(1)
+	q.MockTopicConfigurer.EXPECT().TopicConfig("other").Return(&headers.TopicConfig{}, nil).Times(1)
+	if topics := s.compactedTopics(); !reflect.DeepEqual(topics, []string{"changelog", "configured"}) {
+		t.Error(topics)
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import "time"
+
+// compressionLoop compresses the closed segments of every topic on every interval until the server closes
+func (s *Server) compressionLoop(compressor SegmentCompressor) {
+	defer s.waitGroup.Done()
+	ticker := time.NewTicker(s.compressionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+		s.compress(compressor)
+	}
+}
+
+// compress compresses the closed segments of every topic
+func (s *Server) compress(compressor SegmentCompressor) {
+	topics, err := s.q.ListTopics("", "", "")
+	if err != nil {
+		s.logger.Errorf("compression: list topics: %s", err.Error())
+		return
+	}
+	for _, topic := range topics {
+		start := time.Now()
+		saved, err := compressor.CompressSegments(topic)
+		if err != nil {
+			s.logger.Errorf("compression: topic %q: %s", topic, err.Error())
+			continue
+		}
+		if saved > 0 {
+			s.logger.Infof("compression: saved %d bytes in topic %q", saved, topic)
+		}
+		if m, ok := s.metrics.(CompressionMetrics); ok {
+			m.CompressionRun(topic, saved, time.Since(start))
+		}
+	}
+}
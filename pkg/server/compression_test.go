@@ -0,0 +1,88 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+)
+
+type compressionMetrics struct {
+	noOpMetrics
+	saved map[string]int64
+}
+
+func (m *compressionMetrics) CompressionRun(topic string, saved int64, d time.Duration) {
+	m.saved[topic] += saved
+}
+
+func TestServer_compress(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	q := NewMockQueue(ctrl)
+	q.EXPECT().RootDir().Return("").AnyTimes()
+	q.EXPECT().Close().Return(nil).Times(1)
+	metrics := &compressionMetrics{saved: make(map[string]int64)}
+	s, err := NewServer(WithQueue(q), WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	compressor := NewMockSegmentCompressor(ctrl)
+
+	// list error
+	q.EXPECT().ListTopics("", "", "").Return(nil, errors.New("test list error")).Times(1)
+	s.compress(compressor)
+
+	gomock.InOrder(
+		q.EXPECT().ListTopics("", "", "").Return([]string{"logs", "failed"}, nil).Times(1),
+		compressor.EXPECT().CompressSegments("logs").Return(int64(1024), nil).Times(1),
+		compressor.EXPECT().CompressSegments("failed").Return(int64(0), errors.New("test compress error")).Times(1),
+	)
+	s.compress(compressor)
+
+	if len(metrics.saved) != 1 || metrics.saved["logs"] != 1024 {
+		t.Error(metrics.saved)
+	}
+}
+
+func TestServer_compressionLoop(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// queue without compression
+	{
+		q := NewMockQueue(ctrl)
+		_, err := NewServer(WithQueue(q), WithCompression(time.Millisecond))
+		if err == nil || err.Error() != "queue does not support compression" {
+			t.Fatal(err)
+		}
+	}
+
+	q := struct {
+		*MockQueue
+		*MockSegmentCompressor
+	}{NewMockQueue(ctrl), NewMockSegmentCompressor(ctrl)}
+	q.MockQueue.EXPECT().RootDir().Return("").Times(1)
+	q.MockQueue.EXPECT().Close().Return(nil).Times(1)
+	q.MockQueue.EXPECT().ListTopics("", "", "").Return([]string{"topic"}, nil).MinTimes(1)
+	compressed := make(chan struct{}, 1)
+	q.MockSegmentCompressor.EXPECT().CompressSegments("topic").DoAndReturn(func(topic string) (int64, error) {
+		select {
+		case compressed <- struct{}{}:
+		default:
+		}
+		return 0, nil
+	}).MinTimes(1)
+
+	s, err := NewServer(WithQueue(q), WithCompression(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-compressed
+	if err = s.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// decodeBody returns the decoded body of a produce request, based on its Content-Encoding header.
+// Only identity and gzip encoded bodies are accepted
+func decodeBody(r *http.Request) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(getFirst(r.Header, headers.ContentEncoding))) {
+	case "", headers.EncodingIdentity:
+		return r.Body, nil
+	case headers.EncodingGzip:
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, headers.ErrInvalidEncoding
+		}
+		return &gzipBody{Reader: gr, body: r.Body}, nil
+	default:
+		return nil, headers.ErrInvalidEncoding
+	}
+}
+
+// gzipBody is a gzip encoded request body, a corrupt stream is reported as an invalid encoding
+type gzipBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		return n, headers.ErrInvalidEncoding
+	}
+	return n, err
+}
+
+func (b *gzipBody) Close() error {
+	_ = b.Reader.Close()
+	return b.body.Close()
+}
+
+// acceptsGzip reports if the Accept-Encoding header of a consume request allows gzip encoded responses
+func acceptsGzip(h http.Header) bool {
+	for _, v := range h[headers.AcceptEncoding] {
+		for _, token := range strings.Split(v, ",") {
+			params := strings.Split(token, ";")
+			if strings.ToLower(strings.TrimSpace(params[0])) != headers.EncodingGzip {
+				continue
+			}
+			accepted := true
+			for _, param := range params[1:] {
+				if q := strings.ReplaceAll(param, " ", ""); strings.HasPrefix(q, "q=") {
+					accepted = strings.Trim(strings.TrimPrefix(q, "q="), "0.") != ""
+				}
+			}
+			return accepted
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter gzip encodes the messages of a successful consume response. Error responses
+// are written as is
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gw          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status == http.StatusOK || status == http.StatusPartialContent {
+		h := w.ResponseWriter.Header()
+		delete(h, "Content-Length")
+		delete(h, "Content-Range")
+		h[headers.ContentEncoding] = []string{headers.EncodingGzip}
+		h["Vary"] = []string{headers.AcceptEncoding}
+		w.gw, _ = gzip.NewWriterLevel(w.ResponseWriter, gzip.BestSpeed)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gw == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gw.Write(b)
+}
+
+// Close flushes any buffered messages to the underlying writer
+func (w *gzipResponseWriter) Close() error {
+	if w.gw == nil {
+		return nil
+	}
+	return w.gw.Close()
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestServer_HandleProduceEncoded(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	q := NewMockQueue(ctrl)
+	q.EXPECT().RootDir().Times(1).Return("")
+	q.EXPECT().Close().Times(1).Return(nil)
+	q.EXPECT().GetTopicOwner("topic").Return("", nil).AnyTimes()
+	q.EXPECT().Produce("topic", []int64{5, 6}, gomock.Any(), gomock.Any()).
+		DoAndReturn(func(topic string, sizes []int64, timestamp uint64, r io.Reader) error {
+			b, err := io.ReadAll(r)
+			if err != nil || string(b) != "hello world" {
+				t.Error(err, string(b))
+			}
+			return err
+		}).Times(1)
+
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	produce := func(encoding string, body []byte) *http.Response {
+		r := httptest.NewRequest(http.MethodPost, "/topics/topic", bytes.NewReader(body))
+		r.Header.Set(headers.HeaderSizes, "5:6")
+		r.Header.Set(headers.ContentEncoding, encoding)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	// gzip bodies are decoded before they are written
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, _ = gw.Write([]byte("hello world"))
+	_ = gw.Close()
+	if resp := produce(headers.EncodingGzip, buf.Bytes()); resp.StatusCode != http.StatusNoContent {
+		t.Error(resp.Status)
+	}
+
+	// unknown encodings and corrupt streams are rejected
+	for _, tc := range []struct {
+		encoding string
+		body     []byte
+	}{{"br", []byte("hello world")}, {headers.EncodingGzip, []byte("hello world")}} {
+		resp := produce(tc.encoding, tc.body)
+		if resp.StatusCode != http.StatusUnsupportedMediaType || headers.ReadErrors(resp.Header) != headers.ErrInvalidEncoding {
+			t.Error(tc.encoding, resp.Status)
+		}
+	}
+}
+
+func TestServer_HandleConsumeEncoded(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	q := NewMockQueue(ctrl)
+	q.EXPECT().RootDir().Times(1).Return("")
+	q.EXPECT().Close().Times(1).Return(nil)
+	q.EXPECT().GetTopicOwner("topic").Return("", nil).AnyTimes()
+	q.EXPECT().Consume("", "topic", int64(0), int64(-1), gomock.Any()).
+		DoAndReturn(func(group, topic string, id, limit int64, w http.ResponseWriter) (int, error) {
+			w.Header()["Content-Length"] = []string{"11"}
+			w.WriteHeader(http.StatusPartialContent)
+			_, err := w.Write([]byte("hello world"))
+			return 2, err
+		}).Times(2)
+	q.EXPECT().Consume("", "topic", int64(1), int64(-1), gomock.Any()).Return(0, headers.ErrTopicDoesNotExist).Times(1)
+
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	consume := func(id, accept string) *http.Response {
+		r := httptest.NewRequest(http.MethodGet, "/topics/topic", nil)
+		r.Header.Set(headers.HeaderID, id)
+		r.Header.Set(headers.AcceptEncoding, accept)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	// responses are gzip encoded if the client accepts it
+	resp := consume("0", "deflate, gzip")
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get(headers.ContentEncoding) != headers.EncodingGzip || resp.Header.Get("Content-Length") != "" {
+		t.Fatal(resp.Status, resp.Header)
+	}
+	gr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(gr); err != nil || string(b) != "hello world" {
+		t.Error(err, string(b))
+	}
+
+	// otherwise they are sent as is
+	resp = consume("0", "gzip;q=0")
+	if b, _ := io.ReadAll(resp.Body); resp.Header.Get(headers.ContentEncoding) != "" || string(b) != "hello world" {
+		t.Error(resp.Header, string(b))
+	}
+
+	// errors are never encoded
+	resp = consume("1", "gzip")
+	if resp.StatusCode != http.StatusPreconditionFailed || resp.Header.Get(headers.ContentEncoding) != "" {
+		t.Error(resp.Status, resp.Header)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for v, expected := range map[string]bool{
+		"":                  false,
+		"identity":          false,
+		"gzip":              true,
+		"GZIP":              true,
+		"br, gzip;q=0.5":    true,
+		"gzip;q=0":          false,
+		"gzip; q=0.000":     false,
+		"deflate, identity": false,
+	} {
+		h := http.Header{}
+		if v != "" {
+			h.Set(headers.AcceptEncoding, v)
+		}
+		if acceptsGzip(h) != expected {
+			t.Error(v, expected)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestServer_HandleCommitOffset(t *testing.T) {
+	topic := "commit_topic"
+	group := "group"
+	t.Run("invalid topic",
+		handleCommitOffset(http.StatusBadRequest, headers.ErrInvalidTopic, "", group, "123", nil))
+	t.Run("missing group",
+		handleCommitOffset(http.StatusBadRequest, headers.ErrInvalidGroup, topic, "", "123", nil))
+	t.Run("missing id",
+		handleCommitOffset(http.StatusBadRequest, headers.ErrInvalidMessageID, topic, group, "", nil))
+	t.Run("negative id",
+		handleCommitOffset(http.StatusBadRequest, headers.ErrInvalidMessageID, topic, group, "-1", nil))
+	t.Run("happy path",
+		handleCommitOffset(http.StatusNoContent, nil, topic, group, "123", func(q *MockQueue) {
+			q.EXPECT().SetConsumerOffset(group, topic, int64(123)).Return(nil).Times(1)
+		}))
+	t.Run("topic doesn't exist",
+		handleCommitOffset(http.StatusPreconditionFailed, headers.ErrTopicDoesNotExist, topic, group, "123", func(q *MockQueue) {
+			q.EXPECT().SetConsumerOffset(group, topic, int64(123)).Return(headers.ErrTopicDoesNotExist).Times(1)
+		}))
+	errUnknown := errors.New("test commit error")
+	t.Run("unknown error",
+		handleCommitOffset(http.StatusInternalServerError, errUnknown, topic, group, "123", func(q *MockQueue) {
+			q.EXPECT().SetConsumerOffset(group, topic, int64(123)).Return(errUnknown).Times(1)
+		}))
+}
+
+func handleCommitOffset(status int, errExpected error, topic, group, id string, expect func(q *MockQueue)) func(t *testing.T) {
+	return func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		// setup mock queue
+		q := NewMockQueue(ctrl)
+		q.EXPECT().RootDir().Times(1).Return("")
+		q.EXPECT().Close().Return(nil).Times(1)
+		if expect != nil {
+			expect(q)
+		}
+
+		// setup server
+		s, err := NewServer(WithQueue(q))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer s.Close()
+
+		// create request
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodPut, "/offsets/"+topic, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		r.Header.Set(headers.HeaderConsumerGroup, group)
+		r.Header.Set(headers.HeaderID, id)
+
+		// handle
+		_, err = getPathTopic(r, "/offsets/")
+		if err != nil {
+			s.HandleCommitOffset(w, r)
+		} else {
+			q.EXPECT().GetTopicOwner(topic).Return("", nil)
+			s.ServeHTTP(w, r)
+		}
+
+		// check result
+		resp := w.Result()
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Error(resp.Status)
+		}
+		err = headers.ReadErrors(resp.Header)
+		if err != errExpected && err.Error() != errExpected.Error() {
+			t.Error(err)
+		}
+	}
+}
+
+func TestServer_HandleCommitOffsetOwnerError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	q := NewMockQueue(ctrl)
+	q.EXPECT().RootDir().Times(1).Return("")
+	q.EXPECT().Close().Return(nil).Times(1)
+	q.EXPECT().GetTopicOwner("topic").Return("", headers.ErrTopicDoesNotExist).Times(1)
+
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodPut, "/offsets/topic", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set(headers.HeaderConsumerGroup, "group")
+	r.Header.Set(headers.HeaderID, "123")
+	s.ServeHTTP(w, r)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Error(resp.Status)
+	}
+	if err := headers.ReadErrors(resp.Header); err != headers.ErrTopicDoesNotExist {
+		t.Error(err)
+	}
+}
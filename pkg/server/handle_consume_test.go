@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	urlpkg "net/url"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/pkg/errors"
@@ -45,6 +46,26 @@ func TestServer_HandleConsume(t *testing.T) {
 		handleConsume(group, http.StatusNoContent, headers.ErrNoContent, "/topics/"+topic+"?id=123", func(q *MockQueue) {
 			q.EXPECT().Consume(group, topic, int64(123), int64(-1), gomock.Any()).Return(0, nil).Times(1)
 		}))
+	t.Run("auto commit",
+		handleConsume(group, http.StatusPartialContent, nil, "/topics/"+topic+"?id=-1&commit=true", func(q *MockQueue) {
+			gomock.InOrder(
+				q.EXPECT().Consume(group, topic, int64(-1), int64(-1), gomock.Any()).
+					DoAndReturn(func(group, topic string, offset, limit int64, w http.ResponseWriter) (int, error) {
+						w.Header()[headers.HeaderNextID] = []string{"133"}
+						w.WriteHeader(http.StatusPartialContent)
+						return 10, nil
+					}).Times(1),
+				q.EXPECT().SetConsumerOffset(group, topic, int64(133)).Return(nil).Times(1),
+			)
+		}))
+	t.Run("auto commit error",
+		handleConsume(group, http.StatusPartialContent, nil, "/topics/"+topic+"?id=-1&commit=true", func(q *MockQueue) {
+			q.EXPECT().Consume(group, topic, int64(-1), int64(-1), gomock.Any()).
+				DoAndReturn(func(group, topic string, offset, limit int64, w http.ResponseWriter) (int, error) {
+					w.WriteHeader(http.StatusPartialContent)
+					return 10, nil
+				}).Times(1)
+		}))
 	errUnknown := errors.New("some unexpected error")
 	t.Run("unknown error",
 		handleConsume(group, http.StatusInternalServerError, errUnknown, "/topics/"+topic+"?id=123", func(q *MockQueue) {
@@ -87,6 +108,7 @@ func handleConsume(group string, status int, errExpected error, url string, expe
 		r.Header.Set(headers.HeaderConsumerGroup, group)
 		r.Header.Set(headers.HeaderID, u.Query().Get("id"))
 		r.Header.Set(headers.HeaderLimit, u.Query().Get("limit"))
+		r.Header.Set(headers.HeaderAutoCommit, u.Query().Get("commit"))
 		fmt.Println(url, r.Header)
 
 		// if no topic, handle directly
@@ -110,3 +132,94 @@ func handleConsume(group string, status int, errExpected error, url string, expe
 		}
 	}
 }
+
+func TestServer_HandleConsumeFramed(t *testing.T) {
+	topic := "consumer_topic"
+	for _, framed := range []string{"", "true"} {
+		ctrl := gomock.NewController(t)
+		q := struct {
+			*MockQueue
+			*MockFramedQueue
+		}{NewMockQueue(ctrl), NewMockFramedQueue(ctrl)}
+		q.MockQueue.EXPECT().RootDir().Times(1).Return("")
+		q.MockQueue.EXPECT().Close().Times(1).Return(nil)
+		q.MockQueue.EXPECT().GetTopicOwner(topic).Return("", nil)
+		if framed == "true" {
+			q.MockFramedQueue.EXPECT().ConsumeFramed("", topic, int64(0), int64(-1), gomock.Any()).Return(1, nil).Times(1)
+		} else {
+			q.MockQueue.EXPECT().Consume("", topic, int64(0), int64(-1), gomock.Any()).Return(1, nil).Times(1)
+		}
+
+		s, err := NewServer(WithQueue(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodGet, "/topics/"+topic, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set(headers.HeaderID, "0")
+		r.Header.Set(headers.HeaderFramed, framed)
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Error(framed, w.Code)
+		}
+		_ = s.Close()
+		ctrl.Finish()
+	}
+}
+
+func TestServer_HandleConsumeScheduled(t *testing.T) {
+	topic := "consumer_topic"
+	group := "group"
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	q := struct {
+		*MockQueue
+		*MockScheduleStore
+	}{NewMockQueue(ctrl), NewMockScheduleStore(ctrl)}
+	q.MockQueue.EXPECT().RootDir().Times(1).Return("")
+	q.MockQueue.EXPECT().Close().Times(1).Return(nil)
+	q.MockQueue.EXPECT().GetTopicOwner(topic).Return("", nil).AnyTimes()
+	q.MockScheduleStore.EXPECT().Schedule(topic).Return(&headers.Schedule{
+		Deferred: map[string][]headers.ScheduledBatch{group: {{FirstID: 3, LastID: 4, NotBefore: time.Unix(100, 0)}}},
+	}, nil).Times(1)
+	q.MockScheduleStore.EXPECT().SetSchedule(topic, gomock.Any()).Return(nil).AnyTimes()
+	gomock.InOrder(
+		// a due deferred batch is delivered first, without moving the offset of the group
+		q.MockQueue.EXPECT().Consume("", topic, int64(3), int64(2), gomock.Any()).
+			DoAndReturn(func(group, topic string, offset, limit int64, w http.ResponseWriter) (int, error) {
+				w.Header()[headers.HeaderNextID] = []string{"5"}
+				return 2, nil
+			}),
+		// then the group reads from its offset, resolved before reading
+		q.MockScheduleStore.EXPECT().ConsumerOffset(group, topic).Return(int64(7), nil),
+		q.MockQueue.EXPECT().Consume("", topic, int64(7), int64(-1), gomock.Any()).
+			DoAndReturn(func(group, topic string, offset, limit int64, w http.ResponseWriter) (int, error) {
+				w.Header()[headers.HeaderNextID] = []string{"8"}
+				return 1, nil
+			}),
+		q.MockQueue.EXPECT().SetConsumerOffset(group, topic, int64(8)).Return(nil),
+	)
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodGet, "/topics/"+topic, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set(headers.HeaderConsumerGroup, group)
+		r.Header.Set(headers.HeaderID, "0")
+		r.Header.Set(headers.HeaderAutoCommit, "true")
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Error(i, w.Code)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package server
 
 import (
-	"bytes"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -53,7 +52,7 @@ func handleCreateTopic(status int, errExpected error, topic string, expect func(
 
 		// create request
 		w := httptest.NewRecorder()
-		r, err := http.NewRequest(http.MethodPut, "/topics/"+topic, bytes.NewBuffer([]byte("test body")))
+		r, err := http.NewRequest(http.MethodPut, "/topics/"+topic, nil)
 		if err != nil {
 			t.Error(err)
 			return
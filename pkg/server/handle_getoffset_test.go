@@ -0,0 +1,112 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestServer_HandleGetOffset(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	since := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	getOffset := func(s *Server, path, since string) *http.Response {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if since != "" {
+			r.Header.Set(headers.HeaderSince, since)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	// queue without seeking by time
+	{
+		q := NewMockQueue(ctrl)
+		q.EXPECT().RootDir().Return("").Times(1)
+		q.EXPECT().Close().Return(nil).Times(1)
+		q.EXPECT().GetTopicOwner("topic").Return("", nil).Times(1)
+		s, err := NewServer(WithQueue(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := getOffset(s, "/offsets/topic", since.Format(time.RFC3339))
+		if resp.StatusCode != http.StatusBadRequest || headers.ReadErrors(resp.Header) != headers.ErrInvalidHeaderSince {
+			t.Error(resp.Status)
+		}
+		_ = s.Close()
+	}
+
+	q := struct {
+		*MockQueue
+		*MockTimeSeeker
+	}{NewMockQueue(ctrl), NewMockTimeSeeker(ctrl)}
+	q.MockQueue.EXPECT().RootDir().Return("").Times(1)
+	q.MockQueue.EXPECT().Close().Return(nil).Times(1)
+	q.MockQueue.EXPECT().GetTopicOwner("topic").Return("", nil).AnyTimes()
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// invalid requests
+	for _, tc := range []struct {
+		path, since string
+		err         error
+	}{
+		{"/offsets/", since.Format(time.RFC3339), headers.ErrInvalidTopic},
+		{"/offsets/topic", "", headers.ErrInvalidHeaderSince},
+		{"/offsets/topic", "yesterday", headers.ErrInvalidHeaderSince},
+	} {
+		resp := getOffset(s, tc.path, tc.since)
+		if resp.StatusCode != http.StatusBadRequest || headers.ReadErrors(resp.Header) != tc.err {
+			t.Error(tc.path, tc.since, resp.Status)
+		}
+	}
+
+	// missing topic
+	q.MockTimeSeeker.EXPECT().OffsetAt("topic", since).Return(int64(0), headers.ErrTopicDoesNotExist).Times(1)
+	if resp := getOffset(s, "/offsets/topic", since.Format(time.RFC3339)); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Error(resp.Status)
+	}
+
+	// happy path
+	q.MockTimeSeeker.EXPECT().OffsetAt("topic", since).Return(int64(123), nil).Times(1)
+	resp := getOffset(s, "/offsets/topic", since.Format(time.RFC3339))
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(headers.HeaderID) != "123" || string(b) != "123" {
+		t.Error(resp.Status, resp.Header, string(b))
+	}
+
+	// consume from a time
+	gomock.InOrder(
+		q.MockTimeSeeker.EXPECT().OffsetAt("topic", since).Return(int64(123), nil).Times(1),
+		q.MockQueue.EXPECT().Consume("", "topic", int64(123), int64(-1), gomock.Any()).
+			DoAndReturn(func(group, topic string, id, limit int64, w http.ResponseWriter) (int, error) {
+				w.WriteHeader(http.StatusPartialContent)
+				return 1, nil
+			}).Times(1),
+		q.MockTimeSeeker.EXPECT().OffsetAt("topic", since).Return(int64(0), errors.New("test seek error")).Times(1),
+	)
+	r := httptest.NewRequest(http.MethodGet, "/topics/topic", nil)
+	r.Header.Set(headers.HeaderSince, since.Format(time.RFC3339))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusPartialContent {
+		t.Error(w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Error(w.Code)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/pkg/errors"
@@ -30,6 +31,14 @@ func TestServer_HandleModifyTopic(t *testing.T) {
 		handleModifyTopic(http.StatusOK, nil, topic, info, bytes.NewBuffer([]byte(`{"truncate":123}`)), func(q *MockQueue) {
 			q.EXPECT().ModifyTopic(topic, gomock.Any()).Return(&headers.TopicInfo{MinOffset: 123, MaxOffset: 456}, nil).Times(1)
 		}))
+	t.Run("before only",
+		handleModifyTopic(http.StatusOK, nil, topic, info, bytes.NewBuffer([]byte(`{"before":"2021-01-01T00:00:00Z"}`)), func(q *MockQueue) {
+			q.EXPECT().ModifyTopic(topic, headers.ModifyRequest{Before: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}).Return(&headers.TopicInfo{MinOffset: 123, MaxOffset: 456}, nil).Times(1)
+		}))
+	t.Run("max size only",
+		handleModifyTopic(http.StatusOK, nil, topic, info, bytes.NewBuffer([]byte(`{"maxSize":1024}`)), func(q *MockQueue) {
+			q.EXPECT().ModifyTopic(topic, headers.ModifyRequest{MaxSize: 1024}).Return(&headers.TopicInfo{MinOffset: 123, MaxOffset: 456}, nil).Times(1)
+		}))
 	t.Run("topic doesn't exist",
 		handleModifyTopic(http.StatusPreconditionFailed, headers.ErrTopicDoesNotExist, topic, info, bytes.NewBuffer([]byte(`{"truncate":123}`)), func(q *MockQueue) {
 			q.EXPECT().ModifyTopic(topic, gomock.Any()).Return(nil, headers.ErrTopicDoesNotExist).Times(1)
@@ -2,13 +2,17 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
 
 	"github.com/haraqa/haraqa/internal/headers"
 )
@@ -83,3 +87,398 @@ func handleProduce(status int, errExpected error, topic string, sizes []string,
 		}
 	}
 }
+
+func TestServer_HandleProduceFramed(t *testing.T) {
+	topic := "produce_topic"
+	frame := headers.AppendFrame(nil, []byte("key"), map[string]string{"content-type": "text/plain"}, []byte("hello"))
+	size := strconv.Itoa(len(frame))
+
+	// queue without framing support
+	{
+		ctrl := gomock.NewController(t)
+		q := NewMockQueue(ctrl)
+		q.EXPECT().RootDir().Times(1).Return("")
+		q.EXPECT().Close().Times(1).Return(nil)
+		q.EXPECT().GetTopicOwner(topic).Return("", nil)
+		status, err := produceFramed(t, q, topic, size, frame)
+		if status != http.StatusBadRequest || !errors.Is(err, headers.ErrInvalidFrame) {
+			t.Error(status, err)
+		}
+		ctrl.Finish()
+	}
+
+	// invalid frame
+	{
+		ctrl := gomock.NewController(t)
+		q := struct {
+			*MockQueue
+			*MockFramedQueue
+		}{NewMockQueue(ctrl), NewMockFramedQueue(ctrl)}
+		q.MockQueue.EXPECT().RootDir().Times(1).Return("")
+		q.MockQueue.EXPECT().Close().Times(1).Return(nil)
+		q.MockQueue.EXPECT().GetTopicOwner(topic).Return("", nil)
+		status, err := produceFramed(t, q, topic, "2", []byte{9, 'a'})
+		if status != http.StatusBadRequest || !errors.Is(err, headers.ErrInvalidFrame) {
+			t.Error(status, err)
+		}
+		ctrl.Finish()
+	}
+
+	// valid frame
+	{
+		ctrl := gomock.NewController(t)
+		q := struct {
+			*MockQueue
+			*MockFramedQueue
+		}{NewMockQueue(ctrl), NewMockFramedQueue(ctrl)}
+		q.MockQueue.EXPECT().RootDir().Times(1).Return("")
+		q.MockQueue.EXPECT().Close().Times(1).Return(nil)
+		q.MockQueue.EXPECT().GetTopicOwner(topic).Return("", nil)
+		q.MockFramedQueue.EXPECT().ProduceFramed(topic, []int64{int64(len(frame))}, gomock.Any(), gomock.Any()).
+			DoAndReturn(func(topic string, sizes []int64, timestamp uint64, r io.Reader) error {
+				b, err := io.ReadAll(r)
+				if err != nil || !bytes.Equal(b, frame) {
+					t.Error(err, b)
+				}
+				return nil
+			}).Times(1)
+		status, err := produceFramed(t, q, topic, size, frame)
+		if status != http.StatusNoContent || err != nil {
+			t.Error(status, err)
+		}
+		ctrl.Finish()
+	}
+}
+
+func produceFramed(t *testing.T, q Queue, topic, sizes string, body []byte) (int, error) {
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodPost, "/topics/"+topic, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set(headers.HeaderSizes, sizes)
+	r.Header.Set(headers.HeaderFramed, "true")
+	s.ServeHTTP(w, r)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+	return resp.StatusCode, headers.ReadErrors(resp.Header)
+}
+
+func TestServer_HandleProduceOffsets(t *testing.T) {
+	topic := "produce_topic"
+	info := &headers.ProduceInfo{FirstID: 3, LastID: 4, FirstTimestamp: time.Unix(100, 0).UTC(), LastTimestamp: time.Unix(100, 0).UTC()}
+	for _, accept := range []string{"", "application/json"} {
+		ctrl := gomock.NewController(t)
+		q := struct {
+			*MockQueue
+			*MockOffsetProducer
+		}{NewMockQueue(ctrl), NewMockOffsetProducer(ctrl)}
+		q.MockQueue.EXPECT().RootDir().Times(1).Return("")
+		q.MockQueue.EXPECT().Close().Times(1).Return(nil)
+		q.MockQueue.EXPECT().GetTopicOwner(topic).Return("", nil)
+		q.MockOffsetProducer.EXPECT().ProduceOffsets(topic, []int64{5, 6}, gomock.Any(), false, gomock.Any()).Return(info, nil).Times(1)
+		s, err := NewServer(WithQueue(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodPost, "/topics/"+topic, bytes.NewBufferString("hello world"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set(headers.HeaderSizes, "5:6")
+		r.Header.Set("Accept", accept)
+		s.ServeHTTP(w, r)
+
+		resp := w.Result()
+		got, err := headers.ReadProduceInfo(resp.Header)
+		if err != nil || got == nil || *got != *info {
+			t.Error(got, err)
+		}
+		if accept == "" {
+			if resp.StatusCode != http.StatusNoContent {
+				t.Error(resp.Status)
+			}
+		} else {
+			var body headers.ProduceInfo
+			if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&body) != nil || body != *info {
+				t.Error(resp.Status, body)
+			}
+		}
+		_ = resp.Body.Close()
+		_ = s.Close()
+		ctrl.Finish()
+	}
+}
+
+func TestServer_HandleProduceIdempotent(t *testing.T) {
+	topic := "produce_topic"
+	info := &headers.ProduceInfo{FirstID: 3, LastID: 4, FirstTimestamp: time.Unix(100, 0).UTC(), LastTimestamp: time.Unix(100, 0).UTC()}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	q := struct {
+		*MockQueue
+		*MockOffsetProducer
+		*MockProducerStateStore
+	}{NewMockQueue(ctrl), NewMockOffsetProducer(ctrl), NewMockProducerStateStore(ctrl)}
+	q.MockQueue.EXPECT().RootDir().Times(1).Return("")
+	q.MockQueue.EXPECT().Close().Times(1).Return(nil)
+	q.MockQueue.EXPECT().GetTopicOwner(topic).Return("", nil).AnyTimes()
+	q.MockOffsetProducer.EXPECT().ProduceOffsets(topic, []int64{5, 6}, gomock.Any(), false, gomock.Any()).Return(info, nil).Times(2)
+	q.MockProducerStateStore.EXPECT().ProducerStates(topic).Return(map[string]headers.ProducerState{}, nil).Times(1)
+	var stored map[string]headers.ProducerState
+	q.MockProducerStateStore.EXPECT().SetProducerStates(topic, gomock.Any()).DoAndReturn(func(_ string, states map[string]headers.ProducerState) error {
+		stored = states
+		return nil
+	}).Times(2)
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	produce := func(seq string) *http.Response {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodPost, "/topics/"+topic, bytes.NewBufferString("hello world"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set(headers.HeaderSizes, "5:6")
+		r.Header.Set(headers.HeaderProducerID, "p1")
+		r.Header.Set(headers.HeaderSequence, seq)
+		s.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	// the first batch of a producer may have any sequence
+	resp := produce("7")
+	if got, err := headers.ReadProduceInfo(resp.Header); resp.StatusCode != http.StatusNoContent || err != nil || *got != *info {
+		t.Error(resp.Status, got, err)
+	}
+	if state := stored["p1"]; state.Sequence != 7 || len(state.Batches) != 1 || *state.Batches[0].Info != *info {
+		t.Error(state)
+	}
+
+	// a resent batch is acknowledged with its ids, without being written again
+	resp = produce("7")
+	if got, err := headers.ReadProduceInfo(resp.Header); resp.StatusCode != http.StatusNoContent || err != nil || !got.Duplicate || got.FirstID != info.FirstID {
+		t.Error(resp.Status, got, err)
+	}
+
+	// skipped sequences are rejected
+	resp = produce("9")
+	if resp.StatusCode != http.StatusConflict || headers.ReadErrors(resp.Header) != headers.ErrOutOfOrderSequence {
+		t.Error(resp.Status)
+	}
+	resp = produce("invalid")
+	if resp.StatusCode != http.StatusBadRequest || headers.ReadErrors(resp.Header) != headers.ErrInvalidSequence {
+		t.Error(resp.Status)
+	}
+
+	resp = produce("8")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get(headers.HeaderDuplicate) != "" {
+		t.Error(resp.Status)
+	}
+	if state := stored["p1"]; state.Sequence != 8 || len(state.Batches) != 2 {
+		t.Error(state)
+	}
+}
+
+func TestServer_HandleProduceIdempotentUnsupported(t *testing.T) {
+	topic := "produce_topic"
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	q := NewMockQueue(ctrl)
+	q.EXPECT().RootDir().Times(1).Return("")
+	q.EXPECT().Close().Times(1).Return(nil)
+	q.EXPECT().GetTopicOwner(topic).Return("", nil)
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodPost, "/topics/"+topic, bytes.NewBufferString("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set(headers.HeaderSizes, "5")
+	r.Header = headers.SetSequence("p1", 1, r.Header)
+	s.ServeHTTP(w, r)
+	if resp := w.Result(); resp.StatusCode != http.StatusBadRequest || headers.ReadErrors(resp.Header) != headers.ErrInvalidProducer {
+		t.Error(resp.Status)
+	}
+}
+
+func TestServer_HandleProduceIf(t *testing.T) {
+	topic := "produce_topic"
+	info := &headers.ProduceInfo{FirstID: 3, LastID: 4, FirstTimestamp: time.Unix(100, 0).UTC(), LastTimestamp: time.Unix(100, 0).UTC()}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	q := struct {
+		*MockQueue
+		*MockConditionalProducer
+	}{NewMockQueue(ctrl), NewMockConditionalProducer(ctrl)}
+	q.MockQueue.EXPECT().RootDir().Times(1).Return("")
+	q.MockQueue.EXPECT().Close().Times(1).Return(nil)
+	q.MockQueue.EXPECT().GetTopicOwner(topic).Return("", nil).AnyTimes()
+	gomock.InOrder(
+		q.MockConditionalProducer.EXPECT().ProduceIf(topic, int64(3), []int64{5, 6}, gomock.Any(), false, gomock.Any()).Return(info, nil),
+		q.MockConditionalProducer.EXPECT().ProduceIf(topic, int64(3), []int64{5, 6}, gomock.Any(), false, gomock.Any()).Return(nil, headers.ErrUnexpectedOffset),
+	)
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	produce := func(expected string) *http.Response {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodPost, "/topics/"+topic, bytes.NewBufferString("hello world"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set(headers.HeaderSizes, "5:6")
+		r.Header.Set(headers.HeaderExpectedID, expected)
+		s.ServeHTTP(w, r)
+		return w.Result()
+	}
+	resp := produce("3")
+	if got, err := headers.ReadProduceInfo(resp.Header); resp.StatusCode != http.StatusNoContent || err != nil || *got != *info {
+		t.Error(resp.Status, got, err)
+	}
+	resp = produce("3")
+	if resp.StatusCode != http.StatusPreconditionFailed || headers.ReadErrors(resp.Header) != headers.ErrUnexpectedOffset {
+		t.Error(resp.Status)
+	}
+	for _, expected := range []string{"-1", "invalid"} {
+		resp = produce(expected)
+		if resp.StatusCode != http.StatusBadRequest || headers.ReadErrors(resp.Header) != headers.ErrInvalidMessageID {
+			t.Error(expected, resp.Status)
+		}
+	}
+
+	// queues without conditional produce reject the request
+	ctrl2 := gomock.NewController(t)
+	defer ctrl2.Finish()
+	plain := NewMockQueue(ctrl2)
+	plain.EXPECT().RootDir().Times(1).Return("")
+	plain.EXPECT().Close().Times(1).Return(nil)
+	plain.EXPECT().GetTopicOwner(topic).Return("", nil)
+	s2, err := NewServer(WithQueue(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	s = s2
+	resp = produce("3")
+	if resp.StatusCode != http.StatusNotImplemented || headers.ReadErrors(resp.Header) != headers.ErrConditionalUnsupported {
+		t.Error(resp.Status)
+	}
+}
+
+func TestServer_HandleProduceScheduled(t *testing.T) {
+	topic := "produce_topic"
+	info := &headers.ProduceInfo{FirstID: 3, LastID: 4, FirstTimestamp: time.Unix(100, 0).UTC(), LastTimestamp: time.Unix(100, 0).UTC()}
+	notBefore := time.Now().Add(time.Hour).UTC()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	q := struct {
+		*MockQueue
+		*MockOffsetProducer
+		*MockScheduleStore
+	}{NewMockQueue(ctrl), NewMockOffsetProducer(ctrl), NewMockScheduleStore(ctrl)}
+	q.MockQueue.EXPECT().RootDir().Times(1).Return("")
+	q.MockQueue.EXPECT().Close().Times(1).Return(nil)
+	q.MockQueue.EXPECT().GetTopicOwner(topic).Return("", nil).AnyTimes()
+	q.MockOffsetProducer.EXPECT().ProduceOffsets(topic, []int64{5, 6}, gomock.Any(), false, gomock.Any()).Return(info, nil).Times(2)
+	q.MockScheduleStore.EXPECT().Schedule(topic).Return(&headers.Schedule{}, nil).Times(1)
+	q.MockScheduleStore.EXPECT().SetSchedule(topic, gomock.Any()).DoAndReturn(func(_ string, schedule *headers.Schedule) error {
+		if len(schedule.Pending) != 1 || schedule.Pending[0] != (headers.ScheduledBatch{FirstID: 3, LastID: 4, NotBefore: notBefore}) {
+			t.Error(schedule.Pending)
+		}
+		return nil
+	}).Times(1)
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	produce := func(notBefore string) *http.Response {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodPost, "/topics/"+topic, bytes.NewBufferString("hello world"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set(headers.HeaderSizes, "5:6")
+		r.Header.Set(headers.HeaderNotBefore, notBefore)
+		s.ServeHTTP(w, r)
+		return w.Result()
+	}
+	// batches due in the future are scheduled, batches already due are not
+	for _, v := range []string{notBefore.Format(time.RFC3339Nano), time.Unix(100, 0).Format(time.RFC3339)} {
+		resp := produce(v)
+		if got, err := headers.ReadProduceInfo(resp.Header); resp.StatusCode != http.StatusNoContent || err != nil || *got != *info {
+			t.Error(v, resp.Status, got, err)
+		}
+	}
+	resp := produce("invalid")
+	if resp.StatusCode != http.StatusBadRequest || headers.ReadErrors(resp.Header) != headers.ErrInvalidNotBefore {
+		t.Error(resp.Status)
+	}
+
+	// queues without scheduling reject the request
+	ctrl2 := gomock.NewController(t)
+	defer ctrl2.Finish()
+	plain := NewMockQueue(ctrl2)
+	plain.EXPECT().RootDir().Times(1).Return("")
+	plain.EXPECT().Close().Times(1).Return(nil)
+	plain.EXPECT().GetTopicOwner(topic).Return("", nil)
+	s2, err := NewServer(WithQueue(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	s = s2
+	resp = produce(notBefore.Format(time.RFC3339Nano))
+	if resp.StatusCode != http.StatusBadRequest || headers.ReadErrors(resp.Header) != headers.ErrInvalidNotBefore {
+		t.Error(resp.Status)
+	}
+}
+
+func TestServer_HandleProduceMaxMessageSize(t *testing.T) {
+	topic := "produce_topic"
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	q := NewMockQueue(ctrl)
+	q.EXPECT().RootDir().Times(1).Return("")
+	q.EXPECT().Close().Times(1).Return(nil)
+	q.EXPECT().GetTopicOwner(topic).Return("", nil)
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// sizes which do not fit in the 32 bits stored with each message are rejected before the body is read
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodPost, "/topics/"+topic, bytes.NewBufferString("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set(headers.HeaderSizes, "5:4294967296")
+	s.ServeHTTP(w, r)
+	if resp := w.Result(); resp.StatusCode != http.StatusRequestEntityTooLarge || headers.ReadErrors(resp.Header) != headers.ErrMessageTooLarge {
+		t.Error(resp.Status)
+	}
+}
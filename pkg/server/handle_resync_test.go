@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/filequeue"
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestServer_HandleResync(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	q := struct {
+		*MockQueue
+		*MockResyncer
+	}{NewMockQueue(ctrl), NewMockResyncer(ctrl)}
+	q.MockQueue.EXPECT().RootDir().Times(1).Return("")
+	q.MockQueue.EXPECT().Close().Times(1).Return(nil)
+	errResync := errors.New("test resync error")
+	gomock.InOrder(
+		q.MockResyncer.EXPECT().Resync(gomock.Any()).Return(nil),
+		q.MockResyncer.EXPECT().Resync(gomock.Any()).Return(errResync),
+	)
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	resync := func() *http.Response {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodPost, "/resync", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ServeHTTP(w, r)
+		return w.Result()
+	}
+	if resp := resync(); resp.StatusCode != http.StatusNoContent {
+		t.Error(resp.Status)
+	}
+	if resp := resync(); resp.StatusCode != http.StatusInternalServerError || headers.ReadErrors(resp.Header).Error() != errResync.Error() {
+		t.Error(resp.Status, headers.ReadErrors(resp.Header))
+	}
+
+	// queues without resync reject the request
+	ctrl2 := gomock.NewController(t)
+	defer ctrl2.Finish()
+	plain := NewMockQueue(ctrl2)
+	plain.EXPECT().RootDir().Times(1).Return("")
+	plain.EXPECT().Close().Times(1).Return(nil)
+	if s, err = NewServer(WithQueue(plain)); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if resp := resync(); resp.StatusCode != http.StatusNotImplemented || headers.ReadErrors(resp.Header) != headers.ErrResyncUnsupported {
+		t.Error(resp.Status, headers.ReadErrors(resp.Header))
+	}
+}
+
+func TestServer_HandleResyncVolumes(t *testing.T) {
+	vol1, vol2 := t.TempDir(), t.TempDir()
+	q, err := filequeue.New(false, 100, vol1, vol2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = q.CreateTopic("topic"); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Produce("topic", []int64{5}, uint64(time.Now().Unix()), bytes.NewBufferString("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first volume is replaced while the server runs
+	if err = os.RemoveAll(filepath.Join(vol1, "topic")); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodPost, "/resync", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	b, err := os.ReadFile(filepath.Join(vol1, "topic", "0000000000000000.log"))
+	if err != nil || string(b) != "hello" {
+		t.Error(string(b), err)
+	}
+}
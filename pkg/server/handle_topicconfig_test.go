@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestServer_TopicConfig(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	do := func(s *Server, method, path string, body io.Reader, h http.Header) *http.Response {
+		r := httptest.NewRequest(method, path, body)
+		for k, v := range h {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	// queue without topic configs
+	{
+		q := NewMockQueue(ctrl)
+		q.EXPECT().RootDir().Return("").Times(1)
+		q.EXPECT().Close().Return(nil).Times(1)
+		q.EXPECT().GetTopicOwner("topic").Return("", nil).Times(2)
+		s, err := NewServer(WithQueue(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, resp := range []*http.Response{
+			do(s, http.MethodGet, "/config/topic", nil, nil),
+			do(s, http.MethodPut, "/topics/topic", bytes.NewBufferString(`{"consumeLimit":5}`), nil),
+			do(s, http.MethodPatch, "/topics/topic", bytes.NewBufferString(`{"config":{}}`), nil),
+		} {
+			if resp.StatusCode != http.StatusBadRequest || headers.ReadErrors(resp.Header) != headers.ErrInvalidTopicConfig {
+				t.Error(resp.Status)
+			}
+		}
+		_ = s.Close()
+	}
+
+	q := struct {
+		*MockQueue
+		*MockTopicConfigurer
+	}{NewMockQueue(ctrl), NewMockTopicConfigurer(ctrl)}
+	q.MockQueue.EXPECT().RootDir().Return("").Times(1)
+	q.MockQueue.EXPECT().Close().Return(nil).Times(1)
+	q.MockQueue.EXPECT().GetTopicOwner("topic").Return("", nil).AnyTimes()
+	s, err := NewServer(WithQueue(q), WithDefaultConsumeLimit(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	config := headers.TopicConfig{ConsumeLimit: 5, MaxMessageSize: 4}
+
+	// create with a config
+	for _, tc := range []struct {
+		body string
+		err  error
+	}{
+		{"hello", headers.ErrInvalidBodyJSON},
+		{`{"consumeLimit":-1}`, headers.ErrInvalidTopicConfig},
+	} {
+		resp := do(s, http.MethodPut, "/topics/topic", bytes.NewBufferString(tc.body), nil)
+		if resp.StatusCode != http.StatusBadRequest || headers.ReadErrors(resp.Header) != tc.err {
+			t.Error(tc.body, resp.Status)
+		}
+	}
+	gomock.InOrder(
+		q.MockQueue.EXPECT().CreateTopic("topic").Return(nil).Times(1),
+		q.MockTopicConfigurer.EXPECT().SetTopicConfig("topic", config).Return(nil).Times(1),
+	)
+	if resp := do(s, http.MethodPut, "/topics/topic", bytes.NewBufferString(`{"consumeLimit":5,"maxMessageSize":4}`), nil); resp.StatusCode != http.StatusCreated {
+		t.Error(resp.Status)
+	}
+
+	// modify the config
+	q.MockTopicConfigurer.EXPECT().SetTopicConfig("topic", headers.TopicConfig{Compact: true}).Return(nil).Times(1)
+	if resp := do(s, http.MethodPatch, "/topics/topic", bytes.NewBufferString(`{"config":{"compact":true}}`), nil); resp.StatusCode != http.StatusNoContent {
+		t.Error(resp.Status)
+	}
+
+	// get the config
+	q.MockTopicConfigurer.EXPECT().TopicConfig("missing").Return(nil, headers.ErrTopicDoesNotExist).Times(1)
+	q.MockQueue.EXPECT().GetTopicOwner("missing").Return("", nil).Times(1)
+	if resp := do(s, http.MethodGet, "/config/missing", nil, nil); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Error(resp.Status)
+	}
+	q.MockTopicConfigurer.EXPECT().TopicConfig("topic").Return(&config, nil).AnyTimes()
+	resp := do(s, http.MethodGet, "/config/topic", nil, nil)
+	var got headers.TopicConfig
+	if err = json.NewDecoder(resp.Body).Decode(&got); err != nil || resp.StatusCode != http.StatusOK || got != config {
+		t.Error(err, resp.Status, got)
+	}
+
+	// messages larger than the max message size are rejected
+	h := http.Header{}
+	headers.SetSizes([]int64{4, 5}, h)
+	if resp := do(s, http.MethodPost, "/topics/topic", bytes.NewBufferString("testhello"), h); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error(resp.Status)
+	}
+
+	// the consume limit of the topic replaces the default limit
+	q.MockQueue.EXPECT().Consume("", "topic", int64(0), int64(5), gomock.Any()).Return(0, nil).Times(1)
+	_ = do(s, http.MethodGet, "/topics/topic", nil, http.Header{headers.HeaderID: []string{"0"}})
+	q.MockQueue.EXPECT().Consume("", "topic", int64(0), int64(2), gomock.Any()).Return(0, nil).Times(1)
+	_ = do(s, http.MethodGet, "/topics/topic", nil, http.Header{headers.HeaderID: []string{"0"}, headers.HeaderLimit: []string{"2"}})
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+
+	"github.com/haraqa/haraqa/internal/filequeue"
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestServer_HandleTransaction(t *testing.T) {
+	batches := []headers.TransactionBatch{
+		{Topic: "topic_a", Messages: [][]byte{[]byte("hello"), []byte("world")}},
+		{Topic: "topic_b", Messages: [][]byte{[]byte("hi")}},
+	}
+	infos := []*headers.ProduceInfo{
+		{FirstID: 3, LastID: 4, FirstTimestamp: time.Unix(100, 0).UTC(), LastTimestamp: time.Unix(100, 0).UTC()},
+		{FirstID: 0, LastID: 0, FirstTimestamp: time.Unix(100, 0).UTC(), LastTimestamp: time.Unix(100, 0).UTC()},
+	}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	q := struct {
+		*MockQueue
+		*MockTransactor
+	}{NewMockQueue(ctrl), NewMockTransactor(ctrl)}
+	q.MockQueue.EXPECT().RootDir().Times(1).Return("")
+	q.MockQueue.EXPECT().Close().Times(1).Return(nil)
+	q.MockQueue.EXPECT().GetTopicOwner("topic_a").Return("", nil).AnyTimes()
+	q.MockQueue.EXPECT().GetTopicOwner("topic_b").Return("", nil).AnyTimes()
+	q.MockQueue.EXPECT().GetTopicOwner("remote_topic").Return("http://127.0.0.1:4353", nil).AnyTimes()
+	gomock.InOrder(
+		q.MockTransactor.EXPECT().ProduceTransaction(batches, gomock.Any()).Return(infos, nil),
+		q.MockTransactor.EXPECT().ProduceTransaction(batches, gomock.Any()).Return(nil, headers.ErrTopicDoesNotExist),
+	)
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	transaction := func(body []byte) *http.Response {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodPost, "/transactions", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	// topics are cleaned like topics of the produce endpoint
+	body, _ := json.Marshal(headers.TransactionRequest{Batches: []headers.TransactionBatch{
+		{Topic: "Topic_A/", Messages: batches[0].Messages},
+		batches[1],
+	}})
+	resp := transaction(body)
+	var response headers.TransactionResponse
+	if err = json.NewDecoder(resp.Body).Decode(&response); resp.StatusCode != http.StatusOK || err != nil || !reflect.DeepEqual(response.Batches, infos) {
+		t.Error(resp.Status, response, err)
+	}
+	body, _ = json.Marshal(headers.TransactionRequest{Batches: batches})
+	resp = transaction(body)
+	if resp.StatusCode != http.StatusPreconditionFailed || headers.ReadErrors(resp.Header) != headers.ErrTopicDoesNotExist {
+		t.Error(resp.Status)
+	}
+
+	// invalid requests
+	for _, c := range []struct {
+		body string
+		err  error
+	}{
+		{`{"batches":`, headers.ErrInvalidBodyJSON},
+		{`{"batches":[]}`, headers.ErrInvalidBodyMissing},
+		{`{"batches":[{"topic":"","messages":["aGk="]}]}`, headers.ErrInvalidTopic},
+		{`{"batches":[{"topic":"topic_a","messages":["aGk="]},{"topic":"remote_topic","messages":["aGk="]}]}`, headers.ErrInvalidTransaction},
+	} {
+		resp = transaction([]byte(c.body))
+		if resp.StatusCode != http.StatusBadRequest || headers.ReadErrors(resp.Header) != c.err {
+			t.Error(c.body, resp.Status, headers.ReadErrors(resp.Header))
+		}
+	}
+
+	// queues without transactions reject the request
+	ctrl2 := gomock.NewController(t)
+	defer ctrl2.Finish()
+	plain := NewMockQueue(ctrl2)
+	plain.EXPECT().RootDir().Times(1).Return("")
+	plain.EXPECT().Close().Times(1).Return(nil)
+	s2, err := NewServer(WithQueue(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	s = s2
+	resp = transaction(body)
+	if resp.StatusCode != http.StatusBadRequest || headers.ReadErrors(resp.Header) != headers.ErrInvalidTransaction {
+		t.Error(resp.Status)
+	}
+}
+
+func TestServer_HandleTransactionTraversal(t *testing.T) {
+	dir := t.TempDir()
+	q, err := filequeue.New(false, 100, filepath.Join(dir, "volume"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a directory next to the volume which a traversal topic would resolve to
+	outside := filepath.Join(dir, "outside")
+	if err = os.Mkdir(outside, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, topic := range []string{"../outside", "nested/../../outside", "/outside"} {
+		body, _ := json.Marshal(headers.TransactionRequest{Batches: []headers.TransactionBatch{
+			{Topic: topic, Messages: [][]byte{[]byte("hi")}},
+		}})
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodPost, "/transactions", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ServeHTTP(w, r)
+		resp := w.Result()
+		if resp.StatusCode != http.StatusBadRequest || headers.ReadErrors(resp.Header) != headers.ErrInvalidTopic {
+			t.Error(topic, resp.Status, headers.ReadErrors(resp.Header))
+		}
+	}
+
+	// nothing is written outside of the volume
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Error(entries)
+	}
+}
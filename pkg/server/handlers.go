@@ -1,7 +1,9 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -76,10 +78,19 @@ func (s *Server) HandleGetAllTopics(w http.ResponseWriter, r *http.Request) {
 }
 
 // HandleCreateTopic handles requests to the /topics/... endpoints with method == PUT.
-// It will create a topic if the topic does not exist.
+// It will create a topic if the topic does not exist. An optional json body sets the
+// configuration stored with the topic
 func (s *Server) HandleCreateTopic(w http.ResponseWriter, r *http.Request) {
+	var body []byte
 	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
 		_ = r.Body.Close()
+		if err != nil {
+			s.logger.Warnf("%s:%s:read body: %s", r.Method, r.URL.Path, err.Error())
+			headers.SetError(w, headers.ErrInvalidBodyJSON)
+			return
+		}
 	}
 
 	topic, err := getTopic(r)
@@ -88,12 +99,35 @@ func (s *Server) HandleCreateTopic(w http.ResponseWriter, r *http.Request) {
 		headers.SetError(w, err)
 		return
 	}
+
+	var config *headers.TopicConfig
+	if len(bytes.TrimSpace(body)) > 0 {
+		config = &headers.TopicConfig{}
+		if err = json.Unmarshal(body, config); err != nil {
+			s.logger.Warnf("%s:%s:json decode: %s", r.Method, r.URL.Path, err.Error())
+			headers.SetError(w, headers.ErrInvalidBodyJSON)
+			return
+		}
+		if err = s.checkTopicConfig(config); err != nil {
+			s.logger.Warnf("%s:%s:topic config: %s", r.Method, r.URL.Path, err.Error())
+			headers.SetError(w, err)
+			return
+		}
+	}
+
 	err = s.q.CreateTopic(topic)
 	if err != nil {
 		s.logger.Warnf("%s:%s:create topic: %s", r.Method, r.URL.Path, err.Error())
 		headers.SetError(w, err)
 		return
 	}
+	if config != nil {
+		if err = s.q.(TopicConfigurer).SetTopicConfig(topic, *config); err != nil {
+			s.logger.Warnf("%s:%s:set topic config: %s", r.Method, r.URL.Path, err.Error())
+			headers.SetError(w, err)
+			return
+		}
+	}
 	w.Header()[headers.ContentType] = []string{"text/plain"}
 	w.WriteHeader(http.StatusCreated)
 }
@@ -136,7 +170,20 @@ func (s *Server) HandleModifyTopic(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if request.Truncate == 0 {
+	if request.Config != nil {
+		if err = s.checkTopicConfig(request.Config); err != nil {
+			s.logger.Warnf("%s:%s:topic config: %s", r.Method, r.URL.Path, err.Error())
+			headers.SetError(w, err)
+			return
+		}
+		if err = s.q.(TopicConfigurer).SetTopicConfig(topic, *request.Config); err != nil {
+			s.logger.Warnf("%s:%s:set topic config: %s", r.Method, r.URL.Path, err.Error())
+			headers.SetError(w, err)
+			return
+		}
+	}
+
+	if request.Truncate == 0 && request.Before.IsZero() && request.MaxSize == 0 {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
@@ -155,6 +202,83 @@ func (s *Server) HandleModifyTopic(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// HandleGetTopicConfig handles requests to the /config/... endpoints with method == GET.
+// It returns the configuration stored with the topic as json
+func (s *Server) HandleGetTopicConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		_ = r.Body.Close()
+	}
+
+	topic, err := getPathTopic(r, "/config/")
+	if err != nil {
+		s.logger.Warnf("%s:%s:topic error: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+
+	addr, err := s.q.GetTopicOwner(topic)
+	if err != nil {
+		s.logger.Warnf("%s:%s:get topic owner: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, headers.ErrInvalidBodyJSON)
+		return
+	}
+	if addr != "" && addr != s.publicAddr {
+		s.handleProxy(w, r, addr)
+		return
+	}
+
+	configurer, ok := s.q.(TopicConfigurer)
+	if !ok {
+		s.logger.Warnf("%s:%s:topic config: queue does not support topic configs", r.Method, r.URL.Path)
+		headers.SetError(w, errors.Wrap(headers.ErrInvalidTopicConfig, "queue does not support topic configs"))
+		return
+	}
+	config, err := configurer.TopicConfig(topic)
+	if err != nil {
+		s.logger.Warnf("%s:%s:topic config: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+	w.Header()[headers.ContentType] = []string{"application/json"}
+	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(config); err != nil {
+		s.logger.Warnf("%s:%s:json write: %s", r.Method, r.URL.Path, err.Error())
+	}
+}
+
+// checkTopicConfig returns an error if the topic config is invalid or the queue cannot store it
+func (s *Server) checkTopicConfig(config *headers.TopicConfig) error {
+	if _, ok := s.q.(TopicConfigurer); !ok {
+		return errors.Wrap(headers.ErrInvalidTopicConfig, "queue does not support topic configs")
+	}
+	return config.Validate()
+}
+
+// topicConfig returns the configuration stored with the topic, or a zero configuration if there is none
+func (s *Server) topicConfig(topic string) headers.TopicConfig {
+	configurer, ok := s.q.(TopicConfigurer)
+	if !ok {
+		return headers.TopicConfig{}
+	}
+	config, err := configurer.TopicConfig(topic)
+	if err != nil || config == nil {
+		return headers.TopicConfig{}
+	}
+	return *config
+}
+
+// maxMessageSize is the size of the largest message the queues can store, the size of each message is stored in
+// 32 bits alongside its checksum
+const maxMessageSize = 1<<32 - 1
+
+// messageSizeLimit returns the size of the largest message which may be produced to the topic
+func (s *Server) messageSizeLimit(topic string) int64 {
+	if limit := s.topicConfig(topic).MaxMessageSize; limit > 0 && limit < maxMessageSize {
+		return limit
+	}
+	return maxMessageSize
+}
+
 // HandleDeleteTopic handles requests to the /topics/... endpoints with method == DELETE.
 // It will delete a topic if the topic exists.
 func (s *Server) HandleDeleteTopic(w http.ResponseWriter, r *http.Request) {
@@ -186,6 +310,8 @@ func (s *Server) HandleDeleteTopic(w http.ResponseWriter, r *http.Request) {
 		headers.SetError(w, err)
 		return
 	}
+	s.producerStates.Delete(topic)
+	s.schedules.Delete(topic)
 	w.Header()[headers.ContentType] = []string{"text/plain"}
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -226,18 +352,238 @@ func (s *Server) HandleProduce(w http.ResponseWriter, r *http.Request) {
 		headers.SetError(w, err)
 		return
 	}
+	maxSize := s.messageSizeLimit(topic)
+	for i := range sizes {
+		if sizes[i] > maxSize {
+			s.logger.Warnf("%s:%s:message %d: %s", r.Method, r.URL.Path, i, headers.ErrMessageTooLarge.Error())
+			headers.SetError(w, headers.ErrMessageTooLarge)
+			return
+		}
+	}
+
+	producer, seq, err := headers.ReadSequence(r.Header)
+	if err != nil {
+		s.logger.Warnf("%s:%s:read sequence: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+	var ps ProducerStateStore
+	if producer != "" {
+		var ok bool
+		if ps, ok = s.q.(ProducerStateStore); !ok {
+			s.logger.Warnf("%s:%s:idempotent produce: queue does not support idempotent producers", r.Method, r.URL.Path)
+			headers.SetError(w, headers.ErrInvalidProducer)
+			return
+		}
+	}
+
+	expected := int64(-1)
+	var cp ConditionalProducer
+	if v := getFirst(r.Header, headers.HeaderExpectedID); v != "" {
+		if expected, err = strconv.ParseInt(v, 10, 64); err != nil || expected < 0 {
+			s.logger.Warnf("%s:%s:read expected id: %s", r.Method, r.URL.Path, headers.ErrInvalidMessageID.Error())
+			headers.SetError(w, headers.ErrInvalidMessageID)
+			return
+		}
+		var ok bool
+		if cp, ok = s.q.(ConditionalProducer); !ok {
+			s.logger.Warnf("%s:%s:conditional produce: queue does not support conditional produce", r.Method, r.URL.Path)
+			headers.SetError(w, headers.ErrConditionalUnsupported)
+			return
+		}
+	}
+
+	var notBefore time.Time
+	var ss ScheduleStore
+	if v := getFirst(r.Header, headers.HeaderNotBefore); v != "" {
+		if notBefore, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			s.logger.Warnf("%s:%s:read not before: %s", r.Method, r.URL.Path, headers.ErrInvalidNotBefore.Error())
+			headers.SetError(w, headers.ErrInvalidNotBefore)
+			return
+		}
+		var ok bool
+		ss, ok = s.q.(ScheduleStore)
+		if _, offsets := s.q.(OffsetProducer); !ok || !offsets {
+			s.logger.Warnf("%s:%s:scheduled produce: queue does not support scheduled messages", r.Method, r.URL.Path)
+			headers.SetError(w, headers.ErrInvalidNotBefore)
+			return
+		}
+	}
+
+	decoded, err := decodeBody(r)
+	if err != nil {
+		s.logger.Warnf("%s:%s:decode body: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+	var body io.Reader = decoded
+	var fq FramedQueue
+	framed := getFirst(r.Header, headers.HeaderFramed) == "true"
+	if framed {
+		var ok bool
+		if fq, ok = s.q.(FramedQueue); !ok {
+			s.logger.Warnf("%s:%s:framed: queue does not support framed messages", r.Method, r.URL.Path)
+			headers.SetError(w, headers.ErrInvalidFrame)
+			return
+		}
+		if body, err = readFrames(decoded, sizes); err != nil {
+			s.logger.Warnf("%s:%s:read frames: %s", r.Method, r.URL.Path, err.Error())
+			headers.SetError(w, err)
+			return
+		}
+	}
 
-	err = s.q.Produce(topic, sizes, uint64(time.Now().UTC().Unix()), r.Body)
+	start := time.Now()
+	produce := func() (*headers.ProduceInfo, error) {
+		if cp != nil {
+			return cp.ProduceIf(topic, expected, sizes, uint64(start.UTC().Unix()), framed, body)
+		}
+		if op, ok := s.q.(OffsetProducer); ok {
+			return op.ProduceOffsets(topic, sizes, uint64(start.UTC().Unix()), framed, body)
+		}
+		if framed {
+			return nil, fq.ProduceFramed(topic, sizes, uint64(start.UTC().Unix()), body)
+		}
+		return nil, s.q.Produce(topic, sizes, uint64(start.UTC().Unix()), body)
+	}
+	if notBefore.After(start) {
+		// hold the batch back from consumer groups until it is due
+		unscheduled := produce
+		produce = func() (*headers.ProduceInfo, error) {
+			return s.produceScheduled(ss, topic, notBefore, unscheduled)
+		}
+	}
+	var info *headers.ProduceInfo
+	var duplicate bool
+	if ps != nil {
+		info, duplicate, err = s.produceIdempotent(ps, topic, producer, seq, start, produce)
+	} else {
+		info, err = produce()
+	}
 	if err != nil {
 		s.logger.Warnf("%s:%s:produce: %s", r.Method, r.URL.Path, err.Error())
 		headers.SetError(w, err)
 		return
 	}
-	s.metrics.ProduceMsgs(len(sizes))
+	if duplicate {
+		// acknowledge a resent batch without counting it again
+		w.Header()[headers.HeaderDuplicate] = []string{"true"}
+	} else {
+		if m, ok := s.metrics.(LatencyMetrics); ok {
+			m.ProduceLatency(s.syncPolicy, time.Since(start))
+		}
+		s.metrics.ProduceMsgs(len(sizes))
+	}
+
+	// report the ids of the messages in the headers, and in the body if json is accepted
+	if info != nil {
+		headers.SetProduceInfo(info, w.Header())
+		if r.Header.Get("Accept") == "application/json" {
+			w.Header()[headers.ContentType] = []string{"application/json"}
+			w.WriteHeader(http.StatusOK)
+			if err = json.NewEncoder(w).Encode(info); err != nil {
+				s.logger.Warnf("%s:%s:json write: %s", r.Method, r.URL.Path, err.Error())
+			}
+			return
+		}
+	}
 	w.Header()[headers.ContentType] = []string{"text/plain"}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// HandleTransaction handles requests to the /transactions endpoint with method == POST.
+// It will add the batches of messages in the json body to their topics atomically, either every
+// batch is stored or none is. All topics of a transaction must be owned by this server
+func (s *Server) HandleTransaction(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		s.logger.Warnf("%s:%s:body required: %s", r.Method, r.URL.Path, headers.ErrInvalidBodyMissing.Error())
+		headers.SetError(w, headers.ErrInvalidBodyMissing)
+		return
+	}
+	defer func() {
+		_ = r.Body.Close()
+	}()
+
+	tq, ok := s.q.(Transactor)
+	if !ok {
+		s.logger.Warnf("%s:%s:transaction: queue does not support transactions", r.Method, r.URL.Path)
+		headers.SetError(w, headers.ErrInvalidTransaction)
+		return
+	}
+
+	decoded, err := decodeBody(r)
+	if err != nil {
+		s.logger.Warnf("%s:%s:decode body: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+	var request headers.TransactionRequest
+	if err = json.NewDecoder(decoded).Decode(&request); err != nil {
+		s.logger.Warnf("%s:%s:json decode: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, headers.ErrInvalidBodyJSON)
+		return
+	}
+	if len(request.Batches) == 0 {
+		s.logger.Warnf("%s:%s:body required: %s", r.Method, r.URL.Path, headers.ErrInvalidBodyMissing.Error())
+		headers.SetError(w, headers.ErrInvalidBodyMissing)
+		return
+	}
+
+	var count int
+	for i := range request.Batches {
+		topic := strings.ToLower(filepath.Clean(request.Batches[i].Topic))
+		if !headers.ValidTopicPath(topic) {
+			s.logger.Warnf("%s:%s:batch %d: %s", r.Method, r.URL.Path, i, headers.ErrInvalidTopic.Error())
+			headers.SetError(w, headers.ErrInvalidTopic)
+			return
+		}
+		request.Batches[i].Topic = topic
+		count += len(request.Batches[i].Messages)
+	}
+	for _, topic := range headers.TransactionTopics(request.Batches) {
+		addr, err := s.q.GetTopicOwner(topic)
+		if err != nil {
+			s.logger.Warnf("%s:%s:get topic owner: %s", r.Method, r.URL.Path, err.Error())
+			headers.SetError(w, err)
+			return
+		}
+		if addr != "" && addr != s.publicAddr {
+			// a transaction cannot span servers
+			s.logger.Warnf("%s:%s:topic %q is owned by %s: %s", r.Method, r.URL.Path, topic, addr, headers.ErrInvalidTransaction.Error())
+			headers.SetError(w, headers.ErrInvalidTransaction)
+			return
+		}
+	}
+	for i, batch := range request.Batches {
+		maxSize := s.messageSizeLimit(batch.Topic)
+		for j := range batch.Messages {
+			if int64(len(batch.Messages[j])) > maxSize {
+				s.logger.Warnf("%s:%s:batch %d message %d: %s", r.Method, r.URL.Path, i, j, headers.ErrMessageTooLarge.Error())
+				headers.SetError(w, headers.ErrMessageTooLarge)
+				return
+			}
+		}
+	}
+
+	start := time.Now()
+	infos, err := tq.ProduceTransaction(request.Batches, uint64(start.UTC().Unix()))
+	if err != nil {
+		s.logger.Warnf("%s:%s:transaction: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+	if m, ok := s.metrics.(LatencyMetrics); ok {
+		m.ProduceLatency(s.syncPolicy, time.Since(start))
+	}
+	s.metrics.ProduceMsgs(count)
+
+	w.Header()[headers.ContentType] = []string{"application/json"}
+	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(headers.TransactionResponse{Batches: infos}); err != nil {
+		s.logger.Warnf("%s:%s:json write: %s", r.Method, r.URL.Path, err.Error())
+	}
+}
+
 // HandleConsume handles requests to the /topics/... endpoints with method == GET.
 // It will retrieve messages from the queue topic
 func (s *Server) HandleConsume(w http.ResponseWriter, r *http.Request) {
@@ -271,14 +617,30 @@ func (s *Server) HandleConsume(w http.ResponseWriter, r *http.Request) {
 			defer lock.Unlock()
 		}
 	}
-	id, err := strconv.ParseInt(getFirst(r.Header, headers.HeaderID), 10, 64)
-	if err != nil {
-		s.logger.Warnf("%s:%s:parse id: %s", r.Method, r.URL.Path, err.Error())
-		headers.SetError(w, headers.ErrInvalidMessageID)
-		return
+	var id int64
+	since := getFirst(r.Header, headers.HeaderSince)
+	if since != "" {
+		// start from the first message produced at or after the given time
+		id, err = s.offsetAt(topic, since)
+		if err != nil {
+			s.logger.Warnf("%s:%s:offset at: %s", r.Method, r.URL.Path, err.Error())
+			headers.SetError(w, err)
+			return
+		}
+	} else {
+		id, err = strconv.ParseInt(getFirst(r.Header, headers.HeaderID), 10, 64)
+		if err != nil {
+			s.logger.Warnf("%s:%s:parse id: %s", r.Method, r.URL.Path, err.Error())
+			headers.SetError(w, headers.ErrInvalidMessageID)
+			return
+		}
 	}
 
-	limit := s.defaultConsumeLimit
+	defaultLimit := s.defaultConsumeLimit
+	if configLimit := s.topicConfig(topic).ConsumeLimit; configLimit > 0 {
+		defaultLimit = configLimit
+	}
+	limit := defaultLimit
 	queryLimit := getFirst(r.Header, headers.HeaderLimit)
 	if queryLimit != "" && queryLimit[0] != '-' {
 		limit, err = strconv.ParseInt(queryLimit, 10, 64)
@@ -288,11 +650,37 @@ func (s *Server) HandleConsume(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if limit <= 0 {
-			limit = s.defaultConsumeLimit
+			limit = defaultLimit
 		}
 	}
 
-	count, err := s.q.Consume(group, topic, id, limit, w)
+	if acceptsGzip(r.Header) {
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer func() {
+			if err := gw.Close(); err != nil {
+				s.logger.Warnf("%s:%s:encode response: %s", r.Method, r.URL.Path, err.Error())
+			}
+		}()
+		w = gw
+	}
+
+	consume := func(group string, id, limit int64) (int, error) {
+		if fq, ok := s.q.(FramedQueue); ok && getFirst(r.Header, headers.HeaderFramed) == "true" {
+			return fq.ConsumeFramed(group, topic, id, limit, w)
+		}
+		return s.q.Consume(group, topic, id, limit, w)
+	}
+	var count int
+	var redelivered bool
+	if ss, ok := s.q.(ScheduleStore); ok && group != "" && id <= 0 && since == "" {
+		// consumer groups reading from their offset skip the messages which are not due yet. The offset of the group
+		// is resolved with the schedule, so the queue reads from the id given rather than the committed offset
+		count, redelivered, err = s.consumeScheduled(ss, group, topic, limit, time.Now(), func(id, limit int64) (int, error) {
+			return consume("", id, limit)
+		})
+	} else {
+		count, err = consume(group, id, limit)
+	}
 	if err != nil {
 		s.logger.Warnf("%s:%s:consume: %s", r.Method, r.URL.Path, err.Error())
 		headers.SetError(w, err)
@@ -303,6 +691,144 @@ func (s *Server) HandleConsume(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	s.metrics.ConsumeMsgs(count)
+
+	// move the consumer group past the batch that was just served, unless it was a deferred batch served out of order
+	if group != "" && !redelivered && getFirst(r.Header, headers.HeaderAutoCommit) == "true" {
+		nextID, err := strconv.ParseInt(getFirst(w.Header(), headers.HeaderNextID), 10, 64)
+		if err != nil {
+			s.logger.Warnf("%s:%s:parse next id: %s", r.Method, r.URL.Path, err.Error())
+			return
+		}
+		if err = s.q.SetConsumerOffset(group, topic, nextID); err != nil {
+			s.logger.Warnf("%s:%s:auto commit: %s", r.Method, r.URL.Path, err.Error())
+		}
+	}
+}
+
+// HandleResync handles requests to the /resync endpoint with method == POST.
+// It reconciles the volumes of the queue, with any copied data reported through the server Logger
+func (s *Server) HandleResync(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		_ = r.Body.Close()
+	}
+
+	rq, ok := s.q.(Resyncer)
+	if !ok {
+		s.logger.Warnf("%s:%s:resync: queue does not support resync", r.Method, r.URL.Path)
+		headers.SetError(w, headers.ErrResyncUnsupported)
+		return
+	}
+	if err := rq.Resync(s.logger.Warnf); err != nil {
+		s.logger.Errorf("%s:%s:resync: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleCommitOffset handles requests to the /offsets/... endpoints with method == PUT.
+// It sets the offset of the consumer group for the topic to the given id, the next consume
+// request from the group with a 0 or negative id will start from this offset
+func (s *Server) HandleCommitOffset(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		_ = r.Body.Close()
+	}
+
+	topic, err := getPathTopic(r, "/offsets/")
+	if err != nil {
+		s.logger.Warnf("%s:%s:topic error: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+
+	addr, err := s.q.GetTopicOwner(topic)
+	if err != nil {
+		s.logger.Warnf("%s:%s:get topic owner: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+	if addr != "" && addr != s.publicAddr {
+		s.handleProxy(w, r, addr)
+		return
+	}
+
+	group := getFirst(r.Header, headers.HeaderConsumerGroup)
+	if group == "" {
+		s.logger.Warnf("%s:%s:group required: %s", r.Method, r.URL.Path, headers.ErrInvalidGroup.Error())
+		headers.SetError(w, headers.ErrInvalidGroup)
+		return
+	}
+	id, err := strconv.ParseInt(getFirst(r.Header, headers.HeaderID), 10, 64)
+	if err != nil || id < 0 {
+		s.logger.Warnf("%s:%s:parse id: %s", r.Method, r.URL.Path, getFirst(r.Header, headers.HeaderID))
+		headers.SetError(w, headers.ErrInvalidMessageID)
+		return
+	}
+
+	tmp, _ := s.consumerGroupLock.LoadOrStore(group+"/"+topic, &sync.Mutex{})
+	if lock, ok := tmp.(*sync.Mutex); ok {
+		lock.Lock()
+		defer lock.Unlock()
+	}
+	err = s.q.SetConsumerOffset(group, topic, id)
+	if err != nil {
+		s.logger.Warnf("%s:%s:commit offset: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+	w.Header()[headers.ContentType] = []string{"text/plain"}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleGetOffset handles requests to the /offsets/... endpoints with method == GET.
+// It returns the id of the first message of the topic produced at or after the X-Since time
+func (s *Server) HandleGetOffset(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		_ = r.Body.Close()
+	}
+
+	topic, err := getPathTopic(r, "/offsets/")
+	if err != nil {
+		s.logger.Warnf("%s:%s:topic error: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+
+	addr, err := s.q.GetTopicOwner(topic)
+	if err != nil {
+		s.logger.Warnf("%s:%s:get topic owner: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, headers.ErrInvalidBodyJSON)
+		return
+	}
+	if addr != "" && addr != s.publicAddr {
+		s.handleProxy(w, r, addr)
+		return
+	}
+
+	id, err := s.offsetAt(topic, getFirst(r.Header, headers.HeaderSince))
+	if err != nil {
+		s.logger.Warnf("%s:%s:offset at: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+	v := strconv.FormatInt(id, 10)
+	w.Header()[headers.HeaderID] = []string{v}
+	w.Header()[headers.ContentType] = []string{"text/plain"}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(v))
+}
+
+// offsetAt resolves an X-Since header, formatted as RFC3339, to the id of the first message produced at or after it
+func (s *Server) offsetAt(topic, since string) (int64, error) {
+	seeker, ok := s.q.(TimeSeeker)
+	if !ok {
+		return 0, errors.Wrap(headers.ErrInvalidHeaderSince, "queue does not support seeking by time")
+	}
+	t, err := time.Parse(time.RFC3339Nano, since)
+	if err != nil {
+		return 0, errors.Wrap(headers.ErrInvalidHeaderSince, err.Error())
+	}
+	return seeker.OffsetAt(topic, t)
 }
 
 func getFirst(m map[string][]string, key string) string {
@@ -313,6 +839,26 @@ func getFirst(m map[string][]string, key string) string {
 	return v[0]
 }
 
+// readFrames reads the framed messages of a produce request, checking that every message is a valid frame
+func readFrames(r io.Reader, sizes []int64) (io.Reader, error) {
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	buf := make([]byte, total)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, errors.Wrap(err, "unable to read framed messages")
+	}
+	var off int64
+	for i, size := range sizes {
+		if _, _, _, err := headers.ParseFrame(buf[off : off+size]); err != nil {
+			return nil, errors.Wrapf(err, "message %d", i)
+		}
+		off += size
+	}
+	return bytes.NewReader(buf), nil
+}
+
 // HandleWatchTopics accepts websocket connections and watches the topic files for writes
 func (s *Server) HandleWatchTopics(w http.ResponseWriter, r *http.Request) {
 	if r.Body != nil {
@@ -410,7 +956,7 @@ func (s *Server) HandleWatchTopics(w http.ResponseWriter, r *http.Request) {
 	for {
 		select {
 		case event := <-watcher.Events:
-			if event.Op == fsnotify.Write && !strings.HasSuffix(event.Name, ".log") {
+			if event.Op == fsnotify.Write && !strings.HasSuffix(event.Name, ".log") && !strings.HasPrefix(filepath.Base(event.Name), ".") {
 				topic := strings.TrimPrefix(filepath.Dir(event.Name), rootDir+string(filepath.Separator))
 				err = conn.WriteMessage(websocket.TextMessage, []byte(topic))
 				err = errors.Wrap(err, "cannot write topic")
@@ -448,11 +994,15 @@ func (s *Server) HandleWatchTopics(w http.ResponseWriter, r *http.Request) {
 }
 
 func getTopic(r *http.Request) (string, error) {
-	i := strings.Index(strings.ToLower(r.URL.Path), "/topics/")
+	return getPathTopic(r, "/topics/")
+}
+
+func getPathTopic(r *http.Request, prefix string) (string, error) {
+	i := strings.Index(strings.ToLower(r.URL.Path), prefix)
 	if i < 0 {
 		return "", headers.ErrInvalidTopic
 	}
-	topic := strings.ToLower(filepath.Clean(r.URL.Path[i+len("/topics/"):]))
+	topic := strings.ToLower(filepath.Clean(r.URL.Path[i+len(prefix):]))
 	if topic == "" || topic == "." {
 		return "", headers.ErrInvalidTopic
 	}
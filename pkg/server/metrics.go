@@ -1,11 +1,40 @@
 package server
 
+import "time"
+
 // Metrics allows for custom metric handlers for counting the number of messages and/or batch size
 type Metrics interface {
 	ProduceMsgs(int)
 	ConsumeMsgs(int)
 }
 
+// LatencyMetrics is an optional interface for Metrics measuring the latency cost of the sync policy.
+// If the Metrics implement it, the time taken by each produce request and each sync is reported
+type LatencyMetrics interface {
+	ProduceLatency(syncPolicy SyncPolicy, d time.Duration)
+	SyncLatency(syncPolicy SyncPolicy, d time.Duration)
+}
+
+// RetentionMetrics is an optional interface for Metrics tracking the runs of WithRetention
+type RetentionMetrics interface {
+	RetentionRun(topic string, removed int64, d time.Duration)
+}
+
+// CompactionMetrics is an optional interface for Metrics tracking the runs of WithCompaction
+type CompactionMetrics interface {
+	CompactionRun(topic string, removed int64, d time.Duration)
+}
+
+// CompressionMetrics is an optional interface for Metrics tracking the runs of WithCompression
+type CompressionMetrics interface {
+	CompressionRun(topic string, saved int64, d time.Duration)
+}
+
+// ArchiveMetrics is an optional interface for Metrics tracking the runs of WithArchive
+type ArchiveMetrics interface {
+	ArchiveRun(topic string, archived int64, d time.Duration)
+}
+
 var _ Metrics = noOpMetrics{}
 
 type noOpMetrics struct{}
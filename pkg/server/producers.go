@@ -0,0 +1,79 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+const (
+	// producerWindow is the number of batches of each idempotent producer which are acknowledged if resent
+	producerWindow = 5
+	// producerExpiry is how long the window of an idle idempotent producer is kept
+	producerExpiry = 7 * 24 * time.Hour
+)
+
+// topicProducers holds the windows of the idempotent producers of a topic, loaded from the queue on first use
+type topicProducers struct {
+	mux    sync.Mutex
+	states map[string]headers.ProducerState
+}
+
+// produceIdempotent calls produce unless the producer already stored a batch with the sequence. Resent batches
+// are reported as duplicates along with the ids they were given, if they are still in the window.
+// The first batch of a producer may have any sequence, every later batch must follow the last stored batch
+func (s *Server) produceIdempotent(store ProducerStateStore, topic, producer string, seq uint64, now time.Time,
+	produce func() (*headers.ProduceInfo, error)) (*headers.ProduceInfo, bool, error) {
+	tmp, _ := s.producerStates.LoadOrStore(topic, &topicProducers{})
+	tp := tmp.(*topicProducers)
+	tp.mux.Lock()
+	defer tp.mux.Unlock()
+
+	if tp.states == nil {
+		states, err := store.ProducerStates(topic)
+		if err != nil {
+			return nil, false, err
+		}
+		tp.states = states
+	}
+
+	state, known := tp.states[producer]
+	if known && seq <= state.Sequence {
+		for _, batch := range state.Batches {
+			if batch.Sequence == seq && batch.Info != nil {
+				info := *batch.Info
+				info.Duplicate = true
+				return &info, true, nil
+			}
+		}
+		return nil, true, nil
+	}
+	if known && seq != state.Sequence+1 {
+		return nil, false, headers.ErrOutOfOrderSequence
+	}
+
+	info, err := produce()
+	if err != nil {
+		return nil, false, err
+	}
+
+	state.Sequence = seq
+	state.Updated = now.UTC()
+	state.Batches = append(state.Batches, headers.ProducedBatch{Sequence: seq, Info: info})
+	if len(state.Batches) > producerWindow {
+		state.Batches = append(state.Batches[:0:0], state.Batches[len(state.Batches)-producerWindow:]...)
+	}
+	tp.states[producer] = state
+	for id := range tp.states {
+		if now.Sub(tp.states[id].Updated) > producerExpiry {
+			delete(tp.states, id)
+		}
+	}
+
+	// the batch is stored, so a failure to persist the window only loses deduplication across restarts
+	if err = store.SetProducerStates(topic, tp.states); err != nil {
+		s.logger.Errorf("producers: topic %q: %s", topic, err.Error())
+	}
+	return info, false, nil
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestServer_ProducerWindow(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	store := NewMockProducerStateStore(ctrl)
+	now := time.Now()
+	store.EXPECT().ProducerStates("topic").Return(map[string]headers.ProducerState{
+		"idle": {Sequence: 1, Updated: now.Add(-producerExpiry - time.Second)},
+	}, nil).Times(1)
+	var stored map[string]headers.ProducerState
+	store.EXPECT().SetProducerStates("topic", gomock.Any()).DoAndReturn(func(_ string, states map[string]headers.ProducerState) error {
+		stored = states
+		return nil
+	}).AnyTimes()
+	s := &Server{producerStates: &sync.Map{}, logger: noopLogger{}}
+	for seq := uint64(1); seq <= producerWindow+2; seq++ {
+		id := int64(seq)
+		_, _, err := s.produceIdempotent(store, "topic", "p1", seq, now, func() (*headers.ProduceInfo, error) {
+			return &headers.ProduceInfo{FirstID: id, LastID: id}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// idle producers expire and only the latest batches are kept
+	if _, ok := stored["idle"]; ok || len(stored) != 1 {
+		t.Error(stored)
+	}
+	if batches := stored["p1"].Batches; len(batches) != producerWindow || batches[0].Sequence != 3 {
+		t.Error(batches)
+	}
+	produce := func() (*headers.ProduceInfo, error) {
+		t.Error("duplicate batch produced")
+		return nil, nil
+	}
+	if info, duplicate, err := s.produceIdempotent(store, "topic", "p1", 3, now, produce); err != nil || !duplicate || info.FirstID != 3 {
+		t.Error(info, duplicate, err)
+	}
+	if info, duplicate, err := s.produceIdempotent(store, "topic", "p1", 2, now, produce); err != nil || !duplicate || info != nil {
+		t.Error(info, duplicate, err)
+	}
+}
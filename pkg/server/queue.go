@@ -3,8 +3,10 @@ package server
 import (
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/haraqa/haraqa/pkg/archive"
 
 	"github.com/haraqa/haraqa/internal/filequeue"
 )
@@ -13,6 +15,21 @@ import (
 //go:generate go run golang.org/x/tools/cmd/goimports -w queue_mock_test.go
 
 var _ Queue = &filequeue.FileQueue{}
+var _ Recoverer = &filequeue.FileQueue{}
+var _ Resyncer = &filequeue.FileQueue{}
+var _ Syncer = &filequeue.FileQueue{}
+var _ FramedQueue = &filequeue.FileQueue{}
+var _ Compactor = &filequeue.FileQueue{}
+var _ SegmentCompressor = &filequeue.FileQueue{}
+var _ Archiver = &filequeue.FileQueue{}
+var _ TimeSeeker = &filequeue.FileQueue{}
+var _ SegmentRoller = &filequeue.FileQueue{}
+var _ TopicConfigurer = &filequeue.FileQueue{}
+var _ OffsetProducer = &filequeue.FileQueue{}
+var _ ProducerStateStore = &filequeue.FileQueue{}
+var _ ConditionalProducer = &filequeue.FileQueue{}
+var _ Transactor = &filequeue.FileQueue{}
+var _ ScheduleStore = &filequeue.FileQueue{}
 
 // Queue is the interface used by the server to produce and consume messages from different distinct categories called topics
 type Queue interface {
@@ -29,3 +46,102 @@ type Queue interface {
 	Consume(group, topic string, id int64, limit int64, w http.ResponseWriter) (int, error)
 	SetConsumerOffset(group, topic string, id int64) error
 }
+
+// Recoverer is an optional interface for queues able to repair themselves after an unclean shutdown
+// or the replacement of a volume. If the queue implements it, Recover is called by NewServer before
+// serving any requests, with any repairs reported through the server Logger
+type Recoverer interface {
+	Recover(logf func(format string, args ...interface{})) error
+}
+
+// Resyncer is an optional interface for queues able to reconcile their volumes while in use.
+// If the queue implements it, a POST to /resync copies any data missing from a volume from the other volumes
+type Resyncer interface {
+	Resync(logf func(format string, args ...interface{})) error
+}
+
+// Syncer is an optional interface for queues able to commit written messages to stable storage.
+// It is required by the SyncBatch and SyncInterval policies
+type Syncer interface {
+	SetSyncPolicy(onWrite, deferred bool)
+	Sync() error
+}
+
+// FramedQueue is an optional interface for queues able to store a key and headers with each message.
+// Framed messages are produced and consumed in the format written by headers.AppendFrame, while
+// Consume only returns the body of each message to clients which do not request frames
+type FramedQueue interface {
+	ProduceFramed(topic string, msgSizes []int64, timestamp uint64, r io.Reader) error
+	ConsumeFramed(group, topic string, id int64, limit int64, w http.ResponseWriter) (int, error)
+}
+
+// Compactor is an optional interface for queues able to compact topics by message key.
+// It is required by WithCompaction
+type Compactor interface {
+	Compact(topic string, tombstonesBefore time.Time) (int64, error)
+}
+
+// SegmentCompressor is an optional interface for queues able to compress the segments of a topic
+// which are no longer written to. It is required by WithCompression
+type SegmentCompressor interface {
+	CompressSegments(topic string) (int64, error)
+}
+
+// Archiver is an optional interface for queues able to move old segments to an archive.ArchiveStore,
+// fetching them back into a local cache when they are consumed. It is required by WithArchive
+type Archiver interface {
+	SetArchive(store archive.ArchiveStore, cacheDir string, cacheSegments int) error
+	ArchiveSegments(topic string, before time.Time) (int64, error)
+}
+
+// TimeSeeker is an optional interface for queues able to find the first message of a topic produced at or
+// after a given time. It is required to consume from a time or get the offset for a time
+type TimeSeeker interface {
+	OffsetAt(topic string, t time.Time) (int64, error)
+}
+
+// SegmentRoller is an optional interface for queues able to start a new segment of a topic once the latest
+// segment reaches a size or an age. It is required by WithSegmentRolling
+type SegmentRoller interface {
+	SetRollPolicy(maxBytes int64, maxAge time.Duration)
+}
+
+// TopicConfigurer is an optional interface for queues able to store a configuration with each topic.
+// It is required to create or modify topics with a config, and to get the config of a topic
+type TopicConfigurer interface {
+	SetTopicConfig(topic string, config headers.TopicConfig) error
+	TopicConfig(topic string) (*headers.TopicConfig, error)
+}
+
+// OffsetProducer is an optional interface for queues able to report the ids given to produced messages.
+// If the queue implements it, produce responses hold the first and last id and timestamp of the messages
+type OffsetProducer interface {
+	ProduceOffsets(topic string, msgSizes []int64, timestamp uint64, framed bool, r io.Reader) (*headers.ProduceInfo, error)
+}
+
+// ProducerStateStore is an optional interface for queues able to store the windows of idempotent producers.
+// If the queue implements it, batches resent by an idempotent producer are acknowledged without being written again
+type ProducerStateStore interface {
+	ProducerStates(topic string) (map[string]headers.ProducerState, error)
+	SetProducerStates(topic string, states map[string]headers.ProducerState) error
+}
+
+// ConditionalProducer is an optional interface for queues able to produce messages only if the next id of the topic
+// is the expected id, for optimistic concurrency between producers
+type ConditionalProducer interface {
+	ProduceIf(topic string, expected int64, msgSizes []int64, timestamp uint64, framed bool, r io.Reader) (*headers.ProduceInfo, error)
+}
+
+// Transactor is an optional interface for queues able to produce batches of messages to several topics atomically.
+// It is required by the transactions endpoint
+type Transactor interface {
+	ProduceTransaction(batches []headers.TransactionBatch, timestamp uint64) ([]*headers.ProduceInfo, error)
+}
+
+// ScheduleStore is an optional interface for queues able to store the scheduling index of a topic, and to report the
+// offset of a consumer group. It is required, along with OffsetProducer, to produce messages with a not before time
+type ScheduleStore interface {
+	Schedule(topic string) (*headers.Schedule, error)
+	SetSchedule(topic string, schedule *headers.Schedule) error
+	ConsumerOffset(group, topic string) (int64, error)
+}
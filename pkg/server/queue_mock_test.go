@@ -8,9 +8,11 @@ import (
 	io "io"
 	http "net/http"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 	headers "github.com/haraqa/haraqa/internal/headers"
+	archive "github.com/haraqa/haraqa/pkg/archive"
 )
 
 // MockQueue is a mock of Queue interface
@@ -179,3 +181,664 @@ func (mr *MockQueueMockRecorder) SetConsumerOffset(group, topic, id interface{})
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetConsumerOffset", reflect.TypeOf((*MockQueue)(nil).SetConsumerOffset), group, topic, id)
 }
+
+// MockRecoverer is a mock of Recoverer interface
+type MockRecoverer struct {
+	ctrl     *gomock.Controller
+	recorder *MockRecovererMockRecorder
+}
+
+// MockRecovererMockRecorder is the mock recorder for MockRecoverer
+type MockRecovererMockRecorder struct {
+	mock *MockRecoverer
+}
+
+// NewMockRecoverer creates a new mock instance
+func NewMockRecoverer(ctrl *gomock.Controller) *MockRecoverer {
+	mock := &MockRecoverer{ctrl: ctrl}
+	mock.recorder = &MockRecovererMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockRecoverer) EXPECT() *MockRecovererMockRecorder {
+	return m.recorder
+}
+
+// Recover mocks base method
+func (m *MockRecoverer) Recover(logf func(string, ...interface{})) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Recover", logf)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Recover indicates an expected call of Recover
+func (mr *MockRecovererMockRecorder) Recover(logf interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Recover", reflect.TypeOf((*MockRecoverer)(nil).Recover), logf)
+}
+
+// MockResyncer is a mock of Resyncer interface
+type MockResyncer struct {
+	ctrl     *gomock.Controller
+	recorder *MockResyncerMockRecorder
+}
+
+// MockResyncerMockRecorder is the mock recorder for MockResyncer
+type MockResyncerMockRecorder struct {
+	mock *MockResyncer
+}
+
+// NewMockResyncer creates a new mock instance
+func NewMockResyncer(ctrl *gomock.Controller) *MockResyncer {
+	mock := &MockResyncer{ctrl: ctrl}
+	mock.recorder = &MockResyncerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockResyncer) EXPECT() *MockResyncerMockRecorder {
+	return m.recorder
+}
+
+// Resync mocks base method
+func (m *MockResyncer) Resync(logf func(string, ...interface{})) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Resync", logf)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Resync indicates an expected call of Resync
+func (mr *MockResyncerMockRecorder) Resync(logf interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Resync", reflect.TypeOf((*MockResyncer)(nil).Resync), logf)
+}
+
+// MockSyncer is a mock of Syncer interface
+type MockSyncer struct {
+	ctrl     *gomock.Controller
+	recorder *MockSyncerMockRecorder
+}
+
+// MockSyncerMockRecorder is the mock recorder for MockSyncer
+type MockSyncerMockRecorder struct {
+	mock *MockSyncer
+}
+
+// NewMockSyncer creates a new mock instance
+func NewMockSyncer(ctrl *gomock.Controller) *MockSyncer {
+	mock := &MockSyncer{ctrl: ctrl}
+	mock.recorder = &MockSyncerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockSyncer) EXPECT() *MockSyncerMockRecorder {
+	return m.recorder
+}
+
+// SetSyncPolicy mocks base method
+func (m *MockSyncer) SetSyncPolicy(onWrite, deferred bool) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetSyncPolicy", onWrite, deferred)
+}
+
+// SetSyncPolicy indicates an expected call of SetSyncPolicy
+func (mr *MockSyncerMockRecorder) SetSyncPolicy(onWrite, deferred interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetSyncPolicy", reflect.TypeOf((*MockSyncer)(nil).SetSyncPolicy), onWrite, deferred)
+}
+
+// Sync mocks base method
+func (m *MockSyncer) Sync() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Sync")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Sync indicates an expected call of Sync
+func (mr *MockSyncerMockRecorder) Sync() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Sync", reflect.TypeOf((*MockSyncer)(nil).Sync))
+}
+
+// MockFramedQueue is a mock of FramedQueue interface
+type MockFramedQueue struct {
+	ctrl     *gomock.Controller
+	recorder *MockFramedQueueMockRecorder
+}
+
+// MockFramedQueueMockRecorder is the mock recorder for MockFramedQueue
+type MockFramedQueueMockRecorder struct {
+	mock *MockFramedQueue
+}
+
+// NewMockFramedQueue creates a new mock instance
+func NewMockFramedQueue(ctrl *gomock.Controller) *MockFramedQueue {
+	mock := &MockFramedQueue{ctrl: ctrl}
+	mock.recorder = &MockFramedQueueMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockFramedQueue) EXPECT() *MockFramedQueueMockRecorder {
+	return m.recorder
+}
+
+// ProduceFramed mocks base method
+func (m *MockFramedQueue) ProduceFramed(topic string, msgSizes []int64, timestamp uint64, r io.Reader) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ProduceFramed", topic, msgSizes, timestamp, r)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ProduceFramed indicates an expected call of ProduceFramed
+func (mr *MockFramedQueueMockRecorder) ProduceFramed(topic, msgSizes, timestamp, r interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ProduceFramed", reflect.TypeOf((*MockFramedQueue)(nil).ProduceFramed), topic, msgSizes, timestamp, r)
+}
+
+// ConsumeFramed mocks base method
+func (m *MockFramedQueue) ConsumeFramed(group, topic string, id, limit int64, w http.ResponseWriter) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConsumeFramed", group, topic, id, limit, w)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ConsumeFramed indicates an expected call of ConsumeFramed
+func (mr *MockFramedQueueMockRecorder) ConsumeFramed(group, topic, id, limit, w interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConsumeFramed", reflect.TypeOf((*MockFramedQueue)(nil).ConsumeFramed), group, topic, id, limit, w)
+}
+
+// MockCompactor is a mock of Compactor interface
+type MockCompactor struct {
+	ctrl     *gomock.Controller
+	recorder *MockCompactorMockRecorder
+}
+
+// MockCompactorMockRecorder is the mock recorder for MockCompactor
+type MockCompactorMockRecorder struct {
+	mock *MockCompactor
+}
+
+// NewMockCompactor creates a new mock instance
+func NewMockCompactor(ctrl *gomock.Controller) *MockCompactor {
+	mock := &MockCompactor{ctrl: ctrl}
+	mock.recorder = &MockCompactorMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockCompactor) EXPECT() *MockCompactorMockRecorder {
+	return m.recorder
+}
+
+// Compact mocks base method
+func (m *MockCompactor) Compact(topic string, tombstonesBefore time.Time) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Compact", topic, tombstonesBefore)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Compact indicates an expected call of Compact
+func (mr *MockCompactorMockRecorder) Compact(topic, tombstonesBefore interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Compact", reflect.TypeOf((*MockCompactor)(nil).Compact), topic, tombstonesBefore)
+}
+
+// MockSegmentCompressor is a mock of SegmentCompressor interface
+type MockSegmentCompressor struct {
+	ctrl     *gomock.Controller
+	recorder *MockSegmentCompressorMockRecorder
+}
+
+// MockSegmentCompressorMockRecorder is the mock recorder for MockSegmentCompressor
+type MockSegmentCompressorMockRecorder struct {
+	mock *MockSegmentCompressor
+}
+
+// NewMockSegmentCompressor creates a new mock instance
+func NewMockSegmentCompressor(ctrl *gomock.Controller) *MockSegmentCompressor {
+	mock := &MockSegmentCompressor{ctrl: ctrl}
+	mock.recorder = &MockSegmentCompressorMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockSegmentCompressor) EXPECT() *MockSegmentCompressorMockRecorder {
+	return m.recorder
+}
+
+// CompressSegments mocks base method
+func (m *MockSegmentCompressor) CompressSegments(topic string) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CompressSegments", topic)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CompressSegments indicates an expected call of CompressSegments
+func (mr *MockSegmentCompressorMockRecorder) CompressSegments(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompressSegments", reflect.TypeOf((*MockSegmentCompressor)(nil).CompressSegments), topic)
+}
+
+// MockArchiver is a mock of Archiver interface
+type MockArchiver struct {
+	ctrl     *gomock.Controller
+	recorder *MockArchiverMockRecorder
+}
+
+// MockArchiverMockRecorder is the mock recorder for MockArchiver
+type MockArchiverMockRecorder struct {
+	mock *MockArchiver
+}
+
+// NewMockArchiver creates a new mock instance
+func NewMockArchiver(ctrl *gomock.Controller) *MockArchiver {
+	mock := &MockArchiver{ctrl: ctrl}
+	mock.recorder = &MockArchiverMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockArchiver) EXPECT() *MockArchiverMockRecorder {
+	return m.recorder
+}
+
+// SetArchive mocks base method
+func (m *MockArchiver) SetArchive(store archive.ArchiveStore, cacheDir string, cacheSegments int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetArchive", store, cacheDir, cacheSegments)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetArchive indicates an expected call of SetArchive
+func (mr *MockArchiverMockRecorder) SetArchive(store, cacheDir, cacheSegments interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetArchive", reflect.TypeOf((*MockArchiver)(nil).SetArchive), store, cacheDir, cacheSegments)
+}
+
+// ArchiveSegments mocks base method
+func (m *MockArchiver) ArchiveSegments(topic string, before time.Time) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ArchiveSegments", topic, before)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ArchiveSegments indicates an expected call of ArchiveSegments
+func (mr *MockArchiverMockRecorder) ArchiveSegments(topic, before interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ArchiveSegments", reflect.TypeOf((*MockArchiver)(nil).ArchiveSegments), topic, before)
+}
+
+// MockTimeSeeker is a mock of TimeSeeker interface
+type MockTimeSeeker struct {
+	ctrl     *gomock.Controller
+	recorder *MockTimeSeekerMockRecorder
+}
+
+// MockTimeSeekerMockRecorder is the mock recorder for MockTimeSeeker
+type MockTimeSeekerMockRecorder struct {
+	mock *MockTimeSeeker
+}
+
+// NewMockTimeSeeker creates a new mock instance
+func NewMockTimeSeeker(ctrl *gomock.Controller) *MockTimeSeeker {
+	mock := &MockTimeSeeker{ctrl: ctrl}
+	mock.recorder = &MockTimeSeekerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockTimeSeeker) EXPECT() *MockTimeSeekerMockRecorder {
+	return m.recorder
+}
+
+// OffsetAt mocks base method
+func (m *MockTimeSeeker) OffsetAt(topic string, t time.Time) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "OffsetAt", topic, t)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// OffsetAt indicates an expected call of OffsetAt
+func (mr *MockTimeSeekerMockRecorder) OffsetAt(topic, t interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OffsetAt", reflect.TypeOf((*MockTimeSeeker)(nil).OffsetAt), topic, t)
+}
+
+// MockSegmentRoller is a mock of SegmentRoller interface
+type MockSegmentRoller struct {
+	ctrl     *gomock.Controller
+	recorder *MockSegmentRollerMockRecorder
+}
+
+// MockSegmentRollerMockRecorder is the mock recorder for MockSegmentRoller
+type MockSegmentRollerMockRecorder struct {
+	mock *MockSegmentRoller
+}
+
+// NewMockSegmentRoller creates a new mock instance
+func NewMockSegmentRoller(ctrl *gomock.Controller) *MockSegmentRoller {
+	mock := &MockSegmentRoller{ctrl: ctrl}
+	mock.recorder = &MockSegmentRollerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockSegmentRoller) EXPECT() *MockSegmentRollerMockRecorder {
+	return m.recorder
+}
+
+// SetRollPolicy mocks base method
+func (m *MockSegmentRoller) SetRollPolicy(maxBytes int64, maxAge time.Duration) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetRollPolicy", maxBytes, maxAge)
+}
+
+// SetRollPolicy indicates an expected call of SetRollPolicy
+func (mr *MockSegmentRollerMockRecorder) SetRollPolicy(maxBytes, maxAge interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetRollPolicy", reflect.TypeOf((*MockSegmentRoller)(nil).SetRollPolicy), maxBytes, maxAge)
+}
+
+// MockTopicConfigurer is a mock of TopicConfigurer interface
+type MockTopicConfigurer struct {
+	ctrl     *gomock.Controller
+	recorder *MockTopicConfigurerMockRecorder
+}
+
+// MockTopicConfigurerMockRecorder is the mock recorder for MockTopicConfigurer
+type MockTopicConfigurerMockRecorder struct {
+	mock *MockTopicConfigurer
+}
+
+// NewMockTopicConfigurer creates a new mock instance
+func NewMockTopicConfigurer(ctrl *gomock.Controller) *MockTopicConfigurer {
+	mock := &MockTopicConfigurer{ctrl: ctrl}
+	mock.recorder = &MockTopicConfigurerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockTopicConfigurer) EXPECT() *MockTopicConfigurerMockRecorder {
+	return m.recorder
+}
+
+// SetTopicConfig mocks base method
+func (m *MockTopicConfigurer) SetTopicConfig(topic string, config headers.TopicConfig) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetTopicConfig", topic, config)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTopicConfig indicates an expected call of SetTopicConfig
+func (mr *MockTopicConfigurerMockRecorder) SetTopicConfig(topic, config interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTopicConfig", reflect.TypeOf((*MockTopicConfigurer)(nil).SetTopicConfig), topic, config)
+}
+
+// TopicConfig mocks base method
+func (m *MockTopicConfigurer) TopicConfig(topic string) (*headers.TopicConfig, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TopicConfig", topic)
+	ret0, _ := ret[0].(*headers.TopicConfig)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TopicConfig indicates an expected call of TopicConfig
+func (mr *MockTopicConfigurerMockRecorder) TopicConfig(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TopicConfig", reflect.TypeOf((*MockTopicConfigurer)(nil).TopicConfig), topic)
+}
+
+// MockOffsetProducer is a mock of OffsetProducer interface
+type MockOffsetProducer struct {
+	ctrl     *gomock.Controller
+	recorder *MockOffsetProducerMockRecorder
+}
+
+// MockOffsetProducerMockRecorder is the mock recorder for MockOffsetProducer
+type MockOffsetProducerMockRecorder struct {
+	mock *MockOffsetProducer
+}
+
+// NewMockOffsetProducer creates a new mock instance
+func NewMockOffsetProducer(ctrl *gomock.Controller) *MockOffsetProducer {
+	mock := &MockOffsetProducer{ctrl: ctrl}
+	mock.recorder = &MockOffsetProducerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockOffsetProducer) EXPECT() *MockOffsetProducerMockRecorder {
+	return m.recorder
+}
+
+// ProduceOffsets mocks base method
+func (m *MockOffsetProducer) ProduceOffsets(topic string, msgSizes []int64, timestamp uint64, framed bool, r io.Reader) (*headers.ProduceInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ProduceOffsets", topic, msgSizes, timestamp, framed, r)
+	ret0, _ := ret[0].(*headers.ProduceInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ProduceOffsets indicates an expected call of ProduceOffsets
+func (mr *MockOffsetProducerMockRecorder) ProduceOffsets(topic, msgSizes, timestamp, framed, r interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ProduceOffsets", reflect.TypeOf((*MockOffsetProducer)(nil).ProduceOffsets), topic, msgSizes, timestamp, framed, r)
+}
+
+// MockProducerStateStore is a mock of ProducerStateStore interface
+type MockProducerStateStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockProducerStateStoreMockRecorder
+}
+
+// MockProducerStateStoreMockRecorder is the mock recorder for MockProducerStateStore
+type MockProducerStateStoreMockRecorder struct {
+	mock *MockProducerStateStore
+}
+
+// NewMockProducerStateStore creates a new mock instance
+func NewMockProducerStateStore(ctrl *gomock.Controller) *MockProducerStateStore {
+	mock := &MockProducerStateStore{ctrl: ctrl}
+	mock.recorder = &MockProducerStateStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockProducerStateStore) EXPECT() *MockProducerStateStoreMockRecorder {
+	return m.recorder
+}
+
+// ProducerStates mocks base method
+func (m *MockProducerStateStore) ProducerStates(topic string) (map[string]headers.ProducerState, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ProducerStates", topic)
+	ret0, _ := ret[0].(map[string]headers.ProducerState)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ProducerStates indicates an expected call of ProducerStates
+func (mr *MockProducerStateStoreMockRecorder) ProducerStates(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ProducerStates", reflect.TypeOf((*MockProducerStateStore)(nil).ProducerStates), topic)
+}
+
+// SetProducerStates mocks base method
+func (m *MockProducerStateStore) SetProducerStates(topic string, states map[string]headers.ProducerState) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetProducerStates", topic, states)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetProducerStates indicates an expected call of SetProducerStates
+func (mr *MockProducerStateStoreMockRecorder) SetProducerStates(topic, states interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetProducerStates", reflect.TypeOf((*MockProducerStateStore)(nil).SetProducerStates), topic, states)
+}
+
+// MockConditionalProducer is a mock of ConditionalProducer interface
+type MockConditionalProducer struct {
+	ctrl     *gomock.Controller
+	recorder *MockConditionalProducerMockRecorder
+}
+
+// MockConditionalProducerMockRecorder is the mock recorder for MockConditionalProducer
+type MockConditionalProducerMockRecorder struct {
+	mock *MockConditionalProducer
+}
+
+// NewMockConditionalProducer creates a new mock instance
+func NewMockConditionalProducer(ctrl *gomock.Controller) *MockConditionalProducer {
+	mock := &MockConditionalProducer{ctrl: ctrl}
+	mock.recorder = &MockConditionalProducerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockConditionalProducer) EXPECT() *MockConditionalProducerMockRecorder {
+	return m.recorder
+}
+
+// ProduceIf mocks base method
+func (m *MockConditionalProducer) ProduceIf(topic string, expected int64, msgSizes []int64, timestamp uint64, framed bool, r io.Reader) (*headers.ProduceInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ProduceIf", topic, expected, msgSizes, timestamp, framed, r)
+	ret0, _ := ret[0].(*headers.ProduceInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ProduceIf indicates an expected call of ProduceIf
+func (mr *MockConditionalProducerMockRecorder) ProduceIf(topic, expected, msgSizes, timestamp, framed, r interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ProduceIf", reflect.TypeOf((*MockConditionalProducer)(nil).ProduceIf), topic, expected, msgSizes, timestamp, framed, r)
+}
+
+// MockTransactor is a mock of Transactor interface
+type MockTransactor struct {
+	ctrl     *gomock.Controller
+	recorder *MockTransactorMockRecorder
+}
+
+// MockTransactorMockRecorder is the mock recorder for MockTransactor
+type MockTransactorMockRecorder struct {
+	mock *MockTransactor
+}
+
+// NewMockTransactor creates a new mock instance
+func NewMockTransactor(ctrl *gomock.Controller) *MockTransactor {
+	mock := &MockTransactor{ctrl: ctrl}
+	mock.recorder = &MockTransactorMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockTransactor) EXPECT() *MockTransactorMockRecorder {
+	return m.recorder
+}
+
+// ProduceTransaction mocks base method
+func (m *MockTransactor) ProduceTransaction(batches []headers.TransactionBatch, timestamp uint64) ([]*headers.ProduceInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ProduceTransaction", batches, timestamp)
+	ret0, _ := ret[0].([]*headers.ProduceInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ProduceTransaction indicates an expected call of ProduceTransaction
+func (mr *MockTransactorMockRecorder) ProduceTransaction(batches, timestamp interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ProduceTransaction", reflect.TypeOf((*MockTransactor)(nil).ProduceTransaction), batches, timestamp)
+}
+
+// MockScheduleStore is a mock of ScheduleStore interface
+type MockScheduleStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockScheduleStoreMockRecorder
+}
+
+// MockScheduleStoreMockRecorder is the mock recorder for MockScheduleStore
+type MockScheduleStoreMockRecorder struct {
+	mock *MockScheduleStore
+}
+
+// NewMockScheduleStore creates a new mock instance
+func NewMockScheduleStore(ctrl *gomock.Controller) *MockScheduleStore {
+	mock := &MockScheduleStore{ctrl: ctrl}
+	mock.recorder = &MockScheduleStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockScheduleStore) EXPECT() *MockScheduleStoreMockRecorder {
+	return m.recorder
+}
+
+// Schedule mocks base method
+func (m *MockScheduleStore) Schedule(topic string) (*headers.Schedule, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Schedule", topic)
+	ret0, _ := ret[0].(*headers.Schedule)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Schedule indicates an expected call of Schedule
+func (mr *MockScheduleStoreMockRecorder) Schedule(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Schedule", reflect.TypeOf((*MockScheduleStore)(nil).Schedule), topic)
+}
+
+// SetSchedule mocks base method
+func (m *MockScheduleStore) SetSchedule(topic string, schedule *headers.Schedule) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetSchedule", topic, schedule)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetSchedule indicates an expected call of SetSchedule
+func (mr *MockScheduleStoreMockRecorder) SetSchedule(topic, schedule interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetSchedule", reflect.TypeOf((*MockScheduleStore)(nil).SetSchedule), topic, schedule)
+}
+
+// ConsumerOffset mocks base method
+func (m *MockScheduleStore) ConsumerOffset(group, topic string) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConsumerOffset", group, topic)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ConsumerOffset indicates an expected call of ConsumerOffset
+func (mr *MockScheduleStoreMockRecorder) ConsumerOffset(group, topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConsumerOffset", reflect.TypeOf((*MockScheduleStore)(nil).ConsumerOffset), group, topic)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"time"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// retentionLoop enforces the retention policies on every interval until the server closes
+func (s *Server) retentionLoop() {
+	defer s.waitGroup.Done()
+	ticker := time.NewTicker(s.retentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+		s.enforceRetention(time.Now())
+	}
+}
+
+// enforceRetention removes the oldest segments of every topic which exceeds its retention policy
+func (s *Server) enforceRetention(now time.Time) {
+	topics, err := s.q.ListTopics("", "", "")
+	if err != nil {
+		s.logger.Errorf("retention: list topics: %s", err.Error())
+		return
+	}
+	for _, topic := range topics {
+		policy := s.retentionPolicy(topic)
+		if policy == (RetentionPolicy{}) {
+			continue
+		}
+
+		start := time.Now()
+		removed, err := s.applyRetention(topic, policy, now)
+		if err != nil {
+			s.logger.Errorf("retention: topic %q: %s", topic, err.Error())
+			continue
+		}
+		if removed > 0 {
+			s.logger.Infof("retention: removed %d messages from topic %q", removed, topic)
+		}
+		if m, ok := s.metrics.(RetentionMetrics); ok {
+			m.RetentionRun(topic, removed, time.Since(start))
+		}
+	}
+}
+
+// retentionPolicy returns the retention policy of a topic. Retention values stored in the topic config
+// override the policies given to WithRetention
+func (s *Server) retentionPolicy(topic string) RetentionPolicy {
+	policy, ok := s.retentionTopics[topic]
+	if !ok {
+		policy = s.retentionDefault
+	}
+	config := s.topicConfig(topic)
+	if config.RetentionAge > 0 {
+		policy.MaxAge = time.Duration(config.RetentionAge) * time.Second
+	}
+	if config.RetentionBytes > 0 {
+		policy.MaxBytes = config.RetentionBytes
+	}
+	if config.RetentionCount > 0 {
+		policy.MaxCount = config.RetentionCount
+	}
+	return policy
+}
+
+// applyRetention applies the policy to the topic through ModifyTopic and returns the number of messages removed.
+// The latest segment of the topic is always kept
+func (s *Server) applyRetention(topic string, policy RetentionPolicy, now time.Time) (int64, error) {
+	before, err := s.q.ModifyTopic(topic, headers.ModifyRequest{})
+	if err != nil || before == nil {
+		return 0, err
+	}
+
+	// remove by age and size
+	after := before
+	if policy.MaxAge > 0 || policy.MaxBytes > 0 {
+		request := headers.ModifyRequest{MaxSize: policy.MaxBytes, KeepLatest: true}
+		if policy.MaxAge > 0 {
+			request.Before = now.Add(-policy.MaxAge)
+		}
+		if after, err = s.q.ModifyTopic(topic, request); err != nil || after == nil {
+			return 0, err
+		}
+	}
+
+	// remove by count, relative to the latest offset
+	if policy.MaxCount > 0 && after.MaxOffset-after.MinOffset+1 > policy.MaxCount {
+		request := headers.ModifyRequest{Truncate: after.MaxOffset - policy.MaxCount + 1, KeepLatest: true}
+		if after, err = s.q.ModifyTopic(topic, request); err != nil || after == nil {
+			return 0, err
+		}
+	}
+
+	return after.MinOffset - before.MinOffset, nil
+}
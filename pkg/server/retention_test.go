@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/filequeue"
+	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/haraqa/haraqa/internal/queue"
+)
+
+type retentionMetrics struct {
+	noOpMetrics
+	removed map[string]int64
+}
+
+func (m *retentionMetrics) RetentionRun(topic string, removed int64, d time.Duration) {
+	m.removed[topic] += removed
+}
+
+func TestServer_enforceRetention(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	now := time.Now()
+	q := NewMockQueue(ctrl)
+	q.EXPECT().RootDir().Return("").AnyTimes()
+	q.EXPECT().Close().Return(nil).Times(1)
+	metrics := &retentionMetrics{removed: make(map[string]int64)}
+	s, err := NewServer(WithQueue(q), WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.retentionDefault = RetentionPolicy{MaxAge: time.Hour, MaxBytes: 1024}
+	s.retentionTopics = map[string]RetentionPolicy{
+		"count": {MaxCount: 10},
+		"none":  {},
+	}
+
+	// list error
+	q.EXPECT().ListTopics("", "", "").Return(nil, errors.New("test list error")).Times(1)
+	s.enforceRetention(now)
+
+	gomock.InOrder(
+		q.EXPECT().ListTopics("", "", "").Return([]string{"default", "count", "none", "failed"}, nil).Times(1),
+
+		// default policy by age and size
+		q.EXPECT().ModifyTopic("default", headers.ModifyRequest{}).Return(&headers.TopicInfo{MinOffset: 0, MaxOffset: 99}, nil).Times(1),
+		q.EXPECT().ModifyTopic("default", headers.ModifyRequest{Before: now.Add(-time.Hour), MaxSize: 1024, KeepLatest: true}).Return(&headers.TopicInfo{MinOffset: 50, MaxOffset: 99}, nil).Times(1),
+
+		// topic policy by count
+		q.EXPECT().ModifyTopic("count", headers.ModifyRequest{}).Return(&headers.TopicInfo{MinOffset: 0, MaxOffset: 99}, nil).Times(1),
+		q.EXPECT().ModifyTopic("count", headers.ModifyRequest{Truncate: 90, KeepLatest: true}).Return(&headers.TopicInfo{MinOffset: 80, MaxOffset: 99}, nil).Times(1),
+
+		// modify error
+		q.EXPECT().ModifyTopic("failed", headers.ModifyRequest{}).Return(nil, errors.New("test modify error")).Times(1),
+	)
+	s.enforceRetention(now)
+
+	if len(metrics.removed) != 2 || metrics.removed["default"] != 50 || metrics.removed["count"] != 80 {
+		t.Error(metrics.removed)
+	}
+}
+
+func TestServer_retentionLoop(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	q := NewMockQueue(ctrl)
+	q.EXPECT().RootDir().Return("").Times(1)
+	q.EXPECT().Close().Return(nil).Times(1)
+	listed := make(chan struct{}, 1)
+	q.EXPECT().ListTopics("", "", "").DoAndReturn(func(prefix, suffix, regex string) ([]string, error) {
+		select {
+		case listed <- struct{}{}:
+		default:
+		}
+		return nil, nil
+	}).MinTimes(1)
+
+	s, err := NewServer(WithQueue(q), WithRetention(time.Millisecond, RetentionPolicy{MaxCount: 1}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-listed
+	if err = s.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServer_retentionPolicy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	q := struct {
+		*MockQueue
+		*MockTopicConfigurer
+	}{NewMockQueue(ctrl), NewMockTopicConfigurer(ctrl)}
+	s := &Server{
+		q:                q,
+		retentionDefault: RetentionPolicy{MaxAge: time.Hour, MaxBytes: 1024},
+		retentionTopics:  map[string]RetentionPolicy{"count": {MaxCount: 10}},
+	}
+	q.MockTopicConfigurer.EXPECT().TopicConfig("default").Return(&headers.TopicConfig{}, nil).Times(1)
+	q.MockTopicConfigurer.EXPECT().TopicConfig("count").Return(&headers.TopicConfig{RetentionAge: 60, RetentionCount: 5}, nil).Times(1)
+	q.MockTopicConfigurer.EXPECT().TopicConfig("failed").Return(nil, errors.New("test config error")).Times(1)
+
+	if policy := s.retentionPolicy("default"); policy != s.retentionDefault {
+		t.Error(policy)
+	}
+	if policy := s.retentionPolicy("count"); policy != (RetentionPolicy{MaxAge: time.Minute, MaxCount: 5}) {
+		t.Error(policy)
+	}
+	if policy := s.retentionPolicy("failed"); policy != s.retentionDefault {
+		t.Error(policy)
+	}
+}
+
+func TestServer_enforceRetentionQueues(t *testing.T) {
+	engines := map[string]func(dir string) (Queue, error){
+		"filequeue": func(dir string) (Queue, error) {
+			return filequeue.New(false, 2, dir)
+		},
+		"queue": func(dir string) (Queue, error) {
+			return queue.NewQueue([]string{dir}, false, 2)
+		},
+	}
+	for name, engine := range engines {
+		t.Run(name, func(t *testing.T) {
+			// volumes are absolute paths in a normal deployment
+			q, err := engine(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			metrics := &retentionMetrics{removed: make(map[string]int64)}
+			s, err := NewServer(WithQueue(q), WithMetrics(metrics))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			s.retentionTopics = map[string]RetentionPolicy{"count": {MaxCount: 3}}
+
+			// three segments holding ids 0 to 5
+			if err = q.CreateTopic("count"); err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			for i := 0; i < 3; i++ {
+				if err = q.Produce("count", []int64{1, 1}, uint64(now.Unix()), bytes.NewBufferString("ab")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// the segment holding the oldest of the last 3 messages is kept
+			s.enforceRetention(now)
+			info, err := q.ModifyTopic("count", headers.ModifyRequest{})
+			if err != nil || info.MinOffset != 2 || info.MaxOffset != 5 {
+				t.Error(info, err)
+			}
+			if metrics.removed["count"] != 2 {
+				t.Error(metrics.removed)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// topicSchedule holds the scheduling index of a topic, loaded from the queue on first use. Batches produced with a
+// not before time hold rw for writing until they are in the index, while consumer groups hold it for reading, so a
+// consumer group never reads a scheduled batch before it is in the index. The index itself is guarded by mux
+type topicSchedule struct {
+	rw       sync.RWMutex
+	mux      sync.Mutex
+	schedule *headers.Schedule
+}
+
+// load reads the index from the queue if it was not read yet, mux must be held
+func (ts *topicSchedule) load(store ScheduleStore, topic string) error {
+	if ts.schedule != nil {
+		return nil
+	}
+	schedule, err := store.Schedule(topic)
+	if err != nil {
+		return err
+	}
+	if schedule.Deferred == nil {
+		schedule.Deferred = make(map[string][]headers.ScheduledBatch)
+	}
+	ts.schedule = schedule
+	return nil
+}
+
+// prune removes the pending batches which are due, every consumer group which skipped them has deferred them.
+// It reports if any batch was removed, mux must be held
+func (ts *topicSchedule) prune(now time.Time) bool {
+	var i int
+	for _, batch := range ts.schedule.Pending {
+		if batch.NotBefore.After(now) {
+			ts.schedule.Pending[i] = batch
+			i++
+		}
+	}
+	pruned := i < len(ts.schedule.Pending)
+	ts.schedule.Pending = ts.schedule.Pending[:i]
+	return pruned
+}
+
+// produceScheduled calls produce and adds the batch to the scheduling index of the topic, consumer groups do not
+// receive it before notBefore. The queue must report the ids given to the batch
+func (s *Server) produceScheduled(store ScheduleStore, topic string, notBefore time.Time,
+	produce func() (*headers.ProduceInfo, error)) (*headers.ProduceInfo, error) {
+	tmp, _ := s.schedules.LoadOrStore(topic, &topicSchedule{})
+	ts := tmp.(*topicSchedule)
+	ts.rw.Lock()
+	defer ts.rw.Unlock()
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+	if err := ts.load(store, topic); err != nil {
+		return nil, err
+	}
+
+	info, err := produce()
+	if err != nil || info == nil {
+		return info, err
+	}
+	ts.schedule.Pending = append(ts.schedule.Pending, headers.ScheduledBatch{FirstID: info.FirstID, LastID: info.LastID, NotBefore: notBefore.UTC()})
+
+	// the batch is stored, so a failure to persist the index only loses the delay across restarts
+	if err = store.SetSchedule(topic, ts.schedule); err != nil {
+		s.logger.Errorf("schedule: topic %q: %s", topic, err.Error())
+	}
+	return info, nil
+}
+
+// consumeScheduled calls consume for a consumer group reading from its committed offset, skipping the batches which
+// are not due yet. Skipped batches are deferred for the group and delivered before any other message once they are
+// due, in which case true is returned and the offset of the group must not be moved. The offset of the group is
+// resolved here, consume must read from the id it is given
+func (s *Server) consumeScheduled(store ScheduleStore, group, topic string, limit int64, now time.Time,
+	consume func(id, limit int64) (int, error)) (int, bool, error) {
+	tmp, _ := s.schedules.LoadOrStore(topic, &topicSchedule{})
+	ts := tmp.(*topicSchedule)
+	ts.rw.RLock()
+	defer ts.rw.RUnlock()
+	ts.mux.Lock()
+	if err := ts.load(store, topic); err != nil {
+		ts.mux.Unlock()
+		return 0, false, err
+	}
+	changed := ts.prune(now)
+
+	// deliver the deferred batches of the group which are due, the oldest first
+	for len(ts.schedule.Deferred[group]) > 0 && !ts.schedule.Deferred[group][0].NotBefore.After(now) {
+		batch := ts.schedule.Deferred[group][0]
+		s.saveSchedule(store, topic, ts, changed)
+		ts.mux.Unlock()
+
+		n, err := consume(batch.FirstID, limitTo(limit, batch.LastID-batch.FirstID+1))
+		if err != nil {
+			return 0, false, err
+		}
+		ts.mux.Lock()
+		deferred := ts.schedule.Deferred[group]
+		if n > 0 {
+			deferred[0].FirstID += int64(n)
+		}
+		if n == 0 || deferred[0].FirstID > deferred[0].LastID {
+			// messages no longer in the topic, such as truncated ones, are dropped
+			deferred = deferred[1:]
+		}
+		ts.schedule.Deferred[group] = deferred
+		if len(deferred) == 0 {
+			delete(ts.schedule.Deferred, group)
+		}
+		changed = true
+		if n > 0 {
+			s.saveSchedule(store, topic, ts, changed)
+			ts.mux.Unlock()
+			return n, true, nil
+		}
+	}
+
+	offset, err := store.ConsumerOffset(group, topic)
+	if err != nil {
+		ts.mux.Unlock()
+		return 0, false, err
+	}
+	if offset < 0 {
+		// groups without an offset start from the beginning of the topic
+		offset = 0
+	}
+
+	// skip the pending batches at the offset of the group, and read no further than the next pending batch
+	var skipped bool
+	for _, batch := range ts.schedule.Pending {
+		if batch.LastID < offset {
+			continue
+		}
+		if batch.FirstID > offset {
+			limit = limitTo(limit, batch.FirstID-offset)
+			break
+		}
+		if !isDeferred(ts.schedule.Deferred[group], batch) {
+			batch.FirstID = offset
+			ts.schedule.Deferred[group] = append(ts.schedule.Deferred[group], batch)
+		}
+		offset = batch.LastID + 1
+		skipped, changed = true, true
+	}
+	s.saveSchedule(store, topic, ts, changed)
+	ts.mux.Unlock()
+
+	// move the group past the deferred batches, they are delivered from the index
+	if skipped {
+		if err = s.q.SetConsumerOffset(group, topic, offset); err != nil {
+			return 0, false, err
+		}
+	}
+	n, err := consume(offset, limit)
+	return n, false, err
+}
+
+// saveSchedule persists the index if it changed, mux must be held
+func (s *Server) saveSchedule(store ScheduleStore, topic string, ts *topicSchedule, changed bool) {
+	if !changed {
+		return
+	}
+	if err := store.SetSchedule(topic, ts.schedule); err != nil {
+		s.logger.Errorf("schedule: topic %q: %s", topic, err.Error())
+	}
+}
+
+// isDeferred reports if the batch is already deferred for a group
+func isDeferred(deferred []headers.ScheduledBatch, batch headers.ScheduledBatch) bool {
+	for i := range deferred {
+		if deferred[i].LastID == batch.LastID {
+			return true
+		}
+	}
+	return false
+}
+
+// limitTo returns the consume limit capped to n messages, a limit below 1 is no limit
+func limitTo(limit, n int64) int64 {
+	if limit <= 0 || limit > n {
+		return n
+	}
+	return limit
+}
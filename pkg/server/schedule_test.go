@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/filequeue"
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestServer_Schedule(t *testing.T) {
+	dir := ".haraqa-server-schedule"
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	q, err := filequeue.New(false, 100, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	const topic = "scheduled"
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{q: q, schedules: &sync.Map{}, logger: noopLogger{}}
+
+	now := time.Now()
+	produce := func(msgs string, notBefore time.Time) {
+		t.Helper()
+		sizes := make([]int64, len(msgs))
+		for i := range sizes {
+			sizes[i] = 1
+		}
+		produce := func() (*headers.ProduceInfo, error) {
+			return q.ProduceOffsets(topic, sizes, uint64(now.Unix()), false, bytes.NewBufferString(msgs))
+		}
+		if notBefore.IsZero() {
+			_, err = produce()
+		} else {
+			_, err = s.produceScheduled(q, topic, notBefore, produce)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	produce("a", time.Time{})
+	produce("bc", now.Add(time.Hour))
+	produce("d", time.Time{})
+
+	consume := func(group string, at time.Time, expected string, redelivered bool) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		n, r, err := s.consumeScheduled(q, group, topic, -1, at, func(id, limit int64) (int, error) {
+			return q.Consume("", topic, id, limit, w)
+		})
+		if err != nil || r != redelivered || w.Body.String() != expected || (n == 0) != (expected == "") {
+			t.Fatal(n, r, w.Body.String(), err)
+		}
+		if n > 0 && !redelivered {
+			next, err := strconv.ParseInt(w.Header().Get(headers.HeaderNextID), 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = q.SetConsumerOffset(group, topic, next); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// the group reads up to the scheduled batch, then skips it
+	consume("group", now, "a", false)
+	consume("group", now, "d", false)
+	consume("group", now, "", false)
+	if schedule, err := q.Schedule(topic); err != nil || len(schedule.Pending) != 1 || len(schedule.Deferred["group"]) != 1 {
+		t.Fatal(schedule, err)
+	}
+
+	// offset based consumers still read the raw log
+	w := httptest.NewRecorder()
+	if _, err = q.Consume("", topic, 1, -1, w); err != nil || w.Body.String() != "bcd" {
+		t.Error(w.Body.String(), err)
+	}
+
+	// the skipped batch is delivered once it is due, groups which did not skip it read it in order
+	later := now.Add(2 * time.Hour)
+	consume("group", later, "bc", true)
+	consume("group", later, "", false)
+	consume("other", later, "abcd", false)
+	if schedule, err := q.Schedule(topic); err != nil || len(schedule.Pending) != 0 || len(schedule.Deferred) != 0 {
+		t.Error(schedule, err)
+	}
+}
+
+func TestServer_ScheduleFirstMessage(t *testing.T) {
+	q, err := filequeue.New(false, 100, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	const topic = "scheduled"
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{q: q, schedules: &sync.Map{}, logger: noopLogger{}}
+
+	// the first message of the topic is scheduled, so the deferred batch starts at id 0
+	now := time.Now()
+	produce := func() (*headers.ProduceInfo, error) {
+		return q.ProduceOffsets(topic, []int64{1}, uint64(now.Unix()), false, bytes.NewBufferString("a"))
+	}
+	if _, err = s.produceScheduled(q, topic, now.Add(time.Hour), produce); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.ProduceOffsets(topic, []int64{1}, uint64(now.Unix()), false, bytes.NewBufferString("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	consume := func(group string, at time.Time, expected string, redelivered bool) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		n, r, err := s.consumeScheduled(q, group, topic, -1, at, func(id, limit int64) (int, error) {
+			return q.Consume("", topic, id, limit, w)
+		})
+		if err != nil || r != redelivered || w.Body.String() != expected || (n == 0) != (expected == "") {
+			t.Fatal(n, r, w.Body.String(), err)
+		}
+		if n > 0 && !redelivered {
+			next, err := strconv.ParseInt(w.Header().Get(headers.HeaderNextID), 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = q.SetConsumerOffset(group, topic, next); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	consume("group", now, "b", false)
+	consume("group", now, "", false)
+
+	later := now.Add(2 * time.Hour)
+	consume("group", later, "a", true)
+	consume("group", later, "", false)
+
+	// groups without an offset start from the beginning of the topic once nothing is pending
+	consume("other", later, "ab", false)
+}
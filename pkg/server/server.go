@@ -12,6 +12,7 @@ import (
 	"github.com/haraqa/haraqa/internal/filequeue"
 	"github.com/haraqa/haraqa/internal/headers"
 	"github.com/haraqa/haraqa/internal/queue"
+	"github.com/haraqa/haraqa/pkg/archive"
 )
 
 // Option represents a optional function argument to NewServer
@@ -64,7 +65,8 @@ func WithDefaultQueue(dirs []string, cache bool, entries int64) Option {
 	}
 }
 
-// WithMetrics sets the handler for produce and consume metrics
+// WithMetrics sets the handler for produce and consume metrics. Handlers may also implement any of the optional
+// metrics interfaces, such as LatencyMetrics, to track the cost of syncs and of background runs
 func WithMetrics(metrics Metrics) Option {
 	return func(s *Server) error {
 		if metrics == nil {
@@ -118,6 +120,141 @@ func WithPublicAddr(addr string) Option {
 	}
 }
 
+// SyncPolicy determines when produced messages are committed to stable storage
+type SyncPolicy string
+
+// Sync policies available to WithSyncPolicy
+const (
+	// SyncNone leaves flushing messages to disk to the operating system
+	SyncNone SyncPolicy = "none"
+	// SyncBatch commits every batch to disk before the produce request is acknowledged
+	SyncBatch SyncPolicy = "batch"
+	// SyncInterval commits all batches written since the previous sync on a fixed interval
+	SyncInterval SyncPolicy = "interval"
+)
+
+// WithSyncPolicy sets when produced messages are committed to stable storage.
+// The interval is only used by the SyncInterval policy
+func WithSyncPolicy(policy SyncPolicy, interval time.Duration) Option {
+	return func(s *Server) error {
+		switch policy {
+		case SyncNone, SyncBatch:
+		case SyncInterval:
+			if interval <= 0 {
+				return errors.New("invalid sync interval, value must be positive")
+			}
+		default:
+			return errors.Errorf("invalid sync policy %q", policy)
+		}
+		s.syncPolicy = policy
+		s.syncInterval = interval
+		return nil
+	}
+}
+
+// RetentionPolicy limits how much of a topic is kept. The oldest segments of the topic are removed once the
+// messages are older than MaxAge, the topic holds more than MaxBytes or more than MaxCount messages.
+// Zero values are unlimited. The latest segment of a topic is never removed
+type RetentionPolicy struct {
+	MaxAge   time.Duration
+	MaxBytes int64
+	MaxCount int64
+}
+
+// WithRetention enforces retention policies on every interval. The topics policies override the default policy
+func WithRetention(interval time.Duration, defaultPolicy RetentionPolicy, topics map[string]RetentionPolicy) Option {
+	return func(s *Server) error {
+		if interval <= 0 {
+			return errors.New("invalid retention interval, value must be positive")
+		}
+		for topic, policy := range topics {
+			if policy.MaxAge < 0 || policy.MaxBytes < 0 || policy.MaxCount < 0 {
+				return errors.Errorf("invalid retention policy for topic %q, values must not be negative", topic)
+			}
+		}
+		if defaultPolicy.MaxAge < 0 || defaultPolicy.MaxBytes < 0 || defaultPolicy.MaxCount < 0 {
+			return errors.New("invalid retention policy, values must not be negative")
+		}
+		s.retentionInterval = interval
+		s.retentionDefault = defaultPolicy
+		s.retentionTopics = topics
+		return nil
+	}
+}
+
+// WithCompaction compacts the given topics on every interval, keeping only the latest message of each key.
+// Tombstones, keyed messages with an empty body, are kept for tombstoneAge so consumers can observe the deletes.
+// The queue must implement the Compactor interface
+func WithCompaction(interval, tombstoneAge time.Duration, topics ...string) Option {
+	return func(s *Server) error {
+		if interval <= 0 {
+			return errors.New("invalid compaction interval, value must be positive")
+		}
+		if tombstoneAge < 0 {
+			return errors.New("invalid tombstone age, value must not be negative")
+		}
+		s.compactionInterval = interval
+		s.compactionTombstoneAge = tombstoneAge
+		s.compactionTopics = topics
+		return nil
+	}
+}
+
+// WithCompression compresses the closed segments of every topic on every interval.
+// The queue must implement the SegmentCompressor interface
+func WithCompression(interval time.Duration) Option {
+	return func(s *Server) error {
+		if interval <= 0 {
+			return errors.New("invalid compression interval, value must be positive")
+		}
+		s.compressionInterval = interval
+		return nil
+	}
+}
+
+// WithArchive moves the closed segments of every topic to the archive store on every interval, once all of
+// their messages are older than age. Consumers reading archived segments fetch them back into cacheDir, where
+// up to cacheSegments segments of each topic are kept. The queue must implement the Archiver interface
+func WithArchive(interval, age time.Duration, store archive.ArchiveStore, cacheDir string, cacheSegments int) Option {
+	return func(s *Server) error {
+		if interval <= 0 {
+			return errors.New("invalid archive interval, value must be positive")
+		}
+		if age < 0 {
+			return errors.New("invalid archive age, value must not be negative")
+		}
+		if store == nil {
+			return errors.New("invalid archive store: store cannot be nil")
+		}
+		if cacheSegments < 0 {
+			return errors.New("invalid archive cache size, value must not be negative")
+		}
+		s.archiveInterval = interval
+		s.archiveAge = age
+		s.archiveStore = store
+		s.archiveCacheDir = cacheDir
+		s.archiveCacheSegments = cacheSegments
+		return nil
+	}
+}
+
+// WithSegmentRolling starts a new segment of a topic once the latest segment holds maxBytes of messages, or once
+// its first message is older than maxAge, in addition to the max number of entries per segment. Zero values disable
+// the limit. The queue must implement the SegmentRoller interface
+func WithSegmentRolling(maxBytes int64, maxAge time.Duration) Option {
+	return func(s *Server) error {
+		if maxBytes < 0 {
+			return errors.New("invalid segment size, value must not be negative")
+		}
+		if maxAge < 0 {
+			return errors.New("invalid segment age, value must not be negative")
+		}
+		s.segmentMaxBytes = maxBytes
+		s.segmentMaxAge = maxAge
+		return nil
+	}
+}
+
 // Server is an http server on top of the given queue (defaults to a file based queue)
 type Server struct {
 	middlewares         []func(http.Handler) http.Handler
@@ -127,11 +264,33 @@ type Server struct {
 	publicAddr          string
 	defaultConsumeLimit int64
 	consumerGroupLock   *sync.Map
+	producerStates      *sync.Map
+	schedules           *sync.Map
 	q                   Queue
 	closed              chan struct{}
 	waitGroup           *sync.WaitGroup
 	wsPingInterval      time.Duration
 	wsUpgrader          websocket.Upgrader
+	syncPolicy          SyncPolicy
+	syncInterval        time.Duration
+	retentionInterval   time.Duration
+	retentionDefault    RetentionPolicy
+	retentionTopics     map[string]RetentionPolicy
+
+	compactionInterval     time.Duration
+	compactionTombstoneAge time.Duration
+	compactionTopics       []string
+
+	compressionInterval time.Duration
+
+	archiveInterval      time.Duration
+	archiveAge           time.Duration
+	archiveStore         archive.ArchiveStore
+	archiveCacheDir      string
+	archiveCacheSegments int
+
+	segmentMaxBytes int64
+	segmentMaxAge   time.Duration
 }
 
 // NewServer creates a new server with the given options
@@ -142,9 +301,12 @@ func NewServer(options ...Option) (*Server, error) {
 		publicAddr:          "localhost",
 		defaultConsumeLimit: -1,
 		consumerGroupLock:   &sync.Map{},
+		producerStates:      &sync.Map{},
+		schedules:           &sync.Map{},
 		closed:              make(chan struct{}),
 		waitGroup:           &sync.WaitGroup{},
 		wsPingInterval:      time.Second * 60,
+		syncPolicy:          SyncNone,
 		wsUpgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
@@ -164,6 +326,74 @@ func NewServer(options ...Option) (*Server, error) {
 		}
 	}
 
+	// repair the queue before serving any requests
+	if r, ok := s.q.(Recoverer); ok {
+		if err := r.Recover(s.logger.Warnf); err != nil {
+			return nil, errors.Wrap(err, "unable to recover queue")
+		}
+	}
+
+	// set when segments roll over
+	if s.segmentMaxBytes > 0 || s.segmentMaxAge > 0 {
+		roller, ok := s.q.(SegmentRoller)
+		if !ok {
+			return nil, errors.New("queue does not support segment rolling")
+		}
+		roller.SetRollPolicy(s.segmentMaxBytes, s.segmentMaxAge)
+	}
+
+	// set how produced messages are committed to disk
+	if s.syncPolicy != SyncNone {
+		syncer, ok := s.q.(Syncer)
+		if !ok {
+			return nil, errors.Errorf("queue does not support the %q sync policy", s.syncPolicy)
+		}
+		syncer.SetSyncPolicy(s.syncPolicy == SyncBatch, s.syncPolicy == SyncInterval)
+		if s.syncPolicy == SyncInterval {
+			s.waitGroup.Add(1)
+			go s.syncLoop(syncer)
+		}
+	}
+
+	// remove expired messages in the background
+	if s.retentionInterval > 0 {
+		s.waitGroup.Add(1)
+		go s.retentionLoop()
+	}
+
+	// compact changelog topics in the background
+	if s.compactionInterval > 0 {
+		compactor, ok := s.q.(Compactor)
+		if !ok {
+			return nil, errors.New("queue does not support compaction")
+		}
+		s.waitGroup.Add(1)
+		go s.compactionLoop(compactor)
+	}
+
+	// compress closed segments in the background
+	if s.compressionInterval > 0 {
+		compressor, ok := s.q.(SegmentCompressor)
+		if !ok {
+			return nil, errors.New("queue does not support compression")
+		}
+		s.waitGroup.Add(1)
+		go s.compressionLoop(compressor)
+	}
+
+	// move old segments to the archive in the background
+	if s.archiveInterval > 0 {
+		archiver, ok := s.q.(Archiver)
+		if !ok {
+			return nil, errors.New("queue does not support archiving")
+		}
+		if err := archiver.SetArchive(s.archiveStore, s.archiveCacheDir, s.archiveCacheSegments); err != nil {
+			return nil, errors.Wrap(err, "unable to set archive")
+		}
+		s.waitGroup.Add(1)
+		go s.archiveLoop(archiver)
+	}
+
 	rawHandler := http.StripPrefix("/raw/", http.FileServer(http.Dir(s.q.RootDir())))
 	s.handler = s.route(rawHandler)
 
@@ -207,6 +437,44 @@ func (s *Server) route(raw http.Handler) http.HandlerFunc {
 			default:
 				s.logger.Warnf("%s:%s:%s", r.Method, r.URL.Path, "invalid method")
 			}
+		case strings.HasPrefix(r.URL.Path, "/offsets/"):
+			switch r.Method {
+			case http.MethodGet:
+				s.HandleGetOffset(w, r)
+			case http.MethodPut:
+				s.HandleCommitOffset(w, r)
+			case http.MethodOptions:
+				s.HandleOptions(w, r)
+			default:
+				s.logger.Warnf("%s:%s:%s", r.Method, r.URL.Path, "invalid method")
+			}
+		case strings.HasPrefix(r.URL.Path, "/config/"):
+			switch r.Method {
+			case http.MethodGet:
+				s.HandleGetTopicConfig(w, r)
+			case http.MethodOptions:
+				s.HandleOptions(w, r)
+			default:
+				s.logger.Warnf("%s:%s:%s", r.Method, r.URL.Path, "invalid method")
+			}
+		case strings.HasPrefix(r.URL.Path, "/transactions"):
+			switch r.Method {
+			case http.MethodPost:
+				s.HandleTransaction(w, r)
+			case http.MethodOptions:
+				s.HandleOptions(w, r)
+			default:
+				s.logger.Warnf("%s:%s:%s", r.Method, r.URL.Path, "invalid method")
+			}
+		case strings.HasPrefix(r.URL.Path, "/resync"):
+			switch r.Method {
+			case http.MethodPost:
+				s.HandleResync(w, r)
+			case http.MethodOptions:
+				s.HandleOptions(w, r)
+			default:
+				s.logger.Warnf("%s:%s:%s", r.Method, r.URL.Path, "invalid method")
+			}
 		case strings.HasPrefix(r.URL.Path, "/raw"):
 			raw.ServeHTTP(w, r)
 		case strings.HasPrefix(r.URL.Path, "/ws/topics"):
@@ -222,6 +490,31 @@ func (s *Server) route(raw http.Handler) http.HandlerFunc {
 	}
 }
 
+// syncLoop commits written messages to disk on every interval, and once more when the server closes
+func (s *Server) syncLoop(syncer Syncer) {
+	defer s.waitGroup.Done()
+	ticker := time.NewTicker(s.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			if err := syncer.Sync(); err != nil {
+				s.logger.Errorf("sync: %s", err.Error())
+			}
+			return
+		}
+		start := time.Now()
+		if err := syncer.Sync(); err != nil {
+			s.logger.Errorf("sync: %s", err.Error())
+			continue
+		}
+		if m, ok := s.metrics.(LatencyMetrics); ok {
+			m.SyncLatency(s.syncPolicy, time.Since(start))
+		}
+	}
+}
+
 // Close closes the server and returns any associated errors
 func (s *Server) Close() error {
 	s.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
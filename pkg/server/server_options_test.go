@@ -5,6 +5,8 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/haraqa/haraqa/pkg/archive"
 )
 
 func TestWithQueue(t *testing.T) {
@@ -118,3 +120,114 @@ func TestWithWebsocketInterval(t *testing.T) {
 		t.Error(s.wsPingInterval)
 	}
 }
+
+func TestWithSyncPolicy(t *testing.T) {
+	s := &Server{}
+	err := WithSyncPolicy("invalid", 0)(s)
+	if err == nil || err.Error() != `invalid sync policy "invalid"` {
+		t.Error(err)
+	}
+	err = WithSyncPolicy(SyncInterval, 0)(s)
+	if err == nil || err.Error() != "invalid sync interval, value must be positive" {
+		t.Error(err)
+	}
+	err = WithSyncPolicy(SyncBatch, 0)(s)
+	if err != nil || s.syncPolicy != SyncBatch {
+		t.Error(err, s.syncPolicy)
+	}
+	err = WithSyncPolicy(SyncInterval, time.Second)(s)
+	if err != nil || s.syncPolicy != SyncInterval || s.syncInterval != time.Second {
+		t.Error(err, s.syncPolicy, s.syncInterval)
+	}
+}
+
+func TestWithRetention(t *testing.T) {
+	s := &Server{}
+	err := WithRetention(0, RetentionPolicy{}, nil)(s)
+	if err == nil || err.Error() != "invalid retention interval, value must be positive" {
+		t.Error(err)
+	}
+	err = WithRetention(time.Second, RetentionPolicy{MaxAge: -1}, nil)(s)
+	if err == nil || err.Error() != "invalid retention policy, values must not be negative" {
+		t.Error(err)
+	}
+	err = WithRetention(time.Second, RetentionPolicy{}, map[string]RetentionPolicy{"topic": {MaxCount: -1}})(s)
+	if err == nil || err.Error() != `invalid retention policy for topic "topic", values must not be negative` {
+		t.Error(err)
+	}
+	topics := map[string]RetentionPolicy{"topic": {MaxBytes: 1024}}
+	err = WithRetention(time.Second, RetentionPolicy{MaxAge: time.Hour}, topics)(s)
+	if err != nil || s.retentionInterval != time.Second || s.retentionDefault.MaxAge != time.Hour || s.retentionTopics["topic"].MaxBytes != 1024 {
+		t.Error(err, s.retentionInterval, s.retentionDefault, s.retentionTopics)
+	}
+}
+
+func TestWithCompaction(t *testing.T) {
+	s := &Server{}
+	err := WithCompaction(0, 0)(s)
+	if err == nil || err.Error() != "invalid compaction interval, value must be positive" {
+		t.Error(err)
+	}
+	err = WithCompaction(time.Second, -1)(s)
+	if err == nil || err.Error() != "invalid tombstone age, value must not be negative" {
+		t.Error(err)
+	}
+	err = WithCompaction(time.Second, time.Hour, "topic")(s)
+	if err != nil || s.compactionInterval != time.Second || s.compactionTombstoneAge != time.Hour || len(s.compactionTopics) != 1 {
+		t.Error(err, s.compactionInterval, s.compactionTombstoneAge, s.compactionTopics)
+	}
+}
+
+func TestWithCompression(t *testing.T) {
+	s := &Server{}
+	err := WithCompression(0)(s)
+	if err == nil || err.Error() != "invalid compression interval, value must be positive" {
+		t.Error(err)
+	}
+	err = WithCompression(time.Second)(s)
+	if err != nil || s.compressionInterval != time.Second {
+		t.Error(err, s.compressionInterval)
+	}
+}
+
+func TestWithArchive(t *testing.T) {
+	s := &Server{}
+	store := &archive.Dir{}
+	for _, tc := range []struct {
+		interval, age time.Duration
+		store         archive.ArchiveStore
+		cacheSegments int
+		expected      string
+	}{
+		{0, time.Hour, store, 1, "invalid archive interval, value must be positive"},
+		{time.Second, -time.Hour, store, 1, "invalid archive age, value must not be negative"},
+		{time.Second, time.Hour, nil, 1, "invalid archive store: store cannot be nil"},
+		{time.Second, time.Hour, store, -1, "invalid archive cache size, value must not be negative"},
+	} {
+		err := WithArchive(tc.interval, tc.age, tc.store, "cache", tc.cacheSegments)(s)
+		if err == nil || err.Error() != tc.expected {
+			t.Error(err)
+		}
+	}
+	err := WithArchive(time.Second, time.Hour, store, "cache", 4)(s)
+	if err != nil || s.archiveInterval != time.Second || s.archiveAge != time.Hour || s.archiveStore != store ||
+		s.archiveCacheDir != "cache" || s.archiveCacheSegments != 4 {
+		t.Error(err, s)
+	}
+}
+
+func TestWithSegmentRolling(t *testing.T) {
+	s := &Server{}
+	err := WithSegmentRolling(-1, time.Hour)(s)
+	if err == nil || err.Error() != "invalid segment size, value must not be negative" {
+		t.Error(err)
+	}
+	err = WithSegmentRolling(1024, -time.Hour)(s)
+	if err == nil || err.Error() != "invalid segment age, value must not be negative" {
+		t.Error(err)
+	}
+	err = WithSegmentRolling(1024, time.Hour)(s)
+	if err != nil || s.segmentMaxBytes != 1024 || s.segmentMaxAge != time.Hour {
+		t.Error(err, s.segmentMaxBytes, s.segmentMaxAge)
+	}
+}
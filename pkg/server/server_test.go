@@ -6,6 +6,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/haraqa/haraqa/internal/headers"
 
@@ -68,6 +69,118 @@ func TestNewServer(t *testing.T) {
 		}
 		s.Close()
 	}
+
+	// with a recoverable queue
+	{
+		q := struct {
+			*MockQueue
+			*MockRecoverer
+		}{NewMockQueue(ctrl), NewMockRecoverer(ctrl)}
+		gomock.InOrder(
+			q.MockRecoverer.EXPECT().Recover(gomock.Any()).Return(nil).Times(1),
+			q.MockQueue.EXPECT().RootDir().Return("./.haraqa").Times(1),
+			q.MockQueue.EXPECT().Close().Times(1),
+		)
+		s, err := NewServer(WithQueue(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+
+	// with a sync policy the queue does not support
+	{
+		q := NewMockQueue(ctrl)
+		_, err := NewServer(WithQueue(q), WithSyncPolicy(SyncBatch, 0))
+		if err == nil || err.Error() != `queue does not support the "batch" sync policy` {
+			t.Fatal(err)
+		}
+	}
+
+	// with segment rolling the queue does not support
+	{
+		q := NewMockQueue(ctrl)
+		_, err := NewServer(WithQueue(q), WithSegmentRolling(1024, 0))
+		if err == nil || err.Error() != "queue does not support segment rolling" {
+			t.Fatal(err)
+		}
+	}
+
+	// with segment rolling
+	{
+		q := struct {
+			*MockQueue
+			*MockSegmentRoller
+		}{NewMockQueue(ctrl), NewMockSegmentRoller(ctrl)}
+		gomock.InOrder(
+			q.MockSegmentRoller.EXPECT().SetRollPolicy(int64(1024), time.Hour).Times(1),
+			q.MockQueue.EXPECT().RootDir().Return("./.haraqa").Times(1),
+			q.MockQueue.EXPECT().Close().Times(1),
+		)
+		s, err := NewServer(WithQueue(q), WithSegmentRolling(1024, time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+
+	// with a batch sync policy
+	{
+		q := struct {
+			*MockQueue
+			*MockSyncer
+		}{NewMockQueue(ctrl), NewMockSyncer(ctrl)}
+		gomock.InOrder(
+			q.MockSyncer.EXPECT().SetSyncPolicy(true, false).Times(1),
+			q.MockQueue.EXPECT().RootDir().Return("./.haraqa").Times(1),
+			q.MockQueue.EXPECT().Close().Times(1),
+		)
+		s, err := NewServer(WithQueue(q), WithSyncPolicy(SyncBatch, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+
+	// with an interval sync policy
+	{
+		q := struct {
+			*MockQueue
+			*MockSyncer
+		}{NewMockQueue(ctrl), NewMockSyncer(ctrl)}
+		synced := make(chan struct{}, 1)
+		gomock.InOrder(
+			q.MockSyncer.EXPECT().SetSyncPolicy(false, true).Times(1),
+			q.MockQueue.EXPECT().RootDir().Return("./.haraqa").Times(1),
+		)
+		q.MockSyncer.EXPECT().Sync().DoAndReturn(func() error {
+			select {
+			case synced <- struct{}{}:
+			default:
+			}
+			return nil
+		}).MinTimes(2)
+		q.MockQueue.EXPECT().Close().Times(1)
+		s, err := NewServer(WithQueue(q), WithSyncPolicy(SyncInterval, time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-synced
+		s.Close()
+	}
+
+	// with a failed recovery
+	{
+		q := struct {
+			*MockQueue
+			*MockRecoverer
+		}{NewMockQueue(ctrl), NewMockRecoverer(ctrl)}
+		q.MockRecoverer.EXPECT().Recover(gomock.Any()).Return(errors.New("test recover error")).Times(1)
+		_, err := NewServer(WithQueue(q))
+		if err == nil || err.Error() != "unable to recover queue: test recover error" {
+			t.Fatal(err)
+		}
+	}
 }
 
 func TestServer_route(t *testing.T) {